@@ -5,11 +5,14 @@ import (
 	"errors"
 	"log"
 	"net"
+	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"chat-server/internal/audit"
 	"chat-server/internal/config"
 	"chat-server/internal/hub"
 	"chat-server/internal/server"
@@ -18,27 +21,52 @@ import (
 func main() {
 	logger := log.New(os.Stdout, "chat-server: ", log.LstdFlags|log.LUTC|log.Lmsgprefix)
 
-	cfg, err := config.FromEnv()
+	cfg, err := loadConfig()
 	if err != nil {
 		logger.Fatalf("failed to load config: %v", err)
 	}
 
-	tcpListener, err := net.Listen("tcp", cfg.ListenAddr)
-	if err != nil {
-		logger.Fatalf("failed to listen on %q: %v", cfg.ListenAddr, err)
-	}
+	var tcpListeners []net.Listener
 	// Best-effort cleanup in case we exit due to a fatal error.
 	defer func() {
-		_ = tcpListener.Close()
+		for _, tcpListener := range tcpListeners {
+			_ = tcpListener.Close()
+		}
 	}()
+	for _, listenAddr := range cfg.ListenAddrs() {
+		tcpListener, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			logger.Fatalf("failed to listen on %q: %v", listenAddr, err)
+		}
+		tcpListeners = append(tcpListeners, tcpListener)
+	}
 
 	rootContext, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stopSignals()
 
-	chatHub := hub.New(logger, cfg)
+	var auditLogger hub.AuditLogger
+	if cfg.AuditLogFile != "" {
+		fileAuditLogger, err := audit.NewFileLogger(cfg.AuditLogFile)
+		if err != nil {
+			logger.Fatalf("failed to open audit log: %v", err)
+		}
+		defer func() {
+			_ = fileAuditLogger.Close()
+		}()
+		auditLogger = fileAuditLogger
+	}
+
+	chatHub := hub.New(logger, cfg, nil, auditLogger, nil)
+	if err := chatHub.RestoreState(); err != nil {
+		logger.Fatalf("failed to restore state: %v", err)
+	}
 	tcpServer := server.NewTCPServer(logger, cfg, chatHub)
 
+	// Serve returns as soon as the listeners close; shutdownDone lets main
+	// wait for clients to be closed and their last frames written.
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		<-rootContext.Done()
 
 		const shutdownTimeout = 5 * time.Second
@@ -50,18 +78,99 @@ func main() {
 		}
 	}()
 
-	logger.Printf("listening on %s", cfg.ListenAddr)
+	// SIGHUP reloads the settings that can change at runtime, such as
+	// timeouts, text limits and the message of the day.
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	go func() {
+		for {
+			select {
+			case <-rootContext.Done():
+				return
+			case <-hangups:
+			}
+
+			reloadedCfg, err := loadConfig()
+			if err != nil {
+				logger.Printf("reload failed, keeping current config: %v", err)
+				continue
+			}
+			tcpServer.Reload(reloadedCfg)
+		}
+	}()
+
+	if cfg.DebugAddr != "" {
+		startDebugServer(rootContext, logger, cfg.DebugAddr)
+	}
+
+	for _, tcpListener := range tcpListeners {
+		logger.Printf("listening on %s", tcpListener.Addr())
+	}
 
-	serveErr := tcpServer.Serve(rootContext, tcpListener)
+	serveErr := tcpServer.Serve(rootContext, tcpListeners...)
 	if serveErr == nil {
+		<-shutdownDone
 		logger.Printf("server stopped")
 		return
 	}
 
 	if errors.Is(serveErr, net.ErrClosed) || errors.Is(rootContext.Err(), context.Canceled) {
+		<-shutdownDone
 		logger.Printf("server stopped")
 		return
 	}
 
 	logger.Fatalf("server error: %v", serveErr)
 }
+
+// loadConfig reads the configuration file named by CHAT_SERVER_CONFIG, if
+// set, and otherwise the environment alone.
+func loadConfig() (config.Config, error) {
+	if path := os.Getenv("CHAT_SERVER_CONFIG"); path != "" {
+		return config.FromFile(path)
+	}
+	return config.FromEnv()
+}
+
+// startDebugServer serves the pprof handlers under /debug/pprof/ on addr
+// until ctx is canceled.
+func startDebugServer(ctx context.Context, logger *log.Logger, addr string) {
+	debugServer := &http.Server{
+		Addr:              addr,
+		Handler:           debugHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		logger.Printf("debug server listening on %s", addr)
+		if err := debugServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Printf("debug server error: %v", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+
+		const shutdownTimeout = 5 * time.Second
+		shutdownContext, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := debugServer.Shutdown(shutdownContext); err != nil {
+			logger.Printf("debug server shutdown error: %v", err)
+		}
+	}()
+}
+
+// debugHandler routes the pprof handlers. They are registered on a
+// dedicated mux, so nothing else is exposed on the debug address.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
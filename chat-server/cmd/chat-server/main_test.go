@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugHandlerServesGoroutineProfile(t *testing.T) {
+	server := httptest.NewServer(debugHandler())
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatalf("GET goroutine profile: %v", err)
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	if response.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine profile") {
+		t.Errorf("status %d, body %.80q; want the goroutine profile", response.StatusCode, body)
+	}
+
+	response, err = http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /metrics status = %d, want %d", response.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestDebugServerStopsWithContext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("reserve port: %v", err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startDebugServer(ctx, log.New(io.Discard, "", 0), addr)
+
+	url := "http://" + addr + "/debug/pprof/goroutine"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		response, err := http.Get(url)
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d", response.StatusCode, http.StatusOK)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("debug server never answered: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	cancel()
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			break
+		}
+		_ = conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("debug server still listening after the context was canceled")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,73 @@
+// Package audit records moderation-relevant events as an append-only
+// trail of JSON lines, kept apart from the operational log so it can be
+// rotated and shipped on its own.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event kinds recorded in the audit trail.
+const (
+	EventIdentify          = "identify"
+	EventDisconnect        = "disconnect"
+	EventKick              = "kick"
+	EventAdminCommand      = "admin_command"
+	EventAdminUnauthorized = "admin_unauthorized"
+)
+
+// Event is a single audit entry. Fields that do not apply to an event kind
+// are left empty and omitted from the output.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	ClientID   string    `json:"client_id,omitempty"`
+	Username   string    `json:"username,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Command    string    `json:"command,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// FileLogger appends events to a file, one JSON object per line.
+type FileLogger struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// NewFileLogger opens path for appending, creating it if needed.
+func NewFileLogger(path string) (*FileLogger, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+
+	return &FileLogger{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+// Audit writes event as a single line.
+func (logger *FileLogger) Audit(event Event) error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
+	if err := logger.encoder.Encode(event); err != nil {
+		return fmt.Errorf("write audit event: %w", err)
+	}
+	return nil
+}
+
+// Close closes the underlying file.
+func (logger *FileLogger) Close() error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
+	return logger.file.Close()
+}
@@ -0,0 +1,74 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLoggerAppendsJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	events := []Event{
+		{Time: at, Event: EventIdentify, ClientID: "c1", Username: "alice", RemoteAddr: "127.0.0.1:5000"},
+		{Time: at, Event: EventKick, ClientID: "c2", Username: "ops", Target: "alice"},
+	}
+
+	// Reopening appends instead of truncating.
+	for _, event := range events {
+		logger, err := NewFileLogger(path)
+		if err != nil {
+			t.Fatalf("NewFileLogger: %v", err)
+		}
+		if err := logger.Audit(event); err != nil {
+			t.Fatalf("Audit: %v", err)
+		}
+		if err := logger.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	defer file.Close()
+
+	var got []Event
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("line %q is not a JSON event: %v", scanner.Text(), err)
+		}
+		got = append(got, event)
+	}
+	if len(got) != len(events) {
+		t.Fatalf("got %d events, want %d", len(got), len(events))
+	}
+	for i := range events {
+		if got[i] != events[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got[i], events[i])
+		}
+	}
+}
+
+func TestEventOmitsEmptyFields(t *testing.T) {
+	line, err := json.Marshal(Event{Event: EventDisconnect, ClientID: "c1", Reason: "gone"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(line, &fields); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	for _, omitted := range []string{"username", "remote_addr", "target", "command"} {
+		if _, present := fields[omitted]; present {
+			t.Errorf("%s present in %s", omitted, line)
+		}
+	}
+}
@@ -1,9 +1,19 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"net"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
+
+	"chat-server/internal/protocol"
 )
 
 type Config struct {
@@ -15,44 +25,410 @@ type Config struct {
 	IdleTimeoutSecs   int
 	MaxUsernameLength int
 	MaxRoomNameLength int
+	MaxTextLength     int
+	MOTD              string
+	MOTDFile          string
+
+	CaseInsensitiveUsernames bool
+	ValidateUTF8             bool
+
+	// WriteEnqueueTimeoutMs bounds how long a send waits for room in a
+	// full write queue before failing. Zero fails immediately.
+	WriteEnqueueTimeoutMs int
+
+	// RoomHistoryDepth is the number of recent messages kept per room for
+	// replay on join. Zero disables history.
+	RoomHistoryDepth int
+
+	// RoomMessagesPerSecond limits ROOM_TEXT per sender and room.
+	// Zero disables the limit.
+	RoomMessagesPerSecond int
+
+	// AdminToken is the shared secret required by ADMIN requests.
+	// An empty token disables the admin channel.
+	AdminToken string
+
+	// ReservedUsernames holds names that users may not claim at IDENTIFY.
+	ReservedUsernames map[string]struct{}
+
+	// ReadBufferBytes is the initial per-connection read buffer size.
+	// The buffer grows on demand up to MaxFrameBytes.
+	ReadBufferBytes int
+
+	// MaxConnections caps concurrent connections; further connections are
+	// answered with SERVER_FULL and closed. Zero means unlimited.
+	MaxConnections int
+
+	// MaxRoomsPerUser caps how many rooms a user can be a member of at once.
+	// Zero means unlimited.
+	MaxRoomsPerUser int
+
+	// ReconnectGraceSecs is how long the session of a dropped connection is
+	// kept for resumption with its reconnect token. Zero disables tokens.
+	ReconnectGraceSecs int
+
+	// MaxRoomMembers caps the number of members of a single room, creator
+	// included. Zero means unlimited.
+	MaxRoomMembers int
+
+	// UsernameHoldSecs keeps the username of a disconnected user reserved
+	// for its reconnect token that long. Zero releases it immediately.
+	UsernameHoldSecs int
+
+	// AllowedCIDRs and DeniedCIDRs filter connections by source address.
+	// Deny takes precedence; an empty allow list allows every address.
+	AllowedCIDRs []*net.IPNet
+	DeniedCIDRs  []*net.IPNet
+
+	// DisabledOperations holds client message types the server refuses
+	// with OPERATION_DISABLED.
+	DisabledOperations map[string]struct{}
+
+	// TCPKeepAliveSecs sets the TCP keepalive period of accepted
+	// connections. Zero keeps the Go runtime default.
+	TCPKeepAliveSecs int
+
+	// MaxPendingInvitesPerRoom caps the invitations a room may have waiting
+	// to be accepted. Zero means unlimited.
+	MaxPendingInvitesPerRoom int
+
+	// InviteTTLSecs is how long an invitation stays valid if not accepted.
+	// Zero means invitations never expire.
+	InviteTTLSecs int
+
+	// SendHello greets every new connection with a SERVER_HELLO frame.
+	SendHello bool
+
+	// TrimCarriageReturn strips a '\r' preceding the '\n' delimiter, so
+	// clients sending CRLF line endings are understood.
+	TrimCarriageReturn bool
+
+	// DebugAddr is the address of the pprof HTTP server. Empty disables it.
+	DebugAddr string
+
+	// CaseInsensitiveRooms makes room names that differ only in case refer
+	// to the same room, which keeps the name it was created with.
+	CaseInsensitiveRooms bool
+
+	// MaxTotalRooms caps how many rooms may exist on the server at once.
+	// Zero means unlimited.
+	MaxTotalRooms int
+
+	// MaxConnectionsPerIP caps concurrent connections from a single source
+	// IP; further ones are answered with TOO_MANY_CONNECTIONS and closed.
+	// Zero means unlimited.
+	MaxConnectionsPerIP int
+
+	// AuditLogFile is the file that receives the audit trail as JSON
+	// lines. Empty disables auditing.
+	AuditLogFile string
+
+	// StateFile is where rooms and their members are saved, periodically
+	// and on shutdown, to be restored at startup. Empty disables it.
+	StateFile string
+
+	// AbsentMemberTTLSecs is how long members restored from the state
+	// file keep their rooms after startup without identifying. Zero keeps
+	// them until they return.
+	AbsentMemberTTLSecs int
+
+	// OverflowPolicy decides what happens to a frame that finds a client's
+	// write queue still full after WriteEnqueueTimeoutMs: one of the
+	// Overflow* values.
+	OverflowPolicy string
+
+	// SequenceNumbers adds a per-connection "seq" counter to every frame
+	// sent to clients, so they can detect dropped frames.
+	SequenceNumbers bool
+
+	// RequireAuth makes IDENTIFY carry a password matching
+	// AuthPasswordSHA256. Clients that fail are disconnected.
+	RequireAuth bool
+
+	// AuthPasswordSHA256 is the hex-encoded SHA-256 hash of the password
+	// required when RequireAuth is set. The password itself is never stored.
+	AuthPasswordSHA256 string
+
+	// MaxIdentifyAttempts disconnects a connection after this many rejected
+	// IDENTIFY requests. Zero means unlimited.
+	MaxIdentifyAttempts int
+
+	// LobbyRoom names a public room every user joins on IDENTIFY. When set,
+	// PUBLIC_TEXT reaches the lobby members only. Empty means PUBLIC_TEXT
+	// reaches every identified user.
+	LobbyRoom string
+
+	// AutoJoinRoom names a public room every user joins on IDENTIFY,
+	// within the usual room limits. Empty disables it.
+	AutoJoinRoom string
+
+	// IdleWarningSecs is how long before an idle disconnect the client is
+	// sent IDLE_WARNING. Zero disables the warning.
+	IdleWarningSecs int
+
+	// MaxPendingInvitesPerUser caps the invitations a single user may have
+	// waiting to be accepted, across all rooms. Zero means unlimited.
+	MaxPendingInvitesPerUser int
+
+	// WriteCoalesceMs is how long a connection waits for more outbound
+	// frames before flushing, so bursts go out in fewer writes. Zero
+	// flushes as soon as a frame is queued.
+	WriteCoalesceMs int
+
+	// IgnoreEmptyFrames treats blank lines as keep-alives instead of
+	// invalid frames. They still reset the idle timer.
+	IgnoreEmptyFrames bool
+
+	// FlowControlHighPercent is the write queue occupancy, as a percentage
+	// of WriteQueueDepth, at which a client is sent FLOW_CONTROL PAUSE.
+	// Zero disables flow control notices.
+	FlowControlHighPercent int
+
+	// FlowControlLowPercent is the occupancy at or below which a paused
+	// client is sent FLOW_CONTROL RESUME.
+	FlowControlLowPercent int
+
+	// GlobalMessagesPerSecond caps the frames the hub processes per second
+	// across all clients. Zero means unlimited.
+	GlobalMessagesPerSecond int
+
+	// ClientByteBudget caps the frame bytes a client may send within any
+	// ClientByteWindowSecs seconds. Zero means unlimited.
+	ClientByteBudget     int
+	ClientByteWindowSecs int
+
+	// MaxByteBudgetViolations is how many frames in a row may be refused
+	// for exceeding ClientByteBudget before the client is disconnected.
+	// Zero never disconnects.
+	MaxByteBudgetViolations int
+
+	// IdentifyTimeoutSecs is how long a connection may stay unidentified
+	// before it is disconnected. Zero means no limit.
+	IdentifyTimeoutSecs int
+
+	// MaxRecipients caps the usernames a single MULTI_TEXT may address.
+	MaxRecipients int
+
+	// MaxProtocolViolations is how many malformed frames in a row a client
+	// is answered INVALID for before it is disconnected. Zero disconnects
+	// on the first one.
+	MaxProtocolViolations int
+
+	// StrictInvitePermission treats INVITE and UNINVITE from a non-member
+	// as a protocol violation, as the spec requires. When false, they are
+	// answered with NOT_JOINED and the connection is kept.
+	StrictInvitePermission bool
+
+	// EmptyRoomTTLSecs is how long a room whose last member left is kept
+	// before it is deleted. Zero deletes it immediately.
+	EmptyRoomTTLSecs int
 }
 
+// Values of Config.OverflowPolicy.
+const (
+	// OverflowDisconnect disconnects the client.
+	OverflowDisconnect = "disconnect"
+	// OverflowDropOldest discards the oldest queued frame to make room.
+	OverflowDropOldest = "drop-oldest"
+	// OverflowDropNewest discards the frame being sent.
+	OverflowDropNewest = "drop-newest"
+)
+
+// Hard ceilings for the name length settings, keeping names displayable
+// and bounding the size of user and room lists.
+const (
+	maxUsernameLengthCeiling = 64
+	maxRoomNameLengthCeiling = 64
+)
+
+// FromEnv loads the configuration from CHAT_SERVER_* environment variables.
 func FromEnv() (Config, error) {
+	return load(&source{})
+}
+
+// FromFile loads the configuration from a JSON file, with environment
+// variables taking precedence over file values.
+//
+// The file holds a single object whose keys are the environment variable
+// names without the CHAT_SERVER_ prefix, in lowercase (CHAT_SERVER_MAX_TEXT_LENGTH
+// becomes "max_text_length"). Lists such as reserved_usernames may be given
+// as JSON arrays. Unknown keys are rejected.
+func FromFile(path string) (Config, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("read config file: %w", err)
+	}
+
+	fileValues, err := parseFileValues(contents)
+	if err != nil {
+		return Config{}, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	src := &source{fileValues: fileValues, used: make(map[string]struct{})}
+	cfg, err := load(src)
+
+	errs := []error{err}
+	for key := range fileValues {
+		if _, used := src.used[key]; !used {
+			errs = append(errs, fmt.Errorf("config file %s: unknown setting %q", path, fileKey(key)))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+func load(src *source) (Config, error) {
 	const (
 		defaultListenAddr      = ":8080"
 		defaultMaxFrameBytes   = 64 * 1024
 		defaultWriteQueueDepth = 128
+		defaultMaxTextLength   = 4096
+		defaultReadBufferBytes = 64 * 1024
 
 		defaultReadTimeoutSecs  = 0
 		defaultWriteTimeoutSecs = 0
 		defaultIdleTimeoutSecs  = 0
 
-		protocolMaxUsernameLength = 8
-		protocolMaxRoomNameLength = 16
+		defaultWriteEnqueueTimeoutMs = 0
+		defaultRoomHistoryDepth      = 0
+		defaultRoomMessagesPerSecond = 0
+		defaultMaxConnections        = 0
+		defaultMaxRoomsPerUser       = 0
+		defaultReconnectGraceSecs    = 0
+		defaultMaxRoomMembers        = 0
+		defaultUsernameHoldSecs      = 0
+		defaultTCPKeepAliveSecs      = 0
+		defaultMaxPendingInvites     = 0
+		defaultInviteTTLSecs         = 0
+		defaultMaxTotalRooms         = 0
+		defaultMaxConnectionsPerIP   = 0
+		defaultAbsentMemberTTLSecs   = 3600
+		defaultMaxIdentifyAttempts   = 0
+		defaultIdleWarningSecs       = 0
+		defaultMaxPendingPerUser     = 0
+		defaultWriteCoalesceMs       = 0
+		defaultFlowControlHigh       = 0
+		defaultFlowControlLow        = 25
+		defaultGlobalMessagesPerSec  = 0
+		defaultClientByteBudget      = 0
+		defaultClientByteWindowSecs  = 10
+		defaultMaxBudgetViolations   = 0
+		defaultIdentifyTimeoutSecs   = 0
+		defaultMaxRecipients         = 20
+		defaultMaxViolations         = 0
+		defaultEmptyRoomTTLSecs      = 0
+
+		defaultMaxUsernameLength = 8
+		defaultMaxRoomNameLength = 16
 	)
 
-	listenAddr := getEnvString("CHAT_SERVER_ADDR", defaultListenAddr)
+	listenAddr := src.getString("CHAT_SERVER_ADDR", defaultListenAddr)
+	motd := src.getString("CHAT_SERVER_MOTD", "")
+	motdFile := src.getString("CHAT_SERVER_MOTD_FILE", "")
+	adminToken := src.getString("CHAT_SERVER_ADMIN_TOKEN", "")
+	debugAddr := src.getString("CHAT_SERVER_DEBUG_ADDR", "")
+	auditLogFile := src.getString("CHAT_SERVER_AUDIT_LOG_FILE", "")
+	stateFile := src.getString("CHAT_SERVER_STATE_FILE", "")
+	overflowPolicy := src.getString("CHAT_SERVER_OVERFLOW_POLICY", OverflowDisconnect)
+	authPasswordSHA256 := strings.ToLower(src.getString("CHAT_SERVER_AUTH_PASSWORD_SHA256", ""))
+	lobbyRoom := src.getString("CHAT_SERVER_LOBBY_ROOM", "")
+	autoJoinRoom := src.getString("CHAT_SERVER_AUTO_JOIN_ROOM", "")
+	reservedUsernames := src.getSet("CHAT_SERVER_RESERVED_USERNAMES")
+	disabledOperations := src.getSet("CHAT_SERVER_DISABLED_OPERATIONS")
 
-	maxFrameBytes, err := getEnvIntStrict("CHAT_SERVER_MAX_FRAME_BYTES", defaultMaxFrameBytes)
-	if err != nil {
-		return Config{}, err
-	}
-	writeQueueDepth, err := getEnvIntStrict("CHAT_SERVER_WRITE_QUEUE_DEPTH", defaultWriteQueueDepth)
-	if err != nil {
-		return Config{}, err
-	}
-	readTimeoutSecs, err := getEnvIntStrict("CHAT_SERVER_READ_TIMEOUT_SECS", defaultReadTimeoutSecs)
-	if err != nil {
-		return Config{}, err
-	}
-	writeTimeoutSecs, err := getEnvIntStrict("CHAT_SERVER_WRITE_TIMEOUT_SECS", defaultWriteTimeoutSecs)
-	if err != nil {
-		return Config{}, err
-	}
-	idleTimeoutSecs, err := getEnvIntStrict("CHAT_SERVER_IDLE_TIMEOUT_SECS", defaultIdleTimeoutSecs)
-	if err != nil {
-		return Config{}, err
-	}
+	allowedCIDRs := src.getCIDRs("CHAT_SERVER_ALLOWED_CIDRS")
+	deniedCIDRs := src.getCIDRs("CHAT_SERVER_DENIED_CIDRS")
+
+	maxFrameBytes := src.getIntStrict("CHAT_SERVER_MAX_FRAME_BYTES", defaultMaxFrameBytes)
+	writeQueueDepth := src.getIntStrict("CHAT_SERVER_WRITE_QUEUE_DEPTH", defaultWriteQueueDepth)
+	readTimeoutSecs := src.getIntStrict("CHAT_SERVER_READ_TIMEOUT_SECS", defaultReadTimeoutSecs)
+	writeTimeoutSecs := src.getIntStrict("CHAT_SERVER_WRITE_TIMEOUT_SECS", defaultWriteTimeoutSecs)
+	idleTimeoutSecs := src.getIntStrict("CHAT_SERVER_IDLE_TIMEOUT_SECS", defaultIdleTimeoutSecs)
+	writeEnqueueTimeoutMs := src.getIntStrict(
+		"CHAT_SERVER_WRITE_ENQUEUE_TIMEOUT_MS",
+		defaultWriteEnqueueTimeoutMs,
+	)
+	roomHistoryDepth := src.getIntStrict("CHAT_SERVER_ROOM_HISTORY_DEPTH", defaultRoomHistoryDepth)
+	roomMessagesPerSecond := src.getIntStrict(
+		"CHAT_SERVER_ROOM_MESSAGES_PER_SECOND",
+		defaultRoomMessagesPerSecond,
+	)
+	readBufferBytes := src.getIntStrict("CHAT_SERVER_READ_BUFFER_BYTES", defaultReadBufferBytes)
+	maxConnections := src.getIntStrict("CHAT_SERVER_MAX_CONNECTIONS", defaultMaxConnections)
+	maxRoomsPerUser := src.getIntStrict("CHAT_SERVER_MAX_ROOMS_PER_USER", defaultMaxRoomsPerUser)
+	reconnectGraceSecs := src.getIntStrict("CHAT_SERVER_RECONNECT_GRACE_SECS", defaultReconnectGraceSecs)
+	maxRoomMembers := src.getIntStrict("CHAT_SERVER_MAX_ROOM_MEMBERS", defaultMaxRoomMembers)
+	usernameHoldSecs := src.getIntStrict("CHAT_SERVER_USERNAME_HOLD_SECS", defaultUsernameHoldSecs)
+	tcpKeepAliveSecs := src.getIntStrict("CHAT_SERVER_TCP_KEEPALIVE_SECS", defaultTCPKeepAliveSecs)
+	maxPendingInvitesPerRoom := src.getIntStrict(
+		"CHAT_SERVER_MAX_PENDING_INVITES_PER_ROOM",
+		defaultMaxPendingInvites,
+	)
+	inviteTTLSecs := src.getIntStrict("CHAT_SERVER_INVITE_TTL_SECS", defaultInviteTTLSecs)
+	maxTotalRooms := src.getIntStrict("CHAT_SERVER_MAX_TOTAL_ROOMS", defaultMaxTotalRooms)
+	maxConnectionsPerIP := src.getIntStrict(
+		"CHAT_SERVER_MAX_CONNECTIONS_PER_IP",
+		defaultMaxConnectionsPerIP,
+	)
+	absentMemberTTLSecs := src.getIntStrict(
+		"CHAT_SERVER_ABSENT_MEMBER_TTL_SECS",
+		defaultAbsentMemberTTLSecs,
+	)
+	maxIdentifyAttempts := src.getIntStrict(
+		"CHAT_SERVER_MAX_IDENTIFY_ATTEMPTS",
+		defaultMaxIdentifyAttempts,
+	)
+	idleWarningSecs := src.getIntStrict("CHAT_SERVER_IDLE_WARNING_SECS", defaultIdleWarningSecs)
+	maxPendingInvitesPerUser := src.getIntStrict(
+		"CHAT_SERVER_MAX_PENDING_INVITES_PER_USER",
+		defaultMaxPendingPerUser,
+	)
+	writeCoalesceMs := src.getIntStrict("CHAT_SERVER_WRITE_COALESCE_MS", defaultWriteCoalesceMs)
+	flowControlHighPercent := src.getIntStrict(
+		"CHAT_SERVER_FLOW_CONTROL_HIGH_PERCENT",
+		defaultFlowControlHigh,
+	)
+	flowControlLowPercent := src.getIntStrict(
+		"CHAT_SERVER_FLOW_CONTROL_LOW_PERCENT",
+		defaultFlowControlLow,
+	)
+	globalMessagesPerSecond := src.getIntStrict(
+		"CHAT_SERVER_GLOBAL_MESSAGES_PER_SECOND",
+		defaultGlobalMessagesPerSec,
+	)
+	clientByteBudget := src.getIntStrict("CHAT_SERVER_CLIENT_BYTE_BUDGET", defaultClientByteBudget)
+	clientByteWindowSecs := src.getIntStrict(
+		"CHAT_SERVER_CLIENT_BYTE_WINDOW_SECS",
+		defaultClientByteWindowSecs,
+	)
+	maxByteBudgetViolations := src.getIntStrict(
+		"CHAT_SERVER_MAX_BYTE_BUDGET_VIOLATIONS",
+		defaultMaxBudgetViolations,
+	)
+	identifyTimeoutSecs := src.getIntStrict(
+		"CHAT_SERVER_IDENTIFY_TIMEOUT_SECS",
+		defaultIdentifyTimeoutSecs,
+	)
+	maxRecipients := src.getIntStrict("CHAT_SERVER_MAX_RECIPIENTS", defaultMaxRecipients)
+	maxProtocolViolations := src.getIntStrict(
+		"CHAT_SERVER_MAX_PROTOCOL_VIOLATIONS",
+		defaultMaxViolations,
+	)
+	emptyRoomTTLSecs := src.getIntStrict("CHAT_SERVER_EMPTY_ROOM_TTL_SECS", defaultEmptyRoomTTLSecs)
+	maxUsernameLength := src.getIntStrict("CHAT_SERVER_MAX_USERNAME_LENGTH", defaultMaxUsernameLength)
+	maxRoomNameLength := src.getIntStrict("CHAT_SERVER_MAX_ROOM_NAME_LENGTH", defaultMaxRoomNameLength)
+	maxTextLength := src.getIntStrict("CHAT_SERVER_MAX_TEXT_LENGTH", defaultMaxTextLength)
+	caseInsensitiveUsernames := src.getBoolStrict("CHAT_SERVER_CASE_INSENSITIVE_USERNAMES", false)
+	validateUTF8 := src.getBoolStrict("CHAT_SERVER_VALIDATE_UTF8", false)
+	sendHello := src.getBoolStrict("CHAT_SERVER_SEND_HELLO", false)
+	trimCarriageReturn := src.getBoolStrict("CHAT_SERVER_TRIM_CARRIAGE_RETURN", true)
+	ignoreEmptyFrames := src.getBoolStrict("CHAT_SERVER_IGNORE_EMPTY_FRAMES", false)
+	strictInvitePermission := src.getBoolStrict("CHAT_SERVER_STRICT_INVITE_PERMISSION", true)
+	caseInsensitiveRooms := src.getBoolStrict("CHAT_SERVER_CASE_INSENSITIVE_ROOMS", false)
+	sequenceNumbers := src.getBoolStrict("CHAT_SERVER_SEQUENCE_NUMBERS", false)
+	requireAuth := src.getBoolStrict("CHAT_SERVER_REQUIRE_AUTH", false)
 
 	cfg := Config{
 		ListenAddr:        listenAddr,
@@ -61,45 +437,491 @@ func FromEnv() (Config, error) {
 		ReadTimeoutSecs:   readTimeoutSecs,
 		WriteTimeoutSecs:  writeTimeoutSecs,
 		IdleTimeoutSecs:   idleTimeoutSecs,
-		MaxUsernameLength: protocolMaxUsernameLength,
-		MaxRoomNameLength: protocolMaxRoomNameLength,
+		MaxUsernameLength: maxUsernameLength,
+		MaxRoomNameLength: maxRoomNameLength,
+		MaxTextLength:     maxTextLength,
+		MOTD:              motd,
+		MOTDFile:          motdFile,
+
+		CaseInsensitiveUsernames: caseInsensitiveUsernames,
+		ValidateUTF8:             validateUTF8,
+		WriteEnqueueTimeoutMs:    writeEnqueueTimeoutMs,
+		RoomHistoryDepth:         roomHistoryDepth,
+		RoomMessagesPerSecond:    roomMessagesPerSecond,
+		ReadBufferBytes:          readBufferBytes,
+		MaxConnections:           maxConnections,
+		MaxRoomsPerUser:          maxRoomsPerUser,
+		ReconnectGraceSecs:       reconnectGraceSecs,
+		MaxRoomMembers:           maxRoomMembers,
+		UsernameHoldSecs:         usernameHoldSecs,
+		AllowedCIDRs:             allowedCIDRs,
+		DeniedCIDRs:              deniedCIDRs,
+		DisabledOperations:       disabledOperations,
+		TCPKeepAliveSecs:         tcpKeepAliveSecs,
+		MaxPendingInvitesPerRoom: maxPendingInvitesPerRoom,
+		InviteTTLSecs:            inviteTTLSecs,
+		SendHello:                sendHello,
+		TrimCarriageReturn:       trimCarriageReturn,
+		DebugAddr:                debugAddr,
+		CaseInsensitiveRooms:     caseInsensitiveRooms,
+		MaxTotalRooms:            maxTotalRooms,
+		MaxConnectionsPerIP:      maxConnectionsPerIP,
+		AuditLogFile:             auditLogFile,
+		StateFile:                stateFile,
+		AbsentMemberTTLSecs:      absentMemberTTLSecs,
+		OverflowPolicy:           overflowPolicy,
+		SequenceNumbers:          sequenceNumbers,
+		RequireAuth:              requireAuth,
+		AuthPasswordSHA256:       authPasswordSHA256,
+		MaxIdentifyAttempts:      maxIdentifyAttempts,
+		LobbyRoom:                lobbyRoom,
+		AutoJoinRoom:             autoJoinRoom,
+		IdleWarningSecs:          idleWarningSecs,
+		MaxPendingInvitesPerUser: maxPendingInvitesPerUser,
+		WriteCoalesceMs:          writeCoalesceMs,
+		IgnoreEmptyFrames:        ignoreEmptyFrames,
+		FlowControlHighPercent:   flowControlHighPercent,
+		FlowControlLowPercent:    flowControlLowPercent,
+		GlobalMessagesPerSecond:  globalMessagesPerSecond,
+		ClientByteBudget:         clientByteBudget,
+		ClientByteWindowSecs:     clientByteWindowSecs,
+		MaxByteBudgetViolations:  maxByteBudgetViolations,
+		IdentifyTimeoutSecs:      identifyTimeoutSecs,
+		MaxRecipients:            maxRecipients,
+		MaxProtocolViolations:    maxProtocolViolations,
+		StrictInvitePermission:   strictInvitePermission,
+		EmptyRoomTTLSecs:         emptyRoomTTLSecs,
+		AdminToken:               adminToken,
+		ReservedUsernames:        reservedUsernames,
+	}
+
+	// An inline MOTD takes precedence over the file.
+	if cfg.MOTD == "" && cfg.MOTDFile != "" {
+		contents, err := os.ReadFile(cfg.MOTDFile)
+		if err != nil {
+			src.errs = append(src.errs, fmt.Errorf("invalid CHAT_SERVER_MOTD_FILE: %w", err))
+		}
+		cfg.MOTD = strings.TrimRight(string(contents), "\r\n")
+	}
+
+	// Values that failed to parse were replaced by their defaults, so
+	// Validate only adds the out-of-range ones.
+	if err := errors.Join(append(src.errs, cfg.Validate())...); err != nil {
+		return Config{}, err
 	}
 
+	return cfg, nil
+}
+
+// Validate checks every setting of cfg and reports all out-of-range values
+// at once, joined with errors.Join.
+func (cfg Config) Validate() error {
+	var errs []error
+
+	if len(cfg.ListenAddrs()) == 0 {
+		errs = append(errs, fmt.Errorf("invalid CHAT_SERVER_ADDR: %q", cfg.ListenAddr))
+	}
 	if cfg.MaxFrameBytes <= 0 {
-		return Config{}, fmt.Errorf("invalid CHAT_SERVER_MAX_FRAME_BYTES: %d", cfg.MaxFrameBytes)
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_MAX_FRAME_BYTES: %d", cfg.MaxFrameBytes,
+		))
 	}
 	if cfg.WriteQueueDepth <= 0 {
-		return Config{}, fmt.Errorf("invalid CHAT_SERVER_WRITE_QUEUE_DEPTH: %d", cfg.WriteQueueDepth)
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_WRITE_QUEUE_DEPTH: %d", cfg.WriteQueueDepth,
+		))
 	}
 	if cfg.ReadTimeoutSecs < 0 {
-		return Config{}, fmt.Errorf("invalid CHAT_SERVER_READ_TIMEOUT_SECS: %d", cfg.ReadTimeoutSecs)
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_READ_TIMEOUT_SECS: %d", cfg.ReadTimeoutSecs,
+		))
 	}
 	if cfg.WriteTimeoutSecs < 0 {
-		return Config{}, fmt.Errorf("invalid CHAT_SERVER_WRITE_TIMEOUT_SECS: %d", cfg.WriteTimeoutSecs)
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_WRITE_TIMEOUT_SECS: %d", cfg.WriteTimeoutSecs,
+		))
 	}
 	if cfg.IdleTimeoutSecs < 0 {
-		return Config{}, fmt.Errorf("invalid CHAT_SERVER_IDLE_TIMEOUT_SECS: %d", cfg.IdleTimeoutSecs)
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_IDLE_TIMEOUT_SECS: %d", cfg.IdleTimeoutSecs,
+		))
+	}
+	if cfg.IdleWarningSecs < 0 ||
+		(cfg.IdleTimeoutSecs > 0 && cfg.IdleWarningSecs >= cfg.IdleTimeoutSecs) {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_IDLE_WARNING_SECS: %d (must be below CHAT_SERVER_IDLE_TIMEOUT_SECS)",
+			cfg.IdleWarningSecs,
+		))
+	}
+	if cfg.FlowControlHighPercent < 0 || cfg.FlowControlHighPercent > 100 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_FLOW_CONTROL_HIGH_PERCENT: %d", cfg.FlowControlHighPercent,
+		))
+	}
+	if cfg.FlowControlLowPercent < 0 ||
+		(cfg.FlowControlHighPercent > 0 && cfg.FlowControlLowPercent >= cfg.FlowControlHighPercent) {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_FLOW_CONTROL_LOW_PERCENT: %d must be below CHAT_SERVER_FLOW_CONTROL_HIGH_PERCENT",
+			cfg.FlowControlLowPercent,
+		))
+	}
+	if cfg.WriteCoalesceMs < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_WRITE_COALESCE_MS: %d", cfg.WriteCoalesceMs,
+		))
+	}
+	if cfg.WriteEnqueueTimeoutMs < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_WRITE_ENQUEUE_TIMEOUT_MS: %d", cfg.WriteEnqueueTimeoutMs,
+		))
+	}
+	if cfg.RoomHistoryDepth < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_ROOM_HISTORY_DEPTH: %d", cfg.RoomHistoryDepth,
+		))
+	}
+	if cfg.AbsentMemberTTLSecs < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_ABSENT_MEMBER_TTL_SECS: %d", cfg.AbsentMemberTTLSecs,
+		))
+	}
+	if cfg.MaxProtocolViolations < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_MAX_PROTOCOL_VIOLATIONS: %d", cfg.MaxProtocolViolations,
+		))
+	}
+	if cfg.EmptyRoomTTLSecs < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_EMPTY_ROOM_TTL_SECS: %d", cfg.EmptyRoomTTLSecs,
+		))
+	}
+	if cfg.MaxRecipients <= 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_MAX_RECIPIENTS: %d", cfg.MaxRecipients,
+		))
+	}
+	if cfg.IdentifyTimeoutSecs < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_IDENTIFY_TIMEOUT_SECS: %d", cfg.IdentifyTimeoutSecs,
+		))
+	}
+	if cfg.ClientByteBudget < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_CLIENT_BYTE_BUDGET: %d", cfg.ClientByteBudget,
+		))
+	}
+	if cfg.ClientByteWindowSecs <= 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_CLIENT_BYTE_WINDOW_SECS: %d", cfg.ClientByteWindowSecs,
+		))
+	}
+	if cfg.MaxByteBudgetViolations < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_MAX_BYTE_BUDGET_VIOLATIONS: %d", cfg.MaxByteBudgetViolations,
+		))
+	}
+	if cfg.GlobalMessagesPerSecond < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_GLOBAL_MESSAGES_PER_SECOND: %d", cfg.GlobalMessagesPerSecond,
+		))
+	}
+	if cfg.RoomMessagesPerSecond < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_ROOM_MESSAGES_PER_SECOND: %d", cfg.RoomMessagesPerSecond,
+		))
+	}
+	if cfg.ReadBufferBytes <= 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_READ_BUFFER_BYTES: %d", cfg.ReadBufferBytes,
+		))
+	}
+	if cfg.MaxConnections < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_MAX_CONNECTIONS: %d", cfg.MaxConnections,
+		))
+	}
+	if cfg.MaxRoomsPerUser < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_MAX_ROOMS_PER_USER: %d", cfg.MaxRoomsPerUser,
+		))
+	}
+	if cfg.ReconnectGraceSecs < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_RECONNECT_GRACE_SECS: %d", cfg.ReconnectGraceSecs,
+		))
+	}
+	if cfg.MaxRoomMembers < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_MAX_ROOM_MEMBERS: %d", cfg.MaxRoomMembers,
+		))
+	}
+	if cfg.UsernameHoldSecs < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_USERNAME_HOLD_SECS: %d", cfg.UsernameHoldSecs,
+		))
+	}
+	if cfg.TCPKeepAliveSecs < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_TCP_KEEPALIVE_SECS: %d", cfg.TCPKeepAliveSecs,
+		))
+	}
+	if cfg.MaxPendingInvitesPerRoom < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_MAX_PENDING_INVITES_PER_ROOM: %d", cfg.MaxPendingInvitesPerRoom,
+		))
+	}
+	if cfg.MaxPendingInvitesPerUser < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_MAX_PENDING_INVITES_PER_USER: %d", cfg.MaxPendingInvitesPerUser,
+		))
+	}
+	if cfg.InviteTTLSecs < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_INVITE_TTL_SECS: %d", cfg.InviteTTLSecs,
+		))
+	}
+	if cfg.MaxTotalRooms < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_MAX_TOTAL_ROOMS: %d", cfg.MaxTotalRooms,
+		))
+	}
+	if cfg.MaxConnectionsPerIP < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_MAX_CONNECTIONS_PER_IP: %d", cfg.MaxConnectionsPerIP,
+		))
+	}
+	if cfg.MaxIdentifyAttempts < 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_MAX_IDENTIFY_ATTEMPTS: %d", cfg.MaxIdentifyAttempts,
+		))
+	}
+	switch cfg.OverflowPolicy {
+	case OverflowDisconnect, OverflowDropOldest, OverflowDropNewest:
+	default:
+		errs = append(errs, fmt.Errorf("invalid CHAT_SERVER_OVERFLOW_POLICY: %q", cfg.OverflowPolicy))
+	}
+	if cfg.RequireAuth && cfg.AuthPasswordSHA256 == "" {
+		errs = append(errs, errors.New(
+			"CHAT_SERVER_REQUIRE_AUTH needs CHAT_SERVER_AUTH_PASSWORD_SHA256",
+		))
+	}
+	if cfg.AuthPasswordSHA256 != "" {
+		if hash, err := hex.DecodeString(cfg.AuthPasswordSHA256); err != nil || len(hash) != sha256.Size {
+			errs = append(errs, errors.New(
+				"invalid CHAT_SERVER_AUTH_PASSWORD_SHA256: must be 64 hex characters",
+			))
+		}
+	}
+	for _, operation := range slices.Sorted(maps.Keys(cfg.DisabledOperations)) {
+		messageType := protocol.MessageType(operation)
+		// IDENTIFY cannot be disabled: no other operation is usable without it.
+		if !protocol.IsClientMessageType(messageType) || messageType == protocol.TypeIdentify {
+			errs = append(errs, fmt.Errorf(
+				"invalid CHAT_SERVER_DISABLED_OPERATIONS: %q", operation,
+			))
+		}
+	}
+	if cfg.MaxUsernameLength <= 0 || cfg.MaxUsernameLength > maxUsernameLengthCeiling {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_MAX_USERNAME_LENGTH: %d (must be 1..%d)",
+			cfg.MaxUsernameLength, maxUsernameLengthCeiling,
+		))
+	}
+	if cfg.MaxRoomNameLength <= 0 || cfg.MaxRoomNameLength > maxRoomNameLengthCeiling {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_MAX_ROOM_NAME_LENGTH: %d (must be 1..%d)",
+			cfg.MaxRoomNameLength, maxRoomNameLengthCeiling,
+		))
+	}
+	if len(cfg.LobbyRoom) > cfg.MaxRoomNameLength {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_LOBBY_ROOM: %q is longer than CHAT_SERVER_MAX_ROOM_NAME_LENGTH",
+			cfg.LobbyRoom,
+		))
+	}
+	if len(cfg.AutoJoinRoom) > cfg.MaxRoomNameLength {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_AUTO_JOIN_ROOM: %q is longer than CHAT_SERVER_MAX_ROOM_NAME_LENGTH",
+			cfg.AutoJoinRoom,
+		))
+	}
+	if cfg.MaxTextLength <= 0 {
+		errs = append(errs, fmt.Errorf(
+			"invalid CHAT_SERVER_MAX_TEXT_LENGTH: %d", cfg.MaxTextLength,
+		))
 	}
 
-	return cfg, nil
+	return errors.Join(errs...)
 }
 
-func getEnvString(key, defaultValue string) string {
+// ListenAddrs splits ListenAddr, a comma-separated list, into the
+// addresses to listen on.
+func (cfg Config) ListenAddrs() []string {
+	var addrs []string
+	for _, addr := range strings.Split(cfg.ListenAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// WithReloaded returns a copy of cfg with the settings that can change
+// while the server runs taken from next. Settings tied to the listener,
+// to connection setup or to state that already exists keep their value.
+func (cfg Config) WithReloaded(next Config) Config {
+	cfg.ReadTimeoutSecs = next.ReadTimeoutSecs
+	cfg.WriteTimeoutSecs = next.WriteTimeoutSecs
+	cfg.WriteEnqueueTimeoutMs = next.WriteEnqueueTimeoutMs
+	cfg.MaxTextLength = next.MaxTextLength
+	cfg.ValidateUTF8 = next.ValidateUTF8
+	cfg.RoomMessagesPerSecond = next.RoomMessagesPerSecond
+	cfg.MOTD = next.MOTD
+	return cfg
+}
+
+// source looks up settings in the environment and then, when loading from
+// a file, in the file values. used records which file values were read,
+// and errs every value that could not be parsed.
+type source struct {
+	fileValues map[string]string
+	used       map[string]struct{}
+	errs       []error
+}
+
+// lookup returns the raw value of a setting. Empty environment variables
+// count as unset.
+func (src *source) lookup(key string) (string, bool) {
+	fileValue, inFile := src.fileValues[key]
+	if inFile {
+		src.used[key] = struct{}{}
+	}
+
 	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value, true
+	}
+	return fileValue, inFile && fileValue != ""
+}
+
+func (src *source) getString(key, defaultValue string) string {
+	if value, ok := src.lookup(key); ok {
 		return value
 	}
 	return defaultValue
 }
 
-func getEnvIntStrict(key string, defaultValue int) (int, error) {
-	value, ok := os.LookupEnv(key)
-	if !ok || value == "" {
-		return defaultValue, nil
+// getSet parses a comma-separated list into a set.
+// Surrounding whitespace is trimmed and empty items are skipped.
+func (src *source) getSet(key string) map[string]struct{} {
+	value, _ := src.lookup(key)
+
+	set := make(map[string]struct{})
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		set[item] = struct{}{}
+	}
+	return set
+}
+
+// getCIDRs parses a comma-separated list of CIDR blocks. Invalid blocks
+// are recorded in src.errs and skipped.
+func (src *source) getCIDRs(key string) []*net.IPNet {
+	var networks []*net.IPNet
+	for item := range src.getSet(key) {
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			src.errs = append(src.errs, fmt.Errorf("invalid %s=%q: %w", key, item, err))
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// getIntStrict parses an integer setting. An invalid value is recorded in
+// src.errs and replaced by defaultValue, so loading goes on and reports
+// every invalid setting at once.
+func (src *source) getIntStrict(key string, defaultValue int) int {
+	value, ok := src.lookup(key)
+	if !ok {
+		return defaultValue
 	}
 
 	parsed, err := strconv.Atoi(value)
 	if err != nil {
-		return 0, fmt.Errorf("invalid %s=%q: %w", key, value, err)
+		src.errs = append(src.errs, fmt.Errorf("invalid %s=%q: %w", key, value, err))
+		return defaultValue
+	}
+	return parsed
+}
+
+// getBoolStrict parses a boolean setting like getIntStrict.
+func (src *source) getBoolStrict(key string, defaultValue bool) bool {
+	value, ok := src.lookup(key)
+	if !ok {
+		return defaultValue
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		src.errs = append(src.errs, fmt.Errorf("invalid %s=%q: %w", key, value, err))
+		return defaultValue
+	}
+	return parsed
+}
+
+// envPrefix is the prefix shared by every environment variable.
+const envPrefix = "CHAT_SERVER_"
+
+// fileKey converts an environment variable name to its config file key.
+func fileKey(envKey string) string {
+	return strings.ToLower(strings.TrimPrefix(envKey, envPrefix))
+}
+
+// parseFileValues flattens a JSON config object into raw setting values
+// keyed by environment variable name. Arrays become comma-separated lists.
+func parseFileValues(contents []byte) (map[string]string, error) {
+	var object map[string]any
+	if err := json.Unmarshal(contents, &object); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(object))
+	for key, rawValue := range object {
+		value, err := fileValueString(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		values[envPrefix+strings.ToUpper(key)] = value
+	}
+	return values, nil
+}
+
+func fileValueString(rawValue any) (string, error) {
+	switch value := rawValue.(type) {
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, 0, len(value))
+		for _, rawItem := range value {
+			if _, isList := rawItem.([]any); isList {
+				return "", fmt.Errorf("nested lists are not supported")
+			}
+			item, err := fileValueString(rawItem)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, item)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", rawValue)
 	}
-	return parsed, nil
 }
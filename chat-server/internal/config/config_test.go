@@ -0,0 +1,515 @@
+package config
+
+import (
+	"errors"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReservedUsernamesFromEnv(t *testing.T) {
+	t.Setenv("CHAT_SERVER_RESERVED_USERNAMES", " admin, ,Server,admin ")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+
+	got := slices.Sorted(maps.Keys(cfg.ReservedUsernames))
+	if want := []string{"Server", "admin"}; !slices.Equal(got, want) {
+		t.Errorf("ReservedUsernames = %v, want %v", got, want)
+	}
+}
+
+func TestReadBufferBytesMustBePositive(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{value: "1024", wantErr: false},
+		{value: "0", wantErr: true},
+		{value: "-1", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			t.Setenv("CHAT_SERVER_READ_BUFFER_BYTES", test.value)
+
+			cfg, err := FromEnv()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if err == nil && cfg.ReadBufferBytes != 1024 {
+				t.Errorf("ReadBufferBytes = %d, want 1024", cfg.ReadBufferBytes)
+			}
+		})
+	}
+}
+
+func TestCIDRListsFromEnv(t *testing.T) {
+	t.Setenv("CHAT_SERVER_ALLOWED_CIDRS", "127.0.0.0/8, ::1/128")
+	t.Setenv("CHAT_SERVER_DENIED_CIDRS", "127.0.0.2/32")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if len(cfg.AllowedCIDRs) != 2 || len(cfg.DeniedCIDRs) != 1 {
+		t.Fatalf("got %d allowed and %d denied blocks, want 2 and 1", len(cfg.AllowedCIDRs), len(cfg.DeniedCIDRs))
+	}
+	if !cfg.DeniedCIDRs[0].Contains(net.IPv4(127, 0, 0, 2)) {
+		t.Errorf("denied block %s does not contain 127.0.0.2", cfg.DeniedCIDRs[0])
+	}
+}
+
+func TestMalformedCIDRIsRejected(t *testing.T) {
+	for _, key := range []string{"CHAT_SERVER_ALLOWED_CIDRS", "CHAT_SERVER_DENIED_CIDRS"} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, "127.0.0.0/8,not-a-cidr")
+
+			if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "not-a-cidr") {
+				t.Errorf("got error %v, want one naming the malformed block", err)
+			}
+		})
+	}
+}
+
+func TestDisabledOperationsFromEnv(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{value: "NEW_ROOM,TEXT", wantErr: false},
+		{value: "NEW_ROOM,SHOUT", wantErr: true},
+		{value: "TEXT_FROM", wantErr: true},
+		{value: "IDENTIFY", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			t.Setenv("CHAT_SERVER_DISABLED_OPERATIONS", test.value)
+
+			cfg, err := FromEnv()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := slices.Sorted(maps.Keys(cfg.DisabledOperations))
+			if want := []string{"NEW_ROOM", "TEXT"}; !slices.Equal(got, want) {
+				t.Errorf("DisabledOperations = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestNameLengthLimitsFromEnv(t *testing.T) {
+	defaults, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if defaults.MaxUsernameLength != 8 || defaults.MaxRoomNameLength != 16 {
+		t.Errorf("default limits = %d and %d, want 8 and 16", defaults.MaxUsernameLength, defaults.MaxRoomNameLength)
+	}
+
+	tests := []struct {
+		key     string
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{key: "CHAT_SERVER_MAX_USERNAME_LENGTH", value: "24", want: 24},
+		{key: "CHAT_SERVER_MAX_USERNAME_LENGTH", value: "0", wantErr: true},
+		{key: "CHAT_SERVER_MAX_USERNAME_LENGTH", value: "-3", wantErr: true},
+		{key: "CHAT_SERVER_MAX_USERNAME_LENGTH", value: "65", wantErr: true},
+		{key: "CHAT_SERVER_MAX_ROOM_NAME_LENGTH", value: "64", want: 64},
+		{key: "CHAT_SERVER_MAX_ROOM_NAME_LENGTH", value: "0", wantErr: true},
+		{key: "CHAT_SERVER_MAX_ROOM_NAME_LENGTH", value: "-1", wantErr: true},
+		{key: "CHAT_SERVER_MAX_ROOM_NAME_LENGTH", value: "1000", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.key+"="+test.value, func(t *testing.T) {
+			t.Setenv(test.key, test.value)
+
+			cfg, err := FromEnv()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := cfg.MaxUsernameLength
+			if test.key == "CHAT_SERVER_MAX_ROOM_NAME_LENGTH" {
+				got = cfg.MaxRoomNameLength
+			}
+			if got != test.want {
+				t.Errorf("limit = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+// writeConfigFile writes contents to a config file in a temporary
+// directory and returns its path.
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "chat-server.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("write config file: %v", err)
+	}
+	return path
+}
+
+func TestFromFile(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"addr": "127.0.0.1:9000",
+		"max_text_length": 512,
+		"reserved_usernames": ["admin", "root"],
+		"denied_cidrs": ["10.0.0.0/8"]
+	}`)
+
+	cfg, err := FromFile(path)
+	if err != nil {
+		t.Fatalf("FromFile: %v", err)
+	}
+	if cfg.ListenAddr != "127.0.0.1:9000" || cfg.MaxTextLength != 512 {
+		t.Errorf("ListenAddr = %q, MaxTextLength = %d, want 127.0.0.1:9000 and 512", cfg.ListenAddr, cfg.MaxTextLength)
+	}
+	if got := slices.Sorted(maps.Keys(cfg.ReservedUsernames)); !slices.Equal(got, []string{"admin", "root"}) {
+		t.Errorf("ReservedUsernames = %v, want [admin root]", got)
+	}
+	if len(cfg.DeniedCIDRs) != 1 || cfg.DeniedCIDRs[0].String() != "10.0.0.0/8" {
+		t.Errorf("DeniedCIDRs = %v, want [10.0.0.0/8]", cfg.DeniedCIDRs)
+	}
+}
+
+func TestFromFileRejectsInvalidFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{name: "malformed json", contents: `{"max_text_length": `, wantErr: "parse config file"},
+		{name: "unknown key", contents: `{"max_txt_length": 10}`, wantErr: `unknown setting "max_txt_length"`},
+		{name: "invalid value", contents: `{"max_text_length": 0}`, wantErr: "CHAT_SERVER_MAX_TEXT_LENGTH"},
+		{name: "nested list", contents: `{"reserved_usernames": [["admin"]]}`, wantErr: "nested lists"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := FromFile(writeConfigFile(t, test.contents))
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+
+	if _, err := FromFile(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file error = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestEnvOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, `{"max_text_length": 512, "write_queue_depth": 32}`)
+	t.Setenv("CHAT_SERVER_MAX_TEXT_LENGTH", "2048")
+
+	cfg, err := FromFile(path)
+	if err != nil {
+		t.Fatalf("FromFile: %v", err)
+	}
+	if cfg.MaxTextLength != 2048 {
+		t.Errorf("MaxTextLength = %d, want the environment's 2048", cfg.MaxTextLength)
+	}
+	if cfg.WriteQueueDepth != 32 {
+		t.Errorf("WriteQueueDepth = %d, want the file's 32", cfg.WriteQueueDepth)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("default config is invalid: %v", err)
+	}
+
+	cfg.MaxFrameBytes = 0
+	cfg.WriteQueueDepth = -1
+	cfg.MaxUsernameLength = 0
+	cfg.TCPKeepAliveSecs = -5
+
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate accepted four invalid settings")
+	}
+	for _, setting := range []string{
+		"CHAT_SERVER_MAX_FRAME_BYTES",
+		"CHAT_SERVER_WRITE_QUEUE_DEPTH",
+		"CHAT_SERVER_MAX_USERNAME_LENGTH",
+		"CHAT_SERVER_TCP_KEEPALIVE_SECS",
+	} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("error does not report %s:\n%v", setting, err)
+		}
+	}
+}
+
+func TestFromEnvReportsParseAndRangeErrorsTogether(t *testing.T) {
+	t.Setenv("CHAT_SERVER_MAX_TEXT_LENGTH", "lots")
+	t.Setenv("CHAT_SERVER_READ_TIMEOUT_SECS", "-1")
+	t.Setenv("CHAT_SERVER_ALLOWED_CIDRS", "10.0.0.0/33")
+
+	_, err := FromEnv()
+	if err == nil {
+		t.Fatal("FromEnv accepted three invalid settings")
+	}
+	for _, setting := range []string{
+		"CHAT_SERVER_MAX_TEXT_LENGTH",
+		"CHAT_SERVER_READ_TIMEOUT_SECS",
+		"CHAT_SERVER_ALLOWED_CIDRS",
+	} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("error does not report %s:\n%v", setting, err)
+		}
+	}
+}
+
+func TestOverflowPolicyFromEnv(t *testing.T) {
+	for _, policy := range []string{OverflowDisconnect, OverflowDropOldest, OverflowDropNewest} {
+		t.Setenv("CHAT_SERVER_OVERFLOW_POLICY", policy)
+
+		cfg, err := FromEnv()
+		if err != nil {
+			t.Fatalf("policy %q: %v", policy, err)
+		}
+		if cfg.OverflowPolicy != policy {
+			t.Errorf("OverflowPolicy = %q, want %q", cfg.OverflowPolicy, policy)
+		}
+	}
+
+	t.Setenv("CHAT_SERVER_OVERFLOW_POLICY", "drop-random")
+	if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "CHAT_SERVER_OVERFLOW_POLICY") {
+		t.Errorf("got error %v for an unknown policy, want CHAT_SERVER_OVERFLOW_POLICY reported", err)
+	}
+}
+
+func TestAuthSettingsFromEnv(t *testing.T) {
+	hash := strings.Repeat("AB", 32)
+	t.Setenv("CHAT_SERVER_REQUIRE_AUTH", "true")
+	t.Setenv("CHAT_SERVER_AUTH_PASSWORD_SHA256", hash)
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if !cfg.RequireAuth || cfg.AuthPasswordSHA256 != strings.ToLower(hash) {
+		t.Errorf("RequireAuth = %t, AuthPasswordSHA256 = %q", cfg.RequireAuth, cfg.AuthPasswordSHA256)
+	}
+
+	for _, bad := range []string{"", "abc", strings.Repeat("zz", 32)} {
+		t.Setenv("CHAT_SERVER_AUTH_PASSWORD_SHA256", bad)
+		if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "CHAT_SERVER_AUTH_PASSWORD_SHA256") {
+			t.Errorf("hash %q: got error %v, want CHAT_SERVER_AUTH_PASSWORD_SHA256 reported", bad, err)
+		}
+	}
+}
+
+func TestLobbyRoomFromEnv(t *testing.T) {
+	t.Setenv("CHAT_SERVER_LOBBY_ROOM", "lobby")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if cfg.LobbyRoom != "lobby" {
+		t.Errorf("LobbyRoom = %q, want lobby", cfg.LobbyRoom)
+	}
+
+	t.Setenv("CHAT_SERVER_MAX_ROOM_NAME_LENGTH", "4")
+	if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "CHAT_SERVER_LOBBY_ROOM") {
+		t.Errorf("got error %v for a lobby name over the limit, want CHAT_SERVER_LOBBY_ROOM reported", err)
+	}
+}
+
+func TestAutoJoinRoomFromEnv(t *testing.T) {
+	t.Setenv("CHAT_SERVER_AUTO_JOIN_ROOM", "welcome")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if cfg.AutoJoinRoom != "welcome" {
+		t.Errorf("AutoJoinRoom = %q, want welcome", cfg.AutoJoinRoom)
+	}
+
+	t.Setenv("CHAT_SERVER_MAX_ROOM_NAME_LENGTH", "4")
+	if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "CHAT_SERVER_AUTO_JOIN_ROOM") {
+		t.Errorf("got error %v for an auto-join room name over the limit, want CHAT_SERVER_AUTO_JOIN_ROOM reported", err)
+	}
+}
+
+func TestIdleWarningMustPrecedeTimeout(t *testing.T) {
+	t.Setenv("CHAT_SERVER_IDLE_TIMEOUT_SECS", "60")
+	t.Setenv("CHAT_SERVER_IDLE_WARNING_SECS", "20")
+	if _, err := FromEnv(); err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+
+	for _, warning := range []string{"60", "90", "-1"} {
+		t.Setenv("CHAT_SERVER_IDLE_WARNING_SECS", warning)
+		if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "CHAT_SERVER_IDLE_WARNING_SECS") {
+			t.Errorf("warning %s: got error %v, want CHAT_SERVER_IDLE_WARNING_SECS reported", warning, err)
+		}
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	tests := []struct {
+		listenAddr string
+		want       []string
+	}{
+		{listenAddr: ":8080", want: []string{":8080"}},
+		{listenAddr: "10.0.0.1:8080, [::1]:8080", want: []string{"10.0.0.1:8080", "[::1]:8080"}},
+		{listenAddr: " ,:8080,, ", want: []string{":8080"}},
+	}
+	for _, test := range tests {
+		if got := (Config{ListenAddr: test.listenAddr}).ListenAddrs(); !slices.Equal(got, test.want) {
+			t.Errorf("ListenAddrs(%q) = %v, want %v", test.listenAddr, got, test.want)
+		}
+	}
+
+	t.Setenv("CHAT_SERVER_ADDR", " , ")
+	if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "CHAT_SERVER_ADDR") {
+		t.Errorf("got error %v for an empty address list, want CHAT_SERVER_ADDR reported", err)
+	}
+}
+
+func TestFlowControlWatermarks(t *testing.T) {
+	tests := []struct {
+		high, low string
+		wantErr   string
+	}{
+		{high: "80", low: "20"},
+		{high: "0", low: "50"},
+		{high: "101", low: "20", wantErr: "CHAT_SERVER_FLOW_CONTROL_HIGH_PERCENT"},
+		{high: "50", low: "50", wantErr: "CHAT_SERVER_FLOW_CONTROL_LOW_PERCENT"},
+		{high: "50", low: "-1", wantErr: "CHAT_SERVER_FLOW_CONTROL_LOW_PERCENT"},
+	}
+	for _, test := range tests {
+		t.Setenv("CHAT_SERVER_FLOW_CONTROL_HIGH_PERCENT", test.high)
+		t.Setenv("CHAT_SERVER_FLOW_CONTROL_LOW_PERCENT", test.low)
+
+		_, err := FromEnv()
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("high %s low %s: %v", test.high, test.low, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("high %s low %s: got error %v, want %s reported", test.high, test.low, err, test.wantErr)
+		}
+	}
+}
+
+func TestGlobalMessagesPerSecondFromEnv(t *testing.T) {
+	t.Setenv("CHAT_SERVER_GLOBAL_MESSAGES_PER_SECOND", "500")
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if cfg.GlobalMessagesPerSecond != 500 {
+		t.Errorf("GlobalMessagesPerSecond = %d, want 500", cfg.GlobalMessagesPerSecond)
+	}
+
+	t.Setenv("CHAT_SERVER_GLOBAL_MESSAGES_PER_SECOND", "-1")
+	if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "CHAT_SERVER_GLOBAL_MESSAGES_PER_SECOND") {
+		t.Errorf("got error %v for a negative rate, want CHAT_SERVER_GLOBAL_MESSAGES_PER_SECOND reported", err)
+	}
+}
+
+func TestClientByteBudgetFromEnv(t *testing.T) {
+	t.Setenv("CHAT_SERVER_CLIENT_BYTE_BUDGET", "65536")
+	t.Setenv("CHAT_SERVER_CLIENT_BYTE_WINDOW_SECS", "30")
+	t.Setenv("CHAT_SERVER_MAX_BYTE_BUDGET_VIOLATIONS", "3")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if cfg.ClientByteBudget != 65536 || cfg.ClientByteWindowSecs != 30 || cfg.MaxByteBudgetViolations != 3 {
+		t.Errorf("budget = %d, window = %d, violations = %d",
+			cfg.ClientByteBudget, cfg.ClientByteWindowSecs, cfg.MaxByteBudgetViolations)
+	}
+
+	t.Setenv("CHAT_SERVER_CLIENT_BYTE_WINDOW_SECS", "0")
+	if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "CHAT_SERVER_CLIENT_BYTE_WINDOW_SECS") {
+		t.Errorf("got error %v for a zero window, want CHAT_SERVER_CLIENT_BYTE_WINDOW_SECS reported", err)
+	}
+}
+
+func TestMaxProtocolViolationsFromEnv(t *testing.T) {
+	t.Setenv("CHAT_SERVER_MAX_PROTOCOL_VIOLATIONS", "4")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if cfg.MaxProtocolViolations != 4 {
+		t.Errorf("MaxProtocolViolations = %d, want 4", cfg.MaxProtocolViolations)
+	}
+
+	t.Setenv("CHAT_SERVER_MAX_PROTOCOL_VIOLATIONS", "-1")
+	if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "CHAT_SERVER_MAX_PROTOCOL_VIOLATIONS") {
+		t.Errorf("got error %v for a negative tolerance, want CHAT_SERVER_MAX_PROTOCOL_VIOLATIONS reported", err)
+	}
+}
+
+func TestStrictInvitePermissionFromEnv(t *testing.T) {
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if !cfg.StrictInvitePermission {
+		t.Error("StrictInvitePermission is off by default, want on")
+	}
+
+	t.Setenv("CHAT_SERVER_STRICT_INVITE_PERMISSION", "false")
+	cfg, err = FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if cfg.StrictInvitePermission {
+		t.Error("StrictInvitePermission still on after setting it false")
+	}
+
+	t.Setenv("CHAT_SERVER_STRICT_INVITE_PERMISSION", "sometimes")
+	if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "CHAT_SERVER_STRICT_INVITE_PERMISSION") {
+		t.Errorf("got error %v for a malformed flag, want CHAT_SERVER_STRICT_INVITE_PERMISSION reported", err)
+	}
+}
+
+func TestEmptyRoomTTLFromEnv(t *testing.T) {
+	t.Setenv("CHAT_SERVER_EMPTY_ROOM_TTL_SECS", "120")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if cfg.EmptyRoomTTLSecs != 120 {
+		t.Errorf("EmptyRoomTTLSecs = %d, want 120", cfg.EmptyRoomTTLSecs)
+	}
+
+	t.Setenv("CHAT_SERVER_EMPTY_ROOM_TTL_SECS", "-5")
+	if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "CHAT_SERVER_EMPTY_ROOM_TTL_SECS") {
+		t.Errorf("got error %v for a negative TTL, want CHAT_SERVER_EMPTY_ROOM_TTL_SECS reported", err)
+	}
+}
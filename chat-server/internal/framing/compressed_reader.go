@@ -0,0 +1,79 @@
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// CompressedReader reads the length-prefixed compressed frames written by
+// CompressedWriter and returns them decompressed.
+type CompressedReader struct {
+	reader        *bufio.Reader
+	method        string
+	maxFrameBytes int
+}
+
+// NewCompressedReader creates a CompressedReader for method, one of
+// CompressionGzip or CompressionDeflate. maxFrameBytes bounds a frame
+// both before and after decompression.
+func NewCompressedReader(reader io.Reader, method string, maxFrameBytes int) (*CompressedReader, error) {
+	switch method {
+	case CompressionGzip, CompressionDeflate:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedCompression, method)
+	}
+
+	return &CompressedReader{
+		reader:        bufio.NewReader(reader),
+		method:        method,
+		maxFrameBytes: maxFrameBytes,
+	}, nil
+}
+
+// ReadFrame reads and decompresses the next frame.
+// A frame larger than maxFrameBytes returns ErrFrameTooLarge; since the
+// stream position is lost then, the reader must not be used afterwards.
+func (cr *CompressedReader) ReadFrame() ([]byte, error) {
+	var prefix [lengthPrefixBytes]byte
+	if _, err := io.ReadFull(cr.reader, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	compressedLength := binary.BigEndian.Uint32(prefix[:])
+	if uint64(compressedLength) > uint64(cr.maxFrameBytes) {
+		return nil, ErrFrameTooLarge
+	}
+
+	compressed := make([]byte, compressedLength)
+	if _, err := io.ReadFull(cr.reader, compressed); err != nil {
+		return nil, fmt.Errorf("read payload: %w", err)
+	}
+
+	var decompressor io.ReadCloser
+	switch cr.method {
+	case CompressionGzip:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, fmt.Errorf("decompress payload: %w", err)
+		}
+		decompressor = gzipReader
+	default:
+		decompressor = flate.NewReader(bytes.NewReader(compressed))
+	}
+	defer decompressor.Close()
+
+	payload, err := io.ReadAll(io.LimitReader(decompressor, int64(cr.maxFrameBytes)+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompress payload: %w", err)
+	}
+	if len(payload) > cr.maxFrameBytes {
+		return nil, ErrFrameTooLarge
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,82 @@
+package framing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCompressedFramesRoundTrip(t *testing.T) {
+	frames := [][]byte{
+		[]byte(`{"type":"TEXT_FROM","username":"alice","text":"hi"}`),
+		[]byte("line one\nline two\n"),
+		[]byte(strings.Repeat("x", 10_000)),
+		{},
+	}
+
+	for _, method := range []string{CompressionGzip, CompressionDeflate} {
+		t.Run(method, func(t *testing.T) {
+			var stream bytes.Buffer
+			writer, err := NewCompressedWriter(&stream, method)
+			if err != nil {
+				t.Fatalf("new writer: %v", err)
+			}
+			if err := writer.WriteFrame(context.Background(), frames[0]); err != nil {
+				t.Fatalf("write frame: %v", err)
+			}
+			if err := writer.WriteFrames(context.Background(), frames[1:]); err != nil {
+				t.Fatalf("write frames: %v", err)
+			}
+
+			reader, err := NewCompressedReader(&stream, method, 1<<20)
+			if err != nil {
+				t.Fatalf("new reader: %v", err)
+			}
+			for i, want := range frames {
+				got, err := reader.ReadFrame()
+				if err != nil {
+					t.Fatalf("read frame %d: %v", i, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("frame %d = %q, want %q", i, got, want)
+				}
+			}
+			if _, err := reader.ReadFrame(); err != io.EOF {
+				t.Errorf("got error %v after the last frame, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestCompressedFrameTooLarge(t *testing.T) {
+	var stream bytes.Buffer
+	writer, err := NewCompressedWriter(&stream, CompressionGzip)
+	if err != nil {
+		t.Fatalf("new writer: %v", err)
+	}
+	// Repeated bytes compress well below the limit, so only the
+	// decompressed size can exceed it.
+	if err := writer.WriteFrame(context.Background(), bytes.Repeat([]byte("a"), 4096)); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+
+	reader, err := NewCompressedReader(&stream, CompressionGzip, 1024)
+	if err != nil {
+		t.Fatalf("new reader: %v", err)
+	}
+	if _, err := reader.ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("got error %v, want %v", err, ErrFrameTooLarge)
+	}
+}
+
+func TestUnsupportedCompression(t *testing.T) {
+	if _, err := NewCompressedWriter(io.Discard, "brotli"); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("writer: got error %v, want %v", err, ErrUnsupportedCompression)
+	}
+	if _, err := NewCompressedReader(strings.NewReader(""), "brotli", 1024); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("reader: got error %v, want %v", err, ErrUnsupportedCompression)
+	}
+}
@@ -0,0 +1,109 @@
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Compression methods supported by CompressedWriter and CompressedReader.
+const (
+	CompressionGzip    = "gzip"
+	CompressionDeflate = "deflate"
+)
+
+// ErrUnsupportedCompression is returned for an unknown compression method.
+var ErrUnsupportedCompression = errors.New("unsupported compression method")
+
+// lengthPrefixBytes is the size of the big-endian length that precedes
+// every compressed frame.
+const lengthPrefixBytes = 4
+
+// compressor is the part of gzip.Writer and flate.Writer that
+// CompressedWriter needs to reuse one compressor for every frame.
+type compressor interface {
+	io.WriteCloser
+	Reset(writer io.Writer)
+}
+
+// CompressedWriter writes length-prefixed compressed frames to an
+// io.Writer. Compressed bytes may contain newlines, so instead of a
+// delimiter each frame is written as:
+// <4-byte big-endian length><compressed payload>
+//
+// Every frame is compressed on its own and can be decompressed without
+// the frames before it.
+type CompressedWriter struct {
+	writer     *bufio.Writer
+	compressor compressor
+	compressed bytes.Buffer
+}
+
+// NewCompressedWriter creates a CompressedWriter using method, one of
+// CompressionGzip or CompressionDeflate. Like LineWriter, it buffers writes
+// internally and is not safe for concurrent use.
+func NewCompressedWriter(writer io.Writer, method string) (*CompressedWriter, error) {
+	compressedWriter := &CompressedWriter{
+		writer: bufio.NewWriter(writer),
+	}
+
+	switch method {
+	case CompressionGzip:
+		compressedWriter.compressor = gzip.NewWriter(&compressedWriter.compressed)
+	case CompressionDeflate:
+		flateWriter, err := flate.NewWriter(&compressedWriter.compressed, flate.DefaultCompression)
+		if err != nil {
+			return nil, fmt.Errorf("create deflate writer: %w", err)
+		}
+		compressedWriter.compressor = flateWriter
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedCompression, method)
+	}
+
+	return compressedWriter, nil
+}
+
+// WriteFrame compresses and writes a single frame.
+// It respects context cancellation before attempting the write.
+func (cw *CompressedWriter) WriteFrame(ctx context.Context, payload []byte) error {
+	return cw.WriteFrames(ctx, [][]byte{payload})
+}
+
+// WriteFrames compresses and writes several frames in order and flushes
+// once. It respects context cancellation before attempting the write.
+func (cw *CompressedWriter) WriteFrames(ctx context.Context, payloads [][]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var prefix [lengthPrefixBytes]byte
+	for _, payload := range payloads {
+		cw.compressed.Reset()
+		cw.compressor.Reset(&cw.compressed)
+		if _, err := cw.compressor.Write(payload); err != nil {
+			return fmt.Errorf("compress payload: %w", err)
+		}
+		if err := cw.compressor.Close(); err != nil {
+			return fmt.Errorf("compress payload: %w", err)
+		}
+
+		binary.BigEndian.PutUint32(prefix[:], uint32(cw.compressed.Len()))
+		if _, err := cw.writer.Write(prefix[:]); err != nil {
+			return fmt.Errorf("write length: %w", err)
+		}
+		if _, err := cw.writer.Write(cw.compressed.Bytes()); err != nil {
+			return fmt.Errorf("write payload: %w", err)
+		}
+	}
+	if err := cw.writer.Flush(); err != nil {
+		return fmt.Errorf("flush writer: %w", err)
+	}
+
+	return nil
+}
@@ -2,62 +2,130 @@ package framing
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 )
 
 // ErrFrameTooLarge is returned when a single frame exceeds the configured limit.
 var ErrFrameTooLarge = errors.New("frame exceeds maximum allowed size")
 
+// ErrFrameTimeout is returned when a frame is not completed before the
+// underlying reader's deadline.
+var ErrFrameTimeout = errors.New("frame not completed before read deadline")
+
 // LineReader reads newline-delimited frames from an io.Reader.
 // A frame is defined as a sequence of bytes terminated by the '\n' character.
-// The delimiter is not included in the returned frame.
+// The delimiter is not included in the returned frame, nor is a '\r'
+// preceding it unless trimming is turned off with SetTrimCarriageReturn.
+//
+// After an oversized frame the reader stays usable: the rest of that frame
+// is discarded up to its delimiter and the next ReadFrame starts on the
+// following frame.
 type LineReader struct {
-	scanner       *bufio.Scanner
+	reader        *bufio.Reader
 	maxFrameBytes int
+
+	// pending accumulates the frame being read across buffer refills.
+	pending []byte
+	// discarding is set once the current frame has exceeded maxFrameBytes;
+	// its remaining bytes are dropped until the delimiter.
+	discarding bool
+
+	keepCarriageReturn bool
 }
 
 // NewLineReader creates a LineReader with a strict maximum frame size.
 // The limit applies to the frame payload only (excluding the '\n' delimiter).
-func NewLineReader(reader io.Reader, maxFrameBytes int) *LineReader {
-	scanner := bufio.NewScanner(reader)
-
-	// bufio.Scanner has a small default buffer; we must raise it explicitly.
-	// We also cap it to maxFrameBytes to avoid unbounded memory usage.
-	initialBuffer := make([]byte, 0, min(maxFrameBytes, 64*1024))
-	scanner.Buffer(initialBuffer, maxFrameBytes)
-
+//
+// initialBufferBytes sets the size of the read buffer; frames longer than
+// it are accumulated up to maxFrameBytes.
+func NewLineReader(reader io.Reader, maxFrameBytes int, initialBufferBytes int) *LineReader {
 	return &LineReader{
-		scanner:       scanner,
+		reader:        bufio.NewReaderSize(reader, min(maxFrameBytes, initialBufferBytes)),
 		maxFrameBytes: maxFrameBytes,
 	}
 }
 
+// SetTrimCarriageReturn controls whether a trailing '\r' is removed from
+// each frame, which makes CRLF line endings behave like plain '\n'.
+// Trimming is on by default.
+func (lr *LineReader) SetTrimCarriageReturn(enabled bool) {
+	lr.keepCarriageReturn = !enabled
+}
+
 // ReadFrame blocks until a full frame is read, the connection is closed,
 // or an error occurs.
 //
+// A single call may perform several reads on the underlying reader. A read
+// deadline set on it before the call is absolute, so it bounds the whole
+// frame rather than each partial read: a peer trickling bytes without ever
+// sending the delimiter still times out.
+//
 // Possible errors:
 //   - io.EOF: the underlying reader was closed cleanly
-//   - ErrFrameTooLarge: a frame exceeded the configured maximum size
+//   - ErrFrameTooLarge: a frame exceeded the configured maximum size; it
+//     has been discarded and reading may continue
+//   - ErrFrameTimeout: the read deadline passed before the frame was complete
 //   - any other error reported by the underlying reader
 func (lr *LineReader) ReadFrame() ([]byte, error) {
-	if lr.scanner.Scan() {
-		frame := lr.scanner.Bytes()
-		// Copy the bytes because Scanner reuses its buffer.
-		copied := make([]byte, len(frame))
-		copy(copied, frame)
-		return copied, nil
-	}
+	for {
+		chunk, err := lr.reader.ReadSlice('\n')
+		complete := err == nil
+		if complete {
+			chunk = chunk[:len(chunk)-1]
+		}
+
+		if !lr.discarding {
+			if len(lr.pending)+len(chunk) > lr.maxFrameBytes {
+				lr.discarding = true
+				lr.pending = lr.pending[:0]
+			} else {
+				lr.pending = append(lr.pending, chunk...)
+			}
+		}
+
+		switch {
+		case complete:
+			if lr.discarding {
+				lr.discarding = false
+				return nil, fmt.Errorf("%w (max=%d bytes)", ErrFrameTooLarge, lr.maxFrameBytes)
+			}
+			return lr.takeFrame(), nil
 
-	if err := lr.scanner.Err(); err != nil {
-		if errors.Is(err, bufio.ErrTooLong) {
-			return nil, fmt.Errorf("%w (max=%d bytes)", ErrFrameTooLarge, lr.maxFrameBytes)
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+
+		case errors.Is(err, io.EOF):
+			// A final frame without a delimiter is still delivered.
+			if len(lr.pending) > 0 && !lr.discarding {
+				return lr.takeFrame(), nil
+			}
+			return nil, io.EOF
+
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			return nil, fmt.Errorf("%w: %v", ErrFrameTimeout, err)
+
+		default:
+			return nil, err
 		}
-		return nil, err
 	}
+}
 
-	return nil, io.EOF
+// takeFrame returns a copy of the pending frame, trimmed of its trailing
+// '\r' if enabled, and resets the pending buffer for the next frame.
+func (lr *LineReader) takeFrame() []byte {
+	frame := lr.pending
+	if !lr.keepCarriageReturn {
+		frame = bytes.TrimSuffix(frame, []byte{'\r'})
+	}
+	// Copy the bytes because pending is reused.
+	copied := make([]byte, len(frame))
+	copy(copied, frame)
+	lr.pending = lr.pending[:0]
+	return copied
 }
 
 func min(a, b int) int {
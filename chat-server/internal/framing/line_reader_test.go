@@ -0,0 +1,132 @@
+package framing
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineReaderGrowsPastInitialBuffer(t *testing.T) {
+	large := strings.Repeat("x", 1000)
+	input := large + "\nshort\n" + large + "\n"
+
+	// bufio enforces a 16-byte minimum, so the frames span many refills.
+	reader := NewLineReader(strings.NewReader(input), 4096, 16)
+
+	for _, want := range []string{large, "short", large} {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		if !bytes.Equal(frame, []byte(want)) {
+			t.Fatalf("got %d-byte frame, want %d bytes", len(frame), len(want))
+		}
+	}
+	if _, err := reader.ReadFrame(); err != io.EOF {
+		t.Errorf("got error %v after the last frame, want io.EOF", err)
+	}
+}
+
+func TestLineReaderBufferCappedByMaxFrame(t *testing.T) {
+	reader := NewLineReader(strings.NewReader("abc\n"), 32, 64*1024)
+
+	if size := reader.reader.Size(); size != 32 {
+		t.Errorf("buffer size = %d, want it capped at 32", size)
+	}
+	frame, err := reader.ReadFrame()
+	if err != nil || string(frame) != "abc" {
+		t.Errorf("got %q, %v; want %q", frame, err, "abc")
+	}
+}
+
+func TestLineReaderDeadlineBoundsWholeFrame(t *testing.T) {
+	serverConn, peerConn := net.Pipe()
+	defer serverConn.Close()
+	defer peerConn.Close()
+
+	// Drip one byte at a time, never completing a frame, so every single
+	// read returns well within the deadline.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := peerConn.Write([]byte("x")); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	reader := NewLineReader(serverConn, 1<<20, 16)
+	start := time.Now()
+	_ = serverConn.SetReadDeadline(start.Add(100 * time.Millisecond))
+
+	_, err := reader.ReadFrame()
+	if !errors.Is(err, ErrFrameTimeout) {
+		t.Fatalf("got error %v, want %v", err, ErrFrameTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timed out after %v, want about 100ms", elapsed)
+	}
+}
+
+func TestLineReaderResyncsAfterOversizedFrame(t *testing.T) {
+	oversized := strings.Repeat("x", 100)
+	input := oversized + "\nok\n" + oversized + oversized + "\nalso ok\n"
+
+	// The 16-byte buffer makes the oversized frames span several refills.
+	reader := NewLineReader(strings.NewReader(input), 32, 16)
+
+	for _, want := range []string{"", "ok", "", "also ok"} {
+		frame, err := reader.ReadFrame()
+		if want == "" {
+			if !errors.Is(err, ErrFrameTooLarge) {
+				t.Fatalf("got %q, %v; want %v", frame, err, ErrFrameTooLarge)
+			}
+			continue
+		}
+		if err != nil || string(frame) != want {
+			t.Fatalf("got %q, %v; want %q", frame, err, want)
+		}
+	}
+	if _, err := reader.ReadFrame(); err != io.EOF {
+		t.Errorf("got error %v after the last frame, want io.EOF", err)
+	}
+}
+
+func TestLineReaderCarriageReturnTrimming(t *testing.T) {
+	const input = "{\"type\":\"USERS\"}\r\n"
+	tests := []struct {
+		name string
+		trim bool
+		want string
+	}{
+		{name: "enabled", trim: true, want: `{"type":"USERS"}`},
+		{name: "disabled", trim: false, want: "{\"type\":\"USERS\"}\r"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := NewLineReader(strings.NewReader(input), 4096, 4096)
+			reader.SetTrimCarriageReturn(test.trim)
+
+			frame, err := reader.ReadFrame()
+			if err != nil {
+				t.Fatalf("read frame: %v", err)
+			}
+			if string(frame) != test.want {
+				t.Errorf("frame = %q, want %q", frame, test.want)
+			}
+		})
+	}
+}
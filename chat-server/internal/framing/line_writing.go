@@ -25,15 +25,24 @@ func NewLineWriter(writer io.Writer) *LineWriter {
 // WriteFrame writes a single frame followed by a newline delimiter.
 // It respects context cancellation before attempting the write.
 func (lw *LineWriter) WriteFrame(ctx context.Context, payload []byte) error {
+	return lw.WriteFrames(ctx, [][]byte{payload})
+}
+
+// WriteFrames writes several frames in order and flushes once, so a burst
+// of frames costs a single write to the underlying writer when it fits in
+// the buffer. It respects context cancellation before attempting the write.
+func (lw *LineWriter) WriteFrames(ctx context.Context, payloads [][]byte) error {
 	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	if _, err := lw.writer.Write(payload); err != nil {
-		return fmt.Errorf("write payload: %w", err)
-	}
-	if err := lw.writer.WriteByte('\n'); err != nil {
-		return fmt.Errorf("write delimiter: %w", err)
+	for _, payload := range payloads {
+		if _, err := lw.writer.Write(payload); err != nil {
+			return fmt.Errorf("write payload: %w", err)
+		}
+		if err := lw.writer.WriteByte('\n'); err != nil {
+			return fmt.Errorf("write delimiter: %w", err)
+		}
 	}
 	if err := lw.writer.Flush(); err != nil {
 		return fmt.Errorf("flush writer: %w", err)
@@ -0,0 +1,35 @@
+package framing
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// countingWriter records every write it receives.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestLineWriterWriteFramesFlushesOnce(t *testing.T) {
+	underlying := &countingWriter{}
+	writer := NewLineWriter(underlying)
+
+	payloads := [][]byte{[]byte(`{"n":1}`), []byte(`{"n":2}`), []byte(`{"n":3}`)}
+	if err := writer.WriteFrames(context.Background(), payloads); err != nil {
+		t.Fatalf("WriteFrames: %v", err)
+	}
+
+	if underlying.writes != 1 {
+		t.Errorf("got %d writes to the connection, want 1", underlying.writes)
+	}
+	if got, want := underlying.String(), "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n"; got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,168 @@
+package hub
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"chat-server/internal/audit"
+	"chat-server/internal/protocol"
+)
+
+// handleAdmin runs an operator command on behalf of a client that
+// presented the admin token. Requests with a wrong token, or any request
+// while no token is configured, are treated as protocol violations.
+func (h *Hub) handleAdmin(
+	ctx context.Context,
+	clientID ClientID,
+	username string,
+	envelope protocol.Envelope,
+) {
+	request, err := protocol.DecodeAdmin(envelope)
+	if err != nil {
+		h.rejectRequest(ctx, clientID, "ADMIN", err)
+		return
+	}
+
+	if !h.isAdminTokenValid(request.Token) {
+		h.logger.Printf("unauthorized admin request: id=%s user=%s", clientID, username)
+		h.recordAudit(audit.Event{
+			Event:      audit.EventAdminUnauthorized,
+			ClientID:   string(clientID),
+			Username:   username,
+			RemoteAddr: h.clientAddr[clientID],
+			Command:    request.Command,
+		})
+		h.sendInvalidAndDisconnect(ctx, clientID, "ADMIN", protocol.ResultUnauthorized)
+		return
+	}
+
+	h.logger.Printf("admin command: id=%s user=%s command=%s", clientID, username, request.Command)
+	h.recordAudit(audit.Event{
+		Event:    audit.EventAdminCommand,
+		ClientID: string(clientID),
+		Username: username,
+		Command:  request.Command,
+		Target:   request.Username,
+	})
+
+	switch request.Command {
+	case protocol.AdminCommandListClients:
+		h.sendMessage(ctx, clientID, protocol.AdminResultMessage{
+			Type:    protocol.TypeAdminResult,
+			Command: request.Command,
+			Clients: h.adminClientsSnapshot(),
+		})
+
+	case protocol.AdminCommandKickUser:
+		h.adminKickUser(ctx, clientID, request.Username)
+
+	default:
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "ADMIN",
+			Result:    protocol.ResultUnknownCommand,
+			Extra:     request.Command,
+		})
+	}
+}
+
+// adminKickUser disconnects the user with the given name. The regular
+// disconnect path notifies the user's rooms and everyone else.
+func (h *Hub) adminKickUser(ctx context.Context, adminClientID ClientID, targetUsername string) {
+	targetClientID, exists := h.usernameOwner[h.usernameKey(targetUsername)]
+	if !exists {
+		h.sendResponse(ctx, adminClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "ADMIN",
+			Result:    protocol.ResultNoSuchUser,
+			Extra:     targetUsername,
+		})
+		return
+	}
+
+	if targetClientID == adminClientID {
+		h.sendResponse(ctx, adminClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "ADMIN",
+			Result:    protocol.ResultCannotKickSelf,
+			Extra:     targetUsername,
+		})
+		return
+	}
+
+	h.recordAudit(audit.Event{
+		Event:    audit.EventKick,
+		ClientID: string(adminClientID),
+		Username: h.clientUser[adminClientID],
+		Target:   h.clientUser[targetClientID],
+	})
+	h.forceDisconnect(ctx, targetClientID, "disconnected by admin", protocol.DisconnectReasonKicked)
+
+	h.sendResponse(ctx, adminClientID, protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: "ADMIN",
+		Result:    protocol.ResultSuccess,
+		Extra:     targetUsername,
+	})
+}
+
+// isPasswordValid checks an IDENTIFY password against the configured hash.
+// Every password is accepted unless RequireAuth is set.
+func (h *Hub) isPasswordValid(password string) bool {
+	if !h.cfg.RequireAuth {
+		return true
+	}
+	expected, err := hex.DecodeString(h.cfg.AuthPasswordSHA256)
+	if err != nil || password == "" {
+		return false
+	}
+	hash := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(hash[:], expected) == 1
+}
+
+// isAdminTokenValid compares a presented token against the configured one
+// in constant time.
+func (h *Hub) isAdminTokenValid(token string) bool {
+	if h.cfg.AdminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.AdminToken)) == 1
+}
+
+// adminClientsSnapshot describes every connected client, ordered by ID.
+func (h *Hub) adminClientsSnapshot() []protocol.AdminClientInfo {
+	now := time.Now()
+	clients := make([]protocol.AdminClientInfo, 0, len(h.clients))
+	for clientID := range h.clients {
+		roomNames := make([]string, 0, len(h.clientRooms[clientID]))
+		for roomName := range h.clientRooms[clientID] {
+			roomNames = append(roomNames, roomName)
+		}
+		sort.Strings(roomNames)
+
+		info := protocol.AdminClientInfo{
+			ID:       string(clientID),
+			Username: h.clientUser[clientID],
+			Status:   h.clientStatus[clientID],
+			Rooms:    roomNames,
+
+			ConnectedAt: h.clientConnectedAt[clientID].UTC(),
+			UptimeSecs:  h.uptimeSecs(clientID, now),
+		}
+		if stats, exists := h.clientStats[clientID]; exists {
+			info.Messages = stats.messageCounts()
+			info.Bytes = stats.bytes
+		}
+
+		clients = append(clients, info)
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ID < clients[j].ID
+	})
+	return clients
+}
@@ -0,0 +1,220 @@
+package hub
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"chat-server/internal/config"
+	"chat-server/internal/protocol"
+)
+
+// adminToken is the token configured by newAdminTestHub.
+const adminToken = "s3cret"
+
+// newAdminTestHub creates a test hub with adminToken configured.
+func newAdminTestHub(t *testing.T) *testHub {
+	t.Helper()
+
+	return newTestHub(t, func(cfg *config.Config) {
+		cfg.AdminToken = adminToken
+	})
+}
+
+func TestAdminListClients(t *testing.T) {
+	th := newAdminTestHub(t)
+	th.identify("admin", "ops")
+	th.identify("bob", "bob")
+	th.send("bob", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("bob", protocol.StatusRequest{Type: protocol.TypeStatus, Status: protocol.StatusBusy})
+	th.drainAll()
+
+	th.send("admin", protocol.AdminRequest{
+		Type:    protocol.TypeAdmin,
+		Token:   adminToken,
+		Command: protocol.AdminCommandListClients,
+	})
+
+	results := messagesOfType(th.drain("admin"), protocol.TypeAdminResult)
+	if len(results) != 1 {
+		t.Fatalf("got %d ADMIN_RESULT messages, want 1", len(results))
+	}
+	clients, _ := results[0]["clients"].([]any)
+	if len(clients) != 2 {
+		t.Fatalf("clients = %v, want 2 entries", clients)
+	}
+
+	// Clients are ordered by ID, so bob comes second.
+	bob, _ := clients[1].(map[string]any)
+	if bob["id"] != "bob" || bob["username"] != "bob" || bob["status"] != string(protocol.StatusBusy) {
+		t.Errorf("bob = %v, want id bob, username bob, status %s", bob, protocol.StatusBusy)
+	}
+	rooms, _ := bob["rooms"].([]any)
+	if !slices.Equal(rooms, []any{"den"}) {
+		t.Errorf("bob rooms = %v, want [den]", rooms)
+	}
+}
+
+func TestAdminInvalidTokenDisconnects(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfgToken  string
+		sentToken string
+	}{
+		{name: "wrong token", cfgToken: adminToken, sentToken: "guess"},
+		{name: "no token configured", cfgToken: "", sentToken: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			th := newTestHub(t, func(cfg *config.Config) {
+				cfg.AdminToken = test.cfgToken
+			})
+			th.identify("mallory", "mallory")
+
+			th.send("mallory", protocol.AdminRequest{
+				Type:    protocol.TypeAdmin,
+				Token:   test.sentToken,
+				Command: protocol.AdminCommandListClients,
+			})
+
+			messages := th.drain("mallory")
+			if results := messagesOfType(messages, protocol.TypeAdminResult); len(results) != 0 {
+				t.Errorf("got ADMIN_RESULT %v with an invalid token", results)
+			}
+			response := findResponse(t, messages, "ADMIN")
+			if response["result"] != string(protocol.ResultUnauthorized) {
+				t.Errorf("result = %v, want %s", response["result"], protocol.ResultUnauthorized)
+			}
+			if th.isConnected("mallory") {
+				t.Error("client still connected after an invalid admin token")
+			}
+			if !strings.Contains(th.logs.String(), "unauthorized admin request") {
+				t.Errorf("unauthorized attempt not logged: %s", th.logs.String())
+			}
+		})
+	}
+}
+
+func TestAdminKickUser(t *testing.T) {
+	th := newAdminTestHub(t)
+	th.identify("admin", "ops")
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+
+	th.send("admin", protocol.AdminRequest{
+		Type:     protocol.TypeAdmin,
+		Token:    adminToken,
+		Command:  protocol.AdminCommandKickUser,
+		Username: "bob",
+	})
+
+	response := findResponse(t, th.drain("admin"), "ADMIN")
+	if response["result"] != string(protocol.ResultSuccess) {
+		t.Errorf("result = %v, want %s", response["result"], protocol.ResultSuccess)
+	}
+	if th.isConnected("bob") {
+		t.Error("kicked client still connected")
+	}
+	if !th.isConnected("admin") {
+		t.Error("admin disconnected by its own kick")
+	}
+
+	notices := messagesOfType(th.drain("alice"), protocol.TypeDisconnected)
+	if len(notices) != 1 || notices[0]["username"] != "bob" || notices[0]["reason"] != protocol.DisconnectReasonKicked {
+		t.Errorf("got %v, want DISCONNECTED bob with reason %s", notices, protocol.DisconnectReasonKicked)
+	}
+}
+
+func TestAdminKickUnknownOrSelf(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		wantResult protocol.ResultCode
+	}{
+		{name: "unknown user", target: "nobody", wantResult: protocol.ResultNoSuchUser},
+		{name: "self", target: "ops", wantResult: protocol.ResultCannotKickSelf},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			th := newAdminTestHub(t)
+			th.identify("admin", "ops")
+
+			th.send("admin", protocol.AdminRequest{
+				Type:     protocol.TypeAdmin,
+				Token:    adminToken,
+				Command:  protocol.AdminCommandKickUser,
+				Username: test.target,
+			})
+
+			response := findResponse(t, th.drain("admin"), "ADMIN")
+			if response["result"] != string(test.wantResult) {
+				t.Errorf("result = %v, want %s", response["result"], test.wantResult)
+			}
+			if !th.isConnected("admin") {
+				t.Error("admin disconnected")
+			}
+		})
+	}
+}
+
+func TestAdminListClientsReportsMessageCounts(t *testing.T) {
+	th := newAdminTestHub(t)
+	th.identify("admin", "ops")
+	th.identify("bob", "bob")
+	th.send("bob", protocol.PublicTextRequest{Type: protocol.TypePublicText, Text: "one"})
+	th.send("bob", protocol.PublicTextRequest{Type: protocol.TypePublicText, Text: "two"})
+	th.drainAll()
+
+	th.send("admin", protocol.AdminRequest{
+		Type:    protocol.TypeAdmin,
+		Token:   adminToken,
+		Command: protocol.AdminCommandListClients,
+	})
+
+	results := messagesOfType(th.drain("admin"), protocol.TypeAdminResult)
+	if len(results) != 1 {
+		t.Fatalf("got %d ADMIN_RESULT messages, want 1", len(results))
+	}
+	clients, _ := results[0]["clients"].([]any)
+	bob, _ := clients[len(clients)-1].(map[string]any)
+	want := map[string]any{"IDENTIFY": float64(1), "PUBLIC_TEXT": float64(2)}
+	if !reflect.DeepEqual(bob["messages"], want) {
+		t.Errorf("bob messages = %v, want %v", bob["messages"], want)
+	}
+	if sentBytes, _ := bob["bytes"].(float64); sentBytes <= 0 {
+		t.Errorf("bob bytes = %v, want a positive count", bob["bytes"])
+	}
+}
+
+func TestAdminListClientsReportsUptime(t *testing.T) {
+	th := newAdminTestHub(t)
+	th.identify("admin", "ops")
+	th.identify("bob", "bob")
+	connectedAt := time.Now().Add(-90 * time.Second)
+	th.hub.clientConnectedAt["bob"] = connectedAt
+
+	th.send("admin", protocol.AdminRequest{
+		Type:    protocol.TypeAdmin,
+		Token:   adminToken,
+		Command: protocol.AdminCommandListClients,
+	})
+
+	results := messagesOfType(th.drain("admin"), protocol.TypeAdminResult)
+	if len(results) != 1 {
+		t.Fatalf("got %d ADMIN_RESULT messages, want 1", len(results))
+	}
+	clients, _ := results[0]["clients"].([]any)
+	bob, _ := clients[len(clients)-1].(map[string]any)
+	if uptime, _ := bob["uptime_secs"].(float64); uptime < 90 || uptime > 150 {
+		t.Errorf("bob uptime = %v, want about 90", bob["uptime_secs"])
+	}
+	reported, err := time.Parse(time.RFC3339Nano, fmt.Sprint(bob["connected_at"]))
+	if err != nil || !reported.Equal(connectedAt.UTC()) {
+		t.Errorf("bob connected_at = %v, want %v", bob["connected_at"], connectedAt.UTC())
+	}
+}
@@ -0,0 +1,28 @@
+package hub
+
+import (
+	"time"
+
+	"chat-server/internal/audit"
+)
+
+// AuditLogger records moderation-relevant events. Audit is called from the
+// hub goroutine, so events are recorded in the order they happen; it
+// should return quickly.
+type AuditLogger interface {
+	Audit(event audit.Event) error
+}
+
+// noopAuditLogger is used when New is given no audit logger.
+type noopAuditLogger struct{}
+
+func (noopAuditLogger) Audit(audit.Event) error { return nil }
+
+// recordAudit stamps event with the current time and hands it to the audit
+// logger. Failures are logged so a broken audit sink never stops the chat.
+func (h *Hub) recordAudit(event audit.Event) {
+	event.Time = time.Now().UTC()
+	if err := h.auditLogger.Audit(event); err != nil {
+		h.logger.Printf("audit error: event=%s err=%v", event.Event, err)
+	}
+}
@@ -0,0 +1,73 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"chat-server/internal/audit"
+	"chat-server/internal/config"
+	"chat-server/internal/protocol"
+)
+
+// capturingAuditLogger keeps every audit event it receives.
+type capturingAuditLogger struct {
+	events []audit.Event
+}
+
+func (logger *capturingAuditLogger) Audit(event audit.Event) error {
+	logger.events = append(logger.events, event)
+	return nil
+}
+
+func TestAuditTrail(t *testing.T) {
+	cfg, err := config.FromEnv()
+	if err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	cfg.AdminToken = adminToken
+	auditLogger := &capturingAuditLogger{}
+	th := newTestHubFrom(t, cfg, nil, auditLogger, nil)
+
+	th.identify("admin", "ops")
+	th.identify("bob", "bob")
+	th.identify("mallory", "mallory")
+	th.send("admin", protocol.AdminRequest{
+		Type:     protocol.TypeAdmin,
+		Token:    adminToken,
+		Command:  protocol.AdminCommandKickUser,
+		Username: "bob",
+	})
+	th.send("mallory", protocol.AdminRequest{
+		Type:    protocol.TypeAdmin,
+		Token:   "guess",
+		Command: protocol.AdminCommandListClients,
+	})
+
+	want := []audit.Event{
+		{Event: audit.EventIdentify, ClientID: "admin", Username: "ops", RemoteAddr: "127.0.0.1:1"},
+		{Event: audit.EventIdentify, ClientID: "bob", Username: "bob", RemoteAddr: "127.0.0.1:1"},
+		{Event: audit.EventIdentify, ClientID: "mallory", Username: "mallory", RemoteAddr: "127.0.0.1:1"},
+		{Event: audit.EventAdminCommand, ClientID: "admin", Username: "ops", Command: protocol.AdminCommandKickUser, Target: "bob"},
+		{Event: audit.EventKick, ClientID: "admin", Username: "ops", Target: "bob"},
+		{Event: audit.EventDisconnect, ClientID: "bob", Username: "bob", RemoteAddr: "127.0.0.1:1", Reason: "disconnected by admin"},
+		{Event: audit.EventAdminUnauthorized, ClientID: "mallory", Username: "mallory", RemoteAddr: "127.0.0.1:1", Command: protocol.AdminCommandListClients},
+	}
+
+	got := auditLogger.events
+	for i := range got {
+		if got[i].Time.IsZero() || got[i].Time.Location() != time.UTC {
+			t.Errorf("event %d time = %v, want a UTC timestamp", i, got[i].Time)
+		}
+		got[i].Time = time.Time{}
+	}
+	// The unauthorized request also disconnects mallory; only the events
+	// up to it are checked.
+	if len(got) < len(want) {
+		t.Fatalf("got %d events, want at least %d:\n%+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
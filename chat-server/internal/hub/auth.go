@@ -0,0 +1,89 @@
+package hub
+
+import (
+	"context"
+	"time"
+
+	"chat-server/internal/protocol"
+)
+
+// Authenticator decides whether a client may identify as username,
+// given the credential it sent in IDENTIFY. Operators can back it with a
+// password file, an HTTP service or anything else.
+//
+// Authenticate runs on its own goroutine, never on the hub's, so it may
+// block; ctx is canceled after authTimeout or when the hub stops. An error
+// rejects the client like a false result and is logged.
+type Authenticator interface {
+	Authenticate(ctx context.Context, username string, credential string) (bool, error)
+}
+
+// allowAllAuthenticator is used when New is given no authenticator. It
+// accepts everyone, and the hub skips it so IDENTIFY stays synchronous.
+type allowAllAuthenticator struct{}
+
+func (allowAllAuthenticator) Authenticate(context.Context, string, string) (bool, error) {
+	return true, nil
+}
+
+// authTimeout bounds a single Authenticate call.
+const authTimeout = 5 * time.Second
+
+// authResult carries the outcome of an Authenticate call back to the hub.
+type authResult struct {
+	clientID ClientID
+	request  protocol.IdentifyRequest
+	accepted bool
+	err      error
+}
+
+// startAuthentication checks request with the authenticator off the hub
+// goroutine. Identification resumes in handleAuthResult; until then the
+// client stays unidentified.
+func (h *Hub) startAuthentication(
+	ctx context.Context,
+	clientID ClientID,
+	request protocol.IdentifyRequest,
+) {
+	h.pendingAuth[clientID] = struct{}{}
+
+	go func() {
+		authCtx, cancel := context.WithTimeout(ctx, authTimeout)
+		defer cancel()
+
+		accepted, err := h.authenticator.Authenticate(authCtx, request.Username, request.Credential)
+		select {
+		case h.authResults <- authResult{
+			clientID: clientID,
+			request:  request,
+			accepted: accepted,
+			err:      err,
+		}:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// handleAuthResult finishes an IDENTIFY once its authentication is done.
+// Results for clients that disconnected in the meantime are dropped.
+func (h *Hub) handleAuthResult(ctx context.Context, result authResult) {
+	if _, pending := h.pendingAuth[result.clientID]; !pending {
+		return
+	}
+	delete(h.pendingAuth, result.clientID)
+
+	if result.err != nil {
+		h.logger.Printf(
+			"authentication error: id=%s username=%s err=%v",
+			result.clientID,
+			result.request.Username,
+			result.err,
+		)
+	}
+	if result.err != nil || !result.accepted {
+		h.sendInvalidAndDisconnect(ctx, result.clientID, "IDENTIFY", protocol.ResultAuthFailed)
+		return
+	}
+
+	h.completeIdentify(ctx, result.clientID, result.request)
+}
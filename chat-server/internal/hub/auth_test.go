@@ -0,0 +1,251 @@
+package hub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chat-server/internal/config"
+	"chat-server/internal/protocol"
+)
+
+func TestIdentifyPassword(t *testing.T) {
+	hash := sha256.Sum256([]byte("hunter2"))
+
+	tests := []struct {
+		name           string
+		password       string
+		wantIdentified bool
+	}{
+		{name: "correct password", password: "hunter2", wantIdentified: true},
+		{name: "wrong password", password: "hunter3", wantIdentified: false},
+		{name: "missing password", password: "", wantIdentified: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			th := newTestHub(t, func(cfg *config.Config) {
+				cfg.RequireAuth = true
+				cfg.AuthPasswordSHA256 = hex.EncodeToString(hash[:])
+			})
+			th.connect("alice")
+
+			th.send("alice", protocol.IdentifyRequest{
+				Type:     protocol.TypeIdentify,
+				Username: "alice",
+				Password: test.password,
+			})
+
+			response := asResponse(t, findResponse(t, th.drain("alice"), "IDENTIFY"))
+			_, identified := th.hub.clientUser["alice"]
+			if identified != test.wantIdentified {
+				t.Errorf("identified = %t, want %t", identified, test.wantIdentified)
+			}
+			if th.isConnected("alice") != test.wantIdentified {
+				t.Errorf("connected = %t, want %t", th.isConnected("alice"), test.wantIdentified)
+			}
+			wantResult := protocol.ResultSuccess
+			if !test.wantIdentified {
+				wantResult = protocol.ResultAuthFailed
+			}
+			if response.Result != wantResult {
+				t.Errorf("result = %s, want %s", response.Result, wantResult)
+			}
+		})
+	}
+}
+
+func TestPasswordIgnoredWithoutRequireAuth(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.connect("alice")
+
+	th.send("alice", protocol.IdentifyRequest{
+		Type:     protocol.TypeIdentify,
+		Username: "alice",
+		Password: "anything",
+	})
+
+	if _, identified := th.hub.clientUser["alice"]; !identified {
+		t.Errorf("alice not identified: %v", th.drain("alice"))
+	}
+}
+
+// stubAuthenticator answers every Authenticate call with accepted and err
+// and records the credentials it was asked about.
+type stubAuthenticator struct {
+	accepted bool
+	err      error
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (a *stubAuthenticator) Authenticate(_ context.Context, username string, credential string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.calls = append(a.calls, username+":"+credential)
+	return a.accepted, a.err
+}
+
+// awaitAuthResult waits for the authentication started by the last
+// IDENTIFY and hands its result to the hub.
+func (th *testHub) awaitAuthResult() {
+	th.t.Helper()
+
+	select {
+	case result := <-th.hub.authResults:
+		th.hub.handleAuthResult(th.ctx, result)
+		th.settle()
+	case <-time.After(5 * time.Second):
+		th.t.Fatal("authentication did not finish")
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	tests := []struct {
+		name           string
+		authenticator  *stubAuthenticator
+		wantIdentified bool
+	}{
+		{name: "accepting", authenticator: &stubAuthenticator{accepted: true}, wantIdentified: true},
+		{name: "rejecting", authenticator: &stubAuthenticator{accepted: false}, wantIdentified: false},
+		{name: "failing", authenticator: &stubAuthenticator{accepted: true, err: errors.New("backend down")}, wantIdentified: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := config.FromEnv()
+			if err != nil {
+				t.Fatalf("default config: %v", err)
+			}
+			th := newTestHubFrom(t, cfg, nil, nil, test.authenticator)
+			th.connect("alice")
+
+			th.send("alice", protocol.IdentifyRequest{
+				Type:       protocol.TypeIdentify,
+				Username:   "alice",
+				Credential: "s3cret",
+			})
+			th.awaitAuthResult()
+
+			test.authenticator.mu.Lock()
+			calls := test.authenticator.calls
+			test.authenticator.mu.Unlock()
+			if len(calls) != 1 || calls[0] != "alice:s3cret" {
+				t.Errorf("Authenticate calls = %v, want one for alice:s3cret", calls)
+			}
+
+			response := asResponse(t, findResponse(t, th.drain("alice"), "IDENTIFY"))
+			_, identified := th.hub.clientUser["alice"]
+			if identified != test.wantIdentified || th.isConnected("alice") != test.wantIdentified {
+				t.Errorf("identified = %t, connected = %t, want both %t",
+					identified, th.isConnected("alice"), test.wantIdentified)
+			}
+			wantResult := protocol.ResultSuccess
+			if !test.wantIdentified {
+				wantResult = protocol.ResultAuthFailed
+			}
+			if response.Result != wantResult {
+				t.Errorf("result = %s, want %s", response.Result, wantResult)
+			}
+			if test.authenticator.err != nil && !strings.Contains(th.logs.String(), "backend down") {
+				t.Errorf("authentication error not logged:\n%s", th.logs.String())
+			}
+		})
+	}
+}
+
+func TestAuthResultForDisconnectedClientIsDropped(t *testing.T) {
+	cfg, err := config.FromEnv()
+	if err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	th := newTestHubFrom(t, cfg, nil, nil, &stubAuthenticator{accepted: true})
+	th.connect("alice")
+
+	th.send("alice", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "alice"})
+	if _, identified := th.hub.clientUser["alice"]; identified {
+		t.Fatal("alice identified before authentication finished")
+	}
+	th.hub.forceDisconnect(th.ctx, "alice", "gone", "")
+	th.awaitAuthResult()
+
+	if _, identified := th.hub.clientUser["alice"]; identified {
+		t.Error("alice identified after disconnecting")
+	}
+	if _, taken := th.hub.usernameOwner[th.hub.usernameKey("alice")]; taken {
+		t.Error("username alice taken by a disconnected client")
+	}
+}
+
+func TestMaxIdentifyAttempts(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.MaxIdentifyAttempts = 3
+	})
+	th.identify("alice", "alice")
+	th.connect("mallory")
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		th.send("mallory", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "alice"})
+
+		responses := messagesOfType(th.drain("mallory"), protocol.TypeResponse)
+		last := asResponse(t, responses[len(responses)-1])
+		if attempt < 3 {
+			if last.Result != protocol.ResultUserAlreadyExists || !th.isConnected("mallory") {
+				t.Fatalf("attempt %d: result %s, connected %t", attempt, last.Result, th.isConnected("mallory"))
+			}
+			continue
+		}
+		if last.Result != protocol.ResultTooManyAttempts {
+			t.Errorf("attempt %d: result = %s, want %s", attempt, last.Result, protocol.ResultTooManyAttempts)
+		}
+	}
+
+	if th.isConnected("mallory") {
+		t.Error("mallory still connected after exhausting identify attempts")
+	}
+	if _, tracked := th.hub.identifyAttempts["mallory"]; tracked {
+		t.Error("attempt counter kept after disconnect")
+	}
+}
+
+func TestSuccessfulIdentifyResetsAttempts(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.MaxIdentifyAttempts = 2
+	})
+	th.identify("alice", "alice")
+	th.connect("bob")
+
+	th.send("bob", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "alice"})
+	if got := th.hub.identifyAttempts["bob"]; got != 1 {
+		t.Fatalf("attempts after one rejection = %d, want 1", got)
+	}
+
+	th.send("bob", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "bob"})
+	if _, identified := th.hub.clientUser["bob"]; !identified {
+		t.Fatalf("bob not identified: %v", th.drain("bob"))
+	}
+	if _, tracked := th.hub.identifyAttempts["bob"]; tracked {
+		t.Error("attempt counter kept after a successful identify")
+	}
+}
+
+func TestIdentifyAttemptsUnlimitedByDefault(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.connect("mallory")
+
+	for range 10 {
+		th.send("mallory", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "alice"})
+	}
+
+	if !th.isConnected("mallory") {
+		t.Error("mallory disconnected with no attempt limit configured")
+	}
+}
@@ -0,0 +1,51 @@
+package hub
+
+import "chat-server/internal/protocol"
+
+// roomHistory is a bounded ring buffer holding the most recent messages
+// posted to a room. It is owned by the hub goroutine.
+type roomHistory struct {
+	entries []protocol.RoomHistoryEntry
+	next    int
+	full    bool
+}
+
+// newRoomHistory creates a history that keeps at most depth messages.
+// It returns nil when depth is not positive, which disables history.
+func newRoomHistory(depth int) *roomHistory {
+	if depth <= 0 {
+		return nil
+	}
+	return &roomHistory{
+		entries: make([]protocol.RoomHistoryEntry, depth),
+	}
+}
+
+// add records a message, evicting the oldest one once the buffer is full.
+func (rh *roomHistory) add(entry protocol.RoomHistoryEntry) {
+	if rh == nil {
+		return
+	}
+
+	rh.entries[rh.next] = entry
+	rh.next = (rh.next + 1) % len(rh.entries)
+	if rh.next == 0 {
+		rh.full = true
+	}
+}
+
+// snapshot returns a copy of the recorded messages, oldest first.
+func (rh *roomHistory) snapshot() []protocol.RoomHistoryEntry {
+	if rh == nil {
+		return nil
+	}
+
+	if !rh.full {
+		return append([]protocol.RoomHistoryEntry(nil), rh.entries[:rh.next]...)
+	}
+
+	ordered := make([]protocol.RoomHistoryEntry, 0, len(rh.entries))
+	ordered = append(ordered, rh.entries[rh.next:]...)
+	ordered = append(ordered, rh.entries[:rh.next]...)
+	return ordered
+}
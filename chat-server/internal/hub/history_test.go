@@ -0,0 +1,56 @@
+package hub
+
+import (
+	"slices"
+	"testing"
+
+	"chat-server/internal/protocol"
+)
+
+// historyTexts returns the texts of entries in order.
+func historyTexts(entries []protocol.RoomHistoryEntry) []string {
+	texts := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		texts = append(texts, entry.Text)
+	}
+	return texts
+}
+
+func TestRoomHistoryTrimsOldest(t *testing.T) {
+	tests := []struct {
+		name  string
+		added []string
+		want  []string
+	}{
+		{name: "empty", added: nil, want: []string{}},
+		{name: "partial", added: []string{"1", "2"}, want: []string{"1", "2"}},
+		{name: "exactly full", added: []string{"1", "2", "3"}, want: []string{"1", "2", "3"}},
+		{name: "wrapped", added: []string{"1", "2", "3", "4", "5"}, want: []string{"3", "4", "5"}},
+		{name: "wrapped twice", added: []string{"1", "2", "3", "4", "5", "6", "7"}, want: []string{"5", "6", "7"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			history := newRoomHistory(3)
+			for _, text := range test.added {
+				history.add(protocol.RoomHistoryEntry{Username: "alice", Text: text})
+			}
+
+			if got := historyTexts(history.snapshot()); !slices.Equal(got, test.want) {
+				t.Errorf("snapshot = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRoomHistoryDisabled(t *testing.T) {
+	history := newRoomHistory(0)
+	if history != nil {
+		t.Fatalf("newRoomHistory(0) = %v, want nil", history)
+	}
+
+	history.add(protocol.RoomHistoryEntry{Username: "alice", Text: "lost"})
+	if got := history.snapshot(); got != nil {
+		t.Errorf("snapshot = %v, want nil", got)
+	}
+}
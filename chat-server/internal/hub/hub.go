@@ -2,10 +2,18 @@ package hub
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"chat-server/internal/audit"
 	"chat-server/internal/config"
 	"chat-server/internal/protocol"
 )
@@ -20,30 +28,86 @@ type ClientWriter interface {
 	Close() error
 }
 
+// PriorityClientWriter is implemented by clients that can deliver critical
+// frames ahead of regular traffic, bypassing a full regular queue.
+type PriorityClientWriter interface {
+	SendPriority(ctx context.Context, frame []byte) error
+}
+
+// CompressingClientWriter is implemented by clients that can compress
+// their outbound frames. SendCompressed queues frame like Send and switches
+// every frame written after it to the given compression method.
+type CompressingClientWriter interface {
+	SendCompressed(ctx context.Context, frame []byte, method string) error
+}
+
 // InboundEvent represents a raw protocol frame received from a client.
+// FrameTooLarge marks a frame that exceeded the size limit and was
+// discarded by the reader; Frame is empty then.
 type InboundEvent struct {
-	ClientID ClientID
-	Frame    []byte
-	At       time.Time
+	ClientID      ClientID
+	Frame         []byte
+	At            time.Time
+	FrameTooLarge bool
 }
 
 // RegisterEvent registers a newly connected client with the hub.
+// RemoteAddr is only used for logging.
 type RegisterEvent struct {
-	ClientID ClientID
-	Writer   ClientWriter
+	ClientID   ClientID
+	Writer     ClientWriter
+	RemoteAddr string
 }
 
 // UnregisterEvent removes a client from the hub and triggers cleanup.
+// Reason is logged; RelayedReason is sent to other users in DISCONNECTED.
 type UnregisterEvent struct {
-	ClientID ClientID
-	Reason   string
+	ClientID      ClientID
+	Reason        string
+	RelayedReason string
 }
 
-// ...
+// RoomState holds the membership state of a single room.
+// Public rooms are listed to every user by LIST_ROOMS; invite-only rooms
+// are only listed to their members and invitees.
 type RoomState struct {
 	name    string
+	public  bool
 	members map[ClientID]struct{}
-	invited map[ClientID]struct{}
+	history *roomHistory
+
+	// invited maps pending invitees to the time they were invited.
+	invited map[ClientID]time.Time
+
+	// rateLimiters holds the ROOM_TEXT limiter of each member that has
+	// posted to the room.
+	rateLimiters map[ClientID]*tokenBucket
+
+	// muted holds members that do not receive ROOM_TEXT_FROM.
+	muted map[ClientID]struct{}
+
+	// absentMembers holds members restored from the state file that have
+	// not identified since the restart, by usernameKey to username. They
+	// keep the room alive and rejoin it when they identify.
+	absentMembers map[string]string
+
+	// owner is the member that created the room, while it remains a
+	// member. Rooms created by the server have no owner.
+	owner ClientID
+
+	// emptySince is when the last member left a room kept for
+	// EmptyRoomTTLSecs. It is zero while the room has members.
+	emptySince time.Time
+}
+
+// removeMember drops a client's membership along with its per-member state.
+func (room *RoomState) removeMember(clientID ClientID) {
+	if room.owner == clientID {
+		room.owner = ""
+	}
+	delete(room.members, clientID)
+	delete(room.rateLimiters, clientID)
+	delete(room.muted, clientID)
 }
 
 // Hub is the single owner of all shared server state.
@@ -55,74 +119,401 @@ type RoomState struct {
 //
 // This design avoids locks and data races by construction.
 type Hub struct {
-	logger *log.Logger
-	cfg    config.Config
-
-	inbound    chan InboundEvent
-	register   chan RegisterEvent
-	unregister chan UnregisterEvent
+	logger        *log.Logger
+	cfg           config.Config
+	observer      HubObserver
+	auditLogger   AuditLogger
+	authenticator Authenticator
+
+	inbound     chan InboundEvent
+	register    chan RegisterEvent
+	unregister  chan UnregisterEvent
+	reload      chan config.Config
+	system      chan systemMessage
+	authResults chan authResult
 
 	// State owned by the hub goroutine only.
-	clients       map[ClientID]ClientWriter
-	clientUser    map[ClientID]string
-	clientStatus  map[ClientID]protocol.Status
+	clients      map[ClientID]ClientWriter
+	clientAddr   map[ClientID]string
+	clientStats  map[ClientID]*clientStats
+	clientUser   map[ClientID]string
+	clientStatus map[ClientID]protocol.Status
+
+	// clientStatusMessage holds custom status lines; absent means none.
+	clientStatusMessage map[ClientID]string
+
+	// clientConnectedAt is when each connection was registered.
+	clientConnectedAt map[ClientID]time.Time
+
+	// clientVersion is the protocol version negotiated at IDENTIFY.
+	clientVersion map[ClientID]int
+
+	// pendingAuth holds clients whose IDENTIFY awaits the authenticator.
+	pendingAuth map[ClientID]struct{}
+
+	// identifyAttempts counts rejected IDENTIFYs of unidentified clients.
+	identifyAttempts map[ClientID]int
+
+	// presenceOptOut holds clients that opted out of presence broadcasts.
+	presenceOptOut map[ClientID]struct{}
+
+	// clientInvites is the reverse index of RoomState.invited: the keys of
+	// the rooms each client holds a pending invitation to. It is kept in
+	// step by addInvitation and removeInvitation, which must be the only
+	// code changing RoomState.invited.
+	clientInvites map[ClientID]map[string]struct{}
+
+	// Reconnect tokens let a client resume its session after a dropped
+	// connection. detachedUntil holds sessions whose connection is gone
+	// but whose state is kept until the given time.
+	reconnectTokens map[string]ClientID
+	clientToken     map[ClientID]string
+	detachedUntil   map[ClientID]time.Time
+
+	// heldUsernames maps username keys of released sessions to their hold.
+	heldUsernames map[string]heldUsername
+
+	// usernameOwner is keyed by usernameKey(username), while clientUser
+	// keeps the username exactly as the user registered it for display.
 	usernameOwner map[string]ClientID
 
+	// reservedUsernames is keyed by usernameKey(username).
+	reservedUsernames map[string]struct{}
+
 	rooms       map[string]*RoomState
 	clientRooms map[ClientID]map[string]struct{}
+
+	// globalLimiter enforces GlobalMessagesPerSecond; nil when unlimited.
+	globalLimiter *tokenBucket
+
+	// stateSavedAt is when rooms were last written to the state file.
+	stateSavedAt time.Time
+
+	// absentMembersUntil is when the members restored by RestoreState that
+	// have not identified since lose their rooms; zero when they never do.
+	absentMembersUntil time.Time
 }
 
 // New creates a new Hub instance.
 // The caller must invoke Run() in its own goroutine.
-func New(logger *log.Logger, cfg config.Config) *Hub {
-	return &Hub{
+// observer may be nil if no one needs to follow hub events,
+// auditLogger may be nil if no audit trail is kept, and authenticator
+// may be nil to let every client identify.
+func New(
+	logger *log.Logger,
+	cfg config.Config,
+	observer HubObserver,
+	auditLogger AuditLogger,
+	authenticator Authenticator,
+) *Hub {
+	if observer == nil {
+		observer = noopObserver{}
+	}
+	if auditLogger == nil {
+		auditLogger = noopAuditLogger{}
+	}
+	if authenticator == nil {
+		authenticator = allowAllAuthenticator{}
+	}
+
+	hubInstance := &Hub{
 		logger:        logger,
 		cfg:           cfg,
+		observer:      observer,
+		auditLogger:   auditLogger,
+		authenticator: authenticator,
 		inbound:       make(chan InboundEvent, 256),
 		register:      make(chan RegisterEvent, 256),
 		unregister:    make(chan UnregisterEvent, 256),
+		reload:        make(chan config.Config, 1),
+		system:        make(chan systemMessage, 64),
+		authResults:   make(chan authResult, 64),
 		clients:       make(map[ClientID]ClientWriter),
+		clientAddr:    make(map[ClientID]string),
+		clientStats:   make(map[ClientID]*clientStats),
 		clientUser:    make(map[ClientID]string),
 		clientStatus:  make(map[ClientID]protocol.Status),
+		clientVersion: make(map[ClientID]int),
 		usernameOwner: make(map[string]ClientID),
 		rooms:         make(map[string]*RoomState),
 		clientRooms:   make(map[ClientID]map[string]struct{}),
+
+		pendingAuth:       make(map[ClientID]struct{}),
+		identifyAttempts:  make(map[ClientID]int),
+		presenceOptOut:    make(map[ClientID]struct{}),
+		clientInvites:     make(map[ClientID]map[string]struct{}),
+		reservedUsernames: make(map[string]struct{}, len(cfg.ReservedUsernames)),
+		reconnectTokens:   make(map[string]ClientID),
+		clientToken:       make(map[ClientID]string),
+		detachedUntil:     make(map[ClientID]time.Time),
+		heldUsernames:     make(map[string]heldUsername),
+
+		clientStatusMessage: make(map[ClientID]string),
+		clientConnectedAt:   make(map[ClientID]time.Time),
+	}
+
+	if cfg.GlobalMessagesPerSecond > 0 {
+		hubInstance.globalLimiter = newTokenBucket(cfg.GlobalMessagesPerSecond, time.Now())
 	}
+
+	for username := range cfg.ReservedUsernames {
+		hubInstance.reservedUsernames[hubInstance.usernameKey(username)] = struct{}{}
+	}
+	hubInstance.reservedUsernames[hubInstance.usernameKey(SystemUsername)] = struct{}{}
+
+	return hubInstance
 }
 
+// maintenanceInterval is how often the hub sweeps time-based state.
+const maintenanceInterval = 1 * time.Second
+
 // Run processes all hub events until the context is canceled.
 func (h *Hub) Run(ctx context.Context) {
+	maintenanceTicker := time.NewTicker(maintenanceInterval)
+	defer maintenanceTicker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
+			// Save before closeAll, which empties and deletes every room.
+			h.saveState(time.Now())
 			h.closeAll("server shutting down")
 			return
 
+		case now := <-maintenanceTicker.C:
+			h.runMaintenance(ctx, now)
+
 		case event := <-h.register:
-			h.clients[event.ClientID] = event.Writer
+			h.registerClient(event)
 
 		case event := <-h.unregister:
-			h.forceDisconnect(ctx, event.ClientID, event.Reason)
+			h.forceDisconnect(ctx, event.ClientID, event.Reason, event.RelayedReason)
+
+		case next := <-h.reload:
+			h.applyReload(next)
+
+		case message := <-h.system:
+			h.handleSystemMessage(ctx, message)
+
+		case result := <-h.authResults:
+			h.handleAuthResult(ctx, result)
 
 		case event := <-h.inbound:
-			h.handleInbound(ctx, event)
+			h.handleInboundRecovering(ctx, event)
+		}
+	}
+}
+
+// registerClient starts tracking a newly connected client.
+func (h *Hub) registerClient(event RegisterEvent) {
+	h.clients[event.ClientID] = event.Writer
+	h.clientAddr[event.ClientID] = event.RemoteAddr
+	h.clientConnectedAt[event.ClientID] = time.Now()
+	h.clientStats[event.ClientID] = newClientStats()
+	h.logger.Printf("client connected: id=%s addr=%s", event.ClientID, event.RemoteAddr)
+}
+
+// handleInboundRecovering handles an inbound event, turning a panic in a
+// handler into a disconnect of the offending client so the hub keeps
+// serving everyone else.
+func (h *Hub) handleInboundRecovering(ctx context.Context, event InboundEvent) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+
+		messageType := protocol.MessageType("unknown")
+		if envelope, err := protocol.DecodeEnvelope(event.Frame); err == nil {
+			messageType = envelope.Type
+		}
+		h.logger.Printf(
+			"handler panic: id=%s type=%s panic=%v\n%s",
+			event.ClientID,
+			messageType,
+			recovered,
+			debug.Stack(),
+		)
+
+		h.forceDisconnect(
+			ctx,
+			event.ClientID,
+			fmt.Sprintf("handler panic: %v", recovered),
+			protocol.DisconnectReasonInternalError,
+		)
+	}()
+
+	var violations int
+	if stats, exists := h.clientStats[event.ClientID]; exists {
+		violations = stats.protocolViolations
+	}
+
+	h.handleInbound(ctx, event)
+
+	// A frame handled without a violation forgives the earlier ones.
+	if stats, exists := h.clientStats[event.ClientID]; exists && stats.protocolViolations == violations {
+		stats.protocolViolations = 0
+	}
+}
+
+// runMaintenance expires time-based state. It runs on the hub goroutine.
+func (h *Hub) runMaintenance(ctx context.Context, now time.Time) {
+	h.expireIdleClients(ctx, now)
+	h.expireUnidentifiedClients(ctx, now)
+	h.expireDetachedSessions(ctx, now)
+	h.expireHeldUsernames(now)
+	h.expireInvitations(now)
+	h.expireAbsentMembers(now)
+	h.expireEmptyRooms(now)
+	h.saveStateIfDue(now)
+}
+
+// expireIdleClients disconnects connections that have sent nothing for
+// IdleTimeoutSecs, warning them with IDLE_WARNING IdleWarningSecs before.
+func (h *Hub) expireIdleClients(ctx context.Context, now time.Time) {
+	if h.cfg.IdleTimeoutSecs <= 0 {
+		return
+	}
+
+	timeout := time.Duration(h.cfg.IdleTimeoutSecs) * time.Second
+	warning := time.Duration(h.cfg.IdleWarningSecs) * time.Second
+	for clientID, stats := range h.clientStats {
+		idle := now.Sub(stats.lastFrameAt)
+		if idle >= timeout {
+			h.forceDisconnect(ctx, clientID, "idle timeout", protocol.DisconnectReasonIdleTimeout)
+			continue
+		}
+
+		if warning > 0 && !stats.idleWarned && idle >= timeout-warning {
+			stats.idleWarned = true
+			h.sendFrame(ctx, clientID, protocol.MustMarshal(protocol.IdleWarningMessage{
+				Type:        protocol.TypeIdleWarning,
+				SecondsLeft: int((timeout - idle).Round(time.Second) / time.Second),
+			}))
+		}
+	}
+}
+
+// expireUnidentifiedClients disconnects connections that have not
+// identified within IdentifyTimeoutSecs of connecting.
+func (h *Hub) expireUnidentifiedClients(ctx context.Context, now time.Time) {
+	if h.cfg.IdentifyTimeoutSecs <= 0 {
+		return
+	}
+
+	cutoff := now.Add(-time.Duration(h.cfg.IdentifyTimeoutSecs) * time.Second)
+	for clientID, connectedAt := range h.clientConnectedAt {
+		if _, isIdentified := h.clientUser[clientID]; isIdentified {
+			continue
+		}
+		if connectedAt.Before(cutoff) {
+			h.forceDisconnect(ctx, clientID, "identify timeout", protocol.DisconnectReasonIdentifyTimeout)
+		}
+	}
+}
+
+// expireInvitations drops pending invitations older than the configured TTL.
+func (h *Hub) expireInvitations(now time.Time) {
+	if h.cfg.InviteTTLSecs <= 0 {
+		return
+	}
+
+	cutoff := now.Add(-time.Duration(h.cfg.InviteTTLSecs) * time.Second)
+	for _, room := range h.rooms {
+		for clientID, invitedAt := range room.invited {
+			if invitedAt.Before(cutoff) {
+				h.removeInvitation(room, clientID)
+			}
+		}
+	}
+}
+
+// expireEmptyRooms deletes rooms that have stayed empty for EmptyRoomTTLSecs.
+func (h *Hub) expireEmptyRooms(now time.Time) {
+	if h.cfg.EmptyRoomTTLSecs <= 0 {
+		return
+	}
+
+	cutoff := now.Add(-time.Duration(h.cfg.EmptyRoomTTLSecs) * time.Second)
+	for _, room := range h.rooms {
+		if !room.emptySince.IsZero() && room.emptySince.Before(cutoff) {
+			h.deleteRoom(room)
+		}
+	}
+}
+
+// addInvitation records a pending invitation of clientID to room.
+func (h *Hub) addInvitation(room *RoomState, clientID ClientID, invitedAt time.Time) {
+	room.invited[clientID] = invitedAt
+
+	roomKeys, exists := h.clientInvites[clientID]
+	if !exists {
+		roomKeys = make(map[string]struct{})
+		h.clientInvites[clientID] = roomKeys
+	}
+	roomKeys[h.roomKey(room.name)] = struct{}{}
+}
+
+// removeInvitation drops the pending invitation of clientID to room, if any.
+func (h *Hub) removeInvitation(room *RoomState, clientID ClientID) {
+	if _, isInvited := room.invited[clientID]; !isInvited {
+		return
+	}
+	delete(room.invited, clientID)
+
+	roomKeys := h.clientInvites[clientID]
+	delete(roomKeys, h.roomKey(room.name))
+	if len(roomKeys) == 0 {
+		delete(h.clientInvites, clientID)
+	}
+}
+
+// hasTooManyInvites reports whether clientID already holds as many pending
+// invitations as MaxPendingInvitesPerUser allows.
+func (h *Hub) hasTooManyInvites(clientID ClientID) bool {
+	return h.cfg.MaxPendingInvitesPerUser > 0 &&
+		len(h.clientInvites[clientID]) >= h.cfg.MaxPendingInvitesPerUser
+}
+
+// Reload applies the runtime-changeable settings of cfg, as selected by
+// config.Config.WithReloaded. It takes effect for existing clients too.
+func (h *Hub) Reload(cfg config.Config) {
+	h.reload <- cfg
+}
+
+// applyReload swaps in reloaded settings. It runs on the hub goroutine.
+func (h *Hub) applyReload(next config.Config) {
+	previousRate := h.cfg.RoomMessagesPerSecond
+	h.cfg = h.cfg.WithReloaded(next)
+
+	// Limiters are built with the rate in force when a member first posts;
+	// drop them so the new rate applies to everyone.
+	if h.cfg.RoomMessagesPerSecond != previousRate {
+		for _, room := range h.rooms {
+			clear(room.rateLimiters)
 		}
 	}
+
+	h.logger.Printf("configuration reloaded")
 }
 
 // Register registers a client connection with the hub.
-func (h *Hub) Register(clientID ClientID, writer ClientWriter) {
+// remoteAddr identifies the peer in logs only.
+func (h *Hub) Register(clientID ClientID, writer ClientWriter, remoteAddr string) {
 	h.register <- RegisterEvent{
-		ClientID: clientID,
-		Writer:   writer,
+		ClientID:   clientID,
+		Writer:     writer,
+		RemoteAddr: remoteAddr,
 	}
 }
 
 // Unregister requests removal of a client from the hub.
+// The reason is only logged; other users see a generic CONNECTION_LOST.
 func (h *Hub) Unregister(clientID ClientID, reason string) {
 	h.unregister <- UnregisterEvent{
-		ClientID: clientID,
-		Reason:   reason,
+		ClientID:      clientID,
+		Reason:        reason,
+		RelayedReason: protocol.DisconnectReasonConnectionLost,
 	}
 }
 
@@ -135,10 +526,51 @@ func (h *Hub) Deliver(clientID ClientID, frame []byte) {
 	}
 }
 
+// DeliverFrameTooLarge tells the hub that a client sent a frame over the
+// size limit. The frame itself was discarded, and the client stays
+// connected.
+func (h *Hub) DeliverFrameTooLarge(clientID ClientID) {
+	h.inbound <- InboundEvent{
+		ClientID:      clientID,
+		At:            time.Now().UTC(),
+		FrameTooLarge: true,
+	}
+}
+
 func (h *Hub) handleInbound(ctx context.Context, event InboundEvent) {
+	if event.FrameTooLarge {
+		h.sendResponse(ctx, event.ClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "INVALID",
+			Result:    protocol.ResultFrameTooLarge,
+		})
+		return
+	}
+
 	envelope, err := protocol.DecodeEnvelope(event.Frame)
+	if stats, exists := h.clientStats[event.ClientID]; exists {
+		stats.recordFrame(envelope.Type, len(event.Frame))
+	}
+	if len(event.Frame) == 0 && h.cfg.IgnoreEmptyFrames {
+		return
+	}
 	if err != nil {
-		h.sendInvalidAndDisconnect(ctx, event.ClientID, "INVALID", "INVALID")
+		h.rejectMalformed(ctx, event.ClientID)
+		return
+	}
+
+	if !h.allowFrameBytes(ctx, event.ClientID, envelope.Type, len(event.Frame)) {
+		return
+	}
+
+	// Last-resort load shedding: whoever arrives once the server-wide
+	// budget is spent is refused, regardless of how much they sent.
+	if h.globalLimiter != nil && !h.globalLimiter.allow(time.Now()) {
+		h.sendResponse(ctx, event.ClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: string(envelope.Type),
+			Result:    protocol.ResultRateLimited,
+		})
 		return
 	}
 
@@ -146,23 +578,47 @@ func (h *Hub) handleInbound(ctx context.Context, event InboundEvent) {
 
 	if !isIdentified {
 		if envelope.Type != protocol.TypeIdentify {
-			h.sendInvalidAndDisconnect(ctx, event.ClientID, "INVALID", "NOT_IDENTIFIED")
+			h.sendInvalidAndDisconnect(ctx, event.ClientID, "INVALID", protocol.ResultNotIdentified)
 			return
 		}
 		h.handleIdentify(ctx, event.ClientID, envelope)
 		return
 	}
 
+	if _, disabled := h.cfg.DisabledOperations[string(envelope.Type)]; disabled {
+		h.sendResponse(ctx, event.ClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: string(envelope.Type),
+			Result:    protocol.ResultOperationDisabled,
+		})
+		return
+	}
+
 	switch envelope.Type {
+	case protocol.TypeIdentify:
+		// The connection keeps its identity; use CHANGE_USERNAME to rename.
+		h.sendResponse(ctx, event.ClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "IDENTIFY",
+			Result:    protocol.ResultAlreadyIdentified,
+			Extra:     username,
+		})
+
 	case protocol.TypeStatus:
 		h.handleStatus(ctx, event.ClientID, username, envelope)
 
 	case protocol.TypeUsers:
 		h.handleUsers(ctx, event.ClientID, envelope)
 
+	case protocol.TypeWhois:
+		h.handleWhois(ctx, event.ClientID, envelope)
+
 	case protocol.TypeText:
 		h.handleText(ctx, event.ClientID, username, envelope)
 
+	case protocol.TypeMultiText:
+		h.handleMultiText(ctx, event.ClientID, username, envelope)
+
 	case protocol.TypePublicText:
 		h.handlePublicText(ctx, event.ClientID, username, envelope)
 
@@ -172,9 +628,15 @@ func (h *Hub) handleInbound(ctx context.Context, event InboundEvent) {
 	case protocol.TypeInvite:
 		h.handleInvite(ctx, event.ClientID, username, envelope)
 
+	case protocol.TypeUninvite:
+		h.handleUninvite(ctx, event.ClientID, envelope)
+
 	case protocol.TypeJoinRoom:
 		h.handleJoinRoom(ctx, event.ClientID, username, envelope)
 
+	case protocol.TypeEnsureRoom:
+		h.handleEnsureRoom(ctx, event.ClientID, username, envelope)
+
 	case protocol.TypeDisconnect:
 		h.handleDisconnect(ctx, event.ClientID, username, envelope)
 
@@ -184,522 +646,1703 @@ func (h *Hub) handleInbound(ctx context.Context, event InboundEvent) {
 	case protocol.TypeRoomText:
 		h.handleRoomText(ctx, event.ClientID, username, envelope)
 
+	case protocol.TypeRoomReport:
+		h.handleRoomReport(ctx, event.ClientID, username, envelope)
+
 	case protocol.TypeLeaveRoom:
 		h.handleLeaveRoom(ctx, event.ClientID, username, envelope)
 
+	case protocol.TypeLeaveAllRooms:
+		h.handleLeaveAllRooms(ctx, event.ClientID, username, envelope)
+
+	case protocol.TypeMyInvites:
+		h.handleMyInvites(ctx, event.ClientID, envelope)
+
+	case protocol.TypeListRooms:
+		h.handleListRooms(ctx, event.ClientID, envelope)
+
+	case protocol.TypeTyping:
+		h.handleTyping(ctx, event.ClientID, username, envelope)
+
+	case protocol.TypeMuteRoom:
+		h.handleMuteRoom(ctx, event.ClientID, envelope)
+
+	case protocol.TypeUnmuteRoom:
+		h.handleUnmuteRoom(ctx, event.ClientID, envelope)
+
+	case protocol.TypeAdmin:
+		h.handleAdmin(ctx, event.ClientID, username, envelope)
+
+	case protocol.TypeChangeUsername:
+		h.handleChangeUsername(ctx, event.ClientID, username, envelope)
+
 	default:
-		h.sendInvalidAndDisconnect(ctx, event.ClientID, "INVALID", "INVALID")
+		// Unknown types are rejected by DecodeEnvelope; this only guards
+		// against a client type added to the protocol without a handler.
+		h.sendInvalidAndDisconnect(ctx, event.ClientID, "INVALID", protocol.ResultInvalid)
 	}
 
 }
 
 func (h *Hub) handleIdentify(ctx context.Context, clientID ClientID, envelope protocol.Envelope) {
+	if _, pending := h.pendingAuth[clientID]; pending {
+		h.sendInvalidAndDisconnect(ctx, clientID, "IDENTIFY", protocol.ResultInvalid)
+		return
+	}
+
 	request, err := protocol.DecodeIdentify(envelope)
 	if err != nil {
-		h.sendInvalidAndDisconnect(ctx, clientID, "INVALID", "INVALID")
+		h.rejectRequest(ctx, clientID, "IDENTIFY", err)
+		h.countFailedIdentify(ctx, clientID)
+		return
+	}
+
+	if !h.isUsernameLengthValid(request.Username) {
+		h.sendInvalidAndDisconnect(ctx, clientID, "INVALID", protocol.ResultInvalid)
+		return
+	}
+
+	if !h.isPasswordValid(request.Password) {
+		h.sendInvalidAndDisconnect(ctx, clientID, "IDENTIFY", protocol.ResultAuthFailed)
+		return
+	}
+
+	if _, allowAll := h.authenticator.(allowAllAuthenticator); !allowAll {
+		h.startAuthentication(ctx, clientID, request)
+		return
+	}
+
+	h.completeIdentify(ctx, clientID, request)
+}
+
+// completeIdentify identifies an authenticated client, or resumes its
+// earlier session.
+func (h *Hub) completeIdentify(ctx context.Context, clientID ClientID, request protocol.IdentifyRequest) {
+	version := request.Version
+	if version == 0 {
+		version = protocol.MinProtocolVersion
+	}
+	if version < protocol.MinProtocolVersion || version > protocol.ProtocolVersion {
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "IDENTIFY",
+			Result:    protocol.ResultUnsupportedVersion,
+			Extra:     request.Username,
+			Version:   protocol.ProtocolVersion,
+		})
+		h.countFailedIdentify(ctx, clientID)
 		return
 	}
 
-	if len(request.Username) == 0 || len(request.Username) > h.cfg.MaxUsernameLength {
-		h.sendInvalidAndDisconnect(ctx, clientID, "INVALID", "INVALID")
+	if request.ReconnectToken != "" &&
+		h.resumeSession(ctx, clientID, request, version) {
+		delete(h.identifyAttempts, clientID)
 		return
 	}
 
-	if _, exists := h.usernameOwner[request.Username]; exists {
+	if result := h.usernameUnavailable(clientID, request.Username, request.ReconnectToken); result != "" {
 		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
 			Type:      protocol.TypeResponse,
 			Operation: "IDENTIFY",
-			Result:    "USER_ALREADY_EXISTS",
+			Result:    result,
 			Extra:     request.Username,
 		})
+		h.countFailedIdentify(ctx, clientID)
 		return
 	}
+	h.reclaimUsername(request.Username)
+	delete(h.identifyAttempts, clientID)
 
 	h.clientUser[clientID] = request.Username
 	h.clientStatus[clientID] = protocol.StatusActive
-	h.usernameOwner[request.Username] = clientID
-
-	h.sendResponse(ctx, clientID, protocol.ResponseMessage{
-		Type:      protocol.TypeResponse,
-		Operation: "IDENTIFY",
-		Result:    "SUCCESS",
-		Extra:     request.Username,
+	h.clientVersion[clientID] = version
+	if request.PresenceNotifications != nil && !*request.PresenceNotifications {
+		h.presenceOptOut[clientID] = struct{}{}
+	}
+	h.usernameOwner[h.usernameKey(request.Username)] = clientID
+
+	h.sendIdentifyResponse(ctx, clientID, protocol.ResponseMessage{
+		Type:           protocol.TypeResponse,
+		Operation:      "IDENTIFY",
+		Result:         protocol.ResultSuccess,
+		Extra:          request.Username,
+		Version:        version,
+		ReconnectToken: h.issueReconnectToken(clientID),
+	}, request.Compression)
+	if request.SelfIdentified {
+		h.sendFrame(ctx, clientID, protocol.MustMarshal(protocol.SelfIdentifiedMessage{
+			Type:      protocol.TypeSelfIdentified,
+			Username:  request.Username,
+			Canonical: h.usernameKey(request.Username),
+		}))
+	}
+	h.observer.OnIdentify(clientID, request.Username)
+	h.recordAudit(audit.Event{
+		Event:      audit.EventIdentify,
+		ClientID:   string(clientID),
+		Username:   request.Username,
+		RemoteAddr: h.clientAddr[clientID],
 	})
 
-	h.broadcastExcept(ctx, clientID, protocol.MustMarshal(protocol.NewUserMessage{
+	// The list already includes the new user, matching the NEW_USER that
+	// everyone else is about to receive.
+	if request.FetchUsers {
+		h.sendUserList(ctx, clientID)
+	}
+
+	if h.cfg.MOTD != "" {
+		h.sendFrame(ctx, clientID, protocol.MustMarshal(protocol.ServerNoticeMessage{
+			Type: protocol.TypeServerNotice,
+			Text: h.cfg.MOTD,
+		}))
+	}
+
+	h.broadcastPresence(ctx, clientID, protocol.MustMarshal(protocol.NewUserMessage{
 		Type:     protocol.TypeNewUser,
 		Username: request.Username,
 	}))
+
+	if h.reattachRooms(ctx, clientID, request.Username) {
+		h.sendMembershipSnapshot(ctx, clientID)
+	}
+	h.joinLobby(ctx, clientID, request.Username)
+	h.autoJoinRoom(ctx, clientID, request.Username)
 }
 
-func (h *Hub) handleStatus(
+// sendIdentifyResponse sends the response to a successful IDENTIFY. When
+// the client asked for a supported compression method and its writer can
+// compress, the response names the method and every later frame uses it.
+func (h *Hub) sendIdentifyResponse(
 	ctx context.Context,
 	clientID ClientID,
-	username string,
-	envelope protocol.Envelope,
+	response protocol.ResponseMessage,
+	compression string,
 ) {
-	request, err := protocol.DecodeStatus(envelope)
+	writer, exists := h.clients[clientID]
+	if !exists {
+		return
+	}
+	compressingWriter, canCompress := writer.(CompressingClientWriter)
+	if !canCompress || !protocol.IsSupportedCompression(compression) {
+		h.sendResponse(ctx, clientID, response)
+		return
+	}
+
+	response.Compression = compression
+	frame, err := protocol.Marshal(response)
 	if err != nil {
-		h.sendInvalidAndDisconnect(ctx, clientID, "INVALID", "INVALID")
+		h.requestUnregisterNonBlocking(
+			clientID,
+			fmt.Sprintf("encode failed: %v", err),
+			protocol.DisconnectReasonSendFailed,
+		)
 		return
 	}
+	if err := compressingWriter.SendCompressed(ctx, frame, compression); err != nil {
+		h.recordDroppedFrame(clientID, frame)
+		h.requestUnregisterNonBlocking(
+			clientID,
+			fmt.Sprintf("send failed: %v", err),
+			protocol.DisconnectReasonSendFailed,
+		)
+	}
+}
 
-	h.clientStatus[clientID] = request.Status
+// isUsernameLengthValid reports whether a username is within the
+// configured length limit.
+func (h *Hub) isUsernameLengthValid(username string) bool {
+	return len(username) > 0 && len(username) <= h.cfg.MaxUsernameLength
+}
 
-	h.broadcastExcept(ctx, clientID, protocol.MustMarshal(protocol.NewStatusMessage{
-		Type:     protocol.TypeNewStatus,
-		Username: username,
-		Status:   request.Status,
-	}))
+// usernameUnavailable returns the result refusing username to clientID,
+// or an empty result when the client may take it. token is the reconnect
+// token the client presented, which reclaims a username held for it.
+func (h *Hub) usernameUnavailable(clientID ClientID, username string, token string) protocol.ResultCode {
+	key := h.usernameKey(username)
+	if _, reserved := h.reservedUsernames[key]; reserved {
+		return protocol.ResultReservedUsername
+	}
+
+	// With case-insensitive usernames a user may change the casing of its
+	// own name, so only a different owner is a collision.
+	owner, exists := h.usernameOwner[key]
+	if (exists && owner != clientID) || h.isUsernameHeld(username, token) {
+		return protocol.ResultUserAlreadyExists
+	}
+	return ""
 }
 
-func (h *Hub) handleUsers(
+func (h *Hub) handleStatus(
 	ctx context.Context,
 	clientID ClientID,
+	username string,
 	envelope protocol.Envelope,
 ) {
-	_, err := protocol.DecodeUsers(envelope)
+	request, err := protocol.DecodeStatus(envelope)
 	if err != nil {
-		h.sendInvalidAndDisconnect(ctx, clientID, "INVALID", "INVALID")
+		h.rejectRequest(ctx, clientID, "STATUS", err)
 		return
 	}
 
-	usersSnapshot := make(map[string]protocol.Status, len(h.clientUser))
-	for knownClientID, knownUsername := range h.clientUser {
-		status, hasStatus := h.clientStatus[knownClientID]
-		if !hasStatus {
-			// Identified users should always have a status; default to ACTIVE defensively.
-			status = protocol.StatusActive
-		}
-		usersSnapshot[knownUsername] = status
+	h.clientStatus[clientID] = request.Status
+	if request.Message == "" {
+		delete(h.clientStatusMessage, clientID)
+	} else {
+		h.clientStatusMessage[clientID] = request.Message
 	}
 
-	userListFrame := protocol.MustMarshal(protocol.UserListMessage{
-		Type:  protocol.TypeUserList,
-		Users: usersSnapshot,
+	legacyFrame := protocol.MustMarshal(protocol.NewStatusMessage{
+		Type:     protocol.TypeNewStatus,
+		Username: username,
+		Status:   request.Status,
+	})
+	frame := protocol.MustMarshal(protocol.NewStatusMessage{
+		Type:     protocol.TypeNewStatus,
+		Username: username,
+		Status:   request.Status,
+		Message:  request.Message,
 	})
 
-	h.sendFrame(ctx, clientID, userListFrame)
+	for recipientClientID := range h.clients {
+		if ctx.Err() != nil {
+			return
+		}
+		if recipientClientID == clientID {
+			continue
+		}
+		if _, optedOut := h.presenceOptOut[recipientClientID]; optedOut {
+			continue
+		}
+		if h.clientVersion[recipientClientID] >= protocol.VersionStatusMessages {
+			h.sendFrame(ctx, recipientClientID, frame)
+		} else {
+			h.sendFrame(ctx, recipientClientID, legacyFrame)
+		}
+	}
+}
+
+// userPresence returns the status and custom status message of a client.
+func (h *Hub) userPresence(clientID ClientID) protocol.UserPresence {
+	status, hasStatus := h.clientStatus[clientID]
+	if !hasStatus {
+		// Identified users should always have a status; default to ACTIVE defensively.
+		status = protocol.StatusActive
+	}
+	return protocol.UserPresence{
+		Status:  status,
+		Message: h.clientStatusMessage[clientID],
+	}
 }
 
-func (h *Hub) handleText(
+// handleChangeUsername renames an identified user. Rooms track members by
+// ClientID, so memberships and invitations carry over unchanged.
+func (h *Hub) handleChangeUsername(
 	ctx context.Context,
-	senderClientID ClientID,
-	senderUsername string,
+	clientID ClientID,
+	username string,
 	envelope protocol.Envelope,
 ) {
-	request, err := protocol.DecodeText(envelope)
+	request, err := protocol.DecodeChangeUsername(envelope)
 	if err != nil {
-		h.sendInvalidAndDisconnect(ctx, senderClientID, "INVALID", "INVALID")
+		h.rejectRequest(ctx, clientID, "CHANGE_USERNAME", err)
 		return
 	}
 
-	recipientClientID, exists := h.usernameOwner[request.Username]
-	if !exists {
-		h.sendResponse(ctx, senderClientID, protocol.ResponseMessage{
+	if !h.isUsernameLengthValid(request.Username) {
+		h.sendInvalidAndDisconnect(ctx, clientID, "INVALID", protocol.ResultInvalid)
+		return
+	}
+
+	if result := h.usernameUnavailable(clientID, request.Username, h.clientToken[clientID]); result != "" {
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
 			Type:      protocol.TypeResponse,
-			Operation: "TEXT",
-			Result:    "NO_SUCH_USER",
+			Operation: "CHANGE_USERNAME",
+			Result:    result,
 			Extra:     request.Username,
 		})
 		return
 	}
 
-	textFrame := protocol.MustMarshal(protocol.TextFromMessage{
-		Type:     protocol.TypeTextFrom,
-		Username: senderUsername,
-		Text:     request.Text,
-	})
-
-	h.sendFrame(ctx, recipientClientID, textFrame)
+	if request.Username == username {
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "CHANGE_USERNAME",
+			Result:    protocol.ResultSuccess,
+			Extra:     request.Username,
+		})
+		return
+	}
+
+	h.reclaimUsername(request.Username)
+	delete(h.usernameOwner, h.usernameKey(username))
+	h.usernameOwner[h.usernameKey(request.Username)] = clientID
+	h.clientUser[clientID] = request.Username
+
+	// A reconnect token only resumes the username it was issued with, so
+	// the renamed session gets a fresh one.
+	var reconnectToken string
+	if _, hasToken := h.clientToken[clientID]; hasToken {
+		reconnectToken = h.issueReconnectToken(clientID)
+	}
+
+	h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+		Type:           protocol.TypeResponse,
+		Operation:      "CHANGE_USERNAME",
+		Result:         protocol.ResultSuccess,
+		Extra:          request.Username,
+		ReconnectToken: reconnectToken,
+	})
+
+	if h.reattachRooms(ctx, clientID, request.Username) {
+		h.sendMembershipSnapshot(ctx, clientID)
+	}
+
+	h.broadcastPresence(ctx, clientID, protocol.MustMarshal(protocol.UsernameChangedMessage{
+		Type:        protocol.TypeUsernameChanged,
+		Username:    username,
+		NewUsername: request.Username,
+	}))
+}
+
+func (h *Hub) handleUsers(
+	ctx context.Context,
+	clientID ClientID,
+	envelope protocol.Envelope,
+) {
+	request, err := protocol.DecodeUsers(envelope)
+	if err != nil {
+		h.rejectRequest(ctx, clientID, "USERS", err)
+		return
+	}
+
+	if request.Cursor == "" && request.Limit == 0 {
+		h.sendUserList(ctx, clientID)
+		return
+	}
+	h.sendUserListPage(ctx, clientID, request.Cursor, request.Limit)
+}
+
+// sendUserList sends the USER_LIST of every identified user, in the
+// format of the client's protocol version.
+func (h *Hub) sendUserList(ctx context.Context, clientID ClientID) {
+	presences := make(map[string]protocol.UserPresence, len(h.clientUser))
+	for knownClientID, knownUsername := range h.clientUser {
+		presences[knownUsername] = h.userPresence(knownClientID)
+	}
+
+	h.sendUserListMessage(ctx, clientID, presences, "")
+}
+
+// sendUserListPage sends up to limit users, sorted by username, that come
+// after cursor. A zero limit sends all of them. Since the cursor is the
+// last username of the previous page, paging stays consistent while users
+// come and go: no user is listed twice, and only users who arrive during
+// the walk may be missed.
+func (h *Hub) sendUserListPage(ctx context.Context, clientID ClientID, cursor string, limit int) {
+	usernameClients := make(map[string]ClientID, len(h.clientUser))
+	for knownClientID, knownUsername := range h.clientUser {
+		if knownUsername > cursor {
+			usernameClients[knownUsername] = knownClientID
+		}
+	}
+	usernames := slices.Sorted(maps.Keys(usernameClients))
+
+	nextCursor := ""
+	if limit > 0 && len(usernames) > limit {
+		usernames = usernames[:limit]
+		nextCursor = usernames[limit-1]
+	}
+
+	presences := make(map[string]protocol.UserPresence, len(usernames))
+	for _, username := range usernames {
+		presences[username] = h.userPresence(usernameClients[username])
+	}
+
+	h.sendUserListMessage(ctx, clientID, presences, nextCursor)
+}
+
+// sendUserListMessage sends presences as a USER_LIST in the format of the
+// client's protocol version.
+func (h *Hub) sendUserListMessage(
+	ctx context.Context,
+	clientID ClientID,
+	presences map[string]protocol.UserPresence,
+	nextCursor string,
+) {
+	if h.clientVersion[clientID] >= protocol.VersionSortedUserLists {
+		h.sendMessage(ctx, clientID, protocol.SortedUserListMessage{
+			Type:       protocol.TypeUserList,
+			Users:      sortedUserEntries(presences),
+			NextCursor: nextCursor,
+		})
+		return
+	}
+
+	if h.clientVersion[clientID] >= protocol.VersionStatusMessages {
+		h.sendMessage(ctx, clientID, protocol.UserPresenceListMessage{
+			Type:       protocol.TypeUserList,
+			Users:      presences,
+			NextCursor: nextCursor,
+		})
+		return
+	}
+
+	h.sendMessage(ctx, clientID, protocol.UserListMessage{
+		Type:       protocol.TypeUserList,
+		Users:      statusesOnly(presences),
+		NextCursor: nextCursor,
+	})
+}
+
+// handleWhois describes a single user. To avoid revealing private rooms,
+// only rooms shared with the requester are listed.
+func (h *Hub) handleWhois(
+	ctx context.Context,
+	clientID ClientID,
+	envelope protocol.Envelope,
+) {
+	request, err := protocol.DecodeWhois(envelope)
+	if err != nil {
+		h.rejectRequest(ctx, clientID, "WHOIS", err)
+		return
+	}
+
+	targetClientID, exists := h.usernameOwner[h.usernameKey(request.Username)]
+	if !exists {
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "WHOIS",
+			Result:    protocol.ResultNoSuchUser,
+			Extra:     request.Username,
+		})
+		return
+	}
+
+	requesterRooms := h.clientRooms[clientID]
+	sharedRooms := make([]string, 0)
+	for roomName := range h.clientRooms[targetClientID] {
+		if _, shared := requesterRooms[roomName]; shared {
+			sharedRooms = append(sharedRooms, roomName)
+		}
+	}
+	sort.Strings(sharedRooms)
+
+	presence := h.userPresence(targetClientID)
+	h.sendMessage(ctx, clientID, protocol.WhoisResultMessage{
+		Type:       protocol.TypeWhoisResult,
+		Username:   h.clientUser[targetClientID],
+		Status:     presence.Status,
+		Message:    presence.Message,
+		Rooms:      sharedRooms,
+		UptimeSecs: h.uptimeSecs(targetClientID, time.Now()),
+	})
+}
+
+// uptimeSecs returns how long a connection has been open, in whole
+// seconds. It is zero for sessions awaiting reconnection.
+func (h *Hub) uptimeSecs(clientID ClientID, now time.Time) int64 {
+	connectedAt, connected := h.clientConnectedAt[clientID]
+	if !connected {
+		return 0
+	}
+	return int64(now.Sub(connectedAt) / time.Second)
+}
+
+func (h *Hub) handleText(
+	ctx context.Context,
+	senderClientID ClientID,
+	senderUsername string,
+	envelope protocol.Envelope,
+) {
+	request, err := protocol.DecodeText(envelope, h.textRules())
+	if err != nil {
+		h.rejectRequest(ctx, senderClientID, "TEXT", err)
+		return
+	}
+
+	recipientClientID, exists := h.usernameOwner[h.usernameKey(request.Username)]
+	if !exists {
+		h.sendResponse(ctx, senderClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "TEXT",
+			Result:    protocol.ResultNoSuchUser,
+			Extra:     request.Username,
+		})
+		return
+	}
+
+	// Compare resolved client IDs rather than raw names, so the guard
+	// also holds for case-insensitive usernames.
+	if recipientClientID == senderClientID {
+		h.sendResponse(ctx, senderClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "TEXT",
+			Result:    protocol.ResultCannotMessageSelf,
+			Extra:     request.Username,
+		})
+		return
+	}
+
+	textFrame := protocol.MustMarshal(protocol.TextFromMessage{
+		Type:     protocol.TypeTextFrom,
+		Username: senderUsername,
+		Text:     request.Text,
+		Meta:     request.Meta,
+		ReplyTo:  request.ReplyTo,
+	})
+
+	h.sendFrame(ctx, recipientClientID, textFrame)
+
+	h.observer.OnMessage(ObservedMessage{
+		Type:      protocol.TypeText,
+		Sender:    senderUsername,
+		Recipient: h.clientUser[recipientClientID],
+		Text:      request.Text,
+	})
+}
+
+// handleMultiText delivers one private message to several users as
+// separate TEXT_FROM frames, and answers with the outcome per username.
+func (h *Hub) handleMultiText(
+	ctx context.Context,
+	senderClientID ClientID,
+	senderUsername string,
+	envelope protocol.Envelope,
+) {
+	request, err := protocol.DecodeMultiText(envelope, h.textRules())
+	if err != nil {
+		h.rejectRequest(ctx, senderClientID, "MULTI_TEXT", err)
+		return
+	}
+
+	if len(request.Usernames) > h.cfg.MaxRecipients {
+		h.sendResponse(ctx, senderClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "MULTI_TEXT",
+			Result:    protocol.ResultTooManyRecipients,
+			Capacity: &protocol.CapacityHint{
+				Current: len(request.Usernames),
+				Max:     h.cfg.MaxRecipients,
+			},
+		})
+		return
+	}
+
+	textFrame := protocol.MustMarshal(protocol.TextFromMessage{
+		Type:     protocol.TypeTextFrom,
+		Username: senderUsername,
+		Text:     request.Text,
+		Meta:     request.Meta,
+		ReplyTo:  request.ReplyTo,
+	})
+
+	targets := &protocol.TargetResults{}
+	delivered := make(map[ClientID]struct{}, len(request.Usernames))
+	for _, targetUsername := range request.Usernames {
+		recipientClientID, exists := h.usernameOwner[h.usernameKey(targetUsername)]
+		if !exists {
+			targets.NoSuchUser = append(targets.NoSuchUser, targetUsername)
+			continue
+		}
+		if recipientClientID == senderClientID {
+			targets.Self = append(targets.Self, targetUsername)
+			continue
+		}
+
+		// A user named twice still gets the message once.
+		if _, alreadyDelivered := delivered[recipientClientID]; !alreadyDelivered {
+			delivered[recipientClientID] = struct{}{}
+			h.sendFrame(ctx, recipientClientID, textFrame)
+			h.observer.OnMessage(ObservedMessage{
+				Type:      protocol.TypeText,
+				Sender:    senderUsername,
+				Recipient: h.clientUser[recipientClientID],
+				Text:      request.Text,
+			})
+		}
+		targets.Succeeded = append(targets.Succeeded, targetUsername)
+	}
+
+	h.sendResponse(ctx, senderClientID, protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: "MULTI_TEXT",
+		Result:    batchResult(len(request.Usernames), len(targets.NoSuchUser)),
+		Targets:   targets,
+	})
+}
+
+func (h *Hub) handlePublicText(
+	ctx context.Context,
+	senderClientID ClientID,
+	senderUsername string,
+	envelope protocol.Envelope,
+) {
+	request, err := protocol.DecodePublicText(envelope, h.textRules())
+	if err != nil {
+		h.rejectRequest(ctx, senderClientID, "PUBLIC_TEXT", err)
+		return
+	}
+
+	publicTextFrame := protocol.MustMarshal(protocol.PublicTextFromMessage{
+		Type:     protocol.TypePublicTextFrom,
+		Username: senderUsername,
+		Text:     request.Text,
+	})
+
+	if h.cfg.LobbyRoom == "" {
+		h.broadcastExcept(ctx, senderClientID, publicTextFrame)
+	} else {
+		lobby, exists := h.rooms[h.roomKey(h.cfg.LobbyRoom)]
+		if !exists || !h.isRoomMember(lobby, senderClientID) {
+			h.sendResponse(ctx, senderClientID, protocol.ResponseMessage{
+				Type:      protocol.TypeResponse,
+				Operation: "PUBLIC_TEXT",
+				Result:    protocol.ResultNotJoined,
+				Extra:     h.cfg.LobbyRoom,
+			})
+			return
+		}
+
+		for memberClientID := range lobby.members {
+			if ctx.Err() != nil {
+				break
+			}
+			if memberClientID != senderClientID {
+				h.sendFrame(ctx, memberClientID, publicTextFrame)
+			}
+		}
+	}
+
+	if request.Echo {
+		h.sendFrame(ctx, senderClientID, publicTextFrame)
+	}
+
+	h.observer.OnMessage(ObservedMessage{
+		Type:   protocol.TypePublicText,
+		Sender: senderUsername,
+		Text:   request.Text,
+	})
+}
+
+func (h *Hub) handleNewRoom(
+	ctx context.Context,
+	creatorClientID ClientID,
+	envelope protocol.Envelope,
+) {
+	request, err := protocol.DecodeNewRoom(envelope)
+	if err != nil {
+		h.rejectRequest(ctx, creatorClientID, "NEW_ROOM", err)
+		return
+	}
+
+	if len(request.RoomName) == 0 || len(request.RoomName) > h.cfg.MaxRoomNameLength {
+		h.sendInvalidAndDisconnect(ctx, creatorClientID, "INVALID", protocol.ResultInvalid)
+		return
+	}
+
+	if _, exists := h.rooms[h.roomKey(request.RoomName)]; exists {
+		h.sendResponse(ctx, creatorClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "NEW_ROOM",
+			Result:    protocol.ResultRoomAlreadyExists,
+			Extra:     request.RoomName,
+		})
+		return
+	}
+
+	if h.rejectIfTooManyRooms(ctx, creatorClientID, "NEW_ROOM", request.RoomName) {
+		return
+	}
+	if h.rejectIfServerRoomLimit(ctx, creatorClientID, "NEW_ROOM", request.RoomName) {
+		return
+	}
+
+	h.createRoom(creatorClientID, request.RoomName, request.Public)
+
+	h.sendResponse(ctx, creatorClientID, protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: "NEW_ROOM",
+		Result:    protocol.ResultSuccess,
+		Extra:     request.RoomName,
+	})
+}
+
+// createRoom creates a room with its creator as the only member.
+func (h *Hub) createRoom(creatorClientID ClientID, roomName string, public bool) *RoomState {
+	newRoom := h.newRoomState(roomName, public)
+	newRoom.members[creatorClientID] = struct{}{}
+	newRoom.owner = creatorClientID
+
+	h.rooms[h.roomKey(roomName)] = newRoom
+	h.ensureClientRoomSet(creatorClientID)[roomName] = struct{}{}
+
+	h.observer.OnRoomJoin(roomName, h.clientUser[creatorClientID])
+	return newRoom
+}
+
+// newRoomState returns an empty room, without registering it.
+func (h *Hub) newRoomState(roomName string, public bool) *RoomState {
+	return &RoomState{
+		name:    roomName,
+		public:  public,
+		members: make(map[ClientID]struct{}),
+		invited: make(map[ClientID]time.Time),
+		history: newRoomHistory(h.cfg.RoomHistoryDepth),
+
+		rateLimiters:  make(map[ClientID]*tokenBucket),
+		muted:         make(map[ClientID]struct{}),
+		absentMembers: make(map[string]string),
+	}
+}
+
+func (h *Hub) handleInvite(
+	ctx context.Context,
+	inviterClientID ClientID,
+	inviterUsername string,
+	envelope protocol.Envelope,
+) {
+	request, err := protocol.DecodeInvite(envelope)
+	if err != nil {
+		h.rejectRequest(ctx, inviterClientID, "INVITE", err)
+		return
+	}
+
+	if len(request.RoomName) == 0 || len(request.RoomName) > h.cfg.MaxRoomNameLength {
+		h.sendInvalidAndDisconnect(ctx, inviterClientID, "INVALID", protocol.ResultInvalid)
+		return
+	}
+
+	room, exists := h.rooms[h.roomKey(request.RoomName)]
+	if !exists {
+		h.sendResponse(ctx, inviterClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "INVITE",
+			Result:    protocol.ResultNoSuchRoom,
+			Extra:     request.RoomName,
+		})
+		return
+	}
+
+	// The spec states only users who are inside a room can invite others to that room.
+	// By default, an inviter outside the room is treated as a protocol violation.
+	if !h.isRoomMember(room, inviterClientID) {
+		h.rejectNonMemberInvite(ctx, inviterClientID, "INVITE", room.name)
+		return
+	}
+
+	invitationFrame := protocol.MustMarshal(protocol.InvitationMessage{
+		Type:     protocol.TypeInvitation,
+		RoomName: room.name,
+		Username: inviterUsername,
+	})
+
+	targets := &protocol.TargetResults{}
+	for _, targetUsername := range request.Usernames {
+		targetClientID, userExists := h.usernameOwner[h.usernameKey(targetUsername)]
+		if !userExists {
+			targets.NoSuchUser = append(targets.NoSuchUser, targetUsername)
+			continue
+		}
+		if _, isMember := room.members[targetClientID]; isMember {
+			targets.AlreadyJoined = append(targets.AlreadyJoined, targetUsername)
+			continue
+		}
+		if _, alreadyInvited := room.invited[targetClientID]; alreadyInvited {
+			targets.AlreadyInvited = append(targets.AlreadyInvited, targetUsername)
+			continue
+		}
+		if h.cfg.MaxPendingInvitesPerRoom > 0 && len(room.invited) >= h.cfg.MaxPendingInvitesPerRoom {
+			targets.OverLimit = append(targets.OverLimit, targetUsername)
+			continue
+		}
+		if h.hasTooManyInvites(targetClientID) {
+			targets.TooManyInvites = append(targets.TooManyInvites, targetUsername)
+			continue
+		}
+
+		h.addInvitation(room, targetClientID, time.Now())
+		h.sendFrame(ctx, targetClientID, invitationFrame)
+		targets.Succeeded = append(targets.Succeeded, targetUsername)
+	}
+
+	response := protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: "INVITE",
+		Result:    batchResult(len(request.Usernames), len(targets.NoSuchUser)),
+		Extra:     request.RoomName,
+		Targets:   targets,
+	}
+	if len(targets.OverLimit) > 0 {
+		response.Capacity = &protocol.CapacityHint{
+			Current: len(room.invited),
+			Max:     h.cfg.MaxPendingInvitesPerRoom,
+		}
+		if len(targets.Succeeded) == 0 {
+			response.Result = protocol.ResultTooManyPendingInvites
+		}
+	}
+	if len(targets.TooManyInvites) > 0 && len(targets.Succeeded) == 0 {
+		response.Result = protocol.ResultTooManyPendingInvites
+	}
+
+	h.sendResponse(ctx, inviterClientID, response)
+}
+
+// handleUninvite rescinds pending invitations. Like INVITE, it is only
+// available to room members.
+func (h *Hub) handleUninvite(
+	ctx context.Context,
+	clientID ClientID,
+	envelope protocol.Envelope,
+) {
+	request, err := protocol.DecodeUninvite(envelope)
+	if err != nil {
+		h.rejectRequest(ctx, clientID, "UNINVITE", err)
+		return
+	}
+
+	if len(request.RoomName) == 0 || len(request.RoomName) > h.cfg.MaxRoomNameLength {
+		h.sendInvalidAndDisconnect(ctx, clientID, "INVALID", protocol.ResultInvalid)
+		return
+	}
+
+	room, exists := h.rooms[h.roomKey(request.RoomName)]
+	if !exists {
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "UNINVITE",
+			Result:    protocol.ResultNoSuchRoom,
+			Extra:     request.RoomName,
+		})
+		return
+	}
+
+	if !h.isRoomMember(room, clientID) {
+		h.rejectNonMemberInvite(ctx, clientID, "UNINVITE", room.name)
+		return
+	}
+
+	targets := &protocol.TargetResults{}
+	for _, targetUsername := range request.Usernames {
+		targetClientID, userExists := h.usernameOwner[h.usernameKey(targetUsername)]
+		if !userExists {
+			targets.NoSuchUser = append(targets.NoSuchUser, targetUsername)
+			continue
+		}
+		if _, isMember := room.members[targetClientID]; isMember {
+			targets.AlreadyJoined = append(targets.AlreadyJoined, targetUsername)
+			continue
+		}
+		if _, isInvited := room.invited[targetClientID]; !isInvited {
+			targets.NotInvited = append(targets.NotInvited, targetUsername)
+			continue
+		}
+
+		h.removeInvitation(room, targetClientID)
+		targets.Succeeded = append(targets.Succeeded, targetUsername)
+	}
+
+	h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: "UNINVITE",
+		Result:    batchResult(len(request.Usernames), len(targets.NoSuchUser)),
+		Extra:     request.RoomName,
+		Targets:   targets,
+	})
+}
+
+// rejectNonMemberInvite answers INVITE or UNINVITE from a client outside
+// the room: a protocol violation under StrictInvitePermission, NOT_JOINED
+// otherwise.
+func (h *Hub) rejectNonMemberInvite(
+	ctx context.Context,
+	clientID ClientID,
+	operation string,
+	roomName string,
+) {
+	if h.cfg.StrictInvitePermission {
+		h.sendInvalidAndDisconnect(ctx, clientID, "INVALID", protocol.ResultInvalid)
+		return
+	}
+
+	h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: operation,
+		Result:    protocol.ResultNotJoined,
+		Extra:     roomName,
+	})
+}
+
+func (h *Hub) handleJoinRoom(
+	ctx context.Context,
+	clientID ClientID,
+	username string,
+	envelope protocol.Envelope,
+) {
+	request, err := protocol.DecodeJoinRoom(envelope)
+	if err != nil {
+		h.rejectRequest(ctx, clientID, "JOIN_ROOM", err)
+		return
+	}
+
+	if len(request.RoomName) == 0 || len(request.RoomName) > h.cfg.MaxRoomNameLength {
+		h.sendInvalidAndDisconnect(ctx, clientID, "INVALID", protocol.ResultInvalid)
+		return
+	}
+
+	room, exists := h.rooms[h.roomKey(request.RoomName)]
+	if !exists {
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "JOIN_ROOM",
+			Result:    protocol.ResultNoSuchRoom,
+			Extra:     request.RoomName,
+		})
+		return
+	}
+
+	// Idempotency: if already a member, return SUCCESS without broadcasting again.
+	if _, alreadyMember := room.members[clientID]; alreadyMember {
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "JOIN_ROOM",
+			Result:    protocol.ResultSuccess,
+			Extra:     request.RoomName,
+		})
+		if request.History {
+			h.sendRoomHistory(ctx, clientID, room)
+		}
+		return
+	}
+
+	_, wasInvited := room.invited[clientID]
+	if !wasInvited && !room.public {
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "JOIN_ROOM",
+			Result:    protocol.ResultNotInvited,
+			Extra:     request.RoomName,
+		})
+		return
+	}
+
+	if h.rejectIfTooManyRooms(ctx, clientID, "JOIN_ROOM", request.RoomName) {
+		return
+	}
+
+	if h.rejectIfRoomFull(ctx, clientID, "JOIN_ROOM", room) {
+		return
+	}
+
+	h.admitRoomMember(clientID, room)
+
+	h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: "JOIN_ROOM",
+		Result:    protocol.ResultSuccess,
+		Extra:     request.RoomName,
+	})
+
+	if request.History {
+		h.sendRoomHistory(ctx, clientID, room)
+	}
+
+	h.announceRoomJoin(ctx, room, username)
+}
+
+// handleEnsureRoom joins a room, creating it as a public room first if it
+// does not exist. Both steps run on the hub goroutine, so no other request
+// can create or fill the room in between.
+func (h *Hub) handleEnsureRoom(
+	ctx context.Context,
+	clientID ClientID,
+	username string,
+	envelope protocol.Envelope,
+) {
+	request, err := protocol.DecodeEnsureRoom(envelope)
+	if err != nil {
+		h.rejectRequest(ctx, clientID, "ENSURE_ROOM", err)
+		return
+	}
+
+	if len(request.RoomName) == 0 || len(request.RoomName) > h.cfg.MaxRoomNameLength {
+		h.sendInvalidAndDisconnect(ctx, clientID, "INVALID", protocol.ResultInvalid)
+		return
+	}
+
+	room, exists := h.rooms[h.roomKey(request.RoomName)]
+	if !exists {
+		if h.rejectIfTooManyRooms(ctx, clientID, "ENSURE_ROOM", request.RoomName) {
+			return
+		}
+		if h.rejectIfServerRoomLimit(ctx, clientID, "ENSURE_ROOM", request.RoomName) {
+			return
+		}
+
+		h.createRoom(clientID, request.RoomName, true)
+
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "ENSURE_ROOM",
+			Result:    protocol.ResultCreated,
+			Extra:     request.RoomName,
+		})
+		return
+	}
+
+	if _, alreadyMember := room.members[clientID]; alreadyMember {
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "ENSURE_ROOM",
+			Result:    protocol.ResultJoined,
+			Extra:     request.RoomName,
+		})
+		return
+	}
+
+	if _, wasInvited := room.invited[clientID]; !wasInvited && !room.public {
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "ENSURE_ROOM",
+			Result:    protocol.ResultNotInvited,
+			Extra:     request.RoomName,
+		})
+		return
+	}
+
+	if h.rejectIfTooManyRooms(ctx, clientID, "ENSURE_ROOM", request.RoomName) {
+		return
+	}
+	if h.rejectIfRoomFull(ctx, clientID, "ENSURE_ROOM", room) {
+		return
+	}
+
+	h.admitRoomMember(clientID, room)
+
+	h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: "ENSURE_ROOM",
+		Result:    protocol.ResultJoined,
+		Extra:     request.RoomName,
+	})
+
+	h.announceRoomJoin(ctx, room, username)
+}
+
+// admitRoomMember turns an invitee, or any user of a public room, into a
+// member of the room.
+func (h *Hub) admitRoomMember(clientID ClientID, room *RoomState) {
+	h.removeInvitation(room, clientID)
+	room.members[clientID] = struct{}{}
+	room.emptySince = time.Time{}
+
+	h.ensureClientRoomSet(clientID)[room.name] = struct{}{}
+}
+
+// joinLobby makes a newly identified user a member of the lobby room, if
+// one is configured, creating it as a public room when needed. Room limits
+// do not apply: the lobby is where PUBLIC_TEXT goes.
+func (h *Hub) joinLobby(ctx context.Context, clientID ClientID, username string) {
+	if h.cfg.LobbyRoom == "" {
+		return
+	}
+
+	lobby, exists := h.rooms[h.roomKey(h.cfg.LobbyRoom)]
+	if !exists {
+		lobby = h.newRoomState(h.cfg.LobbyRoom, true)
+		h.rooms[h.roomKey(lobby.name)] = lobby
+	}
+	// A user restored to the lobby by reattachRooms is already in.
+	if h.isRoomMember(lobby, clientID) {
+		return
+	}
+
+	h.admitRoomMember(clientID, lobby)
+	h.announceRoomJoin(ctx, lobby, username)
+}
+
+// autoJoinRoom makes a newly identified user a member of the configured
+// auto-join room, creating it as a public room when needed. Unlike the
+// lobby, the room limits apply; a refused join is answered as a JOIN_ROOM
+// would be.
+func (h *Hub) autoJoinRoom(ctx context.Context, clientID ClientID, username string) {
+	roomName := h.cfg.AutoJoinRoom
+	if roomName == "" {
+		return
+	}
+
+	room, exists := h.rooms[h.roomKey(roomName)]
+	if !exists {
+		if h.rejectIfTooManyRooms(ctx, clientID, "JOIN_ROOM", roomName) {
+			return
+		}
+		if h.rejectIfServerRoomLimit(ctx, clientID, "JOIN_ROOM", roomName) {
+			return
+		}
+		room = h.newRoomState(roomName, true)
+		h.rooms[h.roomKey(roomName)] = room
+	} else {
+		if h.isRoomMember(room, clientID) {
+			return
+		}
+		if h.rejectIfTooManyRooms(ctx, clientID, "JOIN_ROOM", room.name) {
+			return
+		}
+		if h.rejectIfRoomFull(ctx, clientID, "JOIN_ROOM", room) {
+			return
+		}
+	}
+
+	h.admitRoomMember(clientID, room)
+	h.announceRoomJoin(ctx, room, username)
+}
+
+// announceRoomJoin broadcasts JOINED_ROOM for a new member.
+func (h *Hub) announceRoomJoin(ctx context.Context, room *RoomState, username string) {
+	joinedFrame := protocol.MustMarshal(protocol.JoinedRoomMessage{
+		Type:     protocol.TypeJoinedRoom,
+		RoomName: room.name,
+		Username: username,
+	})
+
+	// The spec says broadcast to users inside the room.
+	// At this point, the user is inside the room, so they will receive it too.
+	for memberClientID := range room.members {
+		h.sendMembershipFrame(ctx, memberClientID, joinedFrame)
+	}
+
+	h.observer.OnRoomJoin(room.name, username)
 }
 
-func (h *Hub) handlePublicText(
-	ctx context.Context,
-	senderClientID ClientID,
-	senderUsername string,
-	envelope protocol.Envelope,
-) {
-	request, err := protocol.DecodePublicText(envelope)
-	if err != nil {
-		h.sendInvalidAndDisconnect(ctx, senderClientID, "INVALID", "INVALID")
+func (h *Hub) handleRoomUsers(
+	ctx context.Context,
+	requestingClientID ClientID,
+	envelope protocol.Envelope,
+) {
+	request, err := protocol.DecodeRoomUsers(envelope)
+	if err != nil {
+		h.rejectRequest(ctx, requestingClientID, "ROOM_USERS", err)
+		return
+	}
+
+	if len(request.RoomName) == 0 || len(request.RoomName) > h.cfg.MaxRoomNameLength {
+		h.sendInvalidAndDisconnect(ctx, requestingClientID, "INVALID", protocol.ResultInvalid)
+		return
+	}
+
+	room, exists := h.rooms[h.roomKey(request.RoomName)]
+	if !exists {
+		h.sendResponse(ctx, requestingClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "ROOM_USERS",
+			Result:    protocol.ResultNoSuchRoom,
+			Extra:     request.RoomName,
+		})
+		return
+	}
+
+	if _, isMember := room.members[requestingClientID]; !isMember {
+		h.sendResponse(ctx, requestingClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "ROOM_USERS",
+			Result:    protocol.ResultNotJoined,
+			Extra:     request.RoomName,
+		})
+		return
+	}
+
+	presences := make(map[string]protocol.UserPresence, len(room.members))
+	for memberClientID := range room.members {
+		memberUsername, isIdentified := h.clientUser[memberClientID]
+		if !isIdentified {
+			// Defensive: members should always be identified.
+			continue
+		}
+
+		presences[memberUsername] = h.userPresence(memberClientID)
+	}
+
+	if h.clientVersion[requestingClientID] >= protocol.VersionSortedUserLists {
+		h.sendMessage(ctx, requestingClientID, protocol.SortedRoomUserListMessage{
+			Type:     protocol.TypeRoomUserList,
+			RoomName: room.name,
+			Users:    sortedUserEntries(presences),
+		})
 		return
 	}
 
-	publicTextFrame := protocol.MustMarshal(protocol.PublicTextFromMessage{
-		Type:     protocol.TypePublicTextFrom,
-		Username: senderUsername,
-		Text:     request.Text,
-	})
+	if h.clientVersion[requestingClientID] >= protocol.VersionStatusMessages {
+		h.sendMessage(ctx, requestingClientID, protocol.RoomUserPresenceListMessage{
+			Type:     protocol.TypeRoomUserList,
+			RoomName: room.name,
+			Users:    presences,
+		})
+		return
+	}
 
-	h.broadcastExcept(ctx, senderClientID, publicTextFrame)
+	h.sendMessage(ctx, requestingClientID, protocol.RoomUserListMessage{
+		Type:     protocol.TypeRoomUserList,
+		RoomName: room.name,
+		Users:    statusesOnly(presences),
+	})
 }
 
-func (h *Hub) handleNewRoom(
+// handleRoomReport delivers a member's report privately to the room owner.
+func (h *Hub) handleRoomReport(
 	ctx context.Context,
-	creatorClientID ClientID,
+	reporterClientID ClientID,
+	reporterUsername string,
 	envelope protocol.Envelope,
 ) {
-	request, err := protocol.DecodeNewRoom(envelope)
+	request, err := protocol.DecodeRoomReport(envelope, h.textRules())
 	if err != nil {
-		h.sendInvalidAndDisconnect(ctx, creatorClientID, "INVALID", "INVALID")
+		h.rejectRequest(ctx, reporterClientID, "ROOM_REPORT", err)
 		return
 	}
 
 	if len(request.RoomName) == 0 || len(request.RoomName) > h.cfg.MaxRoomNameLength {
-		h.sendInvalidAndDisconnect(ctx, creatorClientID, "INVALID", "INVALID")
+		h.sendInvalidAndDisconnect(ctx, reporterClientID, "INVALID", protocol.ResultInvalid)
 		return
 	}
 
-	if _, exists := h.rooms[request.RoomName]; exists {
-		h.sendResponse(ctx, creatorClientID, protocol.ResponseMessage{
+	room, exists := h.rooms[h.roomKey(request.RoomName)]
+	if !exists {
+		h.sendResponse(ctx, reporterClientID, protocol.ResponseMessage{
 			Type:      protocol.TypeResponse,
-			Operation: "NEW_ROOM",
-			Result:    "ROOM_ALREADY_EXISTS",
+			Operation: "ROOM_REPORT",
+			Result:    protocol.ResultNoSuchRoom,
 			Extra:     request.RoomName,
 		})
 		return
 	}
 
-	newRoom := &RoomState{
-		name:    request.RoomName,
-		members: make(map[ClientID]struct{}),
-		invited: make(map[ClientID]struct{}),
+	if !h.isRoomMember(room, reporterClientID) {
+		h.sendResponse(ctx, reporterClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "ROOM_REPORT",
+			Result:    protocol.ResultNotJoined,
+			Extra:     request.RoomName,
+		})
+		return
+	}
+
+	// Reports share the ROOM_TEXT limiter, so they cannot be used to
+	// flood the owner instead.
+	if !h.allowRoomMessage(room, reporterClientID) {
+		h.sendResponse(ctx, reporterClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "ROOM_REPORT",
+			Result:    protocol.ResultRateLimited,
+			Extra:     request.RoomName,
+		})
+		return
+	}
+
+	if room.owner == "" {
+		h.sendResponse(ctx, reporterClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "ROOM_REPORT",
+			Result:    protocol.ResultNoOwner,
+			Extra:     request.RoomName,
+		})
+		return
 	}
-	newRoom.members[creatorClientID] = struct{}{}
 
-	h.rooms[request.RoomName] = newRoom
-	h.ensureClientRoomSet(creatorClientID)[request.RoomName] = struct{}{}
+	h.sendMessage(ctx, room.owner, protocol.RoomReportFromMessage{
+		Type:     protocol.TypeRoomReportFrom,
+		RoomName: room.name,
+		Username: reporterUsername,
+		Text:     request.Text,
+	})
 
-	h.sendResponse(ctx, creatorClientID, protocol.ResponseMessage{
+	h.sendResponse(ctx, reporterClientID, protocol.ResponseMessage{
 		Type:      protocol.TypeResponse,
-		Operation: "NEW_ROOM",
-		Result:    "SUCCESS",
+		Operation: "ROOM_REPORT",
+		Result:    protocol.ResultSuccess,
 		Extra:     request.RoomName,
 	})
 }
 
-func (h *Hub) handleInvite(
+func (h *Hub) handleRoomText(
 	ctx context.Context,
-	inviterClientID ClientID,
-	inviterUsername string,
+	senderClientID ClientID,
+	senderUsername string,
 	envelope protocol.Envelope,
 ) {
-	request, err := protocol.DecodeInvite(envelope)
+	request, err := protocol.DecodeRoomText(envelope, h.textRules())
 	if err != nil {
-		h.sendInvalidAndDisconnect(ctx, inviterClientID, "INVALID", "INVALID")
+		h.rejectRequest(ctx, senderClientID, "ROOM_TEXT", err)
 		return
 	}
 
 	if len(request.RoomName) == 0 || len(request.RoomName) > h.cfg.MaxRoomNameLength {
-		h.sendInvalidAndDisconnect(ctx, inviterClientID, "INVALID", "INVALID")
+		h.sendInvalidAndDisconnect(ctx, senderClientID, "INVALID", protocol.ResultInvalid)
 		return
 	}
 
-	room, exists := h.rooms[request.RoomName]
+	room, exists := h.rooms[h.roomKey(request.RoomName)]
 	if !exists {
-		h.sendResponse(ctx, inviterClientID, protocol.ResponseMessage{
+		h.sendResponse(ctx, senderClientID, protocol.ResponseMessage{
 			Type:      protocol.TypeResponse,
-			Operation: "INVITE",
-			Result:    "NO_SUCH_ROOM",
+			Operation: "ROOM_TEXT",
+			Result:    protocol.ResultNoSuchRoom,
 			Extra:     request.RoomName,
 		})
 		return
 	}
 
-	// The spec states only users who are inside a room can invite others to that room.
-	// This is treated as a protocol violation if the inviter is not a room member.
-	if !h.isRoomMember(room, inviterClientID) {
-		h.sendInvalidAndDisconnect(ctx, inviterClientID, "INVALID", "INVALID")
+	if _, isMember := room.members[senderClientID]; !isMember {
+		h.sendResponse(ctx, senderClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "ROOM_TEXT",
+			Result:    protocol.ResultNotJoined,
+			Extra:     request.RoomName,
+		})
 		return
 	}
 
-	recipientClientIDs := make([]ClientID, 0, len(request.Usernames))
-	for _, targetUsername := range request.Usernames {
-		targetClientID, userExists := h.usernameOwner[targetUsername]
-		if !userExists {
-			h.sendResponse(ctx, inviterClientID, protocol.ResponseMessage{
-				Type:      protocol.TypeResponse,
-				Operation: "INVITE",
-				Result:    "NO_SUCH_USER",
-				Extra:     targetUsername,
-			})
-			return
-		}
-		recipientClientIDs = append(recipientClientIDs, targetClientID)
+	if !h.allowRoomMessage(room, senderClientID) {
+		h.sendResponse(ctx, senderClientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: "ROOM_TEXT",
+			Result:    protocol.ResultRateLimited,
+			Extra:     request.RoomName,
+		})
+		return
 	}
 
-	invitationFrame := protocol.MustMarshal(protocol.InvitationMessage{
-		Type:     protocol.TypeInvitation,
-		RoomName: request.RoomName,
-		Username: inviterUsername,
+	room.history.add(protocol.RoomHistoryEntry{
+		Username: senderUsername,
+		Text:     request.Text,
+		Meta:     request.Meta,
+		ReplyTo:  request.ReplyTo,
+	})
+
+	roomTextFrame := protocol.MustMarshal(protocol.RoomTextFromMessage{
+		Type:     protocol.TypeRoomTextFrom,
+		RoomName: room.name,
+		Username: senderUsername,
+		Text:     request.Text,
+		Meta:     request.Meta,
+		ReplyTo:  request.ReplyTo,
 	})
 
-	for _, recipientClientID := range recipientClientIDs {
-		// Ignore already joined users.
-		if _, isMember := room.members[recipientClientID]; isMember {
+	mentioned := h.mentionedUsernames(request.Text)
+	for memberClientID := range room.members {
+		if ctx.Err() != nil {
+			break
+		}
+		if memberClientID == senderClientID {
+			continue
+		}
+		if _, isMuted := room.muted[memberClientID]; isMuted {
 			continue
 		}
-		// Ignore already invited users.
-		if _, alreadyInvited := room.invited[recipientClientID]; alreadyInvited {
+		if _, isMentioned := mentioned[h.usernameKey(h.clientUser[memberClientID])]; isMentioned {
+			h.sendMentionFrame(ctx, memberClientID, roomTextFrame)
 			continue
 		}
+		h.sendFrame(ctx, memberClientID, roomTextFrame)
+	}
 
-		room.invited[recipientClientID] = struct{}{}
-		h.sendFrame(ctx, recipientClientID, invitationFrame)
+	// The echo is an acknowledgment, so it ignores the sender's mute setting.
+	if request.Echo {
+		h.sendFrame(ctx, senderClientID, roomTextFrame)
 	}
+
+	h.observer.OnMessage(ObservedMessage{
+		Type:     protocol.TypeRoomText,
+		Sender:   senderUsername,
+		RoomName: room.name,
+		Text:     request.Text,
+	})
 }
 
-func (h *Hub) handleJoinRoom(
+func (h *Hub) handleLeaveRoom(
 	ctx context.Context,
-	clientID ClientID,
-	username string,
+	leavingClientID ClientID,
+	leavingUsername string,
 	envelope protocol.Envelope,
 ) {
-	request, err := protocol.DecodeJoinRoom(envelope)
+	request, err := protocol.DecodeLeaveRoom(envelope)
 	if err != nil {
-		h.sendInvalidAndDisconnect(ctx, clientID, "INVALID", "INVALID")
+		h.rejectRequest(ctx, leavingClientID, "LEAVE_ROOM", err)
 		return
 	}
 
 	if len(request.RoomName) == 0 || len(request.RoomName) > h.cfg.MaxRoomNameLength {
-		h.sendInvalidAndDisconnect(ctx, clientID, "INVALID", "INVALID")
+		h.sendInvalidAndDisconnect(ctx, leavingClientID, "INVALID", protocol.ResultInvalid)
 		return
 	}
 
-	room, exists := h.rooms[request.RoomName]
+	room, exists := h.rooms[h.roomKey(request.RoomName)]
 	if !exists {
-		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
-			Type:      protocol.TypeResponse,
-			Operation: "JOIN_ROOM",
-			Result:    "NO_SUCH_ROOM",
-			Extra:     request.RoomName,
-		})
-		return
-	}
-
-	// Idempotency: if already a member, return SUCCESS without broadcasting again.
-	if _, alreadyMember := room.members[clientID]; alreadyMember {
-		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+		h.sendResponse(ctx, leavingClientID, protocol.ResponseMessage{
 			Type:      protocol.TypeResponse,
-			Operation: "JOIN_ROOM",
-			Result:    "SUCCESS",
+			Operation: "LEAVE_ROOM",
+			Result:    protocol.ResultNoSuchRoom,
 			Extra:     request.RoomName,
 		})
 		return
 	}
 
-	if _, wasInvited := room.invited[clientID]; !wasInvited {
-		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+	if _, isMember := room.members[leavingClientID]; !isMember {
+		h.sendResponse(ctx, leavingClientID, protocol.ResponseMessage{
 			Type:      protocol.TypeResponse,
-			Operation: "JOIN_ROOM",
-			Result:    "NOT_INVITED",
+			Operation: "LEAVE_ROOM",
+			Result:    protocol.ResultNotJoined,
 			Extra:     request.RoomName,
 		})
 		return
 	}
 
-	// Transition: invited -> member
-	delete(room.invited, clientID)
-	room.members[clientID] = struct{}{}
+	// Remove membership.
+	room.removeMember(leavingClientID)
 
-	h.ensureClientRoomSet(clientID)[request.RoomName] = struct{}{}
+	// Update reverse index.
+	clientRoomSet, hasClientRooms := h.clientRooms[leavingClientID]
+	if hasClientRooms {
+		delete(clientRoomSet, room.name)
+		if len(clientRoomSet) == 0 {
+			delete(h.clientRooms, leavingClientID)
+		}
+	}
 
-	h.sendResponse(ctx, clientID, protocol.ResponseMessage{
-		Type:      protocol.TypeResponse,
-		Operation: "JOIN_ROOM",
-		Result:    "SUCCESS",
-		Extra:     request.RoomName,
+	leftFrame := protocol.MustMarshal(protocol.LeftRoomMessage{
+		Type:     protocol.TypeLeftRoom,
+		RoomName: room.name,
+		Username: leavingUsername,
 	})
 
-	joinedFrame := protocol.MustMarshal(protocol.JoinedRoomMessage{
-		Type:     protocol.TypeJoinedRoom,
-		RoomName: request.RoomName,
-		Username: username,
-	})
+	// Broadcast to remaining room members (sender excluded because they already left).
+	for memberClientID := range room.members {
+		h.sendMembershipFrame(ctx, memberClientID, leftFrame)
+	}
 
-	// The spec says broadcast to users inside the room.
-	// At this point, the user is inside the room, so they will receive it too.
-	h.broadcastToRoomMembers(ctx, room, joinedFrame)
+	h.deleteRoomIfEmpty(room)
 }
 
-func (h *Hub) handleRoomUsers(
+// handleLeaveAllRooms leaves every joined room at once, notifying each
+// room like a LEAVE_ROOM would. Extra holds the number of rooms left.
+func (h *Hub) handleLeaveAllRooms(
 	ctx context.Context,
-	requestingClientID ClientID,
+	leavingClientID ClientID,
+	leavingUsername string,
 	envelope protocol.Envelope,
 ) {
-	request, err := protocol.DecodeRoomUsers(envelope)
+	_, err := protocol.DecodeLeaveAllRooms(envelope)
 	if err != nil {
-		h.sendInvalidAndDisconnect(ctx, requestingClientID, "INVALID", "INVALID")
+		h.rejectRequest(ctx, leavingClientID, "LEAVE_ALL_ROOMS", err)
 		return
 	}
 
-	if len(request.RoomName) == 0 || len(request.RoomName) > h.cfg.MaxRoomNameLength {
-		h.sendInvalidAndDisconnect(ctx, requestingClientID, "INVALID", "INVALID")
+	roomsLeft := len(h.clientRooms[leavingClientID])
+	h.leaveAllJoinedRoomsWithNotification(ctx, leavingClientID, leavingUsername)
+
+	h.sendResponse(ctx, leavingClientID, protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: "LEAVE_ALL_ROOMS",
+		Result:    protocol.ResultSuccess,
+		Extra:     strconv.Itoa(roomsLeft),
+	})
+}
+
+// handleMyInvites lists the rooms the client was invited to and has not
+// joined yet, sorted by name.
+func (h *Hub) handleMyInvites(
+	ctx context.Context,
+	clientID ClientID,
+	envelope protocol.Envelope,
+) {
+	_, err := protocol.DecodeMyInvites(envelope)
+	if err != nil {
+		h.rejectRequest(ctx, clientID, "MY_INVITES", err)
 		return
 	}
 
-	room, exists := h.rooms[request.RoomName]
-	if !exists {
-		h.sendResponse(ctx, requestingClientID, protocol.ResponseMessage{
-			Type:      protocol.TypeResponse,
-			Operation: "ROOM_USERS",
-			Result:    "NO_SUCH_ROOM",
-			Extra:     request.RoomName,
-		})
-		return
+	roomNames := make([]string, 0, len(h.clientInvites[clientID]))
+	for roomKey := range h.clientInvites[clientID] {
+		if room, exists := h.rooms[roomKey]; exists {
+			roomNames = append(roomNames, room.name)
+		}
 	}
+	slices.Sort(roomNames)
 
-	if _, isMember := room.members[requestingClientID]; !isMember {
-		h.sendResponse(ctx, requestingClientID, protocol.ResponseMessage{
-			Type:      protocol.TypeResponse,
-			Operation: "ROOM_USERS",
-			Result:    "NOT_JOINED",
-			Extra:     request.RoomName,
-		})
+	h.sendMessage(ctx, clientID, protocol.MyInvitesResultMessage{
+		Type:  protocol.TypeMyInvitesResult,
+		Rooms: roomNames,
+	})
+}
+
+// sendMembershipSnapshot tells a client which rooms it is currently in.
+func (h *Hub) sendMembershipSnapshot(ctx context.Context, clientID ClientID) {
+	// clientRooms holds room names as created, not room keys.
+	roomNames := make([]string, 0, len(h.clientRooms[clientID]))
+	for roomName := range h.clientRooms[clientID] {
+		if room, exists := h.rooms[h.roomKey(roomName)]; exists {
+			roomNames = append(roomNames, room.name)
+		}
+	}
+	slices.Sort(roomNames)
+
+	h.sendMessage(ctx, clientID, protocol.RoomMembershipSnapshotMessage{
+		Type:  protocol.TypeRoomMembershipSnapshot,
+		Rooms: roomNames,
+	})
+}
+
+func (h *Hub) handleListRooms(
+	ctx context.Context,
+	requestingClientID ClientID,
+	envelope protocol.Envelope,
+) {
+	_, err := protocol.DecodeListRooms(envelope)
+	if err != nil {
+		h.rejectRequest(ctx, requestingClientID, "LIST_ROOMS", err)
 		return
 	}
 
-	roomUsersSnapshot := make(map[string]protocol.Status, len(room.members))
-	for memberClientID := range room.members {
-		memberUsername, isIdentified := h.clientUser[memberClientID]
-		if !isIdentified {
-			// Defensive: members should always be identified.
+	roomsSnapshot := make(map[string]int, len(h.rooms))
+	for _, room := range h.rooms {
+		if !h.isRoomVisibleTo(room, requestingClientID) {
 			continue
 		}
-
-		memberStatus, hasStatus := h.clientStatus[memberClientID]
-		if !hasStatus {
-			memberStatus = protocol.StatusActive
-		}
-
-		roomUsersSnapshot[memberUsername] = memberStatus
+		roomsSnapshot[room.name] = len(room.members)
 	}
 
-	roomUserListFrame := protocol.MustMarshal(protocol.RoomUserListMessage{
-		Type:     protocol.TypeRoomUserList,
-		RoomName: request.RoomName,
-		Users:    roomUsersSnapshot,
+	h.sendMessage(ctx, requestingClientID, protocol.RoomListMessage{
+		Type:  protocol.TypeRoomList,
+		Rooms: roomsSnapshot,
 	})
-
-	h.sendFrame(ctx, requestingClientID, roomUserListFrame)
 }
 
-func (h *Hub) handleRoomText(
+// handleTyping relays a typing hint to room members or a private chat peer.
+// Hints are ephemeral: they are never acknowledged, unknown targets are
+// silently ignored, and delivery is best-effort.
+func (h *Hub) handleTyping(
 	ctx context.Context,
 	senderClientID ClientID,
 	senderUsername string,
 	envelope protocol.Envelope,
 ) {
-	request, err := protocol.DecodeRoomText(envelope)
-	if err != nil {
-		h.sendInvalidAndDisconnect(ctx, senderClientID, "INVALID", "INVALID")
+	request, err := protocol.DecodeTyping(envelope)
+	if errors.Is(err, protocol.ErrRecoverable) {
+		// TYPING is never answered, not even when it is invalid.
 		return
 	}
-
-	if len(request.RoomName) == 0 || len(request.RoomName) > h.cfg.MaxRoomNameLength {
-		h.sendInvalidAndDisconnect(ctx, senderClientID, "INVALID", "INVALID")
+	if err != nil {
+		h.rejectRequest(ctx, senderClientID, "TYPING", err)
 		return
 	}
 
-	room, exists := h.rooms[request.RoomName]
-	if !exists {
-		h.sendResponse(ctx, senderClientID, protocol.ResponseMessage{
-			Type:      protocol.TypeResponse,
-			Operation: "ROOM_TEXT",
-			Result:    "NO_SUCH_ROOM",
-			Extra:     request.RoomName,
-		})
+	if request.RoomName == "" {
+		recipientClientID, exists := h.usernameOwner[h.usernameKey(request.Username)]
+		if !exists || recipientClientID == senderClientID {
+			return
+		}
+		h.sendEphemeralFrame(ctx, recipientClientID, protocol.MustMarshal(protocol.TypingFromMessage{
+			Type:     protocol.TypeTypingFrom,
+			Username: senderUsername,
+		}))
 		return
 	}
 
-	if _, isMember := room.members[senderClientID]; !isMember {
-		h.sendResponse(ctx, senderClientID, protocol.ResponseMessage{
-			Type:      protocol.TypeResponse,
-			Operation: "ROOM_TEXT",
-			Result:    "NOT_JOINED",
-			Extra:     request.RoomName,
-		})
+	room, exists := h.rooms[h.roomKey(request.RoomName)]
+	if !exists || !h.isRoomMember(room, senderClientID) {
 		return
 	}
 
-	roomTextFrame := protocol.MustMarshal(protocol.RoomTextFromMessage{
-		Type:     protocol.TypeRoomTextFrom,
-		RoomName: request.RoomName,
+	typingFrame := protocol.MustMarshal(protocol.TypingFromMessage{
+		Type:     protocol.TypeTypingFrom,
+		RoomName: room.name,
 		Username: senderUsername,
-		Text:     request.Text,
 	})
 
 	for memberClientID := range room.members {
 		if memberClientID == senderClientID {
 			continue
 		}
-		h.sendFrame(ctx, memberClientID, roomTextFrame)
+		if _, isMuted := room.muted[memberClientID]; isMuted {
+			continue
+		}
+		h.sendEphemeralFrame(ctx, memberClientID, typingFrame)
 	}
 }
 
-func (h *Hub) handleLeaveRoom(
+func (h *Hub) handleMuteRoom(
 	ctx context.Context,
-	leavingClientID ClientID,
-	leavingUsername string,
+	clientID ClientID,
 	envelope protocol.Envelope,
 ) {
-	request, err := protocol.DecodeLeaveRoom(envelope)
+	request, err := protocol.DecodeMuteRoom(envelope)
 	if err != nil {
-		h.sendInvalidAndDisconnect(ctx, leavingClientID, "INVALID", "INVALID")
+		h.rejectRequest(ctx, clientID, "MUTE_ROOM", err)
 		return
 	}
 
-	if len(request.RoomName) == 0 || len(request.RoomName) > h.cfg.MaxRoomNameLength {
-		h.sendInvalidAndDisconnect(ctx, leavingClientID, "INVALID", "INVALID")
+	h.setRoomMuted(ctx, clientID, "MUTE_ROOM", request.RoomName, true)
+}
+
+func (h *Hub) handleUnmuteRoom(
+	ctx context.Context,
+	clientID ClientID,
+	envelope protocol.Envelope,
+) {
+	request, err := protocol.DecodeUnmuteRoom(envelope)
+	if err != nil {
+		h.rejectRequest(ctx, clientID, "UNMUTE_ROOM", err)
+		return
+	}
+
+	h.setRoomMuted(ctx, clientID, "UNMUTE_ROOM", request.RoomName, false)
+}
+
+// setRoomMuted toggles whether a member receives ROOM_TEXT_FROM for a room.
+func (h *Hub) setRoomMuted(
+	ctx context.Context,
+	clientID ClientID,
+	operation string,
+	roomName string,
+	muted bool,
+) {
+	if len(roomName) > h.cfg.MaxRoomNameLength {
+		h.sendInvalidAndDisconnect(ctx, clientID, "INVALID", protocol.ResultInvalid)
 		return
 	}
 
-	room, exists := h.rooms[request.RoomName]
+	room, exists := h.rooms[h.roomKey(roomName)]
 	if !exists {
-		h.sendResponse(ctx, leavingClientID, protocol.ResponseMessage{
-			Type:      protocol.TypeResponse,
-			Operation: "LEAVE_ROOM",
-			Result:    "NO_SUCH_ROOM",
-			Extra:     request.RoomName,
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: operation,
+			Result:    protocol.ResultNoSuchRoom,
+			Extra:     roomName,
 		})
 		return
 	}
 
-	if _, isMember := room.members[leavingClientID]; !isMember {
-		h.sendResponse(ctx, leavingClientID, protocol.ResponseMessage{
+	if !h.isRoomMember(room, clientID) {
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
 			Type:      protocol.TypeResponse,
-			Operation: "LEAVE_ROOM",
-			Result:    "NOT_JOINED",
-			Extra:     request.RoomName,
+			Operation: operation,
+			Result:    protocol.ResultNotJoined,
+			Extra:     roomName,
 		})
 		return
 	}
 
-	// Remove membership.
-	delete(room.members, leavingClientID)
-
-	// Update reverse index.
-	clientRoomSet, hasClientRooms := h.clientRooms[leavingClientID]
-	if hasClientRooms {
-		delete(clientRoomSet, request.RoomName)
-		if len(clientRoomSet) == 0 {
-			delete(h.clientRooms, leavingClientID)
-		}
+	if muted {
+		room.muted[clientID] = struct{}{}
+	} else {
+		delete(room.muted, clientID)
 	}
 
-	leftFrame := protocol.MustMarshal(protocol.LeftRoomMessage{
-		Type:     protocol.TypeLeftRoom,
-		RoomName: request.RoomName,
-		Username: leavingUsername,
+	h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: operation,
+		Result:    protocol.ResultSuccess,
+		Extra:     roomName,
 	})
-
-	// Broadcast to remaining room members (sender excluded because they already left).
-	for memberClientID := range room.members {
-		h.sendFrame(ctx, memberClientID, leftFrame)
-	}
-
-	h.deleteRoomIfEmpty(request.RoomName, room)
 }
 
 func (h *Hub) handleDisconnect(
@@ -708,20 +2351,25 @@ func (h *Hub) handleDisconnect(
 	username string,
 	envelope protocol.Envelope,
 ) {
-	_, err := protocol.DecodeDisconnect(envelope)
+	request, err := protocol.DecodeDisconnect(envelope)
 	if err != nil {
-		h.sendInvalidAndDisconnect(ctx, clientID, "INVALID", "INVALID")
+		h.rejectRequest(ctx, clientID, "DISCONNECT", err)
 		return
 	}
 
-	h.forceDisconnect(ctx, clientID, fmt.Sprintf("client requested disconnect (user=%s)", username))
+	h.forceDisconnect(
+		ctx,
+		clientID,
+		fmt.Sprintf("client requested disconnect (user=%s)", username),
+		request.Reason,
+	)
 }
 
 func (h *Hub) sendInvalidAndDisconnect(
 	ctx context.Context,
 	clientID ClientID,
 	operation string,
-	result string,
+	result protocol.ResultCode,
 ) {
 	h.sendResponse(ctx, clientID, protocol.ResponseMessage{
 		Type:      protocol.TypeResponse,
@@ -733,9 +2381,173 @@ func (h *Hub) sendInvalidAndDisconnect(
 		ctx,
 		clientID,
 		fmt.Sprintf("protocol violation: operation=%s result=%s", operation, result),
+		protocol.DisconnectReasonProtocolViolation,
 	)
 }
 
+// countFailedIdentify records a rejected IDENTIFY that left the connection
+// open, and disconnects the client once it reaches MaxIdentifyAttempts.
+func (h *Hub) countFailedIdentify(ctx context.Context, clientID ClientID) {
+	if h.cfg.MaxIdentifyAttempts <= 0 {
+		return
+	}
+	if _, connected := h.clients[clientID]; !connected {
+		return
+	}
+
+	h.identifyAttempts[clientID]++
+	if h.identifyAttempts[clientID] >= h.cfg.MaxIdentifyAttempts {
+		h.sendInvalidAndDisconnect(ctx, clientID, "IDENTIFY", protocol.ResultTooManyAttempts)
+	}
+}
+
+// statusesOnly reduces presences to the bare statuses listed to clients
+// older than VersionStatusMessages.
+func statusesOnly(presences map[string]protocol.UserPresence) map[string]protocol.Status {
+	statuses := make(map[string]protocol.Status, len(presences))
+	for username, presence := range presences {
+		statuses[username] = presence.Status
+	}
+	return statuses
+}
+
+// sortedUserEntries lists presences sorted by username, for clients
+// speaking VersionSortedUserLists or later.
+func sortedUserEntries(presences map[string]protocol.UserPresence) []protocol.SortedUserEntry {
+	entries := make([]protocol.SortedUserEntry, 0, len(presences))
+	for _, username := range slices.Sorted(maps.Keys(presences)) {
+		entries = append(entries, protocol.SortedUserEntry{
+			Username: username,
+			Status:   presences[username].Status,
+			Message:  presences[username].Message,
+		})
+	}
+	return entries
+}
+
+// batchResult summarizes an operation addressing several users, of which
+// unresolved could not be found.
+func batchResult(requested int, unresolved int) protocol.ResultCode {
+	switch unresolved {
+	case 0:
+		return protocol.ResultSuccess
+	case requested:
+		return protocol.ResultNoSuchUser
+	default:
+		return protocol.ResultPartialSuccess
+	}
+}
+
+// rejectRequest answers a request that failed decoding or validation.
+// Recoverable errors are reported to the client and the connection is kept;
+// anything else is a protocol violation and disconnects the client.
+func (h *Hub) rejectRequest(
+	ctx context.Context,
+	clientID ClientID,
+	operation string,
+	err error,
+) {
+	switch {
+	case errors.Is(err, protocol.ErrTextTooLong):
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: operation,
+			Result:    protocol.ResultTextTooLong,
+		})
+
+	case errors.Is(err, protocol.ErrInvalidUTF8):
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: operation,
+			Result:    protocol.ResultInvalidUTF8,
+		})
+
+	case errors.Is(err, protocol.ErrMetaTooLarge):
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: operation,
+			Result:    protocol.ResultMetaTooLarge,
+		})
+
+	case errors.Is(err, protocol.ErrRecoverable):
+		h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+			Type:      protocol.TypeResponse,
+			Operation: operation,
+			Result:    protocol.ResultInvalid,
+		})
+
+	default:
+		h.rejectMalformed(ctx, clientID)
+	}
+}
+
+// rejectMalformed answers a frame that is not valid protocol with INVALID.
+// The client is disconnected unless MaxProtocolViolations tolerates one
+// more malformed frame in a row.
+func (h *Hub) rejectMalformed(ctx context.Context, clientID ClientID) {
+	stats, exists := h.clientStats[clientID]
+	if !exists || stats.protocolViolations >= h.cfg.MaxProtocolViolations {
+		h.sendInvalidAndDisconnect(ctx, clientID, "INVALID", protocol.ResultInvalid)
+		return
+	}
+
+	stats.protocolViolations++
+	h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: "INVALID",
+		Result:    protocol.ResultInvalid,
+	})
+}
+
+// textRules returns the validation rules for messaging text fields.
+func (h *Hub) textRules() protocol.TextRules {
+	return protocol.TextRules{
+		MaxLength:   h.cfg.MaxTextLength,
+		RequireUTF8: h.cfg.ValidateUTF8,
+	}
+}
+
+// usernameKey returns the key under which a username is stored in
+// usernameOwner. With case-insensitive usernames, "Bob" and "bob" share a key.
+func (h *Hub) usernameKey(username string) string {
+	if h.cfg.CaseInsensitiveUsernames {
+		return strings.ToLower(username)
+	}
+	return username
+}
+
+// roomKey returns the key of a room name in h.rooms. The room keeps its
+// name as created for display.
+func (h *Hub) roomKey(roomName string) string {
+	if h.cfg.CaseInsensitiveRooms {
+		return strings.ToLower(roomName)
+	}
+	return roomName
+}
+
+// mentionedUsernames returns the usernameKey of every "@username" mention
+// in text. Punctuation right after a mention ("@bob,") is not part of it.
+func (h *Hub) mentionedUsernames(text string) map[string]struct{} {
+	var mentioned map[string]struct{}
+	for _, word := range strings.Fields(text) {
+		username, isMention := strings.CutPrefix(word, "@")
+		if !isMention {
+			continue
+		}
+
+		username = strings.TrimRight(username, ".,:;!?)")
+		if username == "" {
+			continue
+		}
+
+		if mentioned == nil {
+			mentioned = make(map[string]struct{})
+		}
+		mentioned[h.usernameKey(username)] = struct{}{}
+	}
+	return mentioned
+}
+
 func (h *Hub) ensureClientRoomSet(clientID ClientID) map[string]struct{} {
 	existingSet, exists := h.clientRooms[clientID]
 	if exists {
@@ -752,21 +2564,191 @@ func (h *Hub) isRoomMember(room *RoomState, clientID ClientID) bool {
 	return isMember
 }
 
+// isRoomVisibleTo reports whether a room should be listed to a client.
+func (h *Hub) isRoomVisibleTo(room *RoomState, clientID ClientID) bool {
+	if room.public || h.isRoomMember(room, clientID) {
+		return true
+	}
+	_, isInvited := room.invited[clientID]
+	return isInvited
+}
+
 func (h *Hub) broadcastToRoomMembers(
 	ctx context.Context,
 	room *RoomState,
 	frame []byte,
 ) {
 	for memberClientID := range room.members {
+		if ctx.Err() != nil {
+			return
+		}
 		h.sendFrame(ctx, memberClientID, frame)
 	}
 }
 
-func (h *Hub) deleteRoomIfEmpty(roomName string, room *RoomState) {
-	if len(room.members) != 0 {
+// allowFrameBytes applies ClientByteBudget to an inbound frame. A refused
+// frame is answered with RATE_LIMITED, and the client is disconnected once
+// MaxByteBudgetViolations frames in a row were refused.
+func (h *Hub) allowFrameBytes(
+	ctx context.Context,
+	clientID ClientID,
+	messageType protocol.MessageType,
+	frameBytes int,
+) bool {
+	stats, exists := h.clientStats[clientID]
+	if h.cfg.ClientByteBudget <= 0 || !exists {
+		return true
+	}
+
+	window := time.Duration(h.cfg.ClientByteWindowSecs) * time.Second
+	if stats.received.allow(time.Now(), frameBytes, h.cfg.ClientByteBudget, window) {
+		stats.budgetViolations = 0
+		return true
+	}
+
+	stats.budgetViolations++
+	if h.cfg.MaxByteBudgetViolations > 0 && stats.budgetViolations >= h.cfg.MaxByteBudgetViolations {
+		h.forceDisconnect(ctx, clientID, "byte budget exceeded", protocol.DisconnectReasonRateLimited)
+		return false
+	}
+
+	h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: string(messageType),
+		Result:    protocol.ResultRateLimited,
+	})
+	return false
+}
+
+// allowRoomMessage applies the per-room, per-sender ROOM_TEXT rate limit.
+func (h *Hub) allowRoomMessage(room *RoomState, senderClientID ClientID) bool {
+	if h.cfg.RoomMessagesPerSecond <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	limiter, exists := room.rateLimiters[senderClientID]
+	if !exists {
+		limiter = newTokenBucket(h.cfg.RoomMessagesPerSecond, now)
+		room.rateLimiters[senderClientID] = limiter
+	}
+	return limiter.allow(now)
+}
+
+// rejectIfTooManyRooms answers TOO_MANY_ROOMS and returns true when the
+// client already belongs to MaxRoomsPerUser rooms.
+func (h *Hub) rejectIfTooManyRooms(
+	ctx context.Context,
+	clientID ClientID,
+	operation string,
+	roomName string,
+) bool {
+	joinedRooms := len(h.clientRooms[clientID])
+	if h.cfg.MaxRoomsPerUser <= 0 || joinedRooms < h.cfg.MaxRoomsPerUser {
+		return false
+	}
+
+	h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: operation,
+		Result:    protocol.ResultTooManyRooms,
+		Extra:     roomName,
+		Capacity: &protocol.CapacityHint{
+			Current: joinedRooms,
+			Max:     h.cfg.MaxRoomsPerUser,
+		},
+	})
+	return true
+}
+
+// rejectIfServerRoomLimit refuses to create a room once MaxTotalRooms
+// rooms exist. Rooms are deleted when their last member leaves, which
+// frees capacity again.
+func (h *Hub) rejectIfServerRoomLimit(
+	ctx context.Context,
+	clientID ClientID,
+	operation string,
+	roomName string,
+) bool {
+	if h.cfg.MaxTotalRooms <= 0 || len(h.rooms) < h.cfg.MaxTotalRooms {
+		return false
+	}
+
+	h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: operation,
+		Result:    protocol.ResultServerRoomLimit,
+		Extra:     roomName,
+		Capacity: &protocol.CapacityHint{
+			Current: len(h.rooms),
+			Max:     h.cfg.MaxTotalRooms,
+		},
+	})
+	return true
+}
+
+// rejectIfRoomFull answers ROOM_FULL and returns true when the room has
+// reached the configured member limit. Only joined members take a slot;
+// pending invitations do not.
+func (h *Hub) rejectIfRoomFull(
+	ctx context.Context,
+	clientID ClientID,
+	operation string,
+	room *RoomState,
+) bool {
+	if h.cfg.MaxRoomMembers <= 0 || len(room.members) < h.cfg.MaxRoomMembers {
+		return false
+	}
+
+	h.sendResponse(ctx, clientID, protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: operation,
+		Result:    protocol.ResultRoomFull,
+		Extra:     room.name,
+		Capacity: &protocol.CapacityHint{
+			Current: len(room.members),
+			Max:     h.cfg.MaxRoomMembers,
+		},
+	})
+	return true
+}
+
+// sendRoomHistory replays the recent messages of a room to a client.
+func (h *Hub) sendRoomHistory(ctx context.Context, clientID ClientID, room *RoomState) {
+	if room.history == nil {
+		return
+	}
+
+	h.sendMessage(ctx, clientID, protocol.RoomHistoryMessage{
+		Type:     protocol.TypeRoomHistory,
+		RoomName: room.name,
+		Messages: room.history.snapshot(),
+	})
+}
+
+// deleteRoomIfEmpty deletes a room nobody is a member of. With
+// EmptyRoomTTLSecs set, the room is only marked empty and left for
+// expireEmptyRooms, so its invitations and history survive a brief absence.
+func (h *Hub) deleteRoomIfEmpty(room *RoomState) {
+	if len(room.members) != 0 || len(room.absentMembers) != 0 {
+		return
+	}
+	if h.cfg.EmptyRoomTTLSecs > 0 {
+		if room.emptySince.IsZero() {
+			room.emptySince = time.Now()
+		}
 		return
 	}
-	delete(h.rooms, roomName)
+	h.deleteRoom(room)
+}
+
+// deleteRoom removes a room along with its pending invitations.
+func (h *Hub) deleteRoom(room *RoomState) {
+	for invitedClientID := range room.invited {
+		h.removeInvitation(room, invitedClientID)
+	}
+	room.history = nil
+	delete(h.rooms, h.roomKey(room.name))
 }
 
 func (h *Hub) sendResponse(
@@ -774,7 +2756,23 @@ func (h *Hub) sendResponse(
 	clientID ClientID,
 	message protocol.ResponseMessage,
 ) {
-	h.sendFrame(ctx, clientID, protocol.MustMarshal(message))
+	h.sendMessage(ctx, clientID, message)
+}
+
+// sendMessage encodes and sends a message built from dynamic data.
+// An encoding failure disconnects only the affected client instead of
+// panicking the hub goroutine.
+func (h *Hub) sendMessage(ctx context.Context, clientID ClientID, message any) {
+	frame, err := protocol.Marshal(message)
+	if err != nil {
+		h.requestUnregisterNonBlocking(
+			clientID,
+			fmt.Sprintf("encode failed: %v", err),
+			protocol.DisconnectReasonSendFailed,
+		)
+		return
+	}
+	h.sendFrame(ctx, clientID, frame)
 }
 
 func (h *Hub) sendFrame(ctx context.Context, clientID ClientID, frame []byte) {
@@ -784,17 +2782,76 @@ func (h *Hub) sendFrame(ctx context.Context, clientID ClientID, frame []byte) {
 	}
 
 	if err := writer.Send(ctx, frame); err != nil {
+		h.recordDroppedFrame(clientID, frame)
 		// Fail closed on outbound delivery issues to avoid leaking resources
 		// and to keep hub state consistent.
 		// Avoid blocking the hub if the unregister channel is full.
-		h.requestUnregisterNonBlocking(clientID, fmt.Sprintf("send failed: %v", err))
+		h.requestUnregisterNonBlocking(
+			clientID,
+			fmt.Sprintf("send failed: %v", err),
+			protocol.DisconnectReasonSendFailed,
+		)
+	}
+}
+
+// sendMentionFrame delivers a message that mentions the recipient through
+// the priority queue, so it still arrives when the regular queue is full.
+// Once the priority queue is full too, it falls back to regular delivery.
+func (h *Hub) sendMentionFrame(ctx context.Context, clientID ClientID, frame []byte) {
+	writer, exists := h.clients[clientID]
+	if !exists {
+		return
+	}
+
+	priorityWriter, hasPriority := writer.(PriorityClientWriter)
+	if !hasPriority || priorityWriter.SendPriority(ctx, frame) != nil {
+		h.sendFrame(ctx, clientID, frame)
+	}
+}
+
+// sendMembershipFrame delivers a JOINED_ROOM or LEFT_ROOM frame. Missing
+// one leaves the client's room roster wrong, so it takes the priority path
+// when the client offers one.
+func (h *Hub) sendMembershipFrame(ctx context.Context, clientID ClientID, frame []byte) {
+	writer, exists := h.clients[clientID]
+	if !exists {
+		return
+	}
+
+	priorityWriter, hasPriority := writer.(PriorityClientWriter)
+	if !hasPriority {
+		h.sendFrame(ctx, clientID, frame)
+		return
+	}
+
+	if err := priorityWriter.SendPriority(ctx, frame); err != nil {
+		h.recordDroppedFrame(clientID, frame)
+		h.requestUnregisterNonBlocking(
+			clientID,
+			fmt.Sprintf("send failed: %v", err),
+			protocol.DisconnectReasonSendFailed,
+		)
+	}
+}
+
+// sendEphemeralFrame delivers a frame that is cheap to lose.
+// Unlike sendFrame, a failed send drops the frame instead of disconnecting
+// the client.
+func (h *Hub) sendEphemeralFrame(ctx context.Context, clientID ClientID, frame []byte) {
+	writer, exists := h.clients[clientID]
+	if !exists {
+		return
+	}
+	if err := writer.Send(ctx, frame); err != nil {
+		h.recordDroppedFrame(clientID, frame)
 	}
 }
 
-func (h *Hub) requestUnregisterNonBlocking(clientID ClientID, reason string) {
+func (h *Hub) requestUnregisterNonBlocking(clientID ClientID, reason string, relayedReason string) {
 	unregisterEvent := UnregisterEvent{
-		ClientID: clientID,
-		Reason:   reason,
+		ClientID:      clientID,
+		Reason:        reason,
+		RelayedReason: relayedReason,
 	}
 
 	select {
@@ -803,19 +2860,50 @@ func (h *Hub) requestUnregisterNonBlocking(clientID ClientID, reason string) {
 	default:
 		// If the queue is full, avoid blocking the hub.
 		// Fail closed and disconnect immediately.
-		h.forceDisconnect(context.Background(), clientID, reason)
+		h.forceDisconnect(context.Background(), clientID, reason, relayedReason)
 	}
 }
 
+// broadcastExcept sends frame to every client except exceptClientID.
+//
+// Like the other fan-out loops, it stops early once ctx is canceled: the
+// server is shutting down and closeAll is about to drop every connection,
+// so the remaining sends would be wasted. Only sends are skipped; hub
+// state is already up to date when a fan-out starts.
 func (h *Hub) broadcastExcept(
 	ctx context.Context,
 	exceptClientID ClientID,
 	frame []byte,
 ) {
 	for clientID := range h.clients {
+		if ctx.Err() != nil {
+			return
+		}
+		if clientID == exceptClientID {
+			continue
+		}
+		h.sendFrame(ctx, clientID, frame)
+	}
+}
+
+// broadcastPresence sends a presence event (NEW_USER, NEW_STATUS or
+// DISCONNECTED) to every client except exceptClientID and those that
+// opted out of presence notifications.
+func (h *Hub) broadcastPresence(
+	ctx context.Context,
+	exceptClientID ClientID,
+	frame []byte,
+) {
+	for clientID := range h.clients {
+		if ctx.Err() != nil {
+			return
+		}
 		if clientID == exceptClientID {
 			continue
 		}
+		if _, optedOut := h.presenceOptOut[clientID]; optedOut {
+			continue
+		}
 		h.sendFrame(ctx, clientID, frame)
 	}
 }
@@ -836,14 +2924,14 @@ func (h *Hub) leaveAllJoinedRoomsWithNotification(
 	}
 
 	for _, roomName := range roomNames {
-		room, exists := h.rooms[roomName]
+		room, exists := h.rooms[h.roomKey(roomName)]
 		if !exists {
 			continue
 		}
 
 		// Remove membership first, then notify remaining members.
-		delete(room.members, leavingClientID)
-		delete(room.invited, leavingClientID)
+		room.removeMember(leavingClientID)
+		h.removeInvitation(room, leavingClientID)
 
 		leftRoomFrame := protocol.MustMarshal(protocol.LeftRoomMessage{
 			Type:     protocol.TypeLeftRoom,
@@ -852,52 +2940,138 @@ func (h *Hub) leaveAllJoinedRoomsWithNotification(
 		})
 
 		for remainingMemberClientID := range room.members {
-			h.sendFrame(ctx, remainingMemberClientID, leftRoomFrame)
+			h.sendMembershipFrame(ctx, remainingMemberClientID, leftRoomFrame)
 		}
 
-		h.deleteRoomIfEmpty(roomName, room)
+		h.deleteRoomIfEmpty(room)
 	}
 
 	delete(h.clientRooms, leavingClientID)
 }
 
-func (h *Hub) forceDisconnect(ctx context.Context, clientID ClientID, reason string) {
+// forceDisconnect removes a client and all of its state. The reason is
+// logged, while relayedReason is sent to other users in DISCONNECTED.
+func (h *Hub) forceDisconnect(
+	ctx context.Context,
+	clientID ClientID,
+	reason string,
+	relayedReason string,
+) {
+	username := h.clientUser[clientID]
+	delete(h.pendingAuth, clientID)
+	delete(h.identifyAttempts, clientID)
+
 	writer, exists := h.clients[clientID]
 	if !exists {
+		// A detached session has no connection left, but deliberate
+		// disconnects such as kicks must still release it.
+		if h.isDetached(clientID) && !isInvoluntaryDisconnect(relayedReason) {
+			h.releaseClientState(ctx, clientID, relayedReason)
+			h.logger.Printf("detached session released: id=%s reason=%s", clientID, reason)
+			h.recordAudit(audit.Event{
+				Event:    audit.EventDisconnect,
+				ClientID: string(clientID),
+				Username: username,
+				Reason:   reason,
+			})
+		}
+		return
+	}
+
+	detached := h.detachSession(clientID, relayedReason)
+	if !detached {
+		h.releaseClientState(ctx, clientID, relayedReason)
+	}
+
+	remoteAddr := h.clientAddr[clientID]
+	statsSummary := h.clientStatsSummary(clientID)
+	// Tell slow readers apart from other send failures.
+	if stats, hasStats := h.clientStats[clientID]; hasStats &&
+		relayedReason == protocol.DisconnectReasonSendFailed {
+		h.logger.Printf(
+			"send failure disconnect: id=%s addr=%s %s",
+			clientID, remoteAddr, stats.dropSummary(),
+		)
+	}
+	delete(h.clients, clientID)
+	delete(h.clientAddr, clientID)
+	delete(h.clientConnectedAt, clientID)
+	delete(h.clientStats, clientID)
+
+	if err := writer.Close(); err != nil {
+		h.logger.Printf("client close error: %v", err)
+	}
+
+	h.recordAudit(audit.Event{
+		Event:      audit.EventDisconnect,
+		ClientID:   string(clientID),
+		Username:   username,
+		RemoteAddr: remoteAddr,
+		Reason:     reason,
+	})
+
+	if detached {
+		h.logger.Printf(
+			"client detached: id=%s addr=%s reason=%s stats: %s",
+			clientID, remoteAddr, reason, statsSummary,
+		)
 		return
 	}
+	h.logger.Printf(
+		"client disconnected: id=%s addr=%s reason=%s stats: %s",
+		clientID, remoteAddr, reason, statsSummary,
+	)
+}
 
+// releaseClientState removes every trace of a client from the hub state,
+// notifying its rooms and other users according to the protocol.
+// It does not touch the client's connection.
+func (h *Hub) releaseClientState(ctx context.Context, clientID ClientID, relayedReason string) {
 	username, hadUser := h.clientUser[clientID]
 
 	// Notify others according to the protocol before removing state.
 	if hadUser {
 		h.leaveAllJoinedRoomsWithNotification(ctx, clientID, username)
+		h.dropPendingInvitations(clientID)
 
 		disconnectedFrame := protocol.MustMarshal(protocol.DisconnectedMessage{
 			Type:     protocol.TypeDisconnected,
 			Username: username,
+			Reason:   relayedReason,
 		})
 
-		h.broadcastExcept(ctx, clientID, disconnectedFrame)
+		h.broadcastPresence(ctx, clientID, disconnectedFrame)
 	} else {
 		// If the client never identified, it cannot be in rooms by protocol,
 		// and DISCONNECTED cannot be formed (no username).
 		delete(h.clientRooms, clientID)
 	}
 
-	delete(h.clients, clientID)
+	if hadUser {
+		h.holdUsername(clientID, username)
+	}
+
 	delete(h.clientUser, clientID)
 	delete(h.clientStatus, clientID)
+	delete(h.clientStatusMessage, clientID)
+	delete(h.clientVersion, clientID)
+	delete(h.presenceOptOut, clientID)
+	h.revokeReconnectToken(clientID)
 
 	if hadUser {
-		delete(h.usernameOwner, username)
+		delete(h.usernameOwner, h.usernameKey(username))
+		h.observer.OnDisconnect(clientID, username, relayedReason)
 	}
+}
 
-	if err := writer.Close(); err != nil {
-		h.logger.Printf("client close error: %v", err)
+// dropPendingInvitations rescinds every invitation clientID still holds.
+func (h *Hub) dropPendingInvitations(clientID ClientID) {
+	for roomKey := range h.clientInvites[clientID] {
+		if room, exists := h.rooms[roomKey]; exists {
+			h.removeInvitation(room, clientID)
+		}
 	}
-
-	h.logger.Printf("client disconnected: id=%s reason=%s", clientID, reason)
+	delete(h.clientInvites, clientID)
 }
 
 func (h *Hub) closeAll(reason string) {
@@ -905,6 +3079,6 @@ func (h *Hub) closeAll(reason string) {
 	ctx := context.Background()
 
 	for clientID := range h.clients {
-		h.forceDisconnect(ctx, clientID, reason)
+		h.forceDisconnect(ctx, clientID, reason, protocol.DisconnectReasonServerShutdown)
 	}
 }
@@ -0,0 +1,2914 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chat-server/internal/config"
+	"chat-server/internal/protocol"
+)
+
+// recordingWriter is a ClientWriter that keeps every frame sent to it.
+type recordingWriter struct {
+	mu      sync.Mutex
+	frames  [][]byte
+	closed  bool
+	sendErr error
+}
+
+func (w *recordingWriter) Send(_ context.Context, frame []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.sendErr != nil {
+		return w.sendErr
+	}
+	w.frames = append(w.frames, append([]byte(nil), frame...))
+	return nil
+}
+
+func (w *recordingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	return nil
+}
+
+// take returns the frames recorded so far and forgets them.
+func (w *recordingWriter) take() [][]byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	frames := w.frames
+	w.frames = nil
+	return frames
+}
+
+// lockedBuffer is a bytes.Buffer safe for the hub logger and the test
+// goroutine to use together.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// testHub drives a Hub from the test goroutine, standing in for Run so
+// every event is handled before the call that caused it returns.
+type testHub struct {
+	t       *testing.T
+	hub     *Hub
+	ctx     context.Context
+	logs    *lockedBuffer
+	writers map[ClientID]*recordingWriter
+}
+
+// newTestHub creates a hub with the default configuration, adjusted by
+// configure when it is not nil.
+func newTestHub(t *testing.T, configure func(*config.Config)) *testHub {
+	t.Helper()
+
+	cfg, err := config.FromEnv()
+	if err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	return newTestHubFrom(t, cfg, nil, nil, nil)
+}
+
+// newTestHubFrom creates a hub from cfg and the given collaborators, any
+// of which may be nil like in New.
+func newTestHubFrom(
+	t *testing.T,
+	cfg config.Config,
+	observer HubObserver,
+	auditLogger AuditLogger,
+	authenticator Authenticator,
+) *testHub {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	logs := &lockedBuffer{}
+	return &testHub{
+		t:       t,
+		hub:     New(log.New(logs, "", 0), cfg, observer, auditLogger, authenticator),
+		ctx:     ctx,
+		logs:    logs,
+		writers: make(map[ClientID]*recordingWriter),
+	}
+}
+
+// connect registers a new client and returns its writer.
+func (th *testHub) connect(clientID ClientID) *recordingWriter {
+	writer := &recordingWriter{}
+	th.writers[clientID] = writer
+	th.hub.registerClient(RegisterEvent{
+		ClientID:   clientID,
+		Writer:     writer,
+		RemoteAddr: "127.0.0.1:1",
+	})
+	return writer
+}
+
+// send encodes message and delivers it as a frame from clientID.
+func (th *testHub) send(clientID ClientID, message any) {
+	th.t.Helper()
+
+	frame, err := json.Marshal(message)
+	if err != nil {
+		th.t.Fatalf("marshal %v: %v", message, err)
+	}
+	th.sendRaw(clientID, frame)
+}
+
+// sendRaw delivers frame from clientID as it was read off the wire.
+func (th *testHub) sendRaw(clientID ClientID, frame []byte) {
+	th.hub.handleInboundRecovering(th.ctx, InboundEvent{
+		ClientID: clientID,
+		Frame:    frame,
+		At:       time.Now().UTC(),
+	})
+	th.settle()
+}
+
+// settle handles the events the hub queued for itself, such as the
+// unregistration of a client whose send failed.
+func (th *testHub) settle() {
+	for {
+		select {
+		case event := <-th.hub.unregister:
+			th.hub.forceDisconnect(th.ctx, event.ClientID, event.Reason, event.RelayedReason)
+		case result := <-th.hub.authResults:
+			th.hub.handleAuthResult(th.ctx, result)
+		case message := <-th.hub.system:
+			th.hub.handleSystemMessage(th.ctx, message)
+		default:
+			return
+		}
+	}
+}
+
+// identify connects clientID and identifies it as username, then drops
+// the frames the identification produced.
+func (th *testHub) identify(clientID ClientID, username string) *recordingWriter {
+	th.t.Helper()
+
+	writer := th.connect(clientID)
+	th.send(clientID, protocol.IdentifyRequest{
+		Type:     protocol.TypeIdentify,
+		Username: username,
+	})
+	if _, identified := th.hub.clientUser[clientID]; !identified {
+		th.t.Fatalf("identify %s as %q failed: %v", clientID, username, th.drain(clientID))
+	}
+	th.drainAll()
+	return writer
+}
+
+// drain decodes and returns the frames sent to clientID since the last
+// drain.
+func (th *testHub) drain(clientID ClientID) []map[string]any {
+	th.t.Helper()
+
+	var messages []map[string]any
+	for _, frame := range th.writers[clientID].take() {
+		var message map[string]any
+		if err := json.Unmarshal(frame, &message); err != nil {
+			th.t.Fatalf("decode frame %s: %v", frame, err)
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// drainAll drops the frames sent to every client so far.
+func (th *testHub) drainAll() {
+	for _, writer := range th.writers {
+		writer.take()
+	}
+}
+
+// isConnected reports whether the hub still holds clientID's connection.
+func (th *testHub) isConnected(clientID ClientID) bool {
+	_, connected := th.hub.clients[clientID]
+	return connected
+}
+
+// messagesOfType returns the messages of the given type.
+func messagesOfType(messages []map[string]any, messageType protocol.MessageType) []map[string]any {
+	var matching []map[string]any
+	for _, message := range messages {
+		if message["type"] == string(messageType) {
+			matching = append(matching, message)
+		}
+	}
+	return matching
+}
+
+// findResponse returns the first RESPONSE to operation, failing the test
+// if there is none.
+func findResponse(t *testing.T, messages []map[string]any, operation string) map[string]any {
+	t.Helper()
+
+	for _, message := range messagesOfType(messages, protocol.TypeResponse) {
+		if message["operation"] == operation {
+			return message
+		}
+	}
+	t.Fatalf("no %s response in %v", operation, messages)
+	return nil
+}
+
+// asResponse converts a decoded RESPONSE back into a ResponseMessage.
+func asResponse(t *testing.T, message map[string]any) protocol.ResponseMessage {
+	t.Helper()
+
+	frame, err := json.Marshal(message)
+	if err != nil {
+		t.Fatalf("marshal %v: %v", message, err)
+	}
+	var response protocol.ResponseMessage
+	if err := json.Unmarshal(frame, &response); err != nil {
+		t.Fatalf("decode response %s: %v", frame, err)
+	}
+	return response
+}
+
+func TestInvalidStatusValueKeepsConnection(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+
+	th.send("alice", map[string]any{"type": protocol.TypeStatus, "status": "SLEEPING"})
+
+	response := findResponse(t, th.drain("alice"), "STATUS")
+	if response["result"] != string(protocol.ResultInvalid) {
+		t.Errorf("result = %v, want %s", response["result"], protocol.ResultInvalid)
+	}
+	if !th.isConnected("alice") {
+		t.Error("client disconnected after an invalid STATUS value")
+	}
+}
+
+func TestMalformedFrameDisconnects(t *testing.T) {
+	th := newTestHub(t, nil)
+	writer := th.identify("alice", "alice")
+
+	th.sendRaw("alice", []byte(`{"type":"STATUS","status":`))
+
+	response := findResponse(t, th.drain("alice"), "INVALID")
+	if response["result"] != string(protocol.ResultInvalid) {
+		t.Errorf("result = %v, want %s", response["result"], protocol.ResultInvalid)
+	}
+	if th.isConnected("alice") {
+		t.Error("client still connected after a malformed frame")
+	}
+	if !writer.closed {
+		t.Error("connection not closed after a malformed frame")
+	}
+}
+
+func TestProtocolViolationsTolerated(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.MaxProtocolViolations = 2
+	})
+	th.identify("alice", "alice")
+
+	for i := 0; i < 2; i++ {
+		th.sendRaw("alice", []byte(`{"type":"STATUS","status":`))
+		findResponse(t, th.drain("alice"), "INVALID")
+		if !th.isConnected("alice") {
+			t.Fatalf("disconnected after %d malformed frames, want the first 2 tolerated", i+1)
+		}
+	}
+
+	th.sendRaw("alice", []byte(`{"type":"STATUS","status":`))
+	findResponse(t, th.drain("alice"), "INVALID")
+	if th.isConnected("alice") {
+		t.Error("still connected after exceeding MaxProtocolViolations")
+	}
+}
+
+func TestValidFrameForgivesProtocolViolations(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.MaxProtocolViolations = 1
+	})
+	th.identify("alice", "alice")
+
+	for i := 0; i < 3; i++ {
+		th.sendRaw("alice", []byte(`{"type":"STATUS","status":`))
+		th.send("alice", protocol.StatusRequest{Type: protocol.TypeStatus, Status: protocol.StatusAway})
+	}
+
+	if !th.isConnected("alice") {
+		t.Error("disconnected although every malformed frame was followed by a valid one")
+	}
+}
+
+func TestSecondIdentifyIsAlreadyIdentified(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.drainAll()
+
+	th.send("alice", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "alice2"})
+
+	response := findResponse(t, th.drain("alice"), "IDENTIFY")
+	if response["result"] != string(protocol.ResultAlreadyIdentified) || response["extra"] != "alice" {
+		t.Errorf("response = %v, want %s with extra alice", response, protocol.ResultAlreadyIdentified)
+	}
+	if !th.isConnected("alice") {
+		t.Error("client disconnected after a second IDENTIFY")
+	}
+	if got := messagesOfType(th.drain("bob"), protocol.TypeNewUser); len(got) != 0 {
+		t.Errorf("second IDENTIFY announced a new user: %v", got)
+	}
+}
+
+func TestListRoomsCountsMembers(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.identify("carol", "carol")
+
+	for _, roomName := range []string{"games", "music"} {
+		th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: roomName, Public: true})
+	}
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "games"})
+	th.send("carol", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "games"})
+	th.send("carol", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "quiet", Public: true})
+	th.drainAll()
+
+	th.send("bob", protocol.ListRoomsRequest{Type: protocol.TypeListRooms})
+
+	lists := messagesOfType(th.drain("bob"), protocol.TypeRoomList)
+	if len(lists) != 1 {
+		t.Fatalf("got %d ROOM_LIST messages, want 1", len(lists))
+	}
+	want := map[string]any{"games": 3.0, "music": 1.0, "quiet": 1.0}
+	rooms, _ := lists[0]["rooms"].(map[string]any)
+	if len(rooms) != len(want) {
+		t.Errorf("rooms = %v, want %v", rooms, want)
+	}
+	for roomName, count := range want {
+		if rooms[roomName] != count {
+			t.Errorf("rooms[%q] = %v, want %v", roomName, rooms[roomName], count)
+		}
+	}
+}
+
+func TestJoinRoomVisibility(t *testing.T) {
+	tests := []struct {
+		name       string
+		public     bool
+		wantResult protocol.ResultCode
+		wantListed bool
+	}{
+		{name: "public room", public: true, wantResult: protocol.ResultSuccess, wantListed: true},
+		{name: "private room", public: false, wantResult: protocol.ResultNotInvited, wantListed: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			th := newTestHub(t, nil)
+			th.identify("alice", "alice")
+			th.identify("bob", "bob")
+			th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: test.public})
+			th.drainAll()
+
+			th.send("bob", protocol.ListRoomsRequest{Type: protocol.TypeListRooms})
+			lists := messagesOfType(th.drain("bob"), protocol.TypeRoomList)
+			if len(lists) != 1 {
+				t.Fatalf("got %d ROOM_LIST messages, want 1", len(lists))
+			}
+			rooms, _ := lists[0]["rooms"].(map[string]any)
+			if _, listed := rooms["den"]; listed != test.wantListed {
+				t.Errorf("den listed = %t, want %t", listed, test.wantListed)
+			}
+
+			th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+			response := findResponse(t, th.drain("bob"), "JOIN_ROOM")
+			if response["result"] != string(test.wantResult) {
+				t.Errorf("result = %v, want %s", response["result"], test.wantResult)
+			}
+			member := th.hub.isRoomMember(th.hub.rooms[th.hub.roomKey("den")], "bob")
+			if member != (test.wantResult == protocol.ResultSuccess) {
+				t.Errorf("bob member = %t after %v", member, response["result"])
+			}
+		})
+	}
+}
+
+func TestMOTDFollowsIdentifyResponse(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.MOTD = "welcome aboard"
+	})
+	th.connect("alice")
+
+	th.send("alice", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "alice"})
+
+	messages := th.drain("alice")
+	if len(messages) < 2 {
+		t.Fatalf("got %v, want IDENTIFY response then SERVER_NOTICE", messages)
+	}
+	if messages[0]["type"] != string(protocol.TypeResponse) ||
+		messages[0]["operation"] != "IDENTIFY" ||
+		messages[0]["result"] != string(protocol.ResultSuccess) {
+		t.Errorf("first message = %v, want IDENTIFY SUCCESS", messages[0])
+	}
+	if messages[1]["type"] != string(protocol.TypeServerNotice) || messages[1]["text"] != "welcome aboard" {
+		t.Errorf("second message = %v, want SERVER_NOTICE with the MOTD", messages[1])
+	}
+}
+
+func TestEmptyMOTDSendsNoNotice(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.MOTD = ""
+	})
+	th.connect("alice")
+
+	th.send("alice", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "alice"})
+
+	if notices := messagesOfType(th.drain("alice"), protocol.TypeServerNotice); len(notices) != 0 {
+		t.Errorf("got SERVER_NOTICE %v with no MOTD", notices)
+	}
+}
+
+func TestCaseInsensitiveUsernames(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.CaseInsensitiveUsernames = true
+	})
+	th.identify("watcher", "watcher")
+	th.connect("first")
+	th.send("first", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "BoB"})
+
+	newUsers := messagesOfType(th.drain("watcher"), protocol.TypeNewUser)
+	if len(newUsers) != 1 || newUsers[0]["username"] != "BoB" {
+		t.Errorf("NEW_USER = %v, want username BoB", newUsers)
+	}
+
+	th.connect("second")
+	th.send("second", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "bob"})
+
+	response := findResponse(t, th.drain("second"), "IDENTIFY")
+	if response["result"] != string(protocol.ResultUserAlreadyExists) {
+		t.Errorf("result = %v, want %s", response["result"], protocol.ResultUserAlreadyExists)
+	}
+
+	th.send("watcher", protocol.UsersRequest{Type: protocol.TypeUsers})
+	lists := messagesOfType(th.drain("watcher"), protocol.TypeUserList)
+	if len(lists) != 1 {
+		t.Fatalf("got %d USER_LIST messages, want 1", len(lists))
+	}
+	users, _ := lists[0]["users"].(map[string]any)
+	if _, listed := users["BoB"]; !listed {
+		t.Errorf("users = %v, want BoB with its registered casing", users)
+	}
+	if _, listed := users["bob"]; listed {
+		t.Errorf("users = %v, lists the rejected bob", users)
+	}
+}
+
+func TestCaseSensitiveUsernamesAreDistinct(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.CaseInsensitiveUsernames = false
+	})
+	th.identify("first", "BoB")
+	th.connect("second")
+
+	th.send("second", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "bob"})
+
+	response := findResponse(t, th.drain("second"), "IDENTIFY")
+	if response["result"] != string(protocol.ResultSuccess) {
+		t.Errorf("result = %v, want %s", response["result"], protocol.ResultSuccess)
+	}
+}
+
+func TestTypingReachesRoomMembersButNotSender(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.identify("carol", "carol")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.drainAll()
+
+	th.send("alice", protocol.TypingRequest{Type: protocol.TypeTyping, RoomName: "den"})
+
+	if messages := th.drain("alice"); len(messages) != 0 {
+		t.Errorf("sender got %v, want nothing", messages)
+	}
+	hints := messagesOfType(th.drain("bob"), protocol.TypeTypingFrom)
+	if len(hints) != 1 || hints[0]["username"] != "alice" || hints[0]["roomname"] != "den" {
+		t.Errorf("member got %v, want one TYPING_FROM alice in den", hints)
+	}
+	if messages := th.drain("carol"); len(messages) != 0 {
+		t.Errorf("non-member got %v, want nothing", messages)
+	}
+}
+
+func TestTypingToUser(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+
+	th.send("alice", protocol.TypingRequest{Type: protocol.TypeTyping, Username: "bob"})
+
+	if messages := th.drain("alice"); len(messages) != 0 {
+		t.Errorf("sender got %v, want nothing", messages)
+	}
+	hints := messagesOfType(th.drain("bob"), protocol.TypeTypingFrom)
+	if len(hints) != 1 || hints[0]["username"] != "alice" {
+		t.Errorf("recipient got %v, want one TYPING_FROM alice", hints)
+	}
+}
+
+func TestInvalidTypingIsDroppedSilently(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+
+	th.send("alice", protocol.TypingRequest{Type: protocol.TypeTyping, RoomName: "den", Username: "bob"})
+
+	if messages := th.drain("alice"); len(messages) != 0 {
+		t.Errorf("sender got %v, want nothing", messages)
+	}
+	if !th.isConnected("alice") {
+		t.Error("client disconnected after an invalid TYPING")
+	}
+}
+
+func TestEncodeFailureDisconnectsOnlyThatClient(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+
+	th.hub.sendMessage(th.ctx, "alice", map[string]any{"type": "BROKEN", "value": make(chan int)})
+	th.settle()
+
+	if th.isConnected("alice") {
+		t.Error("client still connected after its message failed to encode")
+	}
+	if !th.isConnected("bob") {
+		t.Error("other client disconnected after an encode failure")
+	}
+
+	th.send("bob", protocol.UsersRequest{Type: protocol.TypeUsers})
+	if lists := messagesOfType(th.drain("bob"), protocol.TypeUserList); len(lists) != 1 {
+		t.Errorf("hub stopped serving after an encode failure: got %d USER_LIST messages", len(lists))
+	}
+}
+
+func TestIdentifyVersionNegotiation(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     int
+		wantResult  protocol.ResultCode
+		wantVersion int
+	}{
+		{name: "omitted", version: 0, wantResult: protocol.ResultSuccess, wantVersion: protocol.MinProtocolVersion},
+		{name: "lower", version: protocol.MinProtocolVersion, wantResult: protocol.ResultSuccess, wantVersion: protocol.MinProtocolVersion},
+		{name: "matched", version: protocol.ProtocolVersion, wantResult: protocol.ResultSuccess, wantVersion: protocol.ProtocolVersion},
+		{name: "unsupported", version: protocol.ProtocolVersion + 1, wantResult: protocol.ResultUnsupportedVersion, wantVersion: protocol.ProtocolVersion},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			th := newTestHub(t, nil)
+			th.connect("alice")
+
+			th.send("alice", protocol.IdentifyRequest{
+				Type:     protocol.TypeIdentify,
+				Username: "alice",
+				Version:  test.version,
+			})
+
+			response := findResponse(t, th.drain("alice"), "IDENTIFY")
+			if response["result"] != string(test.wantResult) {
+				t.Errorf("result = %v, want %s", response["result"], test.wantResult)
+			}
+			if response["version"] != float64(test.wantVersion) {
+				t.Errorf("version = %v, want %d", response["version"], test.wantVersion)
+			}
+			if test.wantResult == protocol.ResultSuccess && th.hub.clientVersion["alice"] != test.wantVersion {
+				t.Errorf("stored version = %d, want %d", th.hub.clientVersion["alice"], test.wantVersion)
+			}
+		})
+	}
+}
+
+func TestDisconnectRelaysClientReason(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+
+	th.send("bob", protocol.DisconnectRequest{Type: protocol.TypeDisconnect, Reason: "going\nto lunch"})
+
+	notices := messagesOfType(th.drain("alice"), protocol.TypeDisconnected)
+	if len(notices) != 1 || notices[0]["username"] != "bob" || notices[0]["reason"] != "going to lunch" {
+		t.Errorf("got %v, want DISCONNECTED bob with reason %q", notices, "going to lunch")
+	}
+}
+
+func TestDisconnectRelaysServerReasonCode(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+
+	th.hub.Unregister("bob", "read error: connection reset by peer")
+	th.settle()
+
+	notices := messagesOfType(th.drain("alice"), protocol.TypeDisconnected)
+	if len(notices) != 1 || notices[0]["reason"] != protocol.DisconnectReasonConnectionLost {
+		t.Errorf("got %v, want DISCONNECTED with reason %s", notices, protocol.DisconnectReasonConnectionLost)
+	}
+}
+
+// roomHistoryTexts returns the texts replayed by a ROOM_HISTORY message.
+func roomHistoryTexts(t *testing.T, message map[string]any) []string {
+	t.Helper()
+
+	entries, _ := message["messages"].([]any)
+	texts := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		fields, _ := entry.(map[string]any)
+		text, _ := fields["text"].(string)
+		texts = append(texts, text)
+	}
+	return texts
+}
+
+func TestJoinRoomReplaysHistoryInOrder(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.RoomHistoryDepth = 2
+	})
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	for _, text := range []string{"one", "two", "three"} {
+		th.send("alice", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: text})
+	}
+	th.drainAll()
+
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den", History: true})
+
+	replays := messagesOfType(th.drain("bob"), protocol.TypeRoomHistory)
+	if len(replays) != 1 {
+		t.Fatalf("got %d ROOM_HISTORY messages, want 1", len(replays))
+	}
+	if got, want := roomHistoryTexts(t, replays[0]), []string{"two", "three"}; !slices.Equal(got, want) {
+		t.Errorf("history = %v, want %v", got, want)
+	}
+}
+
+func TestJoinRoomWithoutHistoryFlag(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.RoomHistoryDepth = 2
+	})
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("alice", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "one"})
+	th.drainAll()
+
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+
+	if replays := messagesOfType(th.drain("bob"), protocol.TypeRoomHistory); len(replays) != 0 {
+		t.Errorf("got ROOM_HISTORY %v without asking for it", replays)
+	}
+}
+
+func TestDeletedRoomDropsHistory(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.RoomHistoryDepth = 2
+		cfg.EmptyRoomTTLSecs = 0
+	})
+	th.identify("alice", "alice")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("alice", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "one"})
+	room := th.hub.rooms[th.hub.roomKey("den")]
+
+	th.send("alice", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "den"})
+
+	if _, exists := th.hub.rooms[th.hub.roomKey("den")]; exists {
+		t.Fatal("room still exists after its last member left")
+	}
+	if room.history != nil {
+		t.Error("deleted room still holds its history")
+	}
+
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.drainAll()
+	th.send("alice", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den", History: true})
+
+	replays := messagesOfType(th.drain("alice"), protocol.TypeRoomHistory)
+	if len(replays) != 1 || len(roomHistoryTexts(t, replays[0])) != 0 {
+		t.Errorf("recreated room replayed %v, want an empty history", replays)
+	}
+}
+
+func TestReservedUsernames(t *testing.T) {
+	tests := []struct {
+		name            string
+		caseInsensitive bool
+		username        string
+		wantResult      protocol.ResultCode
+	}{
+		{name: "reserved", username: "admin", wantResult: protocol.ResultReservedUsername},
+		{name: "not reserved", username: "alice", wantResult: protocol.ResultSuccess},
+		{name: "case variation, case-insensitive", caseInsensitive: true, username: "AdMiN", wantResult: protocol.ResultReservedUsername},
+		{name: "case variation, case-sensitive", caseInsensitive: false, username: "AdMiN", wantResult: protocol.ResultSuccess},
+		{name: "system username", caseInsensitive: true, username: strings.ToUpper(SystemUsername), wantResult: protocol.ResultReservedUsername},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			th := newTestHub(t, func(cfg *config.Config) {
+				cfg.ReservedUsernames = map[string]struct{}{"admin": {}}
+				cfg.CaseInsensitiveUsernames = test.caseInsensitive
+			})
+			th.connect("client")
+
+			th.send("client", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: test.username})
+
+			response := findResponse(t, th.drain("client"), "IDENTIFY")
+			if response["result"] != string(test.wantResult) {
+				t.Errorf("result = %v, want %s", response["result"], test.wantResult)
+			}
+		})
+	}
+}
+
+func TestInvalidUTF8TextKeepsConnection(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.ValidateUTF8 = true
+	})
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+
+	th.sendRaw("alice", []byte("{\"type\":\"PUBLIC_TEXT\",\"text\":\"bad \xff byte\"}"))
+
+	response := findResponse(t, th.drain("alice"), "PUBLIC_TEXT")
+	if response["result"] != string(protocol.ResultInvalidUTF8) {
+		t.Errorf("result = %v, want %s", response["result"], protocol.ResultInvalidUTF8)
+	}
+	if !th.isConnected("alice") {
+		t.Error("client disconnected after invalid UTF-8 text")
+	}
+	if messages := th.drain("bob"); len(messages) != 0 {
+		t.Errorf("invalid text was delivered: %v", messages)
+	}
+}
+
+func TestRoomMessageRateLimit(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.RoomMessagesPerSecond = 3
+		cfg.EmptyRoomTTLSecs = 0
+	})
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.drainAll()
+
+	for range 6 {
+		th.send("alice", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "spam"})
+	}
+
+	if delivered := messagesOfType(th.drain("bob"), protocol.TypeRoomTextFrom); len(delivered) != 3 {
+		t.Errorf("bob got %d messages, want 3", len(delivered))
+	}
+	limited := 0
+	for _, response := range messagesOfType(th.drain("alice"), protocol.TypeResponse) {
+		if response["operation"] == "ROOM_TEXT" && response["result"] == string(protocol.ResultRateLimited) {
+			limited++
+		}
+	}
+	if limited != 3 {
+		t.Errorf("got %d RATE_LIMITED responses, want 3", limited)
+	}
+
+	room := th.hub.rooms[th.hub.roomKey("den")]
+	th.send("alice", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "den"})
+	if _, exists := room.rateLimiters["alice"]; exists {
+		t.Error("limiter kept after leaving the room")
+	}
+
+	th.send("bob", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "hi"})
+	th.send("bob", protocol.DisconnectRequest{Type: protocol.TypeDisconnect})
+	if _, exists := room.rateLimiters["bob"]; exists {
+		t.Error("limiter kept after disconnecting")
+	}
+}
+
+func TestMutedMemberMissesTextButGetsMembership(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.identify("carol", "carol")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.send("bob", protocol.MuteRoomRequest{Type: protocol.TypeMuteRoom, RoomName: "den"})
+	if response := findResponse(t, th.drain("bob"), "MUTE_ROOM"); response["result"] != string(protocol.ResultSuccess) {
+		t.Fatalf("MUTE_ROOM result = %v, want %s", response["result"], protocol.ResultSuccess)
+	}
+	th.drainAll()
+
+	th.send("alice", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "hello"})
+	th.send("carol", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.send("carol", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "den"})
+
+	messages := th.drain("bob")
+	if texts := messagesOfType(messages, protocol.TypeRoomTextFrom); len(texts) != 0 {
+		t.Errorf("muted member got room text %v", texts)
+	}
+	if joins := messagesOfType(messages, protocol.TypeJoinedRoom); len(joins) != 1 {
+		t.Errorf("muted member got %d JOINED_ROOM, want 1", len(joins))
+	}
+	if leaves := messagesOfType(messages, protocol.TypeLeftRoom); len(leaves) != 1 {
+		t.Errorf("muted member got %d LEFT_ROOM, want 1", len(leaves))
+	}
+
+	th.send("bob", protocol.UnmuteRoomRequest{Type: protocol.TypeUnmuteRoom, RoomName: "den"})
+	th.send("alice", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "again"})
+	if texts := messagesOfType(th.drain("bob"), protocol.TypeRoomTextFrom); len(texts) != 1 {
+		t.Errorf("unmuted member got %d room texts, want 1", len(texts))
+	}
+}
+
+func TestMuteClearedOnLeaveAndDisconnect(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	room := th.hub.rooms[th.hub.roomKey("den")]
+
+	th.send("bob", protocol.MuteRoomRequest{Type: protocol.TypeMuteRoom, RoomName: "den"})
+	th.send("bob", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "den"})
+	if _, muted := room.muted["bob"]; muted {
+		t.Error("mute kept after leaving the room")
+	}
+
+	th.send("alice", protocol.MuteRoomRequest{Type: protocol.TypeMuteRoom, RoomName: "den"})
+	th.send("alice", protocol.DisconnectRequest{Type: protocol.TypeDisconnect})
+	if _, muted := room.muted["alice"]; muted {
+		t.Error("mute kept after disconnecting")
+	}
+}
+
+func TestTextEcho(t *testing.T) {
+	tests := []struct {
+		name     string
+		echo     bool
+		wantEcho int
+	}{
+		{name: "echo on", echo: true, wantEcho: 1},
+		{name: "echo off", echo: false, wantEcho: 0},
+	}
+
+	for _, test := range tests {
+		t.Run("room "+test.name, func(t *testing.T) {
+			th := newTestHub(t, nil)
+			th.identify("alice", "alice")
+			th.identify("bob", "bob")
+			th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+			th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+			th.drainAll()
+
+			th.send("alice", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "hi", Echo: test.echo})
+
+			if echoes := messagesOfType(th.drain("alice"), protocol.TypeRoomTextFrom); len(echoes) != test.wantEcho {
+				t.Errorf("sender got %d ROOM_TEXT_FROM, want %d", len(echoes), test.wantEcho)
+			}
+			if delivered := messagesOfType(th.drain("bob"), protocol.TypeRoomTextFrom); len(delivered) != 1 {
+				t.Errorf("member got %d ROOM_TEXT_FROM, want 1", len(delivered))
+			}
+		})
+
+		t.Run("public "+test.name, func(t *testing.T) {
+			th := newTestHub(t, nil)
+			th.identify("alice", "alice")
+			th.identify("bob", "bob")
+
+			th.send("alice", protocol.PublicTextRequest{Type: protocol.TypePublicText, Text: "hi", Echo: test.echo})
+
+			if echoes := messagesOfType(th.drain("alice"), protocol.TypePublicTextFrom); len(echoes) != test.wantEcho {
+				t.Errorf("sender got %d PUBLIC_TEXT_FROM, want %d", len(echoes), test.wantEcho)
+			}
+			if delivered := messagesOfType(th.drain("bob"), protocol.TypePublicTextFrom); len(delivered) != 1 {
+				t.Errorf("other user got %d PUBLIC_TEXT_FROM, want 1", len(delivered))
+			}
+		})
+	}
+}
+
+// newInviteTestHub creates a hub where alice owns the private room "den",
+// bob is a member, carol is invited, and dave is neither.
+func newInviteTestHub(t *testing.T) *testHub {
+	t.Helper()
+
+	th := newTestHub(t, nil)
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		th.identify(ClientID(username), username)
+	}
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den"})
+	th.send("alice", protocol.InviteRequest{Type: protocol.TypeInvite, RoomName: "den", Usernames: []string{"bob", "carol"}})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.drainAll()
+	return th
+}
+
+func TestInviteReportsEachTarget(t *testing.T) {
+	th := newInviteTestHub(t)
+
+	th.send("alice", protocol.InviteRequest{
+		Type:      protocol.TypeInvite,
+		RoomName:  "den",
+		Usernames: []string{"dave", "ghost", "bob", "carol"},
+	})
+
+	response := asResponse(t, findResponse(t, th.drain("alice"), "INVITE"))
+	if response.Result != protocol.ResultPartialSuccess {
+		t.Errorf("result = %s, want %s", response.Result, protocol.ResultPartialSuccess)
+	}
+	want := protocol.TargetResults{
+		Succeeded:      []string{"dave"},
+		NoSuchUser:     []string{"ghost"},
+		AlreadyJoined:  []string{"bob"},
+		AlreadyInvited: []string{"carol"},
+	}
+	if response.Targets == nil || !reflect.DeepEqual(*response.Targets, want) {
+		t.Errorf("targets = %+v, want %+v", response.Targets, want)
+	}
+	if invitations := messagesOfType(th.drain("dave"), protocol.TypeInvitation); len(invitations) != 1 {
+		t.Errorf("dave got %d INVITATION messages, want 1", len(invitations))
+	}
+}
+
+func TestInviteOnlyUnknownUsers(t *testing.T) {
+	th := newInviteTestHub(t)
+
+	th.send("alice", protocol.InviteRequest{
+		Type:      protocol.TypeInvite,
+		RoomName:  "den",
+		Usernames: []string{"ghost", "phantom"},
+	})
+
+	response := asResponse(t, findResponse(t, th.drain("alice"), "INVITE"))
+	if response.Result != protocol.ResultNoSuchUser {
+		t.Errorf("result = %s, want %s", response.Result, protocol.ResultNoSuchUser)
+	}
+}
+
+func TestTextToSelfIsRejected(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.CaseInsensitiveUsernames = true
+	})
+	th.identify("alice", "Alice")
+	th.identify("bob", "bob")
+
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "ALICE", Text: "me"})
+
+	messages := th.drain("alice")
+	if response := findResponse(t, messages, "TEXT"); response["result"] != string(protocol.ResultCannotMessageSelf) {
+		t.Errorf("result = %v, want %s", response["result"], protocol.ResultCannotMessageSelf)
+	}
+	if texts := messagesOfType(messages, protocol.TypeTextFrom); len(texts) != 0 {
+		t.Errorf("self-addressed text delivered: %v", texts)
+	}
+
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: "hi"})
+
+	texts := messagesOfType(th.drain("bob"), protocol.TypeTextFrom)
+	if len(texts) != 1 || texts[0]["username"] != "Alice" || texts[0]["text"] != "hi" {
+		t.Errorf("bob got %v, want TEXT_FROM Alice", texts)
+	}
+}
+
+func TestTooManyRoomsReportsCapacity(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.MaxRoomsPerUser = 2
+	})
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "one", Public: true})
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "two", Public: true})
+	th.send("bob", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "three", Public: true})
+	th.drainAll()
+
+	for _, request := range []any{
+		protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "four", Public: true},
+		protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "three"},
+	} {
+		th.send("alice", request)
+
+		var response protocol.ResponseMessage
+		for _, message := range messagesOfType(th.drain("alice"), protocol.TypeResponse) {
+			response = asResponse(t, message)
+		}
+		if response.Result != protocol.ResultTooManyRooms {
+			t.Errorf("%s result = %s, want %s", response.Operation, response.Result, protocol.ResultTooManyRooms)
+			continue
+		}
+		if response.Capacity == nil || *response.Capacity != (protocol.CapacityHint{Current: 2, Max: 2}) {
+			t.Errorf("%s capacity = %+v, want 2 of 2", response.Operation, response.Capacity)
+		}
+	}
+}
+
+func TestPresenceOptOut(t *testing.T) {
+	th := newTestHub(t, nil)
+	optOut := false
+	th.connect("quiet")
+	th.send("quiet", protocol.IdentifyRequest{
+		Type:                  protocol.TypeIdentify,
+		Username:              "quiet",
+		PresenceNotifications: &optOut,
+	})
+	th.identify("loud", "loud")
+	th.drainAll()
+
+	th.connect("alice")
+	th.send("alice", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "alice"})
+	th.send("alice", protocol.StatusRequest{Type: protocol.TypeStatus, Status: protocol.StatusBusy})
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "quiet", Text: "psst"})
+	th.send("alice", protocol.DisconnectRequest{Type: protocol.TypeDisconnect})
+
+	quiet := th.drain("quiet")
+	loud := th.drain("loud")
+	for _, presenceType := range []protocol.MessageType{protocol.TypeNewUser, protocol.TypeNewStatus, protocol.TypeDisconnected} {
+		if got := messagesOfType(quiet, presenceType); len(got) != 0 {
+			t.Errorf("opted-out client got %v", got)
+		}
+		if got := messagesOfType(loud, presenceType); len(got) != 1 {
+			t.Errorf("other client got %d %s, want 1", len(got), presenceType)
+		}
+	}
+	if texts := messagesOfType(quiet, protocol.TypeTextFrom); len(texts) != 1 {
+		t.Errorf("opted-out client got %d TEXT_FROM, want 1", len(texts))
+	}
+
+	th.send("quiet", protocol.UsersRequest{Type: protocol.TypeUsers})
+	if lists := messagesOfType(th.drain("quiet"), protocol.TypeUserList); len(lists) != 1 {
+		t.Errorf("opted-out client got %d USER_LIST, want 1", len(lists))
+	}
+}
+
+func TestChangeUsername(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.drainAll()
+
+	th.send("alice", protocol.ChangeUsernameRequest{Type: protocol.TypeChangeUsername, Username: "alicia"})
+
+	if response := findResponse(t, th.drain("alice"), "CHANGE_USERNAME"); response["result"] != string(protocol.ResultSuccess) {
+		t.Fatalf("result = %v, want %s", response["result"], protocol.ResultSuccess)
+	}
+	changes := messagesOfType(th.drain("bob"), protocol.TypeUsernameChanged)
+	if len(changes) != 1 || changes[0]["username"] != "alice" || changes[0]["new_username"] != "alicia" {
+		t.Errorf("got %v, want USERNAME_CHANGED alice to alicia", changes)
+	}
+	if owner := th.hub.usernameOwner[th.hub.usernameKey("alicia")]; owner != "alice" {
+		t.Errorf("alicia owned by %q, want alice", owner)
+	}
+	if _, stillOwned := th.hub.usernameOwner[th.hub.usernameKey("alice")]; stillOwned {
+		t.Error("old username still owned after the rename")
+	}
+
+	th.send("bob", protocol.RoomUsersRequest{Type: protocol.TypeRoomUsers, RoomName: "den"})
+	lists := messagesOfType(th.drain("bob"), protocol.TypeRoomUserList)
+	if len(lists) != 1 {
+		t.Fatalf("got %d ROOM_USER_LIST messages, want 1", len(lists))
+	}
+	users, _ := lists[0]["users"].(map[string]any)
+	if _, listed := users["alicia"]; !listed || len(users) != 2 {
+		t.Errorf("room users = %v, want alicia and bob", users)
+	}
+
+	th.identify("carol", "carol")
+	th.send("carol", protocol.TextRequest{Type: protocol.TypeText, Username: "alicia", Text: "hi"})
+	if texts := messagesOfType(th.drain("alice"), protocol.TypeTextFrom); len(texts) != 1 {
+		t.Errorf("renamed user got %d TEXT_FROM, want 1", len(texts))
+	}
+}
+
+func TestChangeUsernameRejected(t *testing.T) {
+	tests := []struct {
+		name       string
+		username   string
+		wantResult protocol.ResultCode
+	}{
+		{name: "taken", username: "bob", wantResult: protocol.ResultUserAlreadyExists},
+		{name: "reserved", username: "admin", wantResult: protocol.ResultReservedUsername},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			th := newTestHub(t, func(cfg *config.Config) {
+				cfg.ReservedUsernames = map[string]struct{}{"admin": {}}
+			})
+			th.identify("alice", "alice")
+			th.identify("bob", "bob")
+
+			th.send("alice", protocol.ChangeUsernameRequest{Type: protocol.TypeChangeUsername, Username: test.username})
+
+			if response := findResponse(t, th.drain("alice"), "CHANGE_USERNAME"); response["result"] != string(test.wantResult) {
+				t.Errorf("result = %v, want %s", response["result"], test.wantResult)
+			}
+			if th.hub.clientUser["alice"] != "alice" {
+				t.Errorf("username = %q after a rejected rename, want alice", th.hub.clientUser["alice"])
+			}
+			if messages := th.drain("bob"); len(messages) != 0 {
+				t.Errorf("rejected rename broadcast %v", messages)
+			}
+		})
+	}
+}
+
+func TestMaxRoomMembers(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.MaxRoomMembers = 2
+	})
+	for _, username := range []string{"alice", "bob", "carol"} {
+		th.identify(ClientID(username), username)
+	}
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	if response := findResponse(t, th.drain("bob"), "JOIN_ROOM"); response["result"] != string(protocol.ResultSuccess) {
+		t.Fatalf("join up to the limit: result = %v, want %s", response["result"], protocol.ResultSuccess)
+	}
+
+	th.send("carol", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	response := asResponse(t, findResponse(t, th.drain("carol"), "JOIN_ROOM"))
+	if response.Result != protocol.ResultRoomFull {
+		t.Fatalf("join over the limit: result = %s, want %s", response.Result, protocol.ResultRoomFull)
+	}
+	if response.Capacity == nil || *response.Capacity != (protocol.CapacityHint{Current: 2, Max: 2}) {
+		t.Errorf("capacity = %+v, want 2 of 2", response.Capacity)
+	}
+	if th.hub.isRoomMember(th.hub.rooms[th.hub.roomKey("den")], "carol") {
+		t.Error("carol admitted to a full room")
+	}
+
+	th.send("bob", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "den"})
+	th.send("carol", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	if response := findResponse(t, th.drain("carol"), "JOIN_ROOM"); response["result"] != string(protocol.ResultSuccess) {
+		t.Errorf("join after a member left: result = %v, want %s", response["result"], protocol.ResultSuccess)
+	}
+}
+
+func TestMaxRoomMembersIgnoresInvitees(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.MaxRoomMembers = 2
+	})
+	for _, username := range []string{"alice", "bob", "carol"} {
+		th.identify(ClientID(username), username)
+	}
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den"})
+	th.send("alice", protocol.InviteRequest{Type: protocol.TypeInvite, RoomName: "den", Usernames: []string{"bob", "carol"}})
+	th.drainAll()
+
+	th.send("carol", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	if response := findResponse(t, th.drain("carol"), "JOIN_ROOM"); response["result"] != string(protocol.ResultSuccess) {
+		t.Errorf("result = %v, want %s", response["result"], protocol.ResultSuccess)
+	}
+}
+
+func TestUninviteReportsEachTarget(t *testing.T) {
+	th := newInviteTestHub(t)
+
+	th.send("alice", protocol.UninviteRequest{
+		Type:      protocol.TypeUninvite,
+		RoomName:  "den",
+		Usernames: []string{"carol", "bob", "dave"},
+	})
+
+	response := asResponse(t, findResponse(t, th.drain("alice"), "UNINVITE"))
+	if response.Result != protocol.ResultSuccess {
+		t.Errorf("result = %s, want %s", response.Result, protocol.ResultSuccess)
+	}
+	want := protocol.TargetResults{
+		Succeeded:     []string{"carol"},
+		AlreadyJoined: []string{"bob"},
+		NotInvited:    []string{"dave"},
+	}
+	if response.Targets == nil || !reflect.DeepEqual(*response.Targets, want) {
+		t.Errorf("targets = %+v, want %+v", response.Targets, want)
+	}
+
+	th.send("carol", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	if response := findResponse(t, th.drain("carol"), "JOIN_ROOM"); response["result"] != string(protocol.ResultNotInvited) {
+		t.Errorf("uninvited join: result = %v, want %s", response["result"], protocol.ResultNotInvited)
+	}
+	if _, pending := th.hub.clientInvites["carol"][th.hub.roomKey("den")]; pending {
+		t.Error("rescinded invitation still indexed for carol")
+	}
+}
+
+func TestUninviteRequiresMembership(t *testing.T) {
+	th := newInviteTestHub(t)
+	th.hub.cfg.StrictInvitePermission = false
+
+	th.send("dave", protocol.UninviteRequest{
+		Type:      protocol.TypeUninvite,
+		RoomName:  "den",
+		Usernames: []string{"carol"},
+	})
+
+	if response := findResponse(t, th.drain("dave"), "UNINVITE"); response["result"] != string(protocol.ResultNotJoined) {
+		t.Errorf("result = %v, want %s", response["result"], protocol.ResultNotJoined)
+	}
+	if _, invited := th.hub.rooms[th.hub.roomKey("den")].invited["carol"]; !invited {
+		t.Error("non-member rescinded an invitation")
+	}
+}
+
+func TestInviteFromNonMember(t *testing.T) {
+	tests := []struct {
+		name          string
+		strict        bool
+		wantOperation string
+		wantResult    protocol.ResultCode
+		wantConnected bool
+	}{
+		{name: "strict", strict: true, wantOperation: "INVALID", wantResult: protocol.ResultInvalid, wantConnected: false},
+		{name: "lenient", strict: false, wantOperation: "INVITE", wantResult: protocol.ResultNotJoined, wantConnected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			th := newInviteTestHub(t)
+			th.hub.cfg.StrictInvitePermission = test.strict
+
+			th.send("dave", protocol.InviteRequest{
+				Type:      protocol.TypeInvite,
+				RoomName:  "den",
+				Usernames: []string{"dave"},
+			})
+
+			response := findResponse(t, th.drain("dave"), test.wantOperation)
+			if response["result"] != string(test.wantResult) {
+				t.Errorf("result = %v, want %s", response["result"], test.wantResult)
+			}
+			if got := th.isConnected("dave"); got != test.wantConnected {
+				t.Errorf("connected = %v, want %v", got, test.wantConnected)
+			}
+			if _, invited := th.hub.rooms[th.hub.roomKey("den")].invited["dave"]; invited {
+				t.Error("non-member invited someone")
+			}
+		})
+	}
+}
+
+// compressingWriter is a recordingWriter that can also compress, and
+// records the method it was switched to.
+type compressingWriter struct {
+	*recordingWriter
+	method string
+}
+
+func (w *compressingWriter) SendCompressed(ctx context.Context, frame []byte, method string) error {
+	w.method = method
+	return w.Send(ctx, frame)
+}
+
+func TestIdentifyNegotiatesCompression(t *testing.T) {
+	tests := []struct {
+		name            string
+		canCompress     bool
+		requested       string
+		wantCompression string
+	}{
+		{name: "gzip", canCompress: true, requested: protocol.CompressionGzip, wantCompression: protocol.CompressionGzip},
+		{name: "deflate", canCompress: true, requested: protocol.CompressionDeflate, wantCompression: protocol.CompressionDeflate},
+		{name: "unsupported method", canCompress: true, requested: "brotli"},
+		{name: "not requested", canCompress: true},
+		{name: "writer cannot compress", canCompress: false, requested: protocol.CompressionGzip},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			th := newTestHub(t, nil)
+			recorder := &recordingWriter{}
+			th.writers["alice"] = recorder
+			writer := &compressingWriter{recordingWriter: recorder}
+			var registered ClientWriter = writer
+			if !test.canCompress {
+				registered = recorder
+			}
+			th.hub.registerClient(RegisterEvent{ClientID: "alice", Writer: registered})
+
+			th.send("alice", protocol.IdentifyRequest{
+				Type:        protocol.TypeIdentify,
+				Username:    "alice",
+				Compression: test.requested,
+			})
+
+			response := asResponse(t, findResponse(t, th.drain("alice"), "IDENTIFY"))
+			if response.Result != protocol.ResultSuccess {
+				t.Fatalf("result = %s, want %s", response.Result, protocol.ResultSuccess)
+			}
+			if response.Compression != test.wantCompression {
+				t.Errorf("response compression = %q, want %q", response.Compression, test.wantCompression)
+			}
+			if writer.method != test.wantCompression {
+				t.Errorf("writer switched to %q, want %q", writer.method, test.wantCompression)
+			}
+		})
+	}
+}
+
+// congestedWriter models a client whose regular queue is full under the
+// drop-newest overflow policy: regular frames vanish, priority frames are
+// still recorded.
+type congestedWriter struct {
+	*recordingWriter
+}
+
+func (w *congestedWriter) Send(context.Context, []byte) error {
+	return nil
+}
+
+func (w *congestedWriter) SendPriority(ctx context.Context, frame []byte) error {
+	return w.recordingWriter.Send(ctx, frame)
+}
+
+func TestMembershipEventsBypassFullQueue(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.identify("carol", "carol")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.drainAll()
+
+	th.hub.clients["alice"] = &congestedWriter{recordingWriter: th.writers["alice"]}
+
+	th.send("bob", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "bulk"})
+	th.send("carol", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.send("bob", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "den"})
+
+	messages := th.drain("alice")
+	if texts := messagesOfType(messages, protocol.TypeRoomTextFrom); len(texts) != 0 {
+		t.Errorf("congested client got bulk text %v", texts)
+	}
+	if joins := messagesOfType(messages, protocol.TypeJoinedRoom); len(joins) != 1 {
+		t.Errorf("congested client got %d JOINED_ROOM, want 1", len(joins))
+	}
+	if leaves := messagesOfType(messages, protocol.TypeLeftRoom); len(leaves) != 1 {
+		t.Errorf("congested client got %d LEFT_ROOM, want 1", len(leaves))
+	}
+	if !th.isConnected("alice") {
+		t.Error("congested client disconnected")
+	}
+}
+
+// panickingWriter panics the first time it is handed a frame containing
+// trigger, standing in for a handler bug.
+type panickingWriter struct {
+	*recordingWriter
+	trigger  string
+	panicked bool
+}
+
+func (w *panickingWriter) Send(ctx context.Context, frame []byte) error {
+	if !w.panicked && strings.Contains(string(frame), w.trigger) {
+		w.panicked = true
+		panic("writer blew up")
+	}
+	return w.recordingWriter.Send(ctx, frame)
+}
+
+func TestHandlerPanicDisconnectsOnlyTheSender(t *testing.T) {
+	th := newTestHub(t, nil)
+	recorder := &recordingWriter{}
+	th.writers["carol"] = recorder
+	th.hub.registerClient(RegisterEvent{
+		ClientID: "carol",
+		Writer:   &panickingWriter{recordingWriter: recorder, trigger: "detonate"},
+	})
+	th.send("carol", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "carol"})
+	th.identify("alice", "alice")
+	th.identify("mallory", "mallory")
+
+	th.send("mallory", protocol.PublicTextRequest{Type: protocol.TypePublicText, Text: "detonate"})
+
+	if th.isConnected("mallory") {
+		t.Error("client whose frame panicked a handler is still connected")
+	}
+	if logs := th.logs.String(); !strings.Contains(logs, "handler panic: id=mallory type=PUBLIC_TEXT") {
+		t.Errorf("panic not logged with client and type:\n%s", logs)
+	}
+
+	th.drainAll()
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "carol", Text: "still there?"})
+	if got := messagesOfType(th.drain("carol"), protocol.TypeTextFrom); len(got) != 1 || got[0]["text"] != "still there?" {
+		t.Errorf("carol got TEXT_FROM %v after the panic, want one message", got)
+	}
+	if !th.isConnected("alice") || !th.isConnected("carol") {
+		t.Error("bystanders were disconnected by another client's panic")
+	}
+}
+
+func TestDisabledOperationsAreRefused(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.DisabledOperations = map[string]struct{}{
+			string(protocol.TypeNewRoom): {},
+			string(protocol.TypeText):    {},
+		}
+	})
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den"})
+	response := asResponse(t, findResponse(t, th.drain("alice"), string(protocol.TypeNewRoom)))
+	if response.Result != protocol.ResultOperationDisabled {
+		t.Errorf("NEW_ROOM result = %s, want %s", response.Result, protocol.ResultOperationDisabled)
+	}
+	if _, exists := th.hub.rooms["den"]; exists {
+		t.Error("disabled NEW_ROOM still created the room")
+	}
+
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: "hi"})
+	response = asResponse(t, findResponse(t, th.drain("alice"), string(protocol.TypeText)))
+	if response.Result != protocol.ResultOperationDisabled {
+		t.Errorf("TEXT result = %s, want %s", response.Result, protocol.ResultOperationDisabled)
+	}
+	if got := messagesOfType(th.drain("bob"), protocol.TypeTextFrom); len(got) != 0 {
+		t.Errorf("bob got %v from a disabled TEXT", got)
+	}
+	if !th.isConnected("alice") {
+		t.Error("a disabled operation disconnected the client")
+	}
+
+	th.send("alice", protocol.PublicTextRequest{Type: protocol.TypePublicText, Text: "hello all"})
+	if got := messagesOfType(th.drain("bob"), protocol.TypePublicTextFrom); len(got) != 1 {
+		t.Errorf("bob got PUBLIC_TEXT_FROM %v, want one message from an enabled operation", got)
+	}
+}
+
+func TestEnsureRoom(t *testing.T) {
+	th := newInviteTestHub(t)
+
+	th.send("carol", protocol.EnsureRoomRequest{Type: protocol.TypeEnsureRoom, RoomName: "lounge"})
+	response := asResponse(t, findResponse(t, th.drain("carol"), "ENSURE_ROOM"))
+	if response.Result != protocol.ResultCreated {
+		t.Errorf("absent room result = %s, want %s", response.Result, protocol.ResultCreated)
+	}
+	lounge, exists := th.hub.rooms["lounge"]
+	if !exists || !lounge.public {
+		t.Fatal("ENSURE_ROOM did not create a public room")
+	}
+	if _, member := lounge.members["carol"]; !member {
+		t.Error("creator is not a member of the ensured room")
+	}
+
+	th.send("dave", protocol.EnsureRoomRequest{Type: protocol.TypeEnsureRoom, RoomName: "lounge"})
+	response = asResponse(t, findResponse(t, th.drain("dave"), "ENSURE_ROOM"))
+	if response.Result != protocol.ResultJoined {
+		t.Errorf("existing room result = %s, want %s", response.Result, protocol.ResultJoined)
+	}
+	if _, member := lounge.members["dave"]; !member {
+		t.Error("ENSURE_ROOM on an existing public room did not join it")
+	}
+	if joined := messagesOfType(th.drain("carol"), protocol.TypeJoinedRoom); len(joined) != 1 || joined[0]["username"] != "dave" {
+		t.Errorf("carol got JOINED_ROOM %v, want dave joining", joined)
+	}
+
+	th.send("dave", protocol.EnsureRoomRequest{Type: protocol.TypeEnsureRoom, RoomName: "den"})
+	response = asResponse(t, findResponse(t, th.drain("dave"), "ENSURE_ROOM"))
+	if response.Result != protocol.ResultNotInvited {
+		t.Errorf("private room result = %s, want %s", response.Result, protocol.ResultNotInvited)
+	}
+	den := th.hub.rooms["den"]
+	if _, member := den.members["dave"]; member || den.public {
+		t.Error("ENSURE_ROOM on a private room joined it or made it public")
+	}
+}
+
+func TestStatusCustomMessage(t *testing.T) {
+	th := newTestHub(t, nil)
+	for _, identity := range []struct {
+		username string
+		version  int
+	}{
+		{"alice", protocol.VersionStatusMessages},
+		{"bob", protocol.VersionStatusMessages},
+		{"carol", protocol.MinProtocolVersion},
+	} {
+		th.connect(ClientID(identity.username))
+		th.send(ClientID(identity.username), protocol.IdentifyRequest{
+			Type:     protocol.TypeIdentify,
+			Username: identity.username,
+			Version:  identity.version,
+		})
+	}
+	th.drainAll()
+
+	th.send("alice", protocol.StatusRequest{Type: protocol.TypeStatus, Status: protocol.StatusBusy, Message: "in a\nmeeting"})
+
+	if got := messagesOfType(th.drain("bob"), protocol.TypeNewStatus); len(got) != 1 || got[0]["message"] != "in a meeting" {
+		t.Errorf("bob got NEW_STATUS %v, want the sanitized message", got)
+	}
+	if got := messagesOfType(th.drain("carol"), protocol.TypeNewStatus); len(got) != 1 || got[0]["message"] != nil {
+		t.Errorf("legacy client got NEW_STATUS %v, want no message field", got)
+	}
+
+	th.send("bob", protocol.UsersRequest{Type: protocol.TypeUsers})
+	userList := messagesOfType(th.drain("bob"), protocol.TypeUserList)
+	if len(userList) != 1 {
+		t.Fatalf("got %d USER_LIST messages, want 1", len(userList))
+	}
+	users, _ := userList[0]["users"].(map[string]any)
+	if want := map[string]any{"status": "BUSY", "message": "in a meeting"}; !reflect.DeepEqual(users["alice"], want) {
+		t.Errorf("alice listed as %v, want %v", users["alice"], want)
+	}
+
+	th.send("alice", protocol.StatusRequest{Type: protocol.TypeStatus, Status: protocol.StatusActive})
+	if got := messagesOfType(th.drain("bob"), protocol.TypeNewStatus); len(got) != 1 || got[0]["message"] != nil {
+		t.Errorf("bob got NEW_STATUS %v after clearing, want no message", got)
+	}
+	if _, stored := th.hub.clientStatusMessage["alice"]; stored {
+		t.Error("cleared status message is still stored")
+	}
+}
+
+func TestPendingInvitesPerRoomCap(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.MaxPendingInvitesPerRoom = 2
+	})
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		th.identify(ClientID(username), username)
+	}
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den"})
+	th.send("alice", protocol.InviteRequest{Type: protocol.TypeInvite, RoomName: "den", Usernames: []string{"bob", "carol"}})
+	th.drainAll()
+
+	th.send("alice", protocol.InviteRequest{Type: protocol.TypeInvite, RoomName: "den", Usernames: []string{"dave"}})
+	response := asResponse(t, findResponse(t, th.drain("alice"), "INVITE"))
+	if response.Result != protocol.ResultTooManyPendingInvites {
+		t.Errorf("result = %s, want %s", response.Result, protocol.ResultTooManyPendingInvites)
+	}
+	if response.Capacity == nil || *response.Capacity != (protocol.CapacityHint{Current: 2, Max: 2}) {
+		t.Errorf("capacity = %+v, want 2 of 2", response.Capacity)
+	}
+	if got := messagesOfType(th.drain("dave"), protocol.TypeInvitation); len(got) != 0 {
+		t.Errorf("dave got %v past the cap", got)
+	}
+
+	// Accepting an invitation frees its slot.
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.drainAll()
+	th.send("alice", protocol.InviteRequest{Type: protocol.TypeInvite, RoomName: "den", Usernames: []string{"dave"}})
+	response = asResponse(t, findResponse(t, th.drain("alice"), "INVITE"))
+	if response.Result != protocol.ResultSuccess {
+		t.Errorf("result after a slot freed = %s, want %s", response.Result, protocol.ResultSuccess)
+	}
+}
+
+func TestPendingInvitesExpire(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.InviteTTLSecs = 60
+	})
+	for _, username := range []string{"alice", "bob", "carol"} {
+		th.identify(ClientID(username), username)
+	}
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den"})
+	th.send("alice", protocol.InviteRequest{Type: protocol.TypeInvite, RoomName: "den", Usernames: []string{"bob", "carol"}})
+	th.drainAll()
+
+	now := time.Now()
+	th.hub.expireInvitations(now.Add(30 * time.Second))
+	if len(th.hub.rooms["den"].invited) != 2 {
+		t.Fatalf("invitations expired before their TTL: %v", th.hub.rooms["den"].invited)
+	}
+
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.drainAll()
+	th.hub.expireInvitations(now.Add(61 * time.Second))
+	if invited := th.hub.rooms["den"].invited; len(invited) != 0 {
+		t.Errorf("invitations left after the TTL: %v", invited)
+	}
+
+	th.send("carol", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	response := asResponse(t, findResponse(t, th.drain("carol"), "JOIN_ROOM"))
+	if response.Result != protocol.ResultNotInvited {
+		t.Errorf("join with an expired invitation = %s, want %s", response.Result, protocol.ResultNotInvited)
+	}
+	if _, member := th.hub.rooms["den"].members["bob"]; !member {
+		t.Error("expiry removed a member who had accepted in time")
+	}
+}
+
+func TestDisconnectLogSummarizesMessageCounts(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("bob", "bob")
+	th.connect("alice")
+
+	requests := []any{
+		protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "alice"},
+		protocol.PublicTextRequest{Type: protocol.TypePublicText, Text: "one"},
+		protocol.PublicTextRequest{Type: protocol.TypePublicText, Text: "two"},
+		protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: "psst"},
+		protocol.StatusRequest{Type: protocol.TypeStatus, Status: protocol.StatusAway},
+	}
+	sentBytes := 0
+	for _, request := range requests {
+		frame, err := json.Marshal(request)
+		if err != nil {
+			t.Fatalf("marshal %v: %v", request, err)
+		}
+		sentBytes += len(frame)
+		th.sendRaw("alice", frame)
+	}
+
+	th.hub.forceDisconnect(th.ctx, "alice", "connection lost", protocol.DisconnectReasonConnectionLost)
+
+	want := fmt.Sprintf(
+		"client disconnected: id=alice addr=127.0.0.1:1 reason=connection lost stats: bytes=%d IDENTIFY=1 PUBLIC_TEXT=2 STATUS=1 TEXT=1",
+		sentBytes,
+	)
+	if logs := th.logs.String(); !strings.Contains(logs, want) {
+		t.Errorf("disconnect log missing %q:\n%s", want, logs)
+	}
+}
+
+func TestWhois(t *testing.T) {
+	th := newInviteTestHub(t)
+	th.send("dave", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "lounge", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "lounge"})
+	th.send("bob", protocol.StatusRequest{Type: protocol.TypeStatus, Status: protocol.StatusAway, Message: "lunch"})
+	th.drainAll()
+
+	tests := []struct {
+		requester ClientID
+		wantRooms []any
+	}{
+		{requester: "alice", wantRooms: []any{"den"}},
+		{requester: "dave", wantRooms: []any{"lounge"}},
+		{requester: "carol", wantRooms: []any{}},
+		{requester: "bob", wantRooms: []any{"den", "lounge"}},
+	}
+	for _, test := range tests {
+		th.send(test.requester, protocol.WhoisRequest{Type: protocol.TypeWhois, Username: "bob"})
+
+		results := messagesOfType(th.drain(test.requester), protocol.TypeWhoisResult)
+		if len(results) != 1 {
+			t.Fatalf("%s got %d WHOIS_RESULT messages, want 1", test.requester, len(results))
+		}
+		result := results[0]
+		if result["username"] != "bob" || result["status"] != string(protocol.StatusAway) || result["message"] != "lunch" {
+			t.Errorf("%s sees bob as %v, want AWAY with message lunch", test.requester, result)
+		}
+		if !reflect.DeepEqual(result["rooms"], test.wantRooms) {
+			t.Errorf("%s sees bob's rooms as %v, want only shared rooms %v", test.requester, result["rooms"], test.wantRooms)
+		}
+	}
+
+	th.send("alice", protocol.WhoisRequest{Type: protocol.TypeWhois, Username: "ghost"})
+	response := asResponse(t, findResponse(t, th.drain("alice"), "WHOIS"))
+	if response.Result != protocol.ResultNoSuchUser || response.Extra != "ghost" {
+		t.Errorf("response = %+v, want %s for ghost", response, protocol.ResultNoSuchUser)
+	}
+}
+
+func TestReloadAppliesMaxTextLength(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.MaxTextLength = 10
+	})
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	text := strings.Repeat("y", 15)
+
+	deliveredTo := func(clientID ClientID) int {
+		return len(messagesOfType(th.drain(clientID), protocol.TypeTextFrom))
+	}
+
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: text})
+	if got := deliveredTo("bob"); got != 0 {
+		t.Fatalf("bob got %d messages over the 10-byte limit", got)
+	}
+	th.drainAll()
+
+	next := th.hub.cfg
+	next.MaxTextLength = 20
+	next.ListenAddr = "0.0.0.0:1"
+	th.hub.applyReload(next)
+
+	if th.hub.cfg.ListenAddr == next.ListenAddr {
+		t.Error("reload changed the listen address")
+	}
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: text})
+	if got := deliveredTo("bob"); got != 1 {
+		t.Errorf("bob got %d messages after raising the limit to 20, want 1", got)
+	}
+
+	next.MaxTextLength = 5
+	th.hub.applyReload(next)
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: "eightchr"})
+	if got := deliveredTo("bob"); got != 0 {
+		t.Errorf("bob got %d messages after lowering the limit to 5, want 0", got)
+	}
+	if !th.isConnected("alice") {
+		t.Error("alice was disconnected for a text over the reloaded limit")
+	}
+}
+
+func TestCaseInsensitiveRooms(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.CaseInsensitiveRooms = true
+	})
+	for _, username := range []string{"alice", "bob", "carol"} {
+		th.identify(ClientID(username), username)
+	}
+
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "General", Public: true})
+	th.drainAll()
+
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "general"})
+	response := asResponse(t, findResponse(t, th.drain("bob"), "JOIN_ROOM"))
+	if response.Result != protocol.ResultSuccess {
+		t.Errorf("join general result = %s, want %s", response.Result, protocol.ResultSuccess)
+	}
+	if joined := messagesOfType(th.drain("alice"), protocol.TypeJoinedRoom); len(joined) != 1 || joined[0]["roomname"] != "General" {
+		t.Errorf("alice got JOINED_ROOM %v, want it under the display name General", joined)
+	}
+
+	th.send("bob", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "GENERAL", Text: "hi"})
+	if got := messagesOfType(th.drain("alice"), protocol.TypeRoomTextFrom); len(got) != 1 || got[0]["roomname"] != "General" {
+		t.Errorf("alice got ROOM_TEXT_FROM %v, want one in General", got)
+	}
+
+	th.send("carol", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "general"})
+	response = asResponse(t, findResponse(t, th.drain("carol"), "NEW_ROOM"))
+	if response.Result != protocol.ResultRoomAlreadyExists {
+		t.Errorf("NEW_ROOM general result = %s, want %s", response.Result, protocol.ResultRoomAlreadyExists)
+	}
+	if len(th.hub.rooms) != 1 {
+		t.Errorf("got %d rooms, want the case variant to collide", len(th.hub.rooms))
+	}
+}
+
+func TestRoomNamesCaseSensitiveByDefault(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "General", Public: true})
+	th.send("bob", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "general", Public: true})
+
+	response := asResponse(t, findResponse(t, th.drain("bob"), "NEW_ROOM"))
+	if response.Result != protocol.ResultSuccess || len(th.hub.rooms) != 2 {
+		t.Errorf("result = %s with %d rooms, want two distinct rooms", response.Result, len(th.hub.rooms))
+	}
+}
+
+func TestServerRoomLimit(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.MaxTotalRooms = 2
+	})
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "one"})
+	th.send("bob", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "two"})
+	th.drainAll()
+
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "three"})
+	response := asResponse(t, findResponse(t, th.drain("alice"), "NEW_ROOM"))
+	if response.Result != protocol.ResultServerRoomLimit {
+		t.Errorf("result = %s, want %s", response.Result, protocol.ResultServerRoomLimit)
+	}
+	if response.Capacity == nil || *response.Capacity != (protocol.CapacityHint{Current: 2, Max: 2}) {
+		t.Errorf("capacity = %+v, want 2 of 2", response.Capacity)
+	}
+
+	th.send("bob", protocol.EnsureRoomRequest{Type: protocol.TypeEnsureRoom, RoomName: "three"})
+	response = asResponse(t, findResponse(t, th.drain("bob"), "ENSURE_ROOM"))
+	if response.Result != protocol.ResultServerRoomLimit {
+		t.Errorf("ENSURE_ROOM result = %s, want %s", response.Result, protocol.ResultServerRoomLimit)
+	}
+
+	// The last member leaving deletes the room and frees its slot.
+	th.send("bob", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "two"})
+	th.drainAll()
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "three"})
+	response = asResponse(t, findResponse(t, th.drain("alice"), "NEW_ROOM"))
+	if response.Result != protocol.ResultSuccess {
+		t.Errorf("result after a room emptied = %s, want %s", response.Result, protocol.ResultSuccess)
+	}
+}
+
+func TestIdentifyFetchUsers(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("bob", "bob")
+
+	th.connect("alice")
+	th.send("alice", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "alice", FetchUsers: true})
+
+	messages := th.drain("alice")
+	if len(messages) < 2 || messages[0]["type"] != string(protocol.TypeResponse) || messages[1]["type"] != string(protocol.TypeUserList) {
+		t.Fatalf("got %v, want the IDENTIFY response followed by USER_LIST", messages)
+	}
+	users, _ := messages[1]["users"].(map[string]any)
+	if len(users) != 2 || users["alice"] == nil || users["bob"] == nil {
+		t.Errorf("users = %v, want alice and bob", users)
+	}
+
+	th.connect("carol")
+	th.send("carol", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "carol"})
+	if got := messagesOfType(th.drain("carol"), protocol.TypeUserList); len(got) != 0 {
+		t.Errorf("got USER_LIST %v without fetch_users", got)
+	}
+}
+
+func TestMentionsBypassFullQueue(t *testing.T) {
+	th := newTestHub(t, nil)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		th.identify(ClientID(username), username)
+	}
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.send("carol", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.drainAll()
+
+	th.hub.clients["bob"] = &congestedWriter{recordingWriter: th.writers["bob"]}
+
+	th.send("alice", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "ordinary chatter"})
+	th.send("alice", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "ping @bob, look"})
+
+	texts := messagesOfType(th.drain("bob"), protocol.TypeRoomTextFrom)
+	if len(texts) != 1 || texts[0]["text"] != "ping @bob, look" {
+		t.Errorf("backpressured bob got %v, want only the mention", texts)
+	}
+	if got := messagesOfType(th.drain("carol"), protocol.TypeRoomTextFrom); len(got) != 2 {
+		t.Errorf("carol got %d messages, want both through regular delivery", len(got))
+	}
+}
+
+func TestMentionedUsernames(t *testing.T) {
+	th := newTestHub(t, nil)
+
+	got := slices.Sorted(maps.Keys(th.hub.mentionedUsernames("@alice, hi @bob! email me@example.com @ @carol)")))
+	if want := []string{"alice", "bob", "carol"}; !slices.Equal(got, want) {
+		t.Errorf("mentions = %v, want %v", got, want)
+	}
+	if got := th.hub.mentionedUsernames("no mentions here"); len(got) != 0 {
+		t.Errorf("mentions = %v, want none", got)
+	}
+}
+
+func TestLeaveAllRooms(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	for _, room := range []string{"den", "lair", "attic"} {
+		th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: room, Public: true})
+	}
+	for _, room := range []string{"den", "lair"} {
+		th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: room})
+	}
+	th.drainAll()
+
+	th.send("alice", protocol.LeaveAllRoomsRequest{Type: protocol.TypeLeaveAllRooms})
+
+	response := asResponse(t, findResponse(t, th.drain("alice"), "LEAVE_ALL_ROOMS"))
+	if response.Result != protocol.ResultSuccess || response.Extra != "3" {
+		t.Errorf("response = %+v, want SUCCESS leaving 3 rooms", response)
+	}
+
+	var leftRooms []string
+	for _, left := range messagesOfType(th.drain("bob"), protocol.TypeLeftRoom) {
+		if left["username"] != "alice" {
+			t.Errorf("LEFT_ROOM for %v, want alice", left["username"])
+		}
+		room, _ := left["roomname"].(string)
+		leftRooms = append(leftRooms, room)
+	}
+	slices.Sort(leftRooms)
+	if !slices.Equal(leftRooms, []string{"den", "lair"}) {
+		t.Errorf("bob saw alice leave %v, want den and lair", leftRooms)
+	}
+
+	if _, exists := th.hub.rooms[th.hub.roomKey("attic")]; exists {
+		t.Error("attic still exists after its only member left")
+	}
+	for _, room := range []string{"den", "lair"} {
+		state, exists := th.hub.rooms[th.hub.roomKey(room)]
+		if !exists {
+			t.Fatalf("%s was deleted while bob is still in it", room)
+		}
+		if th.hub.isRoomMember(state, "alice") {
+			t.Errorf("alice is still a member of %s", room)
+		}
+	}
+	if rooms := th.hub.clientRooms["alice"]; len(rooms) != 0 {
+		t.Errorf("alice still tracked in rooms %v", rooms)
+	}
+}
+
+// cancelingWriter cancels the hub context on the first frame sent to any
+// writer sharing its counter, like a shutdown arriving mid-broadcast.
+type cancelingWriter struct {
+	recordingWriter
+	sends  *int
+	cancel context.CancelFunc
+}
+
+func (w *cancelingWriter) Send(ctx context.Context, frame []byte) error {
+	*w.sends++
+	w.cancel()
+	return w.recordingWriter.Send(ctx, frame)
+}
+
+func TestBroadcastsStopWhenContextCanceled(t *testing.T) {
+	const clients = 50
+
+	tests := []struct {
+		name      string
+		broadcast func(th *testHub, ctx context.Context)
+	}{
+		{
+			name: "broadcastExcept",
+			broadcast: func(th *testHub, ctx context.Context) {
+				th.hub.broadcastExcept(ctx, "", []byte(`{"type":"NEW_USER"}`))
+			},
+		},
+		{
+			name: "broadcastToRoomMembers",
+			broadcast: func(th *testHub, ctx context.Context) {
+				th.hub.broadcastToRoomMembers(ctx, th.hub.rooms[th.hub.roomKey("den")], []byte(`{"type":"JOINED_ROOM"}`))
+			},
+		},
+		{
+			name: "room text fan-out",
+			broadcast: func(th *testHub, ctx context.Context) {
+				frame, _ := json.Marshal(protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "hi"})
+				th.hub.handleInboundRecovering(ctx, InboundEvent{ClientID: "user0", Frame: frame, At: time.Now().UTC()})
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			th := newTestHub(t, nil)
+			for i := range clients {
+				th.identify(ClientID(fmt.Sprintf("user%d", i)), fmt.Sprintf("user%d", i))
+			}
+			th.send("user0", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+			for i := 1; i < clients; i++ {
+				th.send(ClientID(fmt.Sprintf("user%d", i)), protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+			}
+			th.drainAll()
+
+			ctx, cancel := context.WithCancel(th.ctx)
+			defer cancel()
+			sends := 0
+			for clientID := range th.hub.clients {
+				th.hub.clients[clientID] = &cancelingWriter{sends: &sends, cancel: cancel}
+			}
+
+			test.broadcast(th, ctx)
+
+			if sends != 1 {
+				t.Errorf("sent %d frames after the context was canceled by the first, want 1", sends)
+			}
+			if members := len(th.hub.rooms[th.hub.roomKey("den")].members); members != clients {
+				t.Errorf("den has %d members after the broadcast, want %d", members, clients)
+			}
+		})
+	}
+}
+
+func TestLobbyPublicText(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.LobbyRoom = "lobby"
+	})
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.identify("carol", "carol")
+	lobby := th.hub.rooms[th.hub.roomKey("lobby")]
+	if lobby == nil || !lobby.public {
+		t.Fatalf("lobby = %+v, want a public room created on identify", lobby)
+	}
+	for _, clientID := range []ClientID{"alice", "bob", "carol"} {
+		if !th.hub.isRoomMember(lobby, clientID) {
+			t.Errorf("%s did not join the lobby on identify", clientID)
+		}
+	}
+	th.send("carol", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "lobby"})
+	th.drainAll()
+
+	th.send("alice", protocol.PublicTextRequest{Type: protocol.TypePublicText, Text: "hello lobby"})
+
+	if got := messagesOfType(th.drain("bob"), protocol.TypePublicTextFrom); len(got) != 1 || got[0]["text"] != "hello lobby" {
+		t.Errorf("bob got %v, want the lobby message", got)
+	}
+	if got := messagesOfType(th.drain("carol"), protocol.TypePublicTextFrom); len(got) != 0 {
+		t.Errorf("carol got %v after leaving the lobby", got)
+	}
+
+	th.send("carol", protocol.PublicTextRequest{Type: protocol.TypePublicText, Text: "anyone?"})
+
+	response := asResponse(t, findResponse(t, th.drain("carol"), "PUBLIC_TEXT"))
+	if response.Result != protocol.ResultNotJoined || response.Extra != "lobby" {
+		t.Errorf("response = %+v, want NOT_JOINED for lobby", response)
+	}
+	if got := messagesOfType(th.drain("alice"), protocol.TypePublicTextFrom); len(got) != 0 {
+		t.Errorf("alice got %v from a user outside the lobby", got)
+	}
+}
+
+func TestPublicTextReachesEveryoneWithoutLobby(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+
+	th.send("alice", protocol.PublicTextRequest{Type: protocol.TypePublicText, Text: "hello"})
+
+	if len(th.hub.rooms) != 0 {
+		t.Errorf("rooms = %v, want none without a lobby", slices.Collect(maps.Keys(th.hub.rooms)))
+	}
+	if got := messagesOfType(th.drain("bob"), protocol.TypePublicTextFrom); len(got) != 1 {
+		t.Errorf("bob got %v, want the public message", got)
+	}
+}
+
+func TestAutoJoinRoom(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.AutoJoinRoom = "welcome"
+	})
+	th.identify("alice", "alice")
+	th.connect("bob")
+
+	th.send("bob", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "bob"})
+
+	room := th.hub.rooms[th.hub.roomKey("welcome")]
+	if room == nil || !room.public {
+		t.Fatalf("welcome = %+v, want a public room created on identify", room)
+	}
+	for _, clientID := range []ClientID{"alice", "bob"} {
+		if !th.hub.isRoomMember(room, clientID) {
+			t.Errorf("%s not in the auto-join room", clientID)
+		}
+	}
+	joined := messagesOfType(th.drain("alice"), protocol.TypeJoinedRoom)
+	if len(joined) != 1 || joined[0]["username"] != "bob" || joined[0]["roomname"] != "welcome" {
+		t.Errorf("alice got %v, want JOINED_ROOM for bob in welcome", joined)
+	}
+	th.drainAll()
+
+	th.send("bob", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "welcome", Text: "hi all"})
+	if got := messagesOfType(th.drain("alice"), protocol.TypeRoomTextFrom); len(got) != 1 || got[0]["text"] != "hi all" {
+		t.Errorf("alice got %v, want bob's ROOM_TEXT", got)
+	}
+	th.send("alice", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "welcome", Text: "welcome bob"})
+	if got := messagesOfType(th.drain("bob"), protocol.TypeRoomTextFrom); len(got) != 1 || got[0]["text"] != "welcome bob" {
+		t.Errorf("bob got %v, want alice's ROOM_TEXT", got)
+	}
+}
+
+func TestAutoJoinRoomRespectsMemberCap(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.AutoJoinRoom = "welcome"
+		cfg.MaxRoomMembers = 1
+	})
+	th.identify("alice", "alice")
+	th.connect("bob")
+
+	th.send("bob", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "bob"})
+
+	if _, identified := th.hub.clientUser["bob"]; !identified {
+		t.Fatal("bob not identified when the auto-join room is full")
+	}
+	response := asResponse(t, findResponse(t, th.drain("bob"), "JOIN_ROOM"))
+	if response.Result != protocol.ResultRoomFull {
+		t.Errorf("auto-join result = %s, want %s", response.Result, protocol.ResultRoomFull)
+	}
+	if th.hub.isRoomMember(th.hub.rooms[th.hub.roomKey("welcome")], "bob") {
+		t.Error("bob admitted to a full auto-join room")
+	}
+}
+
+func TestIdleWarningBeforeDisconnect(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.IdleTimeoutSecs = 60
+		cfg.IdleWarningSecs = 20
+	})
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+
+	// Both have been quiet for 45 seconds, inside the warning window.
+	now := time.Now()
+	for _, stats := range th.hub.clientStats {
+		stats.lastFrameAt = now.Add(-45 * time.Second)
+	}
+	th.hub.expireIdleClients(th.ctx, now)
+	th.hub.expireIdleClients(th.ctx, now.Add(time.Second))
+
+	for _, clientID := range []ClientID{"alice", "bob"} {
+		warnings := messagesOfType(th.drain(clientID), protocol.TypeIdleWarning)
+		if len(warnings) != 1 || warnings[0]["seconds_left"] != float64(15) {
+			t.Errorf("%s got %v, want one IDLE_WARNING with 15 seconds left", clientID, warnings)
+		}
+		if !th.isConnected(clientID) {
+			t.Fatalf("%s disconnected by the warning", clientID)
+		}
+	}
+
+	// Alice answers the warning; bob ignores it.
+	th.send("alice", protocol.StatusRequest{Type: protocol.TypeStatus, Status: protocol.StatusActive})
+	th.drainAll()
+	th.hub.expireIdleClients(th.ctx, now.Add(20*time.Second))
+
+	if !th.isConnected("alice") {
+		t.Error("alice disconnected after answering the warning")
+	}
+	if got := messagesOfType(th.drain("alice"), protocol.TypeIdleWarning); len(got) != 0 {
+		t.Errorf("alice warned again right after answering: %v", got)
+	}
+	if th.isConnected("bob") {
+		t.Error("bob still connected after ignoring the warning past the timeout")
+	}
+	if !strings.Contains(th.logs.String(), "id=bob addr=127.0.0.1:1 reason=idle timeout") {
+		t.Errorf("idle disconnect not logged:\n%s", th.logs.String())
+	}
+}
+
+func TestNoIdleWarningWhenDisabled(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.IdleTimeoutSecs = 60
+	})
+	th.identify("alice", "alice")
+
+	now := time.Now()
+	th.hub.clientStats["alice"].lastFrameAt = now.Add(-59 * time.Second)
+	th.hub.expireIdleClients(th.ctx, now)
+
+	if got := messagesOfType(th.drain("alice"), protocol.TypeIdleWarning); len(got) != 0 {
+		t.Errorf("got %v with IdleWarningSecs unset", got)
+	}
+	th.hub.expireIdleClients(th.ctx, now.Add(time.Second))
+	if th.isConnected("alice") {
+		t.Error("alice still connected at the idle timeout")
+	}
+}
+
+func TestUserListPagination(t *testing.T) {
+	const users = 25
+
+	th := newTestHub(t, nil)
+	want := make([]string, 0, users)
+	for i := range users {
+		username := fmt.Sprintf("user%02d", i)
+		th.identify(ClientID(username), username)
+		want = append(want, username)
+	}
+
+	var seen []string
+	cursor := ""
+	for page := 0; ; page++ {
+		if page > users {
+			t.Fatal("pagination did not end")
+		}
+		th.send("user00", protocol.UsersRequest{Type: protocol.TypeUsers, Cursor: cursor, Limit: 7})
+		lists := messagesOfType(th.drain("user00"), protocol.TypeUserList)
+		if len(lists) != 1 {
+			t.Fatalf("page %d: got %d USER_LIST messages, want 1", page, len(lists))
+		}
+		pageUsers, _ := lists[0]["users"].(map[string]any)
+		if len(pageUsers) > 7 {
+			t.Errorf("page %d has %d users, over the limit of 7", page, len(pageUsers))
+		}
+		seen = append(seen, slices.Sorted(maps.Keys(pageUsers))...)
+
+		next, _ := lists[0]["next_cursor"].(string)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if !slices.Equal(seen, want) {
+		t.Errorf("pages listed %v, want every user once in order %v", seen, want)
+	}
+}
+
+func TestUserListWithoutPaginationIsComplete(t *testing.T) {
+	th := newTestHub(t, nil)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		th.identify(ClientID(username), username)
+	}
+
+	th.send("alice", protocol.UsersRequest{Type: protocol.TypeUsers})
+
+	lists := messagesOfType(th.drain("alice"), protocol.TypeUserList)
+	if len(lists) != 1 {
+		t.Fatalf("got %d USER_LIST messages, want 1", len(lists))
+	}
+	users, _ := lists[0]["users"].(map[string]any)
+	if len(users) != 3 || lists[0]["next_cursor"] != nil {
+		t.Errorf("USER_LIST = %v, want all 3 users and no cursor", lists[0])
+	}
+}
+
+// identifyVersion connects clientID and identifies it as username
+// speaking the given protocol version.
+func (th *testHub) identifyVersion(clientID ClientID, username string, version int) {
+	th.t.Helper()
+
+	th.connect(clientID)
+	th.send(clientID, protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: username, Version: version})
+	if _, identified := th.hub.clientUser[clientID]; !identified {
+		th.t.Fatalf("identify %s as %q failed: %v", clientID, username, th.drain(clientID))
+	}
+	th.drainAll()
+}
+
+// sortedEntryNames decodes the users of a sorted USER_LIST or
+// ROOM_USER_LIST and returns their names in the order sent.
+func sortedEntryNames(t *testing.T, message map[string]any) []string {
+	t.Helper()
+
+	frame, err := json.Marshal(message)
+	if err != nil {
+		t.Fatalf("marshal %v: %v", message, err)
+	}
+	var list protocol.SortedRoomUserListMessage
+	if err := json.Unmarshal(frame, &list); err != nil {
+		t.Fatalf("users of %s are not a sorted list: %v", frame, err)
+	}
+	names := make([]string, len(list.Users))
+	for i, entry := range list.Users {
+		names[i] = entry.Username
+	}
+	return names
+}
+
+func TestUserListsSortedForNewClients(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identifyVersion("mike", "mike", protocol.VersionSortedUserLists)
+	for _, username := range []string{"zed", "alice", "bob"} {
+		th.identify(ClientID(username), username)
+	}
+	th.send("mike", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	for _, username := range []string{"zed", "alice", "bob"} {
+		th.send(ClientID(username), protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	}
+	th.drainAll()
+	want := []string{"alice", "bob", "mike", "zed"}
+
+	th.send("mike", protocol.UsersRequest{Type: protocol.TypeUsers})
+	lists := messagesOfType(th.drain("mike"), protocol.TypeUserList)
+	if len(lists) != 1 {
+		t.Fatalf("got %d USER_LIST messages, want 1", len(lists))
+	}
+	if got := sortedEntryNames(t, lists[0]); !slices.Equal(got, want) {
+		t.Errorf("USER_LIST order = %v, want %v", got, want)
+	}
+
+	th.send("mike", protocol.RoomUsersRequest{Type: protocol.TypeRoomUsers, RoomName: "den"})
+	roomLists := messagesOfType(th.drain("mike"), protocol.TypeRoomUserList)
+	if len(roomLists) != 1 {
+		t.Fatalf("got %d ROOM_USER_LIST messages, want 1", len(roomLists))
+	}
+	if got := sortedEntryNames(t, roomLists[0]); !slices.Equal(got, want) {
+		t.Errorf("ROOM_USER_LIST order = %v, want %v", got, want)
+	}
+}
+
+func TestUserListsStayMapsForOlderClients(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+
+	th.send("alice", protocol.UsersRequest{Type: protocol.TypeUsers})
+
+	lists := messagesOfType(th.drain("alice"), protocol.TypeUserList)
+	if len(lists) != 1 {
+		t.Fatalf("got %d USER_LIST messages, want 1", len(lists))
+	}
+	if users, isMap := lists[0]["users"].(map[string]any); !isMap || len(users) != 2 {
+		t.Errorf("users = %v, want a map of both users for a version %d client", lists[0]["users"], protocol.MinProtocolVersion)
+	}
+}
+
+func TestRoomReportReachesOnlyOwner(t *testing.T) {
+	th := newTestHub(t, nil)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		th.identify(ClientID(username), username)
+	}
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.send("carol", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.drainAll()
+
+	th.send("bob", protocol.RoomReportRequest{Type: protocol.TypeRoomReport, RoomName: "den", Text: "carol is spamming"})
+
+	response := asResponse(t, findResponse(t, th.drain("bob"), "ROOM_REPORT"))
+	if response.Result != protocol.ResultSuccess {
+		t.Errorf("result = %s, want %s", response.Result, protocol.ResultSuccess)
+	}
+	reports := messagesOfType(th.drain("alice"), protocol.TypeRoomReportFrom)
+	if len(reports) != 1 || reports[0]["username"] != "bob" || reports[0]["roomname"] != "den" || reports[0]["text"] != "carol is spamming" {
+		t.Errorf("owner got %v, want bob's report about den", reports)
+	}
+	if got := th.drain("carol"); len(got) != 0 {
+		t.Errorf("carol got %v, want nothing", got)
+	}
+}
+
+func TestRoomReportRejected(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.LobbyRoom = "lobby"
+	})
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "study", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "study"})
+	th.send("alice", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "study"})
+	th.drainAll()
+
+	tests := []struct {
+		name       string
+		roomName   string
+		wantResult protocol.ResultCode
+	}{
+		{name: "non-member", roomName: "den", wantResult: protocol.ResultNotJoined},
+		{name: "unknown room", roomName: "attic", wantResult: protocol.ResultNoSuchRoom},
+		{name: "room without owner", roomName: "lobby", wantResult: protocol.ResultNoOwner},
+		{name: "owner left", roomName: "study", wantResult: protocol.ResultNoOwner},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			th.send("bob", protocol.RoomReportRequest{Type: protocol.TypeRoomReport, RoomName: test.roomName, Text: "help"})
+
+			response := asResponse(t, findResponse(t, th.drain("bob"), "ROOM_REPORT"))
+			if response.Result != test.wantResult {
+				t.Errorf("result = %s, want %s", response.Result, test.wantResult)
+			}
+			if reports := messagesOfType(th.drain("alice"), protocol.TypeRoomReportFrom); len(reports) != 0 {
+				t.Errorf("alice got %v for a rejected report", reports)
+			}
+		})
+	}
+}
+
+func TestUptime(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+
+	connectedAt := th.hub.clientConnectedAt["bob"]
+	if connectedAt.IsZero() {
+		t.Fatal("no connection time recorded for bob")
+	}
+	if got := th.hub.uptimeSecs("bob", connectedAt.Add(90*time.Second+500*time.Millisecond)); got != 90 {
+		t.Errorf("uptime after 90.5s = %d, want 90", got)
+	}
+
+	// Move bob's connection two hours into the past, so WHOIS, which reads
+	// the real clock, reports at least that long.
+	th.hub.clientConnectedAt["bob"] = time.Now().Add(-2 * time.Hour)
+	th.send("alice", protocol.WhoisRequest{Type: protocol.TypeWhois, Username: "bob"})
+	results := messagesOfType(th.drain("alice"), protocol.TypeWhoisResult)
+	if len(results) != 1 {
+		t.Fatalf("got %d WHOIS_RESULT messages, want 1", len(results))
+	}
+	if uptime, _ := results[0]["uptime_secs"].(float64); uptime < 7200 || uptime > 7260 {
+		t.Errorf("WHOIS uptime = %v, want about 7200", results[0]["uptime_secs"])
+	}
+
+	th.hub.forceDisconnect(th.ctx, "bob", "connection lost", protocol.DisconnectReasonConnectionLost)
+	if _, tracked := th.hub.clientConnectedAt["bob"]; tracked {
+		t.Error("connection time kept after disconnect")
+	}
+	if got := th.hub.uptimeSecs("bob", time.Now()); got != 0 {
+		t.Errorf("uptime of a disconnected client = %d, want 0", got)
+	}
+}
+
+func TestPendingInvitesPerUserCap(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.MaxPendingInvitesPerUser = 2
+	})
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	for _, room := range []string{"r1", "r2", "r3", "r4"} {
+		th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: room})
+	}
+	th.drainAll()
+
+	invite := func(room string) protocol.ResponseMessage {
+		t.Helper()
+		th.send("alice", protocol.InviteRequest{Type: protocol.TypeInvite, RoomName: room, Usernames: []string{"bob"}})
+		return asResponse(t, findResponse(t, th.drain("alice"), "INVITE"))
+	}
+
+	for _, room := range []string{"r1", "r2"} {
+		if response := invite(room); response.Result != protocol.ResultSuccess {
+			t.Fatalf("invite to %s under the cap: result = %s", room, response.Result)
+		}
+	}
+	th.drainAll()
+
+	response := invite("r3")
+	if response.Result != protocol.ResultTooManyPendingInvites {
+		t.Errorf("result = %s, want %s", response.Result, protocol.ResultTooManyPendingInvites)
+	}
+	if response.Targets == nil || !slices.Equal(response.Targets.TooManyInvites, []string{"bob"}) {
+		t.Errorf("targets = %+v, want bob reported as holding too many invites", response.Targets)
+	}
+	if got := messagesOfType(th.drain("bob"), protocol.TypeInvitation); len(got) != 0 {
+		t.Errorf("bob got %v past the cap", got)
+	}
+
+	// Joining a room uses up its invitation.
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "r1"})
+	th.drainAll()
+	if response := invite("r3"); response.Result != protocol.ResultSuccess {
+		t.Errorf("invite after joining a room: result = %s, want %s", response.Result, protocol.ResultSuccess)
+	}
+
+	// Deleting a room drops the invitations to it.
+	th.send("alice", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "r2"})
+	th.drainAll()
+	if response := invite("r4"); response.Result != protocol.ResultSuccess {
+		t.Errorf("invite after a room was deleted: result = %s, want %s", response.Result, protocol.ResultSuccess)
+	}
+	if got := len(th.hub.clientInvites["bob"]); got != 2 {
+		t.Errorf("bob holds %d invitations, want 2", got)
+	}
+}
+
+func TestEmptyFrames(t *testing.T) {
+	tests := []struct {
+		name          string
+		ignore        bool
+		wantConnected bool
+	}{
+		{name: "ignored", ignore: true, wantConnected: true},
+		{name: "rejected by default", ignore: false, wantConnected: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			th := newTestHub(t, func(cfg *config.Config) {
+				cfg.IgnoreEmptyFrames = test.ignore
+			})
+			th.identify("alice", "alice")
+			th.identify("bob", "bob")
+			stale := time.Now().Add(-time.Hour)
+			th.hub.clientStats["alice"].lastFrameAt = stale
+
+			th.sendRaw("alice", nil)
+			if th.isConnected("alice") != test.wantConnected {
+				t.Fatalf("connected after an empty frame = %t, want %t", th.isConnected("alice"), test.wantConnected)
+			}
+			if !test.wantConnected {
+				return
+			}
+			if messages := th.drain("alice"); len(messages) != 0 {
+				t.Errorf("empty frame answered with %v", messages)
+			}
+			if !th.hub.clientStats["alice"].lastFrameAt.After(stale) {
+				t.Error("empty frame did not reset the idle timer")
+			}
+
+			th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: "still here"})
+			th.sendRaw("alice", []byte{})
+			th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: "and here"})
+
+			if got := messagesOfType(th.drain("bob"), protocol.TypeTextFrom); len(got) != 2 {
+				t.Errorf("bob got %v, want both messages around the empty frame", got)
+			}
+			if !th.isConnected("alice") {
+				t.Error("alice disconnected by interleaved empty frames")
+			}
+		})
+	}
+}
+
+func TestMetaPassthrough(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.drainAll()
+	meta := json.RawMessage(`{"reply_to":"m-1","tags":["a","b"]}`)
+	wantMeta := map[string]any{"reply_to": "m-1", "tags": []any{"a", "b"}}
+
+	th.send("alice", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "hi", Meta: meta})
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: "psst", Meta: meta})
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: "plain"})
+
+	messages := th.drain("bob")
+	roomTexts := messagesOfType(messages, protocol.TypeRoomTextFrom)
+	if len(roomTexts) != 1 || !reflect.DeepEqual(roomTexts[0]["meta"], wantMeta) {
+		t.Errorf("ROOM_TEXT_FROM = %v, want meta %v", roomTexts, wantMeta)
+	}
+	texts := messagesOfType(messages, protocol.TypeTextFrom)
+	if len(texts) != 2 {
+		t.Fatalf("got %d TEXT_FROM messages, want 2", len(texts))
+	}
+	if !reflect.DeepEqual(texts[0]["meta"], wantMeta) {
+		t.Errorf("TEXT_FROM meta = %v, want %v", texts[0]["meta"], wantMeta)
+	}
+	if _, hasMeta := texts[1]["meta"]; hasMeta {
+		t.Errorf("TEXT_FROM without meta = %v, want no meta field", texts[1])
+	}
+}
+
+func TestOversizedMetaIsRejected(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	meta := json.RawMessage(`{"s":"` + strings.Repeat("x", protocol.MaxMetaBytes) + `"}`)
+
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: "psst", Meta: meta})
+
+	response := asResponse(t, findResponse(t, th.drain("alice"), "TEXT"))
+	if response.Result != protocol.ResultMetaTooLarge {
+		t.Errorf("result = %s, want %s", response.Result, protocol.ResultMetaTooLarge)
+	}
+	if got := th.drain("bob"); len(got) != 0 {
+		t.Errorf("bob got %v for a rejected message", got)
+	}
+	if !th.isConnected("alice") {
+		t.Error("alice disconnected for oversized meta")
+	}
+}
+
+func TestReplyToRoundTrips(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.drainAll()
+
+	th.send("alice", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "agreed", ReplyTo: "m-1"})
+	th.send("alice", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "new topic"})
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: "re", ReplyTo: "m-2"})
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: "hello"})
+
+	messages := th.drain("bob")
+	for _, messageType := range []protocol.MessageType{protocol.TypeRoomTextFrom, protocol.TypeTextFrom} {
+		delivered := messagesOfType(messages, messageType)
+		if len(delivered) != 2 {
+			t.Fatalf("got %d %s messages, want 2", len(delivered), messageType)
+		}
+		if delivered[0]["reply_to"] == nil {
+			t.Errorf("%s reply lost its reply_to: %v", messageType, delivered[0])
+		}
+		if _, hasReply := delivered[1]["reply_to"]; hasReply {
+			t.Errorf("%s without reply_to = %v, want no reply_to field", messageType, delivered[1])
+		}
+	}
+	if got := messagesOfType(messages, protocol.TypeRoomTextFrom)[0]["reply_to"]; got != "m-1" {
+		t.Errorf("ROOM_TEXT_FROM reply_to = %v, want m-1", got)
+	}
+	if got := messagesOfType(messages, protocol.TypeTextFrom)[0]["reply_to"]; got != "m-2" {
+		t.Errorf("TEXT_FROM reply_to = %v, want m-2", got)
+	}
+}
+
+func TestIdentifyTimeout(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.IdentifyTimeoutSecs = 30
+	})
+	th.connect("alice")
+	ghost := th.connect("ghost")
+	th.send("alice", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "alice"})
+	now := time.Now()
+
+	th.hub.expireUnidentifiedClients(th.ctx, now.Add(29*time.Second))
+	if !th.isConnected("ghost") {
+		t.Fatal("ghost disconnected before the identify timeout")
+	}
+
+	th.hub.expireUnidentifiedClients(th.ctx, now.Add(31*time.Second))
+	if th.isConnected("ghost") || !ghost.closed {
+		t.Error("ghost still connected after the identify timeout")
+	}
+	if !strings.Contains(th.logs.String(), "id=ghost addr=127.0.0.1:1 reason=identify timeout") {
+		t.Errorf("identify timeout not logged:\n%s", th.logs.String())
+	}
+	if !th.isConnected("alice") {
+		t.Error("alice disconnected after identifying in time")
+	}
+}
+
+func TestNoIdentifyTimeoutByDefault(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.connect("ghost")
+
+	th.hub.expireUnidentifiedClients(th.ctx, time.Now().Add(24*time.Hour))
+
+	if !th.isConnected("ghost") {
+		t.Error("ghost disconnected with no identify timeout configured")
+	}
+}
+
+func TestMultiText(t *testing.T) {
+	th := newTestHub(t, nil)
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		th.identify(ClientID(username), username)
+	}
+
+	th.send("alice", protocol.MultiTextRequest{
+		Type:      protocol.TypeMultiText,
+		Usernames: []string{"bob", "nobody", "carol", "bob", "alice"},
+		Text:      "team meeting at noon",
+	})
+
+	response := asResponse(t, findResponse(t, th.drain("alice"), "MULTI_TEXT"))
+	if response.Result != protocol.ResultPartialSuccess {
+		t.Errorf("result = %s, want %s", response.Result, protocol.ResultPartialSuccess)
+	}
+	if response.Targets == nil {
+		t.Fatal("response has no per-target results")
+	}
+	if !slices.Equal(response.Targets.Succeeded, []string{"bob", "carol", "bob"}) ||
+		!slices.Equal(response.Targets.NoSuchUser, []string{"nobody"}) ||
+		!slices.Equal(response.Targets.Self, []string{"alice"}) {
+		t.Errorf("targets = %+v, want bob and carol delivered, nobody unknown and alice as self", response.Targets)
+	}
+
+	for _, recipient := range []ClientID{"bob", "carol"} {
+		texts := messagesOfType(th.drain(recipient), protocol.TypeTextFrom)
+		if len(texts) != 1 || texts[0]["username"] != "alice" || texts[0]["text"] != "team meeting at noon" {
+			t.Errorf("%s got %v, want one TEXT_FROM alice", recipient, texts)
+		}
+	}
+	if got := th.drain("dave"); len(got) != 0 {
+		t.Errorf("dave got %v without being addressed", got)
+	}
+}
+
+func TestMultiTextRecipientLimit(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.MaxRecipients = 2
+	})
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		th.identify(ClientID(username), username)
+	}
+
+	th.send("alice", protocol.MultiTextRequest{
+		Type:      protocol.TypeMultiText,
+		Usernames: []string{"bob", "carol", "dave"},
+		Text:      "hi",
+	})
+
+	response := asResponse(t, findResponse(t, th.drain("alice"), "MULTI_TEXT"))
+	if response.Result != protocol.ResultTooManyRecipients {
+		t.Errorf("result = %s, want %s", response.Result, protocol.ResultTooManyRecipients)
+	}
+	if response.Capacity == nil || *response.Capacity != (protocol.CapacityHint{Current: 3, Max: 2}) {
+		t.Errorf("capacity = %+v, want 3 of 2", response.Capacity)
+	}
+	for _, recipient := range []ClientID{"bob", "carol", "dave"} {
+		if got := th.drain(recipient); len(got) != 0 {
+			t.Errorf("%s got %v from a refused MULTI_TEXT", recipient, got)
+		}
+	}
+}
+
+func TestSelfIdentified(t *testing.T) {
+	tests := []struct {
+		name            string
+		caseInsensitive bool
+		wantCanonical   string
+	}{
+		{name: "case-insensitive usernames", caseInsensitive: true, wantCanonical: "bob"},
+		{name: "case-sensitive usernames", caseInsensitive: false, wantCanonical: "BoB"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			th := newTestHub(t, func(cfg *config.Config) {
+				cfg.CaseInsensitiveUsernames = test.caseInsensitive
+			})
+			th.identify("watcher", "watcher")
+			th.connect("bob")
+
+			th.send("bob", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "BoB", SelfIdentified: true})
+
+			messages := th.drain("bob")
+			selves := messagesOfType(messages, protocol.TypeSelfIdentified)
+			if len(selves) != 1 {
+				t.Fatalf("got %d SELF_IDENTIFIED messages, want 1: %v", len(selves), messages)
+			}
+			if selves[0]["username"] != "BoB" || selves[0]["canonical"] != test.wantCanonical {
+				t.Errorf("SELF_IDENTIFIED = %v, want username BoB with canonical %s", selves[0], test.wantCanonical)
+			}
+			if got := messagesOfType(messages, protocol.TypeNewUser); len(got) != 0 {
+				t.Errorf("bob got its own NEW_USER: %v", got)
+			}
+			if got := messagesOfType(th.drain("watcher"), protocol.TypeSelfIdentified); len(got) != 0 {
+				t.Errorf("SELF_IDENTIFIED reached another user: %v", got)
+			}
+		})
+	}
+}
+
+func TestNoSelfIdentifiedUnlessRequested(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.connect("bob")
+
+	th.send("bob", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "bob"})
+
+	if got := messagesOfType(th.drain("bob"), protocol.TypeSelfIdentified); len(got) != 0 {
+		t.Errorf("got %v without asking for it", got)
+	}
+}
+
+func TestMyInvites(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	for _, room := range []string{"kitchen", "attic", "garden", "cellar"} {
+		th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: room})
+	}
+	for _, room := range []string{"kitchen", "attic", "garden"} {
+		th.send("alice", protocol.InviteRequest{Type: protocol.TypeInvite, RoomName: room, Usernames: []string{"bob"}})
+	}
+	th.drainAll()
+
+	myInvites := func() []string {
+		t.Helper()
+		th.send("bob", protocol.MyInvitesRequest{Type: protocol.TypeMyInvites})
+		results := messagesOfType(th.drain("bob"), protocol.TypeMyInvitesResult)
+		if len(results) != 1 {
+			t.Fatalf("got %d MY_INVITES_RESULT messages, want 1", len(results))
+		}
+		var rooms []string
+		for _, room := range results[0]["rooms"].([]any) {
+			rooms = append(rooms, room.(string))
+		}
+		return rooms
+	}
+
+	if got, want := myInvites(), []string{"attic", "garden", "kitchen"}; !slices.Equal(got, want) {
+		t.Errorf("rooms = %v, want %v", got, want)
+	}
+
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "attic"})
+	th.drainAll()
+	if got, want := myInvites(), []string{"garden", "kitchen"}; !slices.Equal(got, want) {
+		t.Errorf("rooms after joining attic = %v, want %v", got, want)
+	}
+
+	th.send("alice", protocol.MyInvitesRequest{Type: protocol.TypeMyInvites})
+	results := messagesOfType(th.drain("alice"), protocol.TypeMyInvitesResult)
+	if len(results) != 1 || len(results[0]["rooms"].([]any)) != 0 {
+		t.Errorf("alice was invited nowhere, got %v", results)
+	}
+}
+
+// assertInviteIndex fails the test unless clientInvites holds exactly the
+// pending invitations recorded in the rooms.
+func assertInviteIndex(t *testing.T, h *Hub) {
+	t.Helper()
+
+	want := make(map[ClientID]map[string]struct{})
+	for roomKey, room := range h.rooms {
+		for clientID := range room.invited {
+			if want[clientID] == nil {
+				want[clientID] = make(map[string]struct{})
+			}
+			want[clientID][roomKey] = struct{}{}
+		}
+	}
+	if !maps.EqualFunc(h.clientInvites, want, maps.Equal) {
+		t.Errorf("clientInvites = %v, want %v", h.clientInvites, want)
+	}
+}
+
+func TestInviteIndexMatchesRooms(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.identify("carol", "carol")
+	for _, room := range []string{"kitchen", "attic", "garden"} {
+		th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: room})
+		th.send("alice", protocol.InviteRequest{Type: protocol.TypeInvite, RoomName: room, Usernames: []string{"bob", "carol"}})
+	}
+	assertInviteIndex(t, th.hub)
+
+	steps := []struct {
+		name string
+		run  func()
+	}{
+		{"join", func() {
+			th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "kitchen"})
+		}},
+		{"uninvite", func() {
+			th.send("alice", protocol.UninviteRequest{Type: protocol.TypeUninvite, RoomName: "attic", Usernames: []string{"carol"}})
+		}},
+		{"leave deleting the room", func() {
+			th.send("alice", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "garden"})
+		}},
+		{"invitee disconnects", func() {
+			th.hub.forceDisconnect(th.ctx, "carol", "connection lost", protocol.DisconnectReasonConnectionLost)
+		}},
+		{"inviter disconnects", func() {
+			th.send("bob", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "kitchen"})
+			th.hub.forceDisconnect(th.ctx, "alice", "connection lost", protocol.DisconnectReasonConnectionLost)
+		}},
+	}
+	for _, step := range steps {
+		step.run()
+		th.settle()
+		t.Run(step.name, func(t *testing.T) { assertInviteIndex(t, th.hub) })
+	}
+
+	if len(th.hub.clientInvites) != 0 {
+		t.Errorf("clientInvites = %v after every room was deleted, want empty", th.hub.clientInvites)
+	}
+}
+
+func TestEmptyRoomTTL(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.EmptyRoomTTLSecs = 30
+	})
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den"})
+	th.send("alice", protocol.InviteRequest{Type: protocol.TypeInvite, RoomName: "den", Usernames: []string{"bob"}})
+	th.send("alice", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "den"})
+	th.drainAll()
+
+	room, exists := th.hub.rooms[th.hub.roomKey("den")]
+	if !exists {
+		t.Fatal("room deleted as soon as it emptied")
+	}
+	th.hub.expireEmptyRooms(time.Now().Add(10 * time.Second))
+	if _, exists := th.hub.rooms[th.hub.roomKey("den")]; !exists {
+		t.Fatal("room reaped before the TTL elapsed")
+	}
+
+	// Until it expires, the empty room keeps its name and is listed with no members.
+	th.send("bob", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den"})
+	if response := findResponse(t, th.drain("bob"), "NEW_ROOM"); response["result"] != string(protocol.ResultRoomAlreadyExists) {
+		t.Errorf("NEW_ROOM on an empty room: result = %v, want %s", response["result"], protocol.ResultRoomAlreadyExists)
+	}
+	th.send("bob", protocol.ListRoomsRequest{Type: protocol.TypeListRooms})
+	lists := messagesOfType(th.drain("bob"), protocol.TypeRoomList)
+	if len(lists) != 1 {
+		t.Fatalf("got %d ROOM_LIST messages, want 1", len(lists))
+	}
+	if rooms, _ := lists[0]["rooms"].(map[string]any); rooms["den"] != 0.0 {
+		t.Errorf("rooms = %v, want den listed with 0 members", rooms)
+	}
+
+	// The invitation survived the empty period, and using it cancels the deletion.
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	if response := findResponse(t, th.drain("bob"), "JOIN_ROOM"); response["result"] != string(protocol.ResultSuccess) {
+		t.Fatalf("join after the room emptied: result = %v, want %s", response["result"], protocol.ResultSuccess)
+	}
+	th.hub.expireEmptyRooms(time.Now().Add(time.Minute))
+	if _, exists := th.hub.rooms[th.hub.roomKey("den")]; !exists {
+		t.Fatal("room with a member reaped")
+	}
+
+	th.send("bob", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "den"})
+	th.drainAll()
+	if room.emptySince.IsZero() {
+		t.Fatal("room not marked empty after its last member left")
+	}
+	th.hub.expireEmptyRooms(room.emptySince.Add(31 * time.Second))
+	if _, exists := th.hub.rooms[th.hub.roomKey("den")]; exists {
+		t.Error("room still present after staying empty past the TTL")
+	}
+}
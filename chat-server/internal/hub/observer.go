@@ -0,0 +1,47 @@
+package hub
+
+import "chat-server/internal/protocol"
+
+// HubObserver is notified of hub events, so integrations such as audit
+// logs, moderation tools or bots can follow the chat without changes to
+// the hub itself.
+//
+// Methods are called synchronously from the hub goroutine, in the order
+// the events happen. They must return quickly and must not call methods
+// that wait on the hub, such as Register or Deliver. Arguments are copies
+// and stay valid after the call.
+type HubObserver interface {
+	// OnIdentify is called when a client identifies as a new user, and
+	// when a session is resumed on a new connection with that client's ID.
+	OnIdentify(clientID ClientID, username string)
+
+	// OnMessage is called for every delivered TEXT, PUBLIC_TEXT and
+	// ROOM_TEXT message.
+	OnMessage(message ObservedMessage)
+
+	// OnRoomJoin is called when a user becomes a member of a room,
+	// including the creator of a new room.
+	OnRoomJoin(roomName string, username string)
+
+	// OnDisconnect is called when a user is gone for good. Sessions kept
+	// for reconnection are reported only once they expire.
+	OnDisconnect(clientID ClientID, username string, reason string)
+}
+
+// ObservedMessage describes a chat message passed to HubObserver.OnMessage.
+// Recipient is set for TEXT and RoomName for ROOM_TEXT.
+type ObservedMessage struct {
+	Type      protocol.MessageType
+	Sender    string
+	Recipient string
+	RoomName  string
+	Text      string
+}
+
+// noopObserver is used when New is given no observer.
+type noopObserver struct{}
+
+func (noopObserver) OnIdentify(ClientID, string)           {}
+func (noopObserver) OnMessage(ObservedMessage)             {}
+func (noopObserver) OnRoomJoin(string, string)             {}
+func (noopObserver) OnDisconnect(ClientID, string, string) {}
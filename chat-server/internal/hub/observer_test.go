@@ -0,0 +1,89 @@
+package hub
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"chat-server/internal/config"
+	"chat-server/internal/protocol"
+)
+
+// recordingObserver records each callback as a line of text.
+type recordingObserver struct {
+	events []string
+}
+
+func (o *recordingObserver) OnIdentify(clientID ClientID, username string) {
+	o.events = append(o.events, fmt.Sprintf("identify %s as %s", clientID, username))
+}
+
+func (o *recordingObserver) OnMessage(message ObservedMessage) {
+	o.events = append(o.events, fmt.Sprintf(
+		"message %s from %s to %q in %q: %s",
+		message.Type, message.Sender, message.Recipient, message.RoomName, message.Text,
+	))
+}
+
+func (o *recordingObserver) OnRoomJoin(roomName string, username string) {
+	o.events = append(o.events, fmt.Sprintf("join %s by %s", roomName, username))
+}
+
+func (o *recordingObserver) OnDisconnect(clientID ClientID, username string, reason string) {
+	o.events = append(o.events, fmt.Sprintf("disconnect %s (%s): %s", clientID, username, reason))
+}
+
+// newObservedTestHub creates a test hub with the default configuration
+// reporting to observer.
+func newObservedTestHub(t *testing.T, observer HubObserver) *testHub {
+	t.Helper()
+
+	cfg, err := config.FromEnv()
+	if err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	return newTestHubFrom(t, cfg, observer, nil, nil)
+}
+
+func TestObserverCallbacksInOrder(t *testing.T) {
+	observer := &recordingObserver{}
+	th := newObservedTestHub(t, observer)
+
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.send("alice", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "welcome"})
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: "psst"})
+	th.send("bob", protocol.PublicTextRequest{Type: protocol.TypePublicText, Text: "hi all"})
+	th.hub.forceDisconnect(th.ctx, "bob", "connection lost", protocol.DisconnectReasonConnectionLost)
+
+	want := []string{
+		"identify alice as alice",
+		"identify bob as bob",
+		"join den by alice",
+		"join den by bob",
+		`message ROOM_TEXT from alice to "" in "den": welcome`,
+		`message TEXT from alice to "bob" in "": psst`,
+		`message PUBLIC_TEXT from bob to "" in "": hi all`,
+		"disconnect bob (bob): CONNECTION_LOST",
+	}
+	if !slices.Equal(observer.events, want) {
+		t.Errorf("events:\n%q\nwant:\n%q", observer.events, want)
+	}
+}
+
+func TestObserverNotCalledForRejectedRequests(t *testing.T) {
+	observer := &recordingObserver{}
+	th := newObservedTestHub(t, observer)
+
+	th.identify("alice", "alice")
+	observer.events = nil
+
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "ghost", Text: "anyone?"})
+	th.send("alice", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "nowhere"})
+
+	if len(observer.events) != 0 {
+		t.Errorf("got events %q for rejected requests, want none", observer.events)
+	}
+}
@@ -0,0 +1,186 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// stateSaveInterval is how often rooms are written to the state file while
+// the server runs. They are also written on shutdown.
+const stateSaveInterval = 30 * time.Second
+
+// persistedState is the content of the state file.
+type persistedState struct {
+	Rooms []persistedRoom `json:"rooms"`
+}
+
+// persistedRoom describes a room and its members by username, since
+// client IDs do not survive a restart.
+type persistedRoom struct {
+	Name    string   `json:"name"`
+	Public  bool     `json:"public"`
+	Members []string `json:"members"`
+}
+
+// RestoreState recreates the rooms saved in the state file. Saved members
+// rejoin their rooms when they identify again. A missing file is not an
+// error. It must be called before Run.
+func (h *Hub) RestoreState() error {
+	if h.cfg.StateFile == "" {
+		return nil
+	}
+
+	contents, err := os.ReadFile(h.cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read state file: %w", err)
+	}
+
+	var state persistedState
+	if err := json.Unmarshal(contents, &state); err != nil {
+		return fmt.Errorf("parse state file %s: %w", h.cfg.StateFile, err)
+	}
+
+	for _, saved := range state.Rooms {
+		if saved.Name == "" || len(saved.Members) == 0 {
+			continue
+		}
+
+		room := h.newRoomState(saved.Name, saved.Public)
+		for _, username := range saved.Members {
+			room.absentMembers[h.usernameKey(username)] = username
+		}
+		h.rooms[h.roomKey(saved.Name)] = room
+	}
+
+	if h.cfg.AbsentMemberTTLSecs > 0 {
+		h.absentMembersUntil = time.Now().Add(time.Duration(h.cfg.AbsentMemberTTLSecs) * time.Second)
+	}
+
+	h.logger.Printf("restored %d rooms from %s", len(h.rooms), h.cfg.StateFile)
+	return nil
+}
+
+// expireAbsentMembers drops the restored members that did not identify
+// within AbsentMemberTTLSecs of startup, deleting rooms left empty.
+func (h *Hub) expireAbsentMembers(now time.Time) {
+	if h.absentMembersUntil.IsZero() || now.Before(h.absentMembersUntil) {
+		return
+	}
+	h.absentMembersUntil = time.Time{}
+
+	dropped := 0
+	for _, room := range h.rooms {
+		if len(room.absentMembers) == 0 {
+			continue
+		}
+		dropped += len(room.absentMembers)
+		clear(room.absentMembers)
+		h.deleteRoomIfEmpty(room)
+	}
+	if dropped > 0 {
+		h.logger.Printf("dropped %d restored members that did not return", dropped)
+	}
+}
+
+// saveStateIfDue writes the state file once stateSaveInterval has passed
+// since the last write.
+func (h *Hub) saveStateIfDue(now time.Time) {
+	if h.cfg.StateFile == "" || now.Sub(h.stateSavedAt) < stateSaveInterval {
+		return
+	}
+	h.saveState(now)
+}
+
+// saveState writes every room with its current and absent members to the
+// state file. The file is replaced atomically, so a crash mid-write keeps
+// the previous state.
+func (h *Hub) saveState(now time.Time) {
+	if h.cfg.StateFile == "" {
+		return
+	}
+	h.stateSavedAt = now
+
+	state := persistedState{Rooms: make([]persistedRoom, 0, len(h.rooms))}
+	for _, room := range h.rooms {
+		members := make([]string, 0, len(room.members)+len(room.absentMembers))
+		for memberClientID := range room.members {
+			if username, isIdentified := h.clientUser[memberClientID]; isIdentified {
+				members = append(members, username)
+			}
+		}
+		for _, username := range room.absentMembers {
+			members = append(members, username)
+		}
+		sort.Strings(members)
+
+		state.Rooms = append(state.Rooms, persistedRoom{
+			Name:    room.name,
+			Public:  room.public,
+			Members: members,
+		})
+	}
+	sort.Slice(state.Rooms, func(i, j int) bool {
+		return state.Rooms[i].Name < state.Rooms[j].Name
+	})
+
+	if err := writeFileAtomic(h.cfg.StateFile, state); err != nil {
+		h.logger.Printf("state save failed: %v", err)
+	}
+}
+
+// writeFileAtomic encodes value as JSON into a temporary file next to path
+// and renames it over path.
+func writeFileAtomic(path string, value any) error {
+	contents, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode state: %w", err)
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temporary state file: %w", err)
+	}
+	defer func() {
+		_ = os.Remove(tempFile.Name())
+	}()
+
+	if _, err := tempFile.Write(contents); err != nil {
+		_ = tempFile.Close()
+		return fmt.Errorf("write temporary state file: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("close temporary state file: %w", err)
+	}
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		return fmt.Errorf("replace state file: %w", err)
+	}
+	return nil
+}
+
+// reattachRooms returns a user who identifies to the restored rooms it was
+// a member of before the restart, announcing it like a regular join. It
+// reports whether any room was reattached.
+func (h *Hub) reattachRooms(ctx context.Context, clientID ClientID, username string) bool {
+	key := h.usernameKey(username)
+	reattached := false
+	for _, room := range h.rooms {
+		if _, wasMember := room.absentMembers[key]; !wasMember {
+			continue
+		}
+		delete(room.absentMembers, key)
+
+		h.admitRoomMember(clientID, room)
+		h.announceRoomJoin(ctx, room, username)
+		reattached = true
+	}
+	return reattached
+}
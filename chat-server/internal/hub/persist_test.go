@@ -0,0 +1,131 @@
+package hub
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"chat-server/internal/config"
+	"chat-server/internal/protocol"
+)
+
+// newPersistTestHub creates a test hub saving its rooms to stateFile.
+func newPersistTestHub(t *testing.T, stateFile string) *testHub {
+	t.Helper()
+
+	return newTestHub(t, func(cfg *config.Config) {
+		cfg.StateFile = stateFile
+		cfg.AbsentMemberTTLSecs = 60
+	})
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	before := newPersistTestHub(t, stateFile)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		before.identify(ClientID(username), username)
+	}
+	before.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den"})
+	before.send("alice", protocol.InviteRequest{Type: protocol.TypeInvite, RoomName: "den", Usernames: []string{"bob"}})
+	before.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	before.send("carol", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "lounge", Public: true})
+	before.hub.saveState(time.Now())
+
+	after := newPersistTestHub(t, stateFile)
+	if err := after.hub.RestoreState(); err != nil {
+		t.Fatalf("RestoreState: %v", err)
+	}
+
+	if got := slices.Sorted(maps.Keys(after.hub.rooms)); !slices.Equal(got, []string{"den", "lounge"}) {
+		t.Fatalf("restored rooms = %v, want [den lounge]", got)
+	}
+	den, lounge := after.hub.rooms["den"], after.hub.rooms["lounge"]
+	if den.public || !lounge.public {
+		t.Errorf("den public = %t, lounge public = %t; want false and true", den.public, lounge.public)
+	}
+	if got := slices.Sorted(maps.Values(den.absentMembers)); !slices.Equal(got, []string{"alice", "bob"}) {
+		t.Errorf("den absent members = %v, want [alice bob]", got)
+	}
+	if len(den.members) != 0 {
+		t.Errorf("den members = %v before anyone identified", den.members)
+	}
+}
+
+func TestRestoredMembersReattachOnIdentify(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	before := newPersistTestHub(t, stateFile)
+	before.identify("alice", "alice")
+	before.identify("bob", "bob")
+	before.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	before.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	before.hub.saveState(time.Now())
+
+	th := newPersistTestHub(t, stateFile)
+	if err := th.hub.RestoreState(); err != nil {
+		t.Fatalf("RestoreState: %v", err)
+	}
+
+	// Restored members reconnect under new client IDs.
+	th.identify("alice-2", "alice")
+	den := th.hub.rooms["den"]
+	if _, member := den.members["alice-2"]; !member {
+		t.Fatal("alice was not reattached to den")
+	}
+
+	th.connect("bob-2")
+	th.send("bob-2", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "bob"})
+	if _, member := den.members["bob-2"]; !member {
+		t.Fatal("bob was not reattached to den")
+	}
+	if joined := messagesOfType(th.drain("alice-2"), protocol.TypeJoinedRoom); len(joined) != 1 || joined[0]["username"] != "bob" {
+		t.Errorf("alice got JOINED_ROOM %v, want bob rejoining", joined)
+	}
+	if len(den.absentMembers) != 0 {
+		t.Errorf("absent members left after both returned: %v", den.absentMembers)
+	}
+
+	th.identify("carol", "carol")
+	if _, member := den.members["carol"]; member {
+		t.Error("a user who was never a member joined a restored room")
+	}
+}
+
+func TestRestoredMembersExpire(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	before := newPersistTestHub(t, stateFile)
+	before.identify("alice", "alice")
+	before.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den"})
+	before.hub.saveState(time.Now())
+
+	th := newPersistTestHub(t, stateFile)
+	if err := th.hub.RestoreState(); err != nil {
+		t.Fatalf("RestoreState: %v", err)
+	}
+
+	th.hub.expireAbsentMembers(time.Now().Add(61 * time.Second))
+	if _, exists := th.hub.rooms["den"]; exists {
+		t.Error("room kept after its restored members failed to return")
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	dir := t.TempDir()
+
+	missing := newPersistTestHub(t, filepath.Join(dir, "missing.json"))
+	if err := missing.hub.RestoreState(); err != nil {
+		t.Errorf("missing state file: %v", err)
+	}
+
+	corruptFile := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corruptFile, []byte(`{"rooms": [`), 0o600); err != nil {
+		t.Fatalf("write state file: %v", err)
+	}
+	corrupt := newPersistTestHub(t, corruptFile)
+	if err := corrupt.hub.RestoreState(); err == nil {
+		t.Error("corrupt state file restored without error")
+	}
+}
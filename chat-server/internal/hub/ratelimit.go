@@ -0,0 +1,69 @@
+package hub
+
+import "time"
+
+// byteWindow sums the bytes received over a sliding time window. Like
+// tokenBucket, it is owned by the hub goroutine.
+type byteWindow struct {
+	entries []byteWindowEntry
+	total   int
+}
+
+type byteWindowEntry struct {
+	at    time.Time
+	bytes int
+}
+
+// allow adds frameBytes received at now unless that would bring the total
+// within the last window over budget, in which case nothing is recorded.
+func (bw *byteWindow) allow(now time.Time, frameBytes int, budget int, window time.Duration) bool {
+	cutoff := now.Add(-window)
+	expired := 0
+	for expired < len(bw.entries) && !bw.entries[expired].at.After(cutoff) {
+		bw.total -= bw.entries[expired].bytes
+		expired++
+	}
+	bw.entries = bw.entries[expired:]
+
+	if bw.total+frameBytes > budget {
+		return false
+	}
+	bw.entries = append(bw.entries, byteWindowEntry{at: now, bytes: frameBytes})
+	bw.total += frameBytes
+	return true
+}
+
+// tokenBucket is a token-bucket rate limiter. It is not safe for
+// concurrent use and is meant to be owned by the hub goroutine.
+type tokenBucket struct {
+	ratePerSecond float64
+	capacity      float64
+	tokens        float64
+	lastRefill    time.Time
+}
+
+// newTokenBucket creates a full bucket that refills at ratePerSecond tokens
+// per second and holds at most one second worth of tokens.
+func newTokenBucket(ratePerSecond int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		ratePerSecond: float64(ratePerSecond),
+		capacity:      float64(ratePerSecond),
+		tokens:        float64(ratePerSecond),
+		lastRefill:    now,
+	}
+}
+
+// allow consumes one token if available.
+func (tb *tokenBucket) allow(now time.Time) bool {
+	elapsed := now.Sub(tb.lastRefill).Seconds()
+	if elapsed > 0 {
+		tb.tokens = min(tb.capacity, tb.tokens+elapsed*tb.ratePerSecond)
+		tb.lastRefill = now
+	}
+
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
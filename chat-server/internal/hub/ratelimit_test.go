@@ -0,0 +1,187 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"chat-server/internal/config"
+	"chat-server/internal/protocol"
+)
+
+func TestTokenBucketRefills(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	bucket := newTokenBucket(2, start)
+
+	for i := range 2 {
+		if !bucket.allow(start) {
+			t.Fatalf("message %d refused by a full bucket", i+1)
+		}
+	}
+	if bucket.allow(start) {
+		t.Fatal("message allowed by an empty bucket")
+	}
+
+	if !bucket.allow(start.Add(500 * time.Millisecond)) {
+		t.Error("message refused after half a second refilled one token")
+	}
+	if bucket.allow(start.Add(500 * time.Millisecond)) {
+		t.Error("second message allowed with no token left")
+	}
+
+	// A long pause refills the bucket to capacity, not beyond.
+	later := start.Add(time.Minute)
+	for i := range 2 {
+		if !bucket.allow(later) {
+			t.Fatalf("message %d refused after a long pause", i+1)
+		}
+	}
+	if bucket.allow(later) {
+		t.Error("bucket refilled beyond its capacity")
+	}
+}
+
+func TestGlobalMessageRateIsBounded(t *testing.T) {
+	const (
+		ratePerSecond = 10
+		senders       = 5
+		perSender     = 10
+	)
+
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.GlobalMessagesPerSecond = ratePerSecond
+	})
+	th.identify("watcher", "watcher")
+	for i := range senders {
+		// Identifying uses up budget too; start the flood with a full one.
+		th.hub.globalLimiter = newTokenBucket(ratePerSecond, time.Now())
+		th.identify(ClientID(fmt.Sprintf("sender%d", i)), fmt.Sprintf("sender%d", i))
+	}
+	th.hub.globalLimiter = newTokenBucket(ratePerSecond, time.Now())
+
+	start := time.Now()
+	for range perSender {
+		for i := range senders {
+			th.send(ClientID(fmt.Sprintf("sender%d", i)), protocol.PublicTextRequest{Type: protocol.TypePublicText, Text: "flood"})
+		}
+	}
+	elapsed := time.Since(start)
+
+	processed := len(messagesOfType(th.drain("watcher"), protocol.TypePublicTextFrom))
+	limit := ratePerSecond + int(math.Ceil(elapsed.Seconds()*ratePerSecond))
+	if processed < ratePerSecond || processed > limit {
+		t.Errorf("processed %d of %d messages in %v, want between %d and %d",
+			processed, senders*perSender, elapsed, ratePerSecond, limit)
+	}
+
+	refused := 0
+	for i := range senders {
+		for _, response := range messagesOfType(th.drain(ClientID(fmt.Sprintf("sender%d", i))), protocol.TypeResponse) {
+			if response["result"] == string(protocol.ResultRateLimited) && response["operation"] == "PUBLIC_TEXT" {
+				refused++
+			}
+		}
+		if !th.isConnected(ClientID(fmt.Sprintf("sender%d", i))) {
+			t.Errorf("sender%d disconnected by load shedding", i)
+		}
+	}
+	if processed+refused != senders*perSender {
+		t.Errorf("processed %d and refused %d, want every one of %d messages accounted for",
+			processed, refused, senders*perSender)
+	}
+}
+
+func TestByteWindowSlides(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	window := &byteWindow{}
+
+	if !window.allow(start, 60, 100, time.Second) {
+		t.Fatal("first frame refused")
+	}
+	if window.allow(start.Add(500*time.Millisecond), 50, 100, time.Second) {
+		t.Fatal("frame over budget allowed")
+	}
+	if !window.allow(start.Add(500*time.Millisecond), 40, 100, time.Second) {
+		t.Fatal("frame within budget refused")
+	}
+	if !window.allow(start.Add(time.Second), 50, 100, time.Second) {
+		t.Error("frame refused after the first one left the window")
+	}
+}
+
+func TestClientByteBudget(t *testing.T) {
+	frame, err := json.Marshal(protocol.RoomTextRequest{
+		Type:     protocol.TypeRoomText,
+		RoomName: "den",
+		Text:     strings.Repeat("x", 300),
+	})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	// Two large frames fit the budget, and the message-count limit would
+	// allow many more.
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.ClientByteBudget = 2*len(frame) + 10
+		cfg.ClientByteWindowSecs = 60
+		cfg.MaxByteBudgetViolations = 2
+		cfg.RoomMessagesPerSecond = 10
+	})
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.drainAll()
+	th.hub.clientStats["alice"].received = byteWindow{}
+
+	for range 2 {
+		th.sendRaw("alice", frame)
+	}
+	if got := messagesOfType(th.drain("bob"), protocol.TypeRoomTextFrom); len(got) != 2 {
+		t.Fatalf("bob got %d messages within the budget, want 2", len(got))
+	}
+
+	th.sendRaw("alice", frame)
+	response := asResponse(t, findResponse(t, th.drain("alice"), "ROOM_TEXT"))
+	if response.Result != protocol.ResultRateLimited {
+		t.Errorf("result over the budget = %s, want %s", response.Result, protocol.ResultRateLimited)
+	}
+	if got := messagesOfType(th.drain("bob"), protocol.TypeRoomTextFrom); len(got) != 0 {
+		t.Errorf("bob got %v past the byte budget", got)
+	}
+	if !th.isConnected("alice") {
+		t.Fatal("alice disconnected on the first violation")
+	}
+
+	th.sendRaw("alice", frame)
+	if th.isConnected("alice") {
+		t.Error("alice still connected after repeated violations")
+	}
+	if !strings.Contains(th.logs.String(), "reason=byte budget exceeded") {
+		t.Errorf("disconnect reason not logged:\n%s", th.logs.String())
+	}
+}
+
+func TestByteBudgetViolationsResetByAllowedFrame(t *testing.T) {
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.ClientByteBudget = 200
+		cfg.ClientByteWindowSecs = 60
+		cfg.MaxByteBudgetViolations = 2
+	})
+	th.identify("alice", "alice")
+	stats := th.hub.clientStats["alice"]
+	stats.received = byteWindow{}
+	large := []byte(`{"type":"PUBLIC_TEXT","text":"` + strings.Repeat("x", 200) + `"}`)
+	small := []byte(`{"type":"PUBLIC_TEXT","text":"hi"}`)
+
+	th.sendRaw("alice", large)
+	th.sendRaw("alice", small)
+	th.sendRaw("alice", large)
+
+	if !th.isConnected("alice") {
+		t.Error("alice disconnected although an allowed frame came between violations")
+	}
+}
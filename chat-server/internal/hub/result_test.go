@@ -0,0 +1,168 @@
+package hub
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"chat-server/internal/config"
+	"chat-server/internal/protocol"
+)
+
+// knownResultCodes returns the values of the ResultCode constants
+// declared in the protocol package.
+func knownResultCodes(t *testing.T) map[string]struct{} {
+	t.Helper()
+
+	file, err := parser.ParseFile(token.NewFileSet(), filepath.Join("..", "protocol", "types.go"), nil, 0)
+	if err != nil {
+		t.Fatalf("parse protocol types: %v", err)
+	}
+
+	codes := make(map[string]struct{})
+	ast.Inspect(file, func(node ast.Node) bool {
+		spec, ok := node.(*ast.ValueSpec)
+		if !ok {
+			return true
+		}
+		if ident, ok := spec.Type.(*ast.Ident); !ok || ident.Name != "ResultCode" {
+			return true
+		}
+		for _, value := range spec.Values {
+			literal, ok := value.(*ast.BasicLit)
+			if !ok {
+				continue
+			}
+			code, err := strconv.Unquote(literal.Value)
+			if err != nil {
+				t.Fatalf("result code %s: %v", literal.Value, err)
+			}
+			codes[code] = struct{}{}
+		}
+		return true
+	})
+	if len(codes) == 0 {
+		t.Fatal("no ResultCode constants found")
+	}
+	return codes
+}
+
+func TestHubUsesResultCodeConstants(t *testing.T) {
+	paths, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatalf("list sources: %v", err)
+	}
+
+	fileSet := token.NewFileSet()
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		source, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read %s: %v", path, err)
+		}
+		file, err := parser.ParseFile(fileSet, path, source, 0)
+		if err != nil {
+			t.Fatalf("parse %s: %v", path, err)
+		}
+
+		ast.Inspect(file, func(node ast.Node) bool {
+			field, ok := node.(*ast.KeyValueExpr)
+			if !ok {
+				return true
+			}
+			if key, ok := field.Key.(*ast.Ident); !ok || key.Name != "Result" {
+				return true
+			}
+			if literal, ok := field.Value.(*ast.BasicLit); ok {
+				t.Errorf("%s: result literal %s instead of a protocol.ResultCode constant",
+					fileSet.Position(literal.Pos()), literal.Value)
+			}
+			return true
+		})
+	}
+}
+
+func TestEmittedResultsAreKnown(t *testing.T) {
+	known := knownResultCodes(t)
+	th := newTestHub(t, func(cfg *config.Config) {
+		cfg.AdminToken = adminToken
+		cfg.MaxRoomMembers = 2
+		cfg.ReservedUsernames = map[string]struct{}{"admin": {}}
+	})
+
+	th.connect("guest")
+	th.send("guest", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: "early"})
+	th.send("guest", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "admin"})
+	th.send("guest", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "guest", Version: protocol.ProtocolVersion + 1})
+	for _, username := range []string{"alice", "bob", "carol"} {
+		th.identify(ClientID(username), username)
+	}
+
+	requests := []struct {
+		clientID ClientID
+		request  any
+	}{
+		{"alice", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "alice"}},
+		{"alice", protocol.StatusRequest{Type: protocol.TypeStatus, Status: protocol.StatusAway}},
+		{"alice", map[string]any{"type": protocol.TypeStatus, "status": "SLEEPING"}},
+		{"alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: "hi"}},
+		{"alice", protocol.TextRequest{Type: protocol.TypeText, Username: "alice", Text: "me"}},
+		{"alice", protocol.TextRequest{Type: protocol.TypeText, Username: "ghost", Text: "boo"}},
+		{"alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: strings.Repeat("x", th.hub.cfg.MaxTextLength+1)}},
+		{"alice", protocol.PublicTextRequest{Type: protocol.TypePublicText, Text: "all"}},
+		{"alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den"}},
+		{"alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den"}},
+		{"alice", protocol.InviteRequest{Type: protocol.TypeInvite, RoomName: "den", Usernames: []string{"bob", "carol", "ghost"}}},
+		{"alice", protocol.InviteRequest{Type: protocol.TypeInvite, RoomName: "nowhere", Usernames: []string{"bob"}}},
+		{"bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"}},
+		{"carol", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"}},
+		{"carol", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "nowhere"}},
+		{"carol", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "let me in"}},
+		{"alice", protocol.UninviteRequest{Type: protocol.TypeUninvite, RoomName: "den", Usernames: []string{"carol", "bob"}}},
+		{"alice", protocol.RoomTextRequest{Type: protocol.TypeRoomText, RoomName: "den", Text: "hello"}},
+		{"alice", protocol.RoomUsersRequest{Type: protocol.TypeRoomUsers, RoomName: "den"}},
+		{"alice", protocol.MuteRoomRequest{Type: protocol.TypeMuteRoom, RoomName: "den"}},
+		{"alice", protocol.UnmuteRoomRequest{Type: protocol.TypeUnmuteRoom, RoomName: "den"}},
+		{"bob", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "den"}},
+		{"bob", protocol.LeaveRoomRequest{Type: protocol.TypeLeaveRoom, RoomName: "den"}},
+		{"alice", protocol.ChangeUsernameRequest{Type: protocol.TypeChangeUsername, Username: "bob"}},
+		{"alice", protocol.ChangeUsernameRequest{Type: protocol.TypeChangeUsername, Username: "alicia"}},
+		{"alice", protocol.AdminRequest{Type: protocol.TypeAdmin, Token: adminToken, Command: "reboot"}},
+		{"alice", protocol.AdminRequest{Type: protocol.TypeAdmin, Token: adminToken, Command: protocol.AdminCommandKickUser, Username: "ghost"}},
+		{"alice", protocol.AdminRequest{Type: protocol.TypeAdmin, Token: adminToken, Command: protocol.AdminCommandKickUser, Username: "alicia"}},
+		{"alice", protocol.AdminRequest{Type: protocol.TypeAdmin, Token: adminToken, Command: protocol.AdminCommandKickUser, Username: "carol"}},
+		{"bob", protocol.AdminRequest{Type: protocol.TypeAdmin, Token: "wrong", Command: protocol.AdminCommandListClients}},
+	}
+
+	responses := 0
+	check := func(clientID ClientID) {
+		for _, response := range messagesOfType(th.drain(clientID), protocol.TypeResponse) {
+			responses++
+			result, _ := response["result"].(string)
+			if _, isKnown := known[result]; !isKnown {
+				t.Errorf("%s got unknown result %q in %v", clientID, result, response)
+			}
+		}
+	}
+
+	check("guest")
+	for _, step := range requests {
+		th.send(step.clientID, step.request)
+		for clientID := range th.writers {
+			check(clientID)
+		}
+	}
+	th.sendRaw("alice", []byte(`{"type":`))
+	check("alice")
+
+	if responses < len(requests)/2 {
+		t.Errorf("checked only %d responses for %d requests", responses, len(requests))
+	}
+}
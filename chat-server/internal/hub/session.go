@@ -0,0 +1,263 @@
+package hub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"chat-server/internal/audit"
+	"chat-server/internal/protocol"
+)
+
+// reconnectTokenBytes is the amount of randomness in a reconnect token.
+const reconnectTokenBytes = 16
+
+// heldUsername is the username of a released session, kept reserved for
+// the holder of its last reconnect token until the given time.
+type heldUsername struct {
+	token string
+	until time.Time
+}
+
+// issueReconnectToken creates a fresh reconnect token for an identified
+// client, replacing any previous one. It returns an empty string when
+// neither session resumption nor username holds are enabled.
+func (h *Hub) issueReconnectToken(clientID ClientID) string {
+	if h.cfg.ReconnectGraceSecs <= 0 && h.cfg.UsernameHoldSecs <= 0 {
+		return ""
+	}
+
+	randomBytes := make([]byte, reconnectTokenBytes)
+	if _, err := rand.Read(randomBytes); err != nil {
+		h.logger.Printf("reconnect token generation failed: %v", err)
+		return ""
+	}
+
+	h.revokeReconnectToken(clientID)
+
+	token := hex.EncodeToString(randomBytes)
+	h.reconnectTokens[token] = clientID
+	h.clientToken[clientID] = token
+	return token
+}
+
+// revokeReconnectToken invalidates the reconnect token of a client and
+// forgets any detached session it had.
+func (h *Hub) revokeReconnectToken(clientID ClientID) {
+	if token, hasToken := h.clientToken[clientID]; hasToken {
+		delete(h.reconnectTokens, token)
+		delete(h.clientToken, clientID)
+	}
+	delete(h.detachedUntil, clientID)
+}
+
+// detachSession keeps the state of an identified client whose connection
+// was lost, so it can be resumed with its reconnect token. Only involuntary
+// transport failures detach; every other disconnect releases the session.
+// It reports whether the session was detached.
+func (h *Hub) detachSession(clientID ClientID, relayedReason string) bool {
+	if h.cfg.ReconnectGraceSecs <= 0 {
+		return false
+	}
+	if _, hasToken := h.clientToken[clientID]; !hasToken {
+		return false
+	}
+
+	if !isInvoluntaryDisconnect(relayedReason) {
+		return false
+	}
+
+	h.detachedUntil[clientID] = time.Now().Add(time.Duration(h.cfg.ReconnectGraceSecs) * time.Second)
+	return true
+}
+
+// isDetached reports whether a client's session is kept without a connection.
+func (h *Hub) isDetached(clientID ClientID) bool {
+	_, detached := h.detachedUntil[clientID]
+	return detached
+}
+
+// isInvoluntaryDisconnect reports whether a disconnect reason describes a
+// transport failure rather than a decision by the client or the server.
+func isInvoluntaryDisconnect(relayedReason string) bool {
+	switch relayedReason {
+	case protocol.DisconnectReasonConnectionLost, protocol.DisconnectReasonSendFailed:
+		return true
+	default:
+		return false
+	}
+}
+
+// expireDetachedSessions releases detached sessions whose grace period
+// has elapsed, notifying rooms and users as for a regular disconnect.
+func (h *Hub) expireDetachedSessions(ctx context.Context, now time.Time) {
+	for clientID, expiresAt := range h.detachedUntil {
+		if now.Before(expiresAt) {
+			continue
+		}
+
+		h.releaseClientState(ctx, clientID, protocol.DisconnectReasonConnectionLost)
+		h.logger.Printf("detached session expired: id=%s", clientID)
+	}
+}
+
+// resumeSession moves the session identified by the request's reconnect
+// token onto a new connection. If the session's previous connection is
+// still open, it is closed without notifying anyone. The resumed session
+// uses version, the protocol version negotiated by the new IDENTIFY. It
+// reports whether the session was resumed; on false the caller proceeds
+// with a regular IDENTIFY.
+func (h *Hub) resumeSession(
+	ctx context.Context,
+	clientID ClientID,
+	request protocol.IdentifyRequest,
+	version int,
+) bool {
+	previousClientID, exists := h.reconnectTokens[request.ReconnectToken]
+	if !exists || previousClientID == clientID {
+		return false
+	}
+
+	previousUsername := h.clientUser[previousClientID]
+	if h.usernameKey(previousUsername) != h.usernameKey(request.Username) {
+		return false
+	}
+
+	if previousWriter, isConnected := h.clients[previousClientID]; isConnected {
+		h.logger.Printf(
+			"client replaced by resumed session: id=%s stats: %s",
+			previousClientID, h.clientStatsSummary(previousClientID),
+		)
+		delete(h.clients, previousClientID)
+		delete(h.clientAddr, previousClientID)
+		delete(h.clientConnectedAt, previousClientID)
+		delete(h.clientStats, previousClientID)
+		if err := previousWriter.Close(); err != nil {
+			h.logger.Printf("client close error: %v", err)
+		}
+	}
+
+	h.revokeReconnectToken(previousClientID)
+	h.transferSession(previousClientID, clientID)
+	h.clientVersion[clientID] = version
+
+	h.sendIdentifyResponse(ctx, clientID, protocol.ResponseMessage{
+		Type:           protocol.TypeResponse,
+		Operation:      "IDENTIFY",
+		Result:         protocol.ResultResumed,
+		Extra:          previousUsername,
+		Version:        version,
+		ReconnectToken: h.issueReconnectToken(clientID),
+	}, request.Compression)
+	h.sendMembershipSnapshot(ctx, clientID)
+	// The session now lives under clientID, which later events such as
+	// OnDisconnect report, so observers and the audit trail learn it here.
+	h.observer.OnIdentify(clientID, previousUsername)
+	h.recordAudit(audit.Event{
+		Event:      audit.EventIdentify,
+		ClientID:   string(clientID),
+		Username:   previousUsername,
+		RemoteAddr: h.clientAddr[clientID],
+		Reason:     "resumed",
+	})
+
+	h.logger.Printf("session resumed: id=%s previous=%s user=%s", clientID, previousClientID, previousUsername)
+	return true
+}
+
+// transferSession re-keys all per-client state from one client ID to
+// another, including room memberships and invitations.
+func (h *Hub) transferSession(from ClientID, to ClientID) {
+	username := h.clientUser[from]
+	h.clientUser[to] = username
+	h.clientStatus[to] = h.clientStatus[from]
+	if statusMessage, hasMessage := h.clientStatusMessage[from]; hasMessage {
+		h.clientStatusMessage[to] = statusMessage
+	}
+	h.clientVersion[to] = h.clientVersion[from]
+	h.usernameOwner[h.usernameKey(username)] = to
+
+	if _, optedOut := h.presenceOptOut[from]; optedOut {
+		h.presenceOptOut[to] = struct{}{}
+	}
+
+	if roomSet, hasRooms := h.clientRooms[from]; hasRooms {
+		h.clientRooms[to] = roomSet
+	}
+
+	for roomKey := range h.clientInvites[from] {
+		if room, exists := h.rooms[roomKey]; exists {
+			invitedAt := room.invited[from]
+			h.removeInvitation(room, from)
+			h.addInvitation(room, to, invitedAt)
+		}
+	}
+
+	for _, room := range h.rooms {
+		if _, isMember := room.members[from]; isMember {
+			room.members[to] = struct{}{}
+		}
+		if _, isMuted := room.muted[from]; isMuted {
+			room.muted[to] = struct{}{}
+		}
+		if limiter, hasLimiter := room.rateLimiters[from]; hasLimiter {
+			room.rateLimiters[to] = limiter
+		}
+		wasOwner := room.owner == from
+		room.removeMember(from)
+		if wasOwner {
+			room.owner = to
+		}
+	}
+
+	delete(h.clientUser, from)
+	delete(h.clientStatus, from)
+	delete(h.clientStatusMessage, from)
+	delete(h.clientVersion, from)
+	delete(h.presenceOptOut, from)
+	delete(h.clientRooms, from)
+}
+
+// holdUsername keeps the username of a client being released reserved for
+// its current reconnect token. It must run before the token is revoked.
+func (h *Hub) holdUsername(clientID ClientID, username string) {
+	if h.cfg.UsernameHoldSecs <= 0 {
+		return
+	}
+
+	token, hasToken := h.clientToken[clientID]
+	if !hasToken {
+		return
+	}
+
+	h.heldUsernames[h.usernameKey(username)] = heldUsername{
+		token: token,
+		until: time.Now().Add(time.Duration(h.cfg.UsernameHoldSecs) * time.Second),
+	}
+}
+
+// isUsernameHeld reports whether a username is reserved for someone other
+// than the holder of token.
+func (h *Hub) isUsernameHeld(username string, token string) bool {
+	hold, isHeld := h.heldUsernames[h.usernameKey(username)]
+	if !isHeld || !time.Now().Before(hold.until) {
+		return false
+	}
+	return token == "" || token != hold.token
+}
+
+// reclaimUsername drops the hold on a username claimed by its holder.
+func (h *Hub) reclaimUsername(username string) {
+	delete(h.heldUsernames, h.usernameKey(username))
+}
+
+// expireHeldUsernames releases username holds whose time has elapsed.
+func (h *Hub) expireHeldUsernames(now time.Time) {
+	for key, hold := range h.heldUsernames {
+		if now.Before(hold.until) {
+			continue
+		}
+		delete(h.heldUsernames, key)
+	}
+}
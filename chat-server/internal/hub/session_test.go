@@ -0,0 +1,262 @@
+package hub
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"chat-server/internal/audit"
+	"chat-server/internal/config"
+	"chat-server/internal/protocol"
+)
+
+// identifyForToken identifies clientID as username and returns the
+// reconnect token from the IDENTIFY response.
+func (th *testHub) identifyForToken(clientID ClientID, username string) string {
+	th.t.Helper()
+
+	th.connect(clientID)
+	th.send(clientID, protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: username})
+	response := asResponse(th.t, findResponse(th.t, th.drain(clientID), "IDENTIFY"))
+	if response.ReconnectToken == "" {
+		th.t.Fatalf("IDENTIFY response %+v has no reconnect token", response)
+	}
+	th.drainAll()
+	return response.ReconnectToken
+}
+
+// newSessionTestHub creates a hub that keeps lost sessions for a minute.
+func newSessionTestHub(t *testing.T) *testHub {
+	t.Helper()
+
+	return newTestHub(t, func(cfg *config.Config) {
+		cfg.ReconnectGraceSecs = 60
+	})
+}
+
+func TestResumeSessionWithinGrace(t *testing.T) {
+	th := newSessionTestHub(t)
+	th.identify("bob", "bob")
+	token := th.identifyForToken("alice", "alice")
+	th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: "den", Public: true})
+	th.send("bob", protocol.JoinRoomRequest{Type: protocol.TypeJoinRoom, RoomName: "den"})
+	th.drainAll()
+
+	th.hub.Unregister("alice", "read error: EOF")
+	th.settle()
+	if notices := messagesOfType(th.drain("bob"), protocol.TypeDisconnected); len(notices) != 0 {
+		t.Errorf("detached session announced as disconnected: %v", notices)
+	}
+
+	th.connect("alice-again")
+	th.send("alice-again", protocol.IdentifyRequest{
+		Type:           protocol.TypeIdentify,
+		Username:       "alice",
+		ReconnectToken: token,
+		Version:        protocol.ProtocolVersion,
+	})
+
+	response := asResponse(t, findResponse(t, th.drain("alice-again"), "IDENTIFY"))
+	if response.Result != protocol.ResultResumed {
+		t.Fatalf("result = %s, want %s", response.Result, protocol.ResultResumed)
+	}
+	if response.ReconnectToken == "" || response.ReconnectToken == token {
+		t.Errorf("reconnect token = %q, want a fresh one", response.ReconnectToken)
+	}
+	if th.hub.clientUser["alice-again"] != "alice" {
+		t.Errorf("username = %q, want alice", th.hub.clientUser["alice-again"])
+	}
+	if th.hub.clientVersion["alice-again"] != protocol.ProtocolVersion {
+		t.Errorf("version = %d, want %d", th.hub.clientVersion["alice-again"], protocol.ProtocolVersion)
+	}
+	if !th.hub.isRoomMember(th.hub.rooms[th.hub.roomKey("den")], "alice-again") {
+		t.Error("resumed session lost its room")
+	}
+}
+
+func TestResumeReportsIdentify(t *testing.T) {
+	cfg, err := config.FromEnv()
+	if err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	cfg.ReconnectGraceSecs = 60
+	observer := &recordingObserver{}
+	auditLogger := &capturingAuditLogger{}
+	th := newTestHubFrom(t, cfg, observer, auditLogger, nil)
+	token := th.identifyForToken("alice", "alice")
+	th.hub.Unregister("alice", "read error: EOF")
+	th.settle()
+	observer.events = nil
+	auditLogger.events = nil
+
+	th.connect("alice-again")
+	th.send("alice-again", protocol.IdentifyRequest{
+		Type:           protocol.TypeIdentify,
+		Username:       "alice",
+		ReconnectToken: token,
+	})
+
+	if want := []string{"identify alice-again as alice"}; !slices.Equal(observer.events, want) {
+		t.Errorf("observer events = %q, want %q", observer.events, want)
+	}
+	if len(auditLogger.events) != 1 {
+		t.Fatalf("got %d audit events, want 1: %+v", len(auditLogger.events), auditLogger.events)
+	}
+	event := auditLogger.events[0]
+	event.Time = time.Time{}
+	want := audit.Event{Event: audit.EventIdentify, ClientID: "alice-again", Username: "alice", RemoteAddr: "127.0.0.1:1", Reason: "resumed"}
+	if event != want {
+		t.Errorf("audit event = %+v, want %+v", event, want)
+	}
+}
+
+func TestResumeSendsMembershipSnapshot(t *testing.T) {
+	th := newSessionTestHub(t)
+	token := th.identifyForToken("alice", "alice")
+	for _, room := range []string{"kitchen", "den"} {
+		th.send("alice", protocol.NewRoomRequest{Type: protocol.TypeNewRoom, RoomName: room})
+	}
+	th.drainAll()
+	if notices := messagesOfType(th.drain("alice"), protocol.TypeRoomMembershipSnapshot); len(notices) != 0 {
+		t.Fatalf("snapshot sent before any reconnect: %v", notices)
+	}
+
+	th.hub.Unregister("alice", "read error: EOF")
+	th.settle()
+	th.connect("alice-again")
+	th.send("alice-again", protocol.IdentifyRequest{
+		Type:           protocol.TypeIdentify,
+		Username:       "alice",
+		ReconnectToken: token,
+	})
+
+	snapshots := messagesOfType(th.drain("alice-again"), protocol.TypeRoomMembershipSnapshot)
+	if len(snapshots) != 1 {
+		t.Fatalf("got %d membership snapshots, want 1", len(snapshots))
+	}
+	var rooms []string
+	for _, room := range snapshots[0]["rooms"].([]any) {
+		rooms = append(rooms, room.(string))
+	}
+	if want := []string{"den", "kitchen"}; !slices.Equal(rooms, want) {
+		t.Errorf("snapshot rooms = %v, want %v", rooms, want)
+	}
+}
+
+func TestReconnectTokenExpires(t *testing.T) {
+	th := newSessionTestHub(t)
+	th.identify("bob", "bob")
+	token := th.identifyForToken("alice", "alice")
+
+	th.hub.Unregister("alice", "read error: EOF")
+	th.settle()
+	th.hub.expireDetachedSessions(th.ctx, time.Now().Add(61*time.Second))
+
+	notices := messagesOfType(th.drain("bob"), protocol.TypeDisconnected)
+	if len(notices) != 1 || notices[0]["username"] != "alice" {
+		t.Errorf("got %v, want DISCONNECTED alice once the grace expired", notices)
+	}
+
+	th.connect("alice-again")
+	th.send("alice-again", protocol.IdentifyRequest{
+		Type:           protocol.TypeIdentify,
+		Username:       "alice",
+		ReconnectToken: token,
+	})
+
+	response := asResponse(t, findResponse(t, th.drain("alice-again"), "IDENTIFY"))
+	if response.Result != protocol.ResultSuccess {
+		t.Errorf("result = %s, want a fresh %s", response.Result, protocol.ResultSuccess)
+	}
+}
+
+func TestResumeReplacesLingeringConnection(t *testing.T) {
+	th := newSessionTestHub(t)
+	token := th.identifyForToken("alice", "alice")
+	previousWriter := th.writers["alice"]
+
+	th.connect("alice-again")
+	th.send("alice-again", protocol.IdentifyRequest{
+		Type:           protocol.TypeIdentify,
+		Username:       "alice",
+		ReconnectToken: token,
+	})
+
+	response := asResponse(t, findResponse(t, th.drain("alice-again"), "IDENTIFY"))
+	if response.Result != protocol.ResultResumed {
+		t.Fatalf("result = %s, want %s", response.Result, protocol.ResultResumed)
+	}
+	if th.isConnected("alice") || !previousWriter.closed {
+		t.Error("previous connection kept after the session resumed elsewhere")
+	}
+}
+
+func TestChangeUsernameRenewsReconnectToken(t *testing.T) {
+	th := newSessionTestHub(t)
+	token := th.identifyForToken("alice", "alice")
+
+	th.send("alice", protocol.ChangeUsernameRequest{Type: protocol.TypeChangeUsername, Username: "alicia"})
+
+	response := asResponse(t, findResponse(t, th.drain("alice"), "CHANGE_USERNAME"))
+	if response.ReconnectToken == "" || response.ReconnectToken == token {
+		t.Fatalf("reconnect token = %q, want a fresh one", response.ReconnectToken)
+	}
+	if _, valid := th.hub.reconnectTokens[token]; valid {
+		t.Error("old reconnect token still valid after the rename")
+	}
+}
+
+// newHoldTestHub creates a hub that holds released usernames for a
+// minute, without keeping detached sessions.
+func newHoldTestHub(t *testing.T) *testHub {
+	t.Helper()
+
+	return newTestHub(t, func(cfg *config.Config) {
+		cfg.ReconnectGraceSecs = 0
+		cfg.UsernameHoldSecs = 60
+	})
+}
+
+func TestHeldUsernameReclaimedByHolder(t *testing.T) {
+	th := newHoldTestHub(t)
+	th.identify("bob", "bob")
+	token := th.identifyForToken("alice", "alice")
+
+	th.send("alice", protocol.DisconnectRequest{Type: protocol.TypeDisconnect})
+	if notices := messagesOfType(th.drain("bob"), protocol.TypeDisconnected); len(notices) != 1 {
+		t.Errorf("got %d DISCONNECTED, want 1 right away", len(notices))
+	}
+
+	th.connect("sniper")
+	th.send("sniper", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "alice"})
+	if response := findResponse(t, th.drain("sniper"), "IDENTIFY"); response["result"] != string(protocol.ResultUserAlreadyExists) {
+		t.Errorf("held name: result = %v, want %s", response["result"], protocol.ResultUserAlreadyExists)
+	}
+
+	th.connect("alice-again")
+	th.send("alice-again", protocol.IdentifyRequest{
+		Type:           protocol.TypeIdentify,
+		Username:       "alice",
+		ReconnectToken: token,
+	})
+	if response := findResponse(t, th.drain("alice-again"), "IDENTIFY"); response["result"] != string(protocol.ResultSuccess) {
+		t.Errorf("holder: result = %v, want %s", response["result"], protocol.ResultSuccess)
+	}
+	if _, held := th.hub.heldUsernames[th.hub.usernameKey("alice")]; held {
+		t.Error("hold kept after the holder reclaimed the name")
+	}
+}
+
+func TestHeldUsernameReleasedAfterHold(t *testing.T) {
+	th := newHoldTestHub(t)
+	th.identifyForToken("alice", "alice")
+	th.send("alice", protocol.DisconnectRequest{Type: protocol.TypeDisconnect})
+
+	th.hub.expireHeldUsernames(time.Now().Add(61 * time.Second))
+
+	th.connect("newcomer")
+	th.send("newcomer", protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: "alice"})
+	if response := findResponse(t, th.drain("newcomer"), "IDENTIFY"); response["result"] != string(protocol.ResultSuccess) {
+		t.Errorf("result = %v, want %s", response["result"], protocol.ResultSuccess)
+	}
+}
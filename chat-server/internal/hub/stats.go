@@ -0,0 +1,125 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"chat-server/internal/protocol"
+)
+
+// recentDropsKept bounds how many dropped frame types a connection's
+// stats remember.
+const recentDropsKept = 8
+
+// clientStats counts what a connection has sent over its lifetime, and
+// the frames it was too slow to take.
+type clientStats struct {
+	messages map[protocol.MessageType]int
+	bytes    int
+
+	// lastFrameAt is when the connection last sent a frame, or connected.
+	// idleWarned records that IDLE_WARNING was sent since then.
+	lastFrameAt time.Time
+	idleWarned  bool
+
+	// dropped counts outbound frames the connection's writer refused;
+	// recentDrops holds the types of the latest ones, oldest first.
+	dropped     int
+	recentDrops []protocol.MessageType
+
+	// received enforces ClientByteBudget; budgetViolations counts the
+	// frames refused by it since the last one allowed.
+	received         byteWindow
+	budgetViolations int
+
+	// protocolViolations counts malformed frames since the last frame
+	// handled without one.
+	protocolViolations int
+}
+
+func newClientStats() *clientStats {
+	return &clientStats{
+		messages:    make(map[protocol.MessageType]int),
+		lastFrameAt: time.Now(),
+	}
+}
+
+// recordFrame counts an inbound frame. Frames that failed envelope
+// decoding are counted in bytes only.
+func (stats *clientStats) recordFrame(messageType protocol.MessageType, frameBytes int) {
+	stats.lastFrameAt = time.Now()
+	stats.idleWarned = false
+	stats.bytes += frameBytes
+	if messageType != "" {
+		stats.messages[messageType]++
+	}
+}
+
+// recordDrop counts an outbound frame the connection's writer refused.
+func (stats *clientStats) recordDrop(frame []byte) {
+	stats.dropped++
+	if len(stats.recentDrops) == recentDropsKept {
+		stats.recentDrops = stats.recentDrops[1:]
+	}
+	stats.recentDrops = append(stats.recentDrops, outboundType(frame))
+}
+
+// dropSummary formats the drop counters for logging, e.g.
+// "dropped=3 recent=ROOM_TEXT_FROM,ROOM_TEXT_FROM,NEW_STATUS".
+func (stats *clientStats) dropSummary() string {
+	recent := make([]string, len(stats.recentDrops))
+	for i, messageType := range stats.recentDrops {
+		recent[i] = string(messageType)
+	}
+	return fmt.Sprintf("dropped=%d recent=%s", stats.dropped, strings.Join(recent, ","))
+}
+
+// outboundType extracts the message type of an outbound frame.
+func outboundType(frame []byte) protocol.MessageType {
+	var header struct {
+		Type protocol.MessageType `json:"type"`
+	}
+	if err := json.Unmarshal(frame, &header); err != nil || header.Type == "" {
+		return "unknown"
+	}
+	return header.Type
+}
+
+// messageCounts returns the per-type message counts keyed by type name.
+func (stats *clientStats) messageCounts() map[string]int {
+	counts := make(map[string]int, len(stats.messages))
+	for messageType, count := range stats.messages {
+		counts[string(messageType)] = count
+	}
+	return counts
+}
+
+// summary formats the counters for logging, e.g. "bytes=120 ROOM_TEXT=2 TEXT=1".
+func (stats *clientStats) summary() string {
+	parts := make([]string, 0, len(stats.messages))
+	for messageType, count := range stats.messages {
+		parts = append(parts, fmt.Sprintf("%s=%d", messageType, count))
+	}
+	sort.Strings(parts)
+
+	return strings.Join(append([]string{fmt.Sprintf("bytes=%d", stats.bytes)}, parts...), " ")
+}
+
+// recordDroppedFrame counts a frame that clientID's writer refused.
+func (h *Hub) recordDroppedFrame(clientID ClientID, frame []byte) {
+	if stats, exists := h.clientStats[clientID]; exists {
+		stats.recordDrop(frame)
+	}
+}
+
+// clientStatsSummary returns the logging summary of a connection's counters.
+func (h *Hub) clientStatsSummary(clientID ClientID) string {
+	stats, exists := h.clientStats[clientID]
+	if !exists {
+		return "none"
+	}
+	return stats.summary()
+}
@@ -0,0 +1,63 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"chat-server/internal/protocol"
+)
+
+func TestSendFailureDisconnectLogsDrops(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	bob := th.identify("bob", "bob")
+	bob.sendErr = errors.New("write queue full")
+
+	// Typing hints are dropped without disconnecting; the private message
+	// that follows is not.
+	th.send("alice", protocol.TypingRequest{Type: protocol.TypeTyping, Username: "bob"})
+	th.send("alice", protocol.TypingRequest{Type: protocol.TypeTyping, Username: "bob"})
+	if !th.isConnected("bob") {
+		t.Fatal("bob disconnected for a dropped typing hint")
+	}
+	th.send("alice", protocol.TextRequest{Type: protocol.TypeText, Username: "bob", Text: "hi"})
+
+	if th.isConnected("bob") {
+		t.Fatal("bob still connected after a failed send")
+	}
+	want := "send failure disconnect: id=bob addr=127.0.0.1:1 dropped=3 recent=TYPING_FROM,TYPING_FROM,TEXT_FROM"
+	if logs := th.logs.String(); !strings.Contains(logs, want) {
+		t.Errorf("disconnect log missing %q:\n%s", want, logs)
+	}
+}
+
+func TestOtherDisconnectsDoNotLogDrops(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+
+	th.hub.forceDisconnect(th.ctx, "alice", "connection lost", protocol.DisconnectReasonConnectionLost)
+
+	if logs := th.logs.String(); strings.Contains(logs, "send failure disconnect") {
+		t.Errorf("connection loss logged as a send failure:\n%s", logs)
+	}
+}
+
+func TestRecentDropsAreBounded(t *testing.T) {
+	stats := newClientStats()
+	for i := range recentDropsKept + 2 {
+		stats.recordDrop([]byte(fmt.Sprintf(`{"type":"T%d"}`, i)))
+	}
+	stats.recordDrop([]byte(`not json`))
+
+	if stats.dropped != recentDropsKept+3 {
+		t.Errorf("dropped = %d, want %d", stats.dropped, recentDropsKept+3)
+	}
+	if len(stats.recentDrops) != recentDropsKept {
+		t.Fatalf("kept %d recent drops, want %d", len(stats.recentDrops), recentDropsKept)
+	}
+	if first, last := stats.recentDrops[0], stats.recentDrops[recentDropsKept-1]; first != "T3" || last != "unknown" {
+		t.Errorf("recent drops run from %s to %s, want T3 to unknown", first, last)
+	}
+}
@@ -0,0 +1,78 @@
+package hub
+
+import (
+	"context"
+
+	"chat-server/internal/protocol"
+)
+
+// SystemUsername is the sender of messages posted by the server itself.
+// It is always reserved, so no user can impersonate it.
+const SystemUsername = "system"
+
+// systemMessage is a message posted by the server. An empty roomName
+// means a broadcast to every user.
+type systemMessage struct {
+	roomName string
+	text     string
+}
+
+// SystemBroadcast sends text to every identified user as a
+// PUBLIC_TEXT_FROM frame from SystemUsername. It does not need a
+// connection and is safe to call from any goroutine.
+func (h *Hub) SystemBroadcast(text string) {
+	h.system <- systemMessage{text: text}
+}
+
+// SystemRoomMessage sends text to the members of roomName as a
+// ROOM_TEXT_FROM frame from SystemUsername, and records it in the room
+// history. A room that does not exist is logged and skipped.
+func (h *Hub) SystemRoomMessage(roomName string, text string) {
+	h.system <- systemMessage{roomName: roomName, text: text}
+}
+
+func (h *Hub) handleSystemMessage(ctx context.Context, message systemMessage) {
+	if message.roomName == "" {
+		publicTextFrame := protocol.MustMarshal(protocol.PublicTextFromMessage{
+			Type:     protocol.TypePublicTextFrom,
+			Username: SystemUsername,
+			Text:     message.text,
+		})
+
+		for clientID := range h.clientUser {
+			if ctx.Err() != nil {
+				return
+			}
+			h.sendFrame(ctx, clientID, publicTextFrame)
+		}
+		return
+	}
+
+	room, exists := h.rooms[h.roomKey(message.roomName)]
+	if !exists {
+		h.logger.Printf("system message dropped: room=%s does not exist", message.roomName)
+		return
+	}
+
+	room.history.add(protocol.RoomHistoryEntry{
+		Username: SystemUsername,
+		Text:     message.text,
+	})
+
+	roomTextFrame := protocol.MustMarshal(protocol.RoomTextFromMessage{
+		Type:     protocol.TypeRoomTextFrom,
+		RoomName: room.name,
+		Username: SystemUsername,
+		Text:     message.text,
+	})
+
+	for memberClientID := range room.members {
+		if ctx.Err() != nil {
+			return
+		}
+		if _, isMuted := room.muted[memberClientID]; isMuted {
+			continue
+		}
+		h.sendFrame(ctx, memberClientID, roomTextFrame)
+	}
+}
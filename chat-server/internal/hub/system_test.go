@@ -0,0 +1,53 @@
+package hub
+
+import (
+	"strings"
+	"testing"
+
+	"chat-server/internal/protocol"
+)
+
+func TestSystemBroadcastReachesEveryUser(t *testing.T) {
+	th := newTestHub(t, nil)
+	th.identify("alice", "alice")
+	th.identify("bob", "bob")
+	th.connect("guest")
+
+	th.hub.SystemBroadcast("maintenance at noon")
+	th.settle()
+
+	for _, clientID := range []ClientID{"alice", "bob"} {
+		got := messagesOfType(th.drain(clientID), protocol.TypePublicTextFrom)
+		if len(got) != 1 || got[0]["username"] != SystemUsername || got[0]["text"] != "maintenance at noon" {
+			t.Errorf("%s got PUBLIC_TEXT_FROM %v, want one from %s", clientID, got, SystemUsername)
+		}
+	}
+	if got := th.drain("guest"); len(got) != 0 {
+		t.Errorf("unidentified guest got %v", got)
+	}
+}
+
+func TestSystemRoomMessageReachesOnlyMembers(t *testing.T) {
+	th := newInviteTestHub(t)
+
+	th.hub.SystemRoomMessage("den", "be nice")
+	th.settle()
+
+	for _, clientID := range []ClientID{"alice", "bob"} {
+		got := messagesOfType(th.drain(clientID), protocol.TypeRoomTextFrom)
+		if len(got) != 1 || got[0]["username"] != SystemUsername || got[0]["roomname"] != "den" {
+			t.Errorf("member %s got ROOM_TEXT_FROM %v, want one from %s", clientID, got, SystemUsername)
+		}
+	}
+	for _, clientID := range []ClientID{"carol", "dave"} {
+		if got := th.drain(clientID); len(got) != 0 {
+			t.Errorf("non-member %s got %v", clientID, got)
+		}
+	}
+
+	th.hub.SystemRoomMessage("nowhere", "hello?")
+	th.settle()
+	if logs := th.logs.String(); !strings.Contains(logs, "system message dropped: room=nowhere") {
+		t.Errorf("message to a missing room not logged:\n%s", logs)
+	}
+}
@@ -4,16 +4,75 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+// ErrRecoverable is matched by every validation error caused by a
+// well-formed message carrying bad field values. Such errors can be
+// reported to the client without tearing down the connection.
+var ErrRecoverable = errors.New("recoverable validation error")
+
 // Protocol-level decode errors.
 var (
 	ErrInvalidJSON   = errors.New("invalid json")
 	ErrMissingType   = errors.New(`missing "type" field`)
 	ErrTypeNotString = errors.New(`"type" field is not a string`)
-	ErrEmptyField    = errors.New("required field is empty")
+	ErrUnknownType   = errors.New(`unknown "type" value`)
+)
+
+// Recoverable validation errors. All of them match ErrRecoverable.
+var (
+	ErrEmptyField    = newRecoverableError("required field is empty")
+	ErrInvalidStatus = newRecoverableError("invalid status value")
+	ErrTextTooLong   = newRecoverableError("text exceeds maximum allowed length")
+	ErrInvalidUTF8   = newRecoverableError("text is not valid UTF-8")
+	ErrInvalidLimit  = newRecoverableError("limit is negative")
+	ErrMetaTooLarge  = newRecoverableError("meta exceeds maximum allowed size")
+	ErrInvalidMeta   = newRecoverableError("meta is not a json object or is nested too deeply")
+	ErrInvalidReply  = newRecoverableError("reply_to is too long or contains control characters")
+	ErrInvalidTyping = newRecoverableError("typing needs exactly one of roomname or username")
 )
 
+// Bounds of the opaque meta object of TEXT and ROOM_TEXT.
+const (
+	// MaxMetaBytes is the maximum encoded size of meta.
+	MaxMetaBytes = 1024
+	// MaxMetaDepth is the maximum nesting of objects and arrays in meta,
+	// the meta object itself included.
+	MaxMetaDepth = 4
+)
+
+// MaxReplyToLength is the maximum length in bytes of the reply_to message
+// reference of TEXT and ROOM_TEXT.
+const MaxReplyToLength = 64
+
+// TextRules constrains the text field of TEXT, PUBLIC_TEXT and ROOM_TEXT.
+type TextRules struct {
+	// MaxLength is the maximum text length in bytes.
+	MaxLength int
+	// RequireUTF8 rejects messages containing invalid UTF-8.
+	RequireUTF8 bool
+}
+
+// recoverableError is a sentinel error that also matches ErrRecoverable.
+type recoverableError struct {
+	message string
+}
+
+func newRecoverableError(message string) error {
+	return &recoverableError{message: message}
+}
+
+func (e *recoverableError) Error() string {
+	return e.message
+}
+
+func (e *recoverableError) Is(target error) bool {
+	return target == ErrRecoverable
+}
+
 // Envelope represents a minimally decoded message.
 // It extracts the message type while preserving the raw JSON payload
 // for strict, type-specific decoding.
@@ -23,7 +82,8 @@ type Envelope struct {
 }
 
 // DecodeEnvelope parses a raw JSON frame and extracts the "type" field.
-// The input must be a JSON object with a string-valued "type" field.
+// The input must be a JSON object whose "type" field names a message type
+// clients may send.
 func DecodeEnvelope(frame []byte) (Envelope, error) {
 	var decodedValue any
 	if err := json.Unmarshal(frame, &decodedValue); err != nil {
@@ -44,6 +104,9 @@ func DecodeEnvelope(frame []byte) (Envelope, error) {
 	if !isString || typeString == "" {
 		return Envelope{}, ErrTypeNotString
 	}
+	if !IsClientMessageType(MessageType(typeString)) {
+		return Envelope{}, fmt.Errorf("%w: %q", ErrUnknownType, typeString)
+	}
 
 	rawCopy := make([]byte, len(frame))
 	copy(rawCopy, frame)
@@ -95,9 +158,11 @@ func DecodeStatus(envelope Envelope) (StatusRequest, error) {
 	case StatusActive, StatusAway, StatusBusy:
 		// valid
 	default:
-		return StatusRequest{}, fmt.Errorf("invalid status value: %q", request.Status)
+		return StatusRequest{}, fmt.Errorf("%w: %q", ErrInvalidStatus, request.Status)
 	}
 
+	request.Message = sanitizeLine(request.Message, MaxStatusMessageLength)
+
 	return request, nil
 }
 
@@ -116,11 +181,16 @@ func DecodeUsers(envelope Envelope) (UsersRequest, error) {
 		)
 	}
 
+	if request.Limit < 0 {
+		return UsersRequest{}, fmt.Errorf("%w: %d", ErrInvalidLimit, request.Limit)
+	}
+
 	return request, nil
 }
 
 // DecodeText decodes and validates a private TEXT request.
-func DecodeText(envelope Envelope) (TextRequest, error) {
+// The text field is checked against rules.
+func DecodeText(envelope Envelope, rules TextRules) (TextRequest, error) {
 	var request TextRequest
 	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
 		return TextRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
@@ -140,12 +210,22 @@ func DecodeText(envelope Envelope) (TextRequest, error) {
 	if request.Text == "" {
 		return TextRequest{}, fmt.Errorf("%w: text", ErrEmptyField)
 	}
+	if err := validateText(envelope, request.Text, rules); err != nil {
+		return TextRequest{}, err
+	}
+	if err := validateMeta(&request.Meta); err != nil {
+		return TextRequest{}, err
+	}
+	if err := validateReplyTo(request.ReplyTo); err != nil {
+		return TextRequest{}, err
+	}
 
 	return request, nil
 }
 
 // DecodePublicText decodes and validates a PUBLIC_TEXT request.
-func DecodePublicText(envelope Envelope) (PublicTextRequest, error) {
+// The text field is checked against rules.
+func DecodePublicText(envelope Envelope, rules TextRules) (PublicTextRequest, error) {
 	var request PublicTextRequest
 	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
 		return PublicTextRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
@@ -162,6 +242,9 @@ func DecodePublicText(envelope Envelope) (PublicTextRequest, error) {
 	if request.Text == "" {
 		return PublicTextRequest{}, fmt.Errorf("%w: text", ErrEmptyField)
 	}
+	if err := validateText(envelope, request.Text, rules); err != nil {
+		return PublicTextRequest{}, err
+	}
 
 	return request, nil
 }
@@ -188,6 +271,28 @@ func DecodeNewRoom(envelope Envelope) (NewRoomRequest, error) {
 	return request, nil
 }
 
+// DecodeEnsureRoom decodes and validates an ENSURE_ROOM request.
+func DecodeEnsureRoom(envelope Envelope) (EnsureRoomRequest, error) {
+	var request EnsureRoomRequest
+	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
+		return EnsureRoomRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+
+	if request.Type != TypeEnsureRoom {
+		return EnsureRoomRequest{}, fmt.Errorf(
+			"expected message type %q, got %q",
+			TypeEnsureRoom,
+			request.Type,
+		)
+	}
+
+	if request.RoomName == "" {
+		return EnsureRoomRequest{}, fmt.Errorf("%w: roomname", ErrEmptyField)
+	}
+
+	return request, nil
+}
+
 // DecodeInvite decodes and validates an INVITE request.
 func DecodeInvite(envelope Envelope) (InviteRequest, error) {
 	var request InviteRequest
@@ -221,6 +326,39 @@ func DecodeInvite(envelope Envelope) (InviteRequest, error) {
 	return request, nil
 }
 
+// DecodeUninvite decodes and validates an UNINVITE request.
+func DecodeUninvite(envelope Envelope) (UninviteRequest, error) {
+	var request UninviteRequest
+	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
+		return UninviteRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+
+	if request.Type != TypeUninvite {
+		return UninviteRequest{}, fmt.Errorf(
+			"expected message type %q, got %q",
+			TypeUninvite,
+			request.Type,
+		)
+	}
+
+	if request.RoomName == "" {
+		return UninviteRequest{}, fmt.Errorf("%w: roomname", ErrEmptyField)
+	}
+	if len(request.Usernames) == 0 {
+		return UninviteRequest{}, fmt.Errorf("%w: usernames", ErrEmptyField)
+	}
+
+	for index, username := range request.Usernames {
+		if username == "" {
+			return UninviteRequest{}, fmt.Errorf(
+				"%w: usernames[%d]", ErrEmptyField, index,
+			)
+		}
+	}
+
+	return request, nil
+}
+
 // DecodeJoinRoom decodes and validates a JOIN_ROOM request.
 func DecodeJoinRoom(envelope Envelope) (JoinRoomRequest, error) {
 	var request JoinRoomRequest
@@ -266,7 +404,8 @@ func DecodeRoomUsers(envelope Envelope) (RoomUsersRequest, error) {
 }
 
 // DecodeRoomText decodes and validates a ROOM_TEXT request.
-func DecodeRoomText(envelope Envelope) (RoomTextRequest, error) {
+// The text field is checked against rules.
+func DecodeRoomText(envelope Envelope, rules TextRules) (RoomTextRequest, error) {
 	var request RoomTextRequest
 	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
 		return RoomTextRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
@@ -286,6 +425,15 @@ func DecodeRoomText(envelope Envelope) (RoomTextRequest, error) {
 	if request.Text == "" {
 		return RoomTextRequest{}, fmt.Errorf("%w: text", ErrEmptyField)
 	}
+	if err := validateText(envelope, request.Text, rules); err != nil {
+		return RoomTextRequest{}, err
+	}
+	if err := validateMeta(&request.Meta); err != nil {
+		return RoomTextRequest{}, err
+	}
+	if err := validateReplyTo(request.ReplyTo); err != nil {
+		return RoomTextRequest{}, err
+	}
 
 	return request, nil
 }
@@ -313,6 +461,8 @@ func DecodeLeaveRoom(envelope Envelope) (LeaveRoomRequest, error) {
 }
 
 // DecodeDisconnect decodes and validates a DISCONNECT request.
+// The reason is sanitized to a single line of at most
+// MaxDisconnectReasonLength bytes.
 func DecodeDisconnect(envelope Envelope) (DisconnectRequest, error) {
 	var request DisconnectRequest
 	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
@@ -327,5 +477,367 @@ func DecodeDisconnect(envelope Envelope) (DisconnectRequest, error) {
 		)
 	}
 
+	request.Reason = sanitizeLine(request.Reason, MaxDisconnectReasonLength)
+
+	return request, nil
+}
+
+// DecodeListRooms decodes and validates a LIST_ROOMS request.
+func DecodeListRooms(envelope Envelope) (ListRoomsRequest, error) {
+	var request ListRoomsRequest
+	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
+		return ListRoomsRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+
+	if request.Type != TypeListRooms {
+		return ListRoomsRequest{}, fmt.Errorf(
+			"expected message type %q, got %q",
+			TypeListRooms,
+			request.Type,
+		)
+	}
+
 	return request, nil
 }
+
+// DecodeTyping decodes and validates a TYPING request.
+func DecodeTyping(envelope Envelope) (TypingRequest, error) {
+	var request TypingRequest
+	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
+		return TypingRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+
+	if request.Type != TypeTyping {
+		return TypingRequest{}, fmt.Errorf(
+			"expected message type %q, got %q",
+			TypeTyping,
+			request.Type,
+		)
+	}
+
+	if (request.RoomName == "") == (request.Username == "") {
+		return TypingRequest{}, ErrInvalidTyping
+	}
+
+	return request, nil
+}
+
+// DecodeAdmin decodes and validates an ADMIN request.
+// The token is not checked here; authorization is up to the caller.
+func DecodeAdmin(envelope Envelope) (AdminRequest, error) {
+	var request AdminRequest
+	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
+		return AdminRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+
+	if request.Type != TypeAdmin {
+		return AdminRequest{}, fmt.Errorf(
+			"expected message type %q, got %q",
+			TypeAdmin,
+			request.Type,
+		)
+	}
+
+	if request.Command == "" {
+		return AdminRequest{}, fmt.Errorf("%w: command", ErrEmptyField)
+	}
+	if request.Command == AdminCommandKickUser && request.Username == "" {
+		return AdminRequest{}, fmt.Errorf("%w: username", ErrEmptyField)
+	}
+
+	return request, nil
+}
+
+// DecodeMuteRoom decodes and validates a MUTE_ROOM request.
+func DecodeMuteRoom(envelope Envelope) (MuteRoomRequest, error) {
+	var request MuteRoomRequest
+	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
+		return MuteRoomRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+
+	if request.Type != TypeMuteRoom {
+		return MuteRoomRequest{}, fmt.Errorf(
+			"expected message type %q, got %q",
+			TypeMuteRoom,
+			request.Type,
+		)
+	}
+
+	if request.RoomName == "" {
+		return MuteRoomRequest{}, fmt.Errorf("%w: roomname", ErrEmptyField)
+	}
+
+	return request, nil
+}
+
+// DecodeUnmuteRoom decodes and validates a UNMUTE_ROOM request.
+func DecodeUnmuteRoom(envelope Envelope) (UnmuteRoomRequest, error) {
+	var request UnmuteRoomRequest
+	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
+		return UnmuteRoomRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+
+	if request.Type != TypeUnmuteRoom {
+		return UnmuteRoomRequest{}, fmt.Errorf(
+			"expected message type %q, got %q",
+			TypeUnmuteRoom,
+			request.Type,
+		)
+	}
+
+	if request.RoomName == "" {
+		return UnmuteRoomRequest{}, fmt.Errorf("%w: roomname", ErrEmptyField)
+	}
+
+	return request, nil
+}
+
+// DecodeChangeUsername decodes and validates a CHANGE_USERNAME request.
+func DecodeChangeUsername(envelope Envelope) (ChangeUsernameRequest, error) {
+	var request ChangeUsernameRequest
+	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
+		return ChangeUsernameRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+
+	if request.Type != TypeChangeUsername {
+		return ChangeUsernameRequest{}, fmt.Errorf(
+			"expected message type %q, got %q",
+			TypeChangeUsername,
+			request.Type,
+		)
+	}
+
+	if request.Username == "" {
+		return ChangeUsernameRequest{}, fmt.Errorf("%w: username", ErrEmptyField)
+	}
+
+	return request, nil
+}
+
+// DecodeWhois decodes and validates a WHOIS request.
+func DecodeWhois(envelope Envelope) (WhoisRequest, error) {
+	var request WhoisRequest
+	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
+		return WhoisRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+
+	if request.Type != TypeWhois {
+		return WhoisRequest{}, fmt.Errorf(
+			"expected message type %q, got %q",
+			TypeWhois,
+			request.Type,
+		)
+	}
+
+	if request.Username == "" {
+		return WhoisRequest{}, fmt.Errorf("%w: username", ErrEmptyField)
+	}
+
+	return request, nil
+}
+
+// DecodeLeaveAllRooms decodes and validates a LEAVE_ALL_ROOMS request.
+func DecodeLeaveAllRooms(envelope Envelope) (LeaveAllRoomsRequest, error) {
+	var request LeaveAllRoomsRequest
+	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
+		return LeaveAllRoomsRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+
+	if request.Type != TypeLeaveAllRooms {
+		return LeaveAllRoomsRequest{}, fmt.Errorf(
+			"expected message type %q, got %q",
+			TypeLeaveAllRooms,
+			request.Type,
+		)
+	}
+
+	return request, nil
+}
+
+// DecodeMyInvites decodes and validates a MY_INVITES request.
+func DecodeMyInvites(envelope Envelope) (MyInvitesRequest, error) {
+	var request MyInvitesRequest
+	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
+		return MyInvitesRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+
+	if request.Type != TypeMyInvites {
+		return MyInvitesRequest{}, fmt.Errorf(
+			"expected message type %q, got %q",
+			TypeMyInvites,
+			request.Type,
+		)
+	}
+
+	return request, nil
+}
+
+// DecodeRoomReport decodes and validates a ROOM_REPORT request.
+// The text field is checked against rules.
+func DecodeRoomReport(envelope Envelope, rules TextRules) (RoomReportRequest, error) {
+	var request RoomReportRequest
+	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
+		return RoomReportRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+
+	if request.Type != TypeRoomReport {
+		return RoomReportRequest{}, fmt.Errorf(
+			"expected message type %q, got %q",
+			TypeRoomReport,
+			request.Type,
+		)
+	}
+
+	if request.RoomName == "" {
+		return RoomReportRequest{}, fmt.Errorf("%w: roomname", ErrEmptyField)
+	}
+	if request.Text == "" {
+		return RoomReportRequest{}, fmt.Errorf("%w: text", ErrEmptyField)
+	}
+	if err := validateText(envelope, request.Text, rules); err != nil {
+		return RoomReportRequest{}, err
+	}
+
+	return request, nil
+}
+
+// DecodeMultiText decodes and validates a MULTI_TEXT request.
+// The text field is checked against rules.
+func DecodeMultiText(envelope Envelope, rules TextRules) (MultiTextRequest, error) {
+	var request MultiTextRequest
+	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
+		return MultiTextRequest{}, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+
+	if request.Type != TypeMultiText {
+		return MultiTextRequest{}, fmt.Errorf(
+			"expected message type %q, got %q",
+			TypeMultiText,
+			request.Type,
+		)
+	}
+
+	if len(request.Usernames) == 0 {
+		return MultiTextRequest{}, fmt.Errorf("%w: usernames", ErrEmptyField)
+	}
+	for index, username := range request.Usernames {
+		if username == "" {
+			return MultiTextRequest{}, fmt.Errorf(
+				"%w: usernames[%d]", ErrEmptyField, index,
+			)
+		}
+	}
+	if request.Text == "" {
+		return MultiTextRequest{}, fmt.Errorf("%w: text", ErrEmptyField)
+	}
+	if err := validateText(envelope, request.Text, rules); err != nil {
+		return MultiTextRequest{}, err
+	}
+	if err := validateMeta(&request.Meta); err != nil {
+		return MultiTextRequest{}, err
+	}
+	if err := validateReplyTo(request.ReplyTo); err != nil {
+		return MultiTextRequest{}, err
+	}
+
+	return request, nil
+}
+
+// validateText checks a decoded text field against rules.
+//
+// encoding/json silently replaces invalid UTF-8 with U+FFFD while decoding,
+// so the encoding check runs on the raw bytes of the text field rather than
+// on the decoded text. Other fields are not checked.
+func validateText(envelope Envelope, text string, rules TextRules) error {
+	if len(text) > rules.MaxLength {
+		return fmt.Errorf("%w: %d > %d bytes", ErrTextTooLong, len(text), rules.MaxLength)
+	}
+	if !rules.RequireUTF8 {
+		return nil
+	}
+
+	var raw struct {
+		Text json.RawMessage `json:"text"`
+	}
+	if err := json.Unmarshal(envelope.Raw, &raw); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+	if !utf8.Valid(raw.Text) {
+		return ErrInvalidUTF8
+	}
+	return nil
+}
+
+// validateMeta bounds an optional meta value. The server passes meta
+// through without interpreting it, so only its shape and size are checked.
+// meta has already been parsed as JSON. A null meta counts as omitted and
+// is reset to nil, so it is not forwarded.
+func validateMeta(rawMeta *json.RawMessage) error {
+	if strings.TrimSpace(string(*rawMeta)) == "null" {
+		*rawMeta = nil
+	}
+	meta := *rawMeta
+	if len(meta) == 0 {
+		return nil
+	}
+	if len(meta) > MaxMetaBytes {
+		return fmt.Errorf("%w: %d > %d bytes", ErrMetaTooLarge, len(meta), MaxMetaBytes)
+	}
+
+	trimmed := strings.TrimSpace(string(meta))
+	if !strings.HasPrefix(trimmed, "{") {
+		return ErrInvalidMeta
+	}
+
+	depth := 0
+	inString := false
+	escaped := false
+	for _, character := range []byte(trimmed) {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && character == '\\':
+			escaped = true
+		case character == '"':
+			inString = !inString
+		case inString:
+		case character == '{' || character == '[':
+			depth++
+			if depth > MaxMetaDepth {
+				return ErrInvalidMeta
+			}
+		case character == '}' || character == ']':
+			depth--
+		}
+	}
+	return nil
+}
+
+// validateReplyTo checks an optional reply_to reference. The referenced
+// message is not looked up; it may no longer be in any history.
+func validateReplyTo(replyTo string) error {
+	if len(replyTo) > MaxReplyToLength {
+		return fmt.Errorf("%w: %d > %d bytes", ErrInvalidReply, len(replyTo), MaxReplyToLength)
+	}
+	if strings.IndexFunc(replyTo, unicode.IsControl) >= 0 {
+		return ErrInvalidReply
+	}
+	return nil
+}
+
+// sanitizeLine replaces control characters (including newlines) with spaces,
+// truncates text to at most maxLength bytes on a rune boundary, and trims
+// surrounding whitespace.
+func sanitizeLine(text string, maxLength int) string {
+	var builder strings.Builder
+	for _, character := range text {
+		if unicode.IsControl(character) {
+			character = ' '
+		}
+		if builder.Len()+utf8.RuneLen(character) > maxLength {
+			break
+		}
+		builder.WriteRune(character)
+	}
+	return strings.TrimSpace(builder.String())
+}
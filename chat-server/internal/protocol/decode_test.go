@@ -0,0 +1,323 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// mustEnvelope encodes message and decodes its envelope, failing the test
+// if either step fails.
+func mustEnvelope(t *testing.T, message any) Envelope {
+	t.Helper()
+
+	frame, err := json.Marshal(message)
+	if err != nil {
+		t.Fatalf("marshal %v: %v", message, err)
+	}
+	envelope, err := DecodeEnvelope(frame)
+	if err != nil {
+		t.Fatalf("decode envelope %s: %v", frame, err)
+	}
+	return envelope
+}
+
+func TestDecodeTextLengthBoundary(t *testing.T) {
+	rules := TextRules{MaxLength: 16}
+
+	tests := []struct {
+		name    string
+		length  int
+		wantErr error
+	}{
+		{name: "at the limit", length: 16},
+		{name: "one byte over", length: 17, wantErr: ErrTextTooLong},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text := strings.Repeat("a", test.length)
+
+			_, err := DecodeText(mustEnvelope(t, TextRequest{
+				Type:     TypeText,
+				Username: "bob",
+				Text:     text,
+			}), rules)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("TEXT: got error %v, want %v", err, test.wantErr)
+			}
+
+			_, err = DecodePublicText(mustEnvelope(t, PublicTextRequest{
+				Type: TypePublicText,
+				Text: text,
+			}), rules)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("PUBLIC_TEXT: got error %v, want %v", err, test.wantErr)
+			}
+
+			_, err = DecodeRoomText(mustEnvelope(t, RoomTextRequest{
+				Type:     TypeRoomText,
+				RoomName: "room",
+				Text:     text,
+			}), rules)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("ROOM_TEXT: got error %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeTextLengthCountsBytes(t *testing.T) {
+	// "é" is two bytes in UTF-8, so four of them exceed a limit of seven.
+	_, err := DecodeText(mustEnvelope(t, TextRequest{
+		Type:     TypeText,
+		Username: "bob",
+		Text:     strings.Repeat("é", 4),
+	}), TextRules{MaxLength: 7})
+	if !errors.Is(err, ErrTextTooLong) {
+		t.Fatalf("got error %v, want %v", err, ErrTextTooLong)
+	}
+}
+
+func TestDecodeTypingNeedsOneTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		request TypingRequest
+		wantErr error
+	}{
+		{name: "room", request: TypingRequest{RoomName: "den"}},
+		{name: "user", request: TypingRequest{Username: "bob"}},
+		{name: "neither", request: TypingRequest{}, wantErr: ErrInvalidTyping},
+		{name: "both", request: TypingRequest{RoomName: "den", Username: "bob"}, wantErr: ErrInvalidTyping},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.request.Type = TypeTyping
+
+			_, err := DecodeTyping(mustEnvelope(t, test.request))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			if test.wantErr != nil && !errors.Is(err, ErrRecoverable) {
+				t.Errorf("error %v is not recoverable", err)
+			}
+		})
+	}
+}
+
+func TestDecodeDisconnectSanitizesReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		reason string
+		want   string
+	}{
+		{name: "plain", reason: "going to lunch", want: "going to lunch"},
+		{name: "newlines", reason: "going\nto\r\nlunch\n", want: "going to  lunch"},
+		{name: "too long", reason: strings.Repeat("a", MaxDisconnectReasonLength+10), want: strings.Repeat("a", MaxDisconnectReasonLength)},
+		{name: "multibyte at the cap", reason: strings.Repeat("a", MaxDisconnectReasonLength-1) + "é", want: strings.Repeat("a", MaxDisconnectReasonLength-1)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := DecodeDisconnect(mustEnvelope(t, DisconnectRequest{
+				Type:   TypeDisconnect,
+				Reason: test.reason,
+			}))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if request.Reason != test.want {
+				t.Errorf("reason = %q, want %q", request.Reason, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeTextUTF8Validation(t *testing.T) {
+	tests := []struct {
+		name        string
+		frame       string
+		requireUTF8 bool
+		wantErr     error
+	}{
+		{name: "multibyte", frame: `{"type":"PUBLIC_TEXT","text":"héllo wörld ✓"}`, requireUTF8: true},
+		{name: "invalid byte", frame: "{\"type\":\"PUBLIC_TEXT\",\"text\":\"bad \xff byte\"}", requireUTF8: true, wantErr: ErrInvalidUTF8},
+		{name: "truncated sequence", frame: "{\"type\":\"PUBLIC_TEXT\",\"text\":\"cut \xe2\x9c\"}", requireUTF8: true, wantErr: ErrInvalidUTF8},
+		{name: "invalid byte, not required", frame: "{\"type\":\"PUBLIC_TEXT\",\"text\":\"bad \xff byte\"}", requireUTF8: false},
+		{name: "invalid byte outside text", frame: "{\"type\":\"PUBLIC_TEXT\",\"text\":\"fine\",\"meta\":{\"k\":\"\xff\"}}", requireUTF8: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envelope, err := DecodeEnvelope([]byte(test.frame))
+			if err != nil {
+				t.Fatalf("decode envelope: %v", err)
+			}
+
+			_, err = DecodePublicText(envelope, TextRules{MaxLength: 256, RequireUTF8: test.requireUTF8})
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeStatusSanitizesMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{name: "plain", message: "in a meeting", want: "in a meeting"},
+		{name: "newlines", message: "in a\r\nmeeting\n", want: "in a  meeting"},
+		{name: "blank", message: " \t ", want: ""},
+		{name: "too long", message: strings.Repeat("z", MaxStatusMessageLength+10), want: strings.Repeat("z", MaxStatusMessageLength)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := DecodeStatus(mustEnvelope(t, StatusRequest{
+				Type:    TypeStatus,
+				Status:  StatusAway,
+				Message: test.message,
+			}))
+			if err != nil {
+				t.Fatalf("DecodeStatus: %v", err)
+			}
+			if request.Message != test.want {
+				t.Errorf("message = %q, want %q", request.Message, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeEnvelopeKnownTypes(t *testing.T) {
+	messageTypes := ClientMessageTypes()
+	if len(messageTypes) == 0 {
+		t.Fatal("no client message types")
+	}
+	if !slices.IsSorted(messageTypes) {
+		t.Errorf("ClientMessageTypes() = %v, want them sorted", messageTypes)
+	}
+
+	for _, messageType := range messageTypes {
+		frame := []byte(`{"type":"` + string(messageType) + `"}`)
+		if _, err := DecodeEnvelope(frame); err != nil {
+			t.Errorf("DecodeEnvelope(%s): %v", frame, err)
+		}
+	}
+
+	for _, messageType := range []MessageType{"SHOUT", "text", TypeTextFrom, TypeResponse} {
+		frame := []byte(`{"type":"` + string(messageType) + `"}`)
+		if _, err := DecodeEnvelope(frame); !errors.Is(err, ErrUnknownType) {
+			t.Errorf("DecodeEnvelope(%s) error = %v, want %v", frame, err, ErrUnknownType)
+		}
+	}
+}
+
+func TestDecodeUsersRejectsNegativeLimit(t *testing.T) {
+	if _, err := DecodeUsers(mustEnvelope(t, UsersRequest{Type: TypeUsers, Cursor: "bob", Limit: 10})); err != nil {
+		t.Errorf("valid page request: %v", err)
+	}
+	if _, err := DecodeUsers(mustEnvelope(t, UsersRequest{Type: TypeUsers, Limit: -1})); !errors.Is(err, ErrInvalidLimit) {
+		t.Errorf("negative limit: got error %v, want %v", err, ErrInvalidLimit)
+	}
+}
+
+func TestDecodeMeta(t *testing.T) {
+	deep := strings.Repeat(`{"a":`, MaxMetaDepth+1) + `1` + strings.Repeat(`}`, MaxMetaDepth+1)
+	atLimit := strings.Repeat(`{"a":`, MaxMetaDepth) + `1` + strings.Repeat(`}`, MaxMetaDepth)
+
+	tests := []struct {
+		name    string
+		meta    string
+		wantErr error
+		// dropped marks a meta that decodes as omitted.
+		dropped bool
+	}{
+		{name: "omitted"},
+		{name: "null", meta: `null`, dropped: true},
+		{name: "object", meta: `{"reply_to":"m-1","tags":["a","b"]}`},
+		{name: "nesting at the limit", meta: atLimit},
+		{name: "brackets inside strings", meta: `{"s":"{{{{{{[[[[[\"}"}`},
+		{name: "nested too deeply", meta: deep, wantErr: ErrInvalidMeta},
+		{name: "not an object", meta: `["a"]`, wantErr: ErrInvalidMeta},
+		{name: "too large", meta: `{"s":"` + strings.Repeat("x", MaxMetaBytes) + `"}`, wantErr: ErrMetaTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := RoomTextRequest{Type: TypeRoomText, RoomName: "den", Text: "hi"}
+			if test.meta != "" {
+				request.Meta = json.RawMessage(test.meta)
+			}
+
+			decoded, err := DecodeRoomText(mustEnvelope(t, request), TextRules{MaxLength: 64})
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("error = %v, want %v", err, test.wantErr)
+			}
+			if err == nil && test.dropped && decoded.Meta != nil {
+				t.Errorf("meta = %s, want it omitted", decoded.Meta)
+			}
+			if err == nil && !test.dropped && string(decoded.Meta) != test.meta {
+				t.Errorf("meta = %s, want %s unchanged", decoded.Meta, test.meta)
+			}
+			if err != nil && !errors.Is(err, ErrRecoverable) {
+				t.Errorf("error %v is not recoverable", err)
+			}
+		})
+	}
+}
+
+func TestDecodeReplyTo(t *testing.T) {
+	tests := []struct {
+		name    string
+		replyTo string
+		wantErr error
+	}{
+		{name: "omitted"},
+		{name: "message id", replyTo: "m-42"},
+		{name: "at the limit", replyTo: strings.Repeat("x", MaxReplyToLength)},
+		{name: "too long", replyTo: strings.Repeat("x", MaxReplyToLength+1), wantErr: ErrInvalidReply},
+		{name: "control character", replyTo: "m-\n42", wantErr: ErrInvalidReply},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := TextRequest{Type: TypeText, Username: "bob", Text: "hi", ReplyTo: test.replyTo}
+
+			decoded, err := DecodeText(mustEnvelope(t, request), TextRules{MaxLength: 64})
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("error = %v, want %v", err, test.wantErr)
+			}
+			if err == nil && decoded.ReplyTo != test.replyTo {
+				t.Errorf("reply_to = %q, want %q", decoded.ReplyTo, test.replyTo)
+			}
+		})
+	}
+}
+
+func TestDecodeMultiTextRequiresRecipients(t *testing.T) {
+	rules := TextRules{MaxLength: 64}
+	tests := []struct {
+		name      string
+		usernames []string
+		wantErr   error
+	}{
+		{name: "recipients", usernames: []string{"bob", "carol"}},
+		{name: "no recipients", usernames: nil, wantErr: ErrEmptyField},
+		{name: "empty username", usernames: []string{"bob", ""}, wantErr: ErrEmptyField},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := MultiTextRequest{Type: TypeMultiText, Usernames: test.usernames, Text: "hi"}
+			if _, err := DecodeMultiText(mustEnvelope(t, request), rules); !errors.Is(err, test.wantErr) {
+				t.Errorf("error = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -3,17 +3,48 @@ package protocol
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 )
 
+// Marshal serializes a protocol message into JSON.
+//
+// Unlike MustMarshal, it reports failures as errors. Use it for messages
+// whose contents are influenced by client input (for example maps keyed
+// by usernames), so an encoding failure can be handled per client.
+func Marshal(message any) ([]byte, error) {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("protocol marshal failed: %w", err)
+	}
+	return encoded, nil
+}
+
 // MustMarshal serializes a protocol message into JSON.
 //
 // This function panics on error because it is only intended to be used
 // with server-owned, well-defined structs. A panic here indicates a
 // programming error, not a runtime condition caused by client input.
 func MustMarshal(message any) []byte {
-	encoded, err := json.Marshal(message)
+	encoded, err := Marshal(message)
 	if err != nil {
-		panic(fmt.Sprintf("protocol marshal failed: %v", err))
+		panic(err.Error())
 	}
 	return encoded
 }
+
+// WithSequence returns a copy of an encoded message with a "seq" field
+// added as its first member. frame must be a JSON object, as produced by
+// Marshal for every server message.
+func WithSequence(frame []byte, seq uint64) []byte {
+	if len(frame) < 2 || frame[0] != '{' {
+		return frame
+	}
+
+	sequenced := make([]byte, 0, len(frame)+24)
+	sequenced = append(sequenced, `{"seq":`...)
+	sequenced = strconv.AppendUint(sequenced, seq, 10)
+	if frame[1] != '}' {
+		sequenced = append(sequenced, ',')
+	}
+	return append(sequenced, frame[1:]...)
+}
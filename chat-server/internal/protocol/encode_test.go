@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMarshalReportsFailure(t *testing.T) {
+	if _, err := Marshal(map[string]float64{"bob": math.NaN()}); err == nil {
+		t.Fatal("Marshal of NaN succeeded, want an error")
+	}
+}
+
+func TestMustMarshalPanicsOnFailure(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("MustMarshal of a channel did not panic")
+		}
+	}()
+	MustMarshal(make(chan int))
+}
+
+func TestWithSequence(t *testing.T) {
+	tests := []struct {
+		frame string
+		want  string
+	}{
+		{frame: `{"type":"NEW_USER","username":"bob"}`, want: `{"seq":7,"type":"NEW_USER","username":"bob"}`},
+		{frame: `{}`, want: `{"seq":7}`},
+		{frame: `[1,2]`, want: `[1,2]`},
+		{frame: ``, want: ``},
+	}
+
+	for _, test := range tests {
+		if got := string(WithSequence([]byte(test.frame), 7)); got != test.want {
+			t.Errorf("WithSequence(%s) = %s, want %s", test.frame, got, test.want)
+		}
+	}
+}
@@ -1,5 +1,118 @@
 package protocol
 
+import (
+	"encoding/json"
+	"slices"
+	"time"
+)
+
+// Protocol versions understood by this server. Clients that omit the
+// version in IDENTIFY are treated as speaking MinProtocolVersion.
+const (
+	MinProtocolVersion = 1
+	ProtocolVersion    = 3
+)
+
+// VersionStatusMessages is the first protocol version with custom status
+// messages. From it on, USER_LIST and ROOM_USER_LIST map each username to
+// a UserPresence object instead of a bare status.
+const VersionStatusMessages = 2
+
+// VersionSortedUserLists is the first protocol version whose USER_LIST and
+// ROOM_USER_LIST carry users as an array of SortedUserEntry, sorted by
+// username, instead of an object keyed by username.
+const VersionSortedUserLists = 3
+
+// Compression methods a client may request in IDENTIFY. Once negotiated,
+// every frame the server sends after the IDENTIFY response is compressed
+// and length-prefixed instead of newline-delimited.
+const (
+	CompressionGzip    = "gzip"
+	CompressionDeflate = "deflate"
+)
+
+// IsSupportedCompression reports whether the server can compress frames
+// with method.
+func IsSupportedCompression(method string) bool {
+	return method == CompressionGzip || method == CompressionDeflate
+}
+
+// MaxStatusMessageLength caps a custom status message, in bytes.
+const MaxStatusMessageLength = 64
+
+// MaxDisconnectReasonLength caps the reason relayed in DISCONNECTED, in bytes.
+const MaxDisconnectReasonLength = 64
+
+// Server-generated reasons relayed in DISCONNECTED for involuntary
+// disconnects. Internal error details are never relayed to other users.
+const (
+	DisconnectReasonConnectionLost    = "CONNECTION_LOST"
+	DisconnectReasonProtocolViolation = "PROTOCOL_VIOLATION"
+	DisconnectReasonSendFailed        = "SEND_FAILED"
+	DisconnectReasonServerShutdown    = "SERVER_SHUTDOWN"
+	DisconnectReasonKicked            = "KICKED"
+	DisconnectReasonInternalError     = "INTERNAL_ERROR"
+	DisconnectReasonIdleTimeout       = "IDLE_TIMEOUT"
+	DisconnectReasonRateLimited       = "RATE_LIMITED"
+	DisconnectReasonIdentifyTimeout   = "IDENTIFY_TIMEOUT"
+)
+
+// States carried by FLOW_CONTROL.
+const (
+	FlowControlPause  = "PAUSE"
+	FlowControlResume = "RESUME"
+)
+
+// Commands accepted in ADMIN requests.
+const (
+	AdminCommandListClients = "list_clients"
+	AdminCommandKickUser    = "kick_user"
+)
+
+// ResultCode is the value of the "result" field in RESPONSE messages.
+type ResultCode string
+
+// Result codes emitted by the server.
+const (
+	ResultSuccess            ResultCode = "SUCCESS"
+	ResultPartialSuccess     ResultCode = "PARTIAL_SUCCESS"
+	ResultResumed            ResultCode = "RESUMED"
+	ResultInvalid            ResultCode = "INVALID"
+	ResultNotIdentified      ResultCode = "NOT_IDENTIFIED"
+	ResultUnauthorized       ResultCode = "UNAUTHORIZED"
+	ResultUnsupportedVersion ResultCode = "UNSUPPORTED_VERSION"
+	ResultReservedUsername   ResultCode = "RESERVED_USERNAME"
+	ResultUserAlreadyExists  ResultCode = "USER_ALREADY_EXISTS"
+	ResultNoSuchUser         ResultCode = "NO_SUCH_USER"
+	ResultCannotMessageSelf  ResultCode = "CANNOT_MESSAGE_SELF"
+	ResultCannotKickSelf     ResultCode = "CANNOT_KICK_SELF"
+	ResultUnknownCommand     ResultCode = "UNKNOWN_COMMAND"
+	ResultRoomAlreadyExists  ResultCode = "ROOM_ALREADY_EXISTS"
+	ResultNoSuchRoom         ResultCode = "NO_SUCH_ROOM"
+	ResultNotInvited         ResultCode = "NOT_INVITED"
+	ResultNotJoined          ResultCode = "NOT_JOINED"
+	ResultRoomFull           ResultCode = "ROOM_FULL"
+	ResultTooManyRooms       ResultCode = "TOO_MANY_ROOMS"
+	ResultServerFull         ResultCode = "SERVER_FULL"
+	ResultRateLimited        ResultCode = "RATE_LIMITED"
+	ResultTextTooLong        ResultCode = "TEXT_TOO_LONG"
+	ResultFrameTooLarge      ResultCode = "FRAME_TOO_LARGE"
+	ResultInvalidUTF8        ResultCode = "INVALID_UTF8"
+	ResultOperationDisabled  ResultCode = "OPERATION_DISABLED"
+	ResultCreated            ResultCode = "CREATED"
+	ResultJoined             ResultCode = "JOINED"
+
+	ResultTooManyPendingInvites ResultCode = "TOO_MANY_PENDING_INVITES"
+	ResultServerRoomLimit       ResultCode = "SERVER_ROOM_LIMIT"
+	ResultTooManyConnections    ResultCode = "TOO_MANY_CONNECTIONS"
+	ResultAuthFailed            ResultCode = "AUTH_FAILED"
+	ResultTooManyAttempts       ResultCode = "TOO_MANY_ATTEMPTS"
+	ResultMetaTooLarge          ResultCode = "META_TOO_LARGE"
+	ResultTooManyRecipients     ResultCode = "TOO_MANY_RECIPIENTS"
+	ResultAlreadyIdentified     ResultCode = "ALREADY_IDENTIFIED"
+	ResultNoOwner               ResultCode = "NO_OWNER"
+)
+
 // Status represents a user's availability state
 type Status string
 
@@ -26,6 +139,20 @@ const (
 	TypeRoomText   MessageType = "ROOM_TEXT"
 	TypeLeaveRoom  MessageType = "LEAVE_ROOM"
 	TypeDisconnect MessageType = "DISCONNECT"
+	TypeListRooms  MessageType = "LIST_ROOMS"
+	TypeTyping     MessageType = "TYPING"
+	TypeAdmin      MessageType = "ADMIN"
+	TypeMuteRoom   MessageType = "MUTE_ROOM"
+	TypeUnmuteRoom MessageType = "UNMUTE_ROOM"
+
+	TypeChangeUsername MessageType = "CHANGE_USERNAME"
+	TypeUninvite       MessageType = "UNINVITE"
+	TypeEnsureRoom     MessageType = "ENSURE_ROOM"
+	TypeWhois          MessageType = "WHOIS"
+	TypeLeaveAllRooms  MessageType = "LEAVE_ALL_ROOMS"
+	TypeRoomReport     MessageType = "ROOM_REPORT"
+	TypeMultiText      MessageType = "MULTI_TEXT"
+	TypeMyInvites      MessageType = "MY_INVITES"
 
 	// Server to Client
 	TypeResponse       MessageType = "RESPONSE"
@@ -40,58 +167,167 @@ const (
 	TypeRoomTextFrom   MessageType = "ROOM_TEXT_FROM"
 	TypeLeftRoom       MessageType = "LEFT_ROOM"
 	TypeDisconnected   MessageType = "DISCONNECTED"
+	TypeRoomList       MessageType = "ROOM_LIST"
+	TypeServerNotice   MessageType = "SERVER_NOTICE"
+	TypeTypingFrom     MessageType = "TYPING_FROM"
+	TypeRoomHistory    MessageType = "ROOM_HISTORY"
+	TypeAdminResult    MessageType = "ADMIN_RESULT"
+
+	TypeUsernameChanged MessageType = "USERNAME_CHANGED"
+	TypeServerHello     MessageType = "SERVER_HELLO"
+	TypeWhoisResult     MessageType = "WHOIS_RESULT"
+	TypeRoomReportFrom  MessageType = "ROOM_REPORT_FROM"
+	TypeIdleWarning     MessageType = "IDLE_WARNING"
+	TypeFlowControl     MessageType = "FLOW_CONTROL"
+	TypeSelfIdentified  MessageType = "SELF_IDENTIFIED"
+	TypeMyInvitesResult MessageType = "MY_INVITES_RESULT"
+
+	TypeRoomMembershipSnapshot MessageType = "ROOM_MEMBERSHIP_SNAPSHOT"
 )
 
+// clientMessageTypes is the set of message types clients may send.
+var clientMessageTypes = map[MessageType]struct{}{
+	TypeIdentify:       {},
+	TypeStatus:         {},
+	TypeUsers:          {},
+	TypeText:           {},
+	TypePublicText:     {},
+	TypeNewRoom:        {},
+	TypeInvite:         {},
+	TypeJoinRoom:       {},
+	TypeRoomUsers:      {},
+	TypeRoomText:       {},
+	TypeLeaveRoom:      {},
+	TypeDisconnect:     {},
+	TypeListRooms:      {},
+	TypeTyping:         {},
+	TypeAdmin:          {},
+	TypeMuteRoom:       {},
+	TypeUnmuteRoom:     {},
+	TypeChangeUsername: {},
+	TypeUninvite:       {},
+	TypeEnsureRoom:     {},
+	TypeWhois:          {},
+	TypeLeaveAllRooms:  {},
+	TypeRoomReport:     {},
+	TypeMultiText:      {},
+	TypeMyInvites:      {},
+}
+
+// IsClientMessageType reports whether messageType is a type clients may send.
+func IsClientMessageType(messageType MessageType) bool {
+	_, known := clientMessageTypes[messageType]
+	return known
+}
+
+// ClientMessageTypes returns every message type clients may send, sorted.
+func ClientMessageTypes() []MessageType {
+	messageTypes := make([]MessageType, 0, len(clientMessageTypes))
+	for messageType := range clientMessageTypes {
+		messageTypes = append(messageTypes, messageType)
+	}
+	slices.Sort(messageTypes)
+	return messageTypes
+}
+
 // Client to Server messages
 
 // IdentifyRequest is sent by a client to identify itself when connecting.
+// Version is the protocol version the client speaks; zero means unspecified.
+// Setting PresenceNotifications to false opts out of NEW_USER, NEW_STATUS
+// and DISCONNECTED broadcasts. ReconnectToken, as returned by a previous
+// IDENTIFY, resumes that session's username and rooms. FetchUsers asks for
+// the USER_LIST right after a successful IDENTIFY. Compression requests a
+// compression method for the frames the server sends; an unsupported one
+// is ignored.
 type IdentifyRequest struct {
-	Type     MessageType `json:"type"`
-	Username string      `json:"username"`
+	Type                  MessageType `json:"type"`
+	Username              string      `json:"username"`
+	Version               int         `json:"version,omitempty"`
+	PresenceNotifications *bool       `json:"presence_notifications,omitempty"`
+	ReconnectToken        string      `json:"reconnect_token,omitempty"`
+	FetchUsers            bool        `json:"fetch_users,omitempty"`
+	Password              string      `json:"password,omitempty"`
+	Credential            string      `json:"credential,omitempty"`
+	SelfIdentified        bool        `json:"self_identified,omitempty"`
+	Compression           string      `json:"compression,omitempty"`
 }
 
-// StatusRequest updates the user's status.
+// StatusRequest updates the user's status. Message is an optional custom
+// status line; omitting it clears the previous one.
 type StatusRequest struct {
-	Type   MessageType `json:"type"`
-	Status Status      `json:"status"`
+	Type    MessageType `json:"type"`
+	Status  Status      `json:"status"`
+	Message string      `json:"message,omitempty"`
 }
 
 // UsersRequest asks the server for the full user list and statuses.
 type UsersRequest struct {
 	Type MessageType `json:"type"`
+
+	// Cursor and Limit request one page of the list: at most Limit users
+	// sorted by name, starting after Cursor, the NextCursor of the
+	// previous page. Both empty requests the whole list.
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
 }
 
 // TextRequest sends a private message to a user.
 type TextRequest struct {
-	Type     MessageType `json:"type"`
-	Username string      `json:"username"`
-	Text     string      `json:"text"`
+	Type     MessageType     `json:"type"`
+	Username string          `json:"username"`
+	Text     string          `json:"text"`
+	Meta     json.RawMessage `json:"meta,omitempty"`
+	ReplyTo  string          `json:"reply_to,omitempty"`
 }
 
 // PublicTextRequest sends a public message to all users except the sender.
+// When Echo is set, the sender also receives the PUBLIC_TEXT_FROM.
 type PublicTextRequest struct {
 	Type MessageType `json:"type"`
 	Text string      `json:"text"`
+	Echo bool        `json:"echo,omitempty"`
 }
 
 // NewRoomRequest creates a new room. The creator becomes the first member.
+// Public rooms can be joined without an invitation.
 type NewRoomRequest struct {
 	Type     MessageType `json:"type"`
 	RoomName string      `json:"roomname"`
+	Public   bool        `json:"public,omitempty"`
+}
+
+// EnsureRoomRequest joins a room, creating it as a public room if it does
+// not exist yet.
+type EnsureRoomRequest struct {
+	Type     MessageType `json:"type"`
+	RoomName string      `json:"roomname"`
 }
 
 // InviteRequest invites users to a room.
-// The server ignores users already invited or already joined.
+// Unknown, already invited and already joined users are skipped and
+// reported in the response; the remaining users are still invited.
 type InviteRequest struct {
 	Type      MessageType `json:"type"`
 	RoomName  string      `json:"roomname"`
 	Usernames []string    `json:"usernames"`
 }
 
-// JoinRoomRequest joins a room the user was invited to.
+// UninviteRequest rescinds pending invitations to a room.
+// Unknown, never invited and already joined users are skipped and
+// reported in the response.
+type UninviteRequest struct {
+	Type      MessageType `json:"type"`
+	RoomName  string      `json:"roomname"`
+	Usernames []string    `json:"usernames"`
+}
+
+// JoinRoomRequest joins a public room or a room the user was invited to.
+// When History is set, recent room messages are replayed after joining.
 type JoinRoomRequest struct {
 	Type     MessageType `json:"type"`
 	RoomName string      `json:"roomname"`
+	History  bool        `json:"history,omitempty"`
 }
 
 // RoomUsersRequest asks for the list of users in a room.
@@ -101,10 +337,14 @@ type RoomUsersRequest struct {
 }
 
 // RoomTextRequest sends a message to all users in a room except the sender.
+// When Echo is set, the sender also receives the ROOM_TEXT_FROM.
 type RoomTextRequest struct {
-	Type     MessageType `json:"type"`
-	RoomName string      `json:"roomname"`
-	Text     string      `json:"text"`
+	Type     MessageType     `json:"type"`
+	RoomName string          `json:"roomname"`
+	Text     string          `json:"text"`
+	Echo     bool            `json:"echo,omitempty"`
+	Meta     json.RawMessage `json:"meta,omitempty"`
+	ReplyTo  string          `json:"reply_to,omitempty"`
 }
 
 // LeaveRoomRequest leaves a room the user previously joined.
@@ -114,19 +354,130 @@ type LeaveRoomRequest struct {
 }
 
 // DisconnectRequest explicitly disconnects the client.
+// The optional reason is relayed to other users.
 type DisconnectRequest struct {
+	Type   MessageType `json:"type"`
+	Reason string      `json:"reason,omitempty"`
+}
+
+// ListRoomsRequest asks for the rooms visible to the user.
+type ListRoomsRequest struct {
 	Type MessageType `json:"type"`
 }
 
+// TypingRequest hints that the user is typing. Exactly one of RoomName
+// (a room the user has joined) or Username (a private chat peer) is set.
+// The server never responds to it.
+type TypingRequest struct {
+	Type     MessageType `json:"type"`
+	RoomName string      `json:"roomname,omitempty"`
+	Username string      `json:"username,omitempty"`
+}
+
+// MuteRoomRequest stops delivery of ROOM_TEXT_FROM for a joined room.
+// Membership notifications are still delivered.
+type MuteRoomRequest struct {
+	Type     MessageType `json:"type"`
+	RoomName string      `json:"roomname"`
+}
+
+// UnmuteRoomRequest resumes delivery of ROOM_TEXT_FROM for a joined room.
+type UnmuteRoomRequest struct {
+	Type     MessageType `json:"type"`
+	RoomName string      `json:"roomname"`
+}
+
+// AdminRequest runs an operator command. It must carry the server's
+// admin token. Username is the target of user-directed commands.
+type AdminRequest struct {
+	Type     MessageType `json:"type"`
+	Token    string      `json:"token"`
+	Command  string      `json:"command"`
+	Username string      `json:"username,omitempty"`
+}
+
+// ChangeUsernameRequest renames the user without leaving its rooms.
+type ChangeUsernameRequest struct {
+	Type     MessageType `json:"type"`
+	Username string      `json:"username"`
+}
+
+// WhoisRequest asks for the status and rooms of a single user.
+type WhoisRequest struct {
+	Type     MessageType `json:"type"`
+	Username string      `json:"username"`
+}
+
+// LeaveAllRoomsRequest leaves every room the user has joined.
+type LeaveAllRoomsRequest struct {
+	Type MessageType `json:"type"`
+}
+
+// MyInvitesRequest asks for the rooms the user has pending invitations to.
+type MyInvitesRequest struct {
+	Type MessageType `json:"type"`
+}
+
+// RoomReportRequest privately flags an issue to the owner of a room.
+type RoomReportRequest struct {
+	Type     MessageType `json:"type"`
+	RoomName string      `json:"roomname"`
+	Text     string      `json:"text"`
+}
+
+// MultiTextRequest sends the same private message to several users, each
+// receiving it as an ordinary TEXT_FROM.
+type MultiTextRequest struct {
+	Type      MessageType     `json:"type"`
+	Usernames []string        `json:"usernames"`
+	Text      string          `json:"text"`
+	Meta      json.RawMessage `json:"meta,omitempty"`
+	ReplyTo   string          `json:"reply_to,omitempty"`
+}
+
 // Server to Client messages
 
 // ResponseMessage is a generic server response for operations that require
 // explicit acknowledgment or error reporting.
+// Version is only set on IDENTIFY responses; Targets is only set on
+// responses to operations addressing several users; Capacity is only set
+// when a request is refused because a limit was reached.
 type ResponseMessage struct {
-	Type      MessageType `json:"type"`
-	Operation string      `json:"operation"`
-	Result    string      `json:"result"`
-	Extra     string      `json:"extra,omitempty"`
+	Type      MessageType    `json:"type"`
+	Operation string         `json:"operation"`
+	Result    ResultCode     `json:"result"`
+	Extra     string         `json:"extra,omitempty"`
+	Version   int            `json:"version,omitempty"`
+	Targets   *TargetResults `json:"targets,omitempty"`
+	Capacity  *CapacityHint  `json:"capacity,omitempty"`
+
+	// ReconnectToken is only set on successful IDENTIFY and
+	// CHANGE_USERNAME responses when session resumption is enabled.
+	ReconnectToken string `json:"reconnect_token,omitempty"`
+
+	// Compression is only set on successful IDENTIFY responses, to the
+	// compression method every following frame is sent with.
+	Compression string `json:"compression,omitempty"`
+}
+
+// CapacityHint reports the usage of a limit at the moment a request was
+// refused, so clients can decide when to retry.
+type CapacityHint struct {
+	Current int `json:"current"`
+	Max     int `json:"max"`
+}
+
+// TargetResults reports the per-user outcome of an operation addressing
+// several users at once.
+type TargetResults struct {
+	Succeeded      []string `json:"succeeded,omitempty"`
+	NoSuchUser     []string `json:"nosuchuser,omitempty"`
+	AlreadyJoined  []string `json:"alreadyjoined,omitempty"`
+	AlreadyInvited []string `json:"alreadyinvited,omitempty"`
+	NotInvited     []string `json:"notinvited,omitempty"`
+	OverLimit      []string `json:"overlimit,omitempty"`
+	TooManyInvites []string `json:"toomanyinvites,omitempty"`
+	Self           []string `json:"self,omitempty"`
 }
 
 // NewUserMessage is broadcast when a new user successfully identifies.
@@ -135,24 +486,53 @@ type NewUserMessage struct {
 	Username string      `json:"username"`
 }
 
+// SelfIdentifiedMessage confirms to an identifying client the username
+// others will see, and Canonical, the form the server compares usernames
+// in. They differ when usernames are case-insensitive.
+type SelfIdentifiedMessage struct {
+	Type      MessageType `json:"type"`
+	Username  string      `json:"username"`
+	Canonical string      `json:"canonical"`
+}
+
 // NewStatusMessage is broadcast when a user changes status.
+// Message is only sent to clients speaking VersionStatusMessages or later.
 type NewStatusMessage struct {
 	Type     MessageType `json:"type"`
 	Username string      `json:"username"`
 	Status   Status      `json:"status"`
+	Message  string      `json:"message,omitempty"`
 }
 
 // UserListMessage is sent in response to USERS.
 type UserListMessage struct {
-	Type  MessageType       `json:"type"`
-	Users map[string]Status `json:"users"`
+	Type       MessageType       `json:"type"`
+	Users      map[string]Status `json:"users"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// UserPresence is a user's status and custom status message, as listed
+// to clients speaking VersionStatusMessages or later.
+type UserPresence struct {
+	Status  Status `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// UserPresenceListMessage is sent in response to USERS to clients speaking
+// VersionStatusMessages or later.
+type UserPresenceListMessage struct {
+	Type       MessageType             `json:"type"`
+	Users      map[string]UserPresence `json:"users"`
+	NextCursor string                  `json:"next_cursor,omitempty"`
 }
 
 // TextFromMessage is delivered to a recipient for private messages.
 type TextFromMessage struct {
-	Type     MessageType `json:"type"`
-	Username string      `json:"username"`
-	Text     string      `json:"text"`
+	Type     MessageType     `json:"type"`
+	Username string          `json:"username"`
+	Text     string          `json:"text"`
+	Meta     json.RawMessage `json:"meta,omitempty"`
+	ReplyTo  string          `json:"reply_to,omitempty"`
 }
 
 // PublicTextFromMessage is broadcast for public messages.
@@ -183,12 +563,46 @@ type RoomUserListMessage struct {
 	Users    map[string]Status `json:"users"`
 }
 
+// RoomUserPresenceListMessage is sent in response to ROOM_USERS to clients
+// speaking VersionStatusMessages or later.
+type RoomUserPresenceListMessage struct {
+	Type     MessageType             `json:"type"`
+	RoomName string                  `json:"roomname"`
+	Users    map[string]UserPresence `json:"users"`
+}
+
+// SortedUserEntry describes one user in the sorted user lists sent to
+// clients speaking VersionSortedUserLists or later.
+type SortedUserEntry struct {
+	Username string `json:"username"`
+	Status   Status `json:"status"`
+	Message  string `json:"message,omitempty"`
+}
+
+// SortedUserListMessage is the USER_LIST sent to clients speaking
+// VersionSortedUserLists or later.
+type SortedUserListMessage struct {
+	Type       MessageType       `json:"type"`
+	Users      []SortedUserEntry `json:"users"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// SortedRoomUserListMessage is the ROOM_USER_LIST sent to clients
+// speaking VersionSortedUserLists or later.
+type SortedRoomUserListMessage struct {
+	Type     MessageType       `json:"type"`
+	RoomName string            `json:"roomname"`
+	Users    []SortedUserEntry `json:"users"`
+}
+
 // RoomTextFromMessage is broadcast to room members for room messages.
 type RoomTextFromMessage struct {
-	Type     MessageType `json:"type"`
-	RoomName string      `json:"roomname"`
-	Username string      `json:"username"`
-	Text     string      `json:"text"`
+	Type     MessageType     `json:"type"`
+	RoomName string          `json:"roomname"`
+	Username string          `json:"username"`
+	Text     string          `json:"text"`
+	Meta     json.RawMessage `json:"meta,omitempty"`
+	ReplyTo  string          `json:"reply_to,omitempty"`
 }
 
 // LeftRoomMessage is broadcast to users in a room when someone leaves.
@@ -199,7 +613,149 @@ type LeftRoomMessage struct {
 }
 
 // DisconnectedMessage is broadcast when a user disconnects.
+// Reason is either the text the user supplied in DISCONNECT or one of the
+// server-generated DisconnectReason codes.
 type DisconnectedMessage struct {
 	Type     MessageType `json:"type"`
 	Username string      `json:"username"`
+	Reason   string      `json:"reason,omitempty"`
+}
+
+// RoomListMessage is sent in response to LIST_ROOMS.
+// Rooms maps each visible room name to its current member count.
+type RoomListMessage struct {
+	Type  MessageType    `json:"type"`
+	Rooms map[string]int `json:"rooms"`
+}
+
+// MyInvitesResultMessage answers MY_INVITES with the names of the rooms
+// the user was invited to and has not joined, sorted.
+type MyInvitesResultMessage struct {
+	Type  MessageType `json:"type"`
+	Rooms []string    `json:"rooms"`
+}
+
+// RoomMembershipSnapshotMessage lists the rooms a client is a member of,
+// sorted. It is sent after a session is resumed or restored rooms are
+// reattached, so the client can replace whatever membership it assumed.
+type RoomMembershipSnapshotMessage struct {
+	Type  MessageType `json:"type"`
+	Rooms []string    `json:"rooms"`
+}
+
+// ServerNoticeMessage carries an informational message from the server
+// itself, such as the message of the day.
+type ServerNoticeMessage struct {
+	Type MessageType `json:"type"`
+	Text string      `json:"text"`
+}
+
+// IdleWarningMessage tells a client it will be disconnected for inactivity
+// in SecondsLeft seconds unless it sends a frame.
+type IdleWarningMessage struct {
+	Type        MessageType `json:"type"`
+	SecondsLeft int         `json:"seconds_left"`
+}
+
+// FlowControlMessage tells a client that its outbound queue is filling up
+// (PAUSE) or has drained again (RESUME), so it can slow down its sends.
+type FlowControlMessage struct {
+	Type  MessageType `json:"type"`
+	State string      `json:"state"`
+}
+
+// TypingFromMessage relays a typing hint. RoomName is empty for hints
+// sent within a private chat.
+type TypingFromMessage struct {
+	Type     MessageType `json:"type"`
+	RoomName string      `json:"roomname,omitempty"`
+	Username string      `json:"username"`
+}
+
+// RoomHistoryEntry is a single message replayed in ROOM_HISTORY.
+type RoomHistoryEntry struct {
+	Username string          `json:"username"`
+	Text     string          `json:"text"`
+	Meta     json.RawMessage `json:"meta,omitempty"`
+	ReplyTo  string          `json:"reply_to,omitempty"`
+}
+
+// RoomHistoryMessage replays recent room messages, oldest first, to a
+// user who joined with history requested.
+type RoomHistoryMessage struct {
+	Type     MessageType        `json:"type"`
+	RoomName string             `json:"roomname"`
+	Messages []RoomHistoryEntry `json:"messages"`
+}
+
+// UsernameChangedMessage is broadcast when a user renames itself.
+// Username is the previous name.
+type UsernameChangedMessage struct {
+	Type        MessageType `json:"type"`
+	Username    string      `json:"username"`
+	NewUsername string      `json:"new_username"`
+}
+
+// WhoisResultMessage is sent in response to WHOIS. Rooms only lists the
+// rooms the requester is also a member of.
+// RoomReportFromMessage delivers a ROOM_REPORT to the room owner.
+type RoomReportFromMessage struct {
+	Type     MessageType `json:"type"`
+	RoomName string      `json:"roomname"`
+	Username string      `json:"username"`
+	Text     string      `json:"text"`
+}
+
+type WhoisResultMessage struct {
+	Type     MessageType `json:"type"`
+	Username string      `json:"username"`
+	Status   Status      `json:"status"`
+	Message  string      `json:"message,omitempty"`
+	Rooms    []string    `json:"rooms"`
+
+	// UptimeSecs is how long the user's connection has been open.
+	UptimeSecs int64 `json:"uptime_secs"`
+}
+
+// ServerHelloMessage greets a client as soon as it connects, before it
+// identifies. Operations lists the message types the server accepts.
+type ServerHelloMessage struct {
+	Type       MessageType   `json:"type"`
+	Version    int           `json:"version"`
+	MinVersion int           `json:"min_version"`
+	Operations []MessageType `json:"operations"`
+	Limits     ServerLimits  `json:"limits"`
+}
+
+// ServerLimits advertises the size limits the server enforces, so clients
+// can validate input before sending it.
+type ServerLimits struct {
+	MaxFrameBytes     int `json:"max_frame_bytes"`
+	MaxTextLength     int `json:"max_text_length"`
+	MaxUsernameLength int `json:"max_username_length"`
+	MaxRoomNameLength int `json:"max_room_name_length"`
+}
+
+// AdminClientInfo describes a connected client in ADMIN_RESULT.
+// Username and Status are empty for clients that have not identified.
+// Messages counts the frames the connection has sent, by type, and Bytes
+// their total size. UptimeSecs is the time elapsed since ConnectedAt.
+type AdminClientInfo struct {
+	ID       string   `json:"id"`
+	Username string   `json:"username,omitempty"`
+	Status   Status   `json:"status,omitempty"`
+	Rooms    []string `json:"rooms"`
+
+	Messages map[string]int `json:"messages,omitempty"`
+	Bytes    int            `json:"bytes"`
+
+	ConnectedAt time.Time `json:"connected_at"`
+	UptimeSecs  int64     `json:"uptime_secs"`
+}
+
+// AdminResultMessage is sent in response to a successful ADMIN request.
+type AdminResultMessage struct {
+	Type    MessageType       `json:"type"`
+	Command string            `json:"command"`
+	Clients []AdminClientInfo `json:"clients,omitempty"`
 }
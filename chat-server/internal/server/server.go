@@ -7,10 +7,14 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"chat-server/internal/config"
+	"chat-server/internal/framing"
 	"chat-server/internal/hub"
+	"chat-server/internal/protocol"
 )
 
 // TCPServer accepts TCP connections and wires them to the Hub.
@@ -21,10 +25,26 @@ type TCPServer struct {
 	hub    *hub.Hub
 
 	listenerMu sync.Mutex
-	listener   net.Listener
+	listeners  []net.Listener
 
 	clientsWaitGroup sync.WaitGroup
 	hubWaitGroup     sync.WaitGroup
+
+	// activeConnections counts connections handed to a TCPClient.
+	activeConnections atomic.Int64
+
+	// connectionsPerIP counts active connections by source IP. It is only
+	// maintained when MaxConnectionsPerIP is set.
+	connectionsPerIPMu sync.Mutex
+	connectionsPerIP   map[string]int
+
+	// liveConfig holds cfg with reloaded settings applied. Clients read
+	// their timeouts from it, so reloads reach existing connections.
+	liveConfig atomic.Pointer[config.Config]
+
+	// rejectSlots bounds the goroutines writing rejection notices. A
+	// connection rejected while every slot is taken is closed without one.
+	rejectSlots chan struct{}
 }
 
 // NewTCPServer creates a new TCPServer instance.
@@ -34,18 +54,34 @@ func NewTCPServer(
 	cfg config.Config,
 	hubInstance *hub.Hub,
 ) *TCPServer {
-	return &TCPServer{
+	server := &TCPServer{
 		logger: logger,
 		cfg:    cfg,
 		hub:    hubInstance,
+
+		connectionsPerIP: make(map[string]int),
+		rejectSlots:      make(chan struct{}, maxPendingRejections),
 	}
+	server.liveConfig.Store(&cfg)
+	return server
 }
 
-// Serve starts accepting connections and blocks until the server stops.
-// It returns net.ErrClosed on normal shutdown.
-func (s *TCPServer) Serve(ctx context.Context, listener net.Listener) error {
+// Reload applies the settings of cfg that can change while the server runs
+// (see config.Config.WithReloaded) to the hub and to every connection,
+// existing ones included. Other settings are ignored.
+func (s *TCPServer) Reload(cfg config.Config) {
+	reloaded := s.liveConfig.Load().WithReloaded(cfg)
+	s.liveConfig.Store(&reloaded)
+	s.hub.Reload(cfg)
+}
+
+// Serve starts accepting connections on every listener, all feeding the
+// same hub, and blocks until the server stops. It returns net.ErrClosed on
+// normal shutdown. If accepting fails on one listener, the others are
+// closed too and the error is returned.
+func (s *TCPServer) Serve(ctx context.Context, listeners ...net.Listener) error {
 	s.listenerMu.Lock()
-	s.listener = listener
+	s.listeners = listeners
 	s.listenerMu.Unlock()
 
 	s.hubWaitGroup.Add(1)
@@ -54,6 +90,28 @@ func (s *TCPServer) Serve(ctx context.Context, listener net.Listener) error {
 		s.hub.Run(ctx)
 	}()
 
+	results := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func() {
+			results <- s.acceptLoop(ctx, listener)
+		}()
+	}
+
+	serveErr := net.ErrClosed
+	for range listeners {
+		err := <-results
+		if !errors.Is(err, net.ErrClosed) && errors.Is(serveErr, net.ErrClosed) {
+			serveErr = err
+			s.closeListeners()
+		}
+	}
+	return serveErr
+}
+
+// acceptLoop accepts connections on listener until it is closed.
+// It returns net.ErrClosed on normal shutdown.
+func (s *TCPServer) acceptLoop(ctx context.Context, listener net.Listener) error {
+	var acceptDelay time.Duration
 	for {
 		connection, err := listener.Accept()
 		if err != nil {
@@ -65,29 +123,79 @@ func (s *TCPServer) Serve(ctx context.Context, listener net.Listener) error {
 			case <-ctx.Done():
 				return net.ErrClosed
 			default:
+			}
+
+			if !isTemporaryAcceptError(err) {
 				return fmt.Errorf("accept connection: %w", err)
 			}
+
+			acceptDelay = nextAcceptDelay(acceptDelay)
+			s.logger.Printf("accept error: %v; retrying in %v", err, acceptDelay)
+
+			timer := time.NewTimer(acceptDelay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return net.ErrClosed
+			case <-timer.C:
+			}
+			continue
+		}
+		acceptDelay = 0
+
+		if !s.isAddressAllowed(connection.RemoteAddr()) {
+			s.logger.Printf("rejecting connection from %s: address not allowed", connection.RemoteAddr())
+			_ = connection.Close()
+			continue
+		}
+
+		if s.cfg.TCPKeepAliveSecs > 0 {
+			keepAlivePeriod := time.Duration(s.cfg.TCPKeepAliveSecs) * time.Second
+			if err := configureKeepAlive(connection, keepAlivePeriod); err != nil {
+				s.logger.Printf("keepalive setup failed for %s: %v", connection.RemoteAddr(), err)
+			}
+		}
+
+		activeConnections, ok := s.reserveConnectionSlot()
+		if !ok {
+			s.reject(
+				connection,
+				protocol.ResultServerFull,
+				int(activeConnections),
+				s.cfg.MaxConnections,
+			)
+			continue
+		}
+
+		ipKey := connectionIPKey(connection.RemoteAddr())
+		if ipConnections, ok := s.acquireIPSlot(ipKey); !ok {
+			s.activeConnections.Add(-1)
+			s.reject(
+				connection,
+				protocol.ResultTooManyConnections,
+				ipConnections,
+				s.cfg.MaxConnectionsPerIP,
+			)
+			continue
 		}
 
 		s.clientsWaitGroup.Add(1)
 		go func(conn net.Conn) {
 			defer s.clientsWaitGroup.Done()
-			client := NewTCPClient(s.logger, s.cfg, s.hub, conn)
+			defer s.activeConnections.Add(-1)
+			defer s.releaseIPSlot(ipKey)
+			client := NewTCPClient(s.logger, s.cfg, &s.liveConfig, s.hub, conn)
 			client.Run(ctx)
 		}(connection)
 	}
 }
 
 // Shutdown gracefully stops accepting new connections and waits for
-// all clients and the hub to terminate.
+// all clients and the hub to terminate. Once the context given to Serve is
+// canceled, clients stop reading but keep writing for a short grace
+// period, so the frames the hub queues while closing them are delivered.
 func (s *TCPServer) Shutdown(ctx context.Context) error {
-	s.listenerMu.Lock()
-	listener := s.listener
-	s.listenerMu.Unlock()
-
-	if listener != nil {
-		_ = listener.Close()
-	}
+	s.closeListeners()
 
 	done := make(chan struct{})
 	go func() {
@@ -104,14 +212,221 @@ func (s *TCPServer) Shutdown(ctx context.Context) error {
 	}
 }
 
-// withOptionalDeadline returns a context with a deadline applied
-// only if seconds is greater than zero.
-func withOptionalDeadline(parent context.Context, seconds int) context.Context {
-	if seconds <= 0 {
-		return parent
+// closeListeners closes every listener, stopping their accept loops.
+func (s *TCPServer) closeListeners() {
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+
+	for _, listener := range s.listeners {
+		_ = listener.Close()
+	}
+}
+
+// isAddressAllowed applies the configured source address filters.
+// Deny lists take precedence over allow lists, and an empty allow list
+// allows every address.
+func (s *TCPServer) isAddressAllowed(addr net.Addr) bool {
+	if len(s.cfg.AllowedCIDRs) == 0 && len(s.cfg.DeniedCIDRs) == 0 {
+		return true
+	}
+
+	ip := remoteIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range s.cfg.DeniedCIDRs {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(s.cfg.AllowedCIDRs) == 0 {
+		return true
+	}
+	for _, network := range s.cfg.AllowedCIDRs {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP extracts the IP address of a connection's remote end.
+func remoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// connectionIPKey identifies the source of a connection for the per-IP
+// limit, falling back to the full address if it has no IP.
+func connectionIPKey(addr net.Addr) string {
+	if ip := remoteIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr.String()
+}
+
+// acquireIPSlot counts a new connection from ipKey unless that would
+// exceed MaxConnectionsPerIP, in which case it returns false along with
+// the number of connections already open from ipKey.
+func (s *TCPServer) acquireIPSlot(ipKey string) (int, bool) {
+	if s.cfg.MaxConnectionsPerIP <= 0 {
+		return 0, true
+	}
+
+	s.connectionsPerIPMu.Lock()
+	defer s.connectionsPerIPMu.Unlock()
+
+	current := s.connectionsPerIP[ipKey]
+	if current >= s.cfg.MaxConnectionsPerIP {
+		return current, false
+	}
+	s.connectionsPerIP[ipKey] = current + 1
+	return current + 1, true
+}
+
+// releaseIPSlot undoes acquireIPSlot once a connection has finished.
+func (s *TCPServer) releaseIPSlot(ipKey string) {
+	if s.cfg.MaxConnectionsPerIP <= 0 {
+		return
+	}
+
+	s.connectionsPerIPMu.Lock()
+	defer s.connectionsPerIPMu.Unlock()
+
+	if s.connectionsPerIP[ipKey] <= 1 {
+		delete(s.connectionsPerIP, ipKey)
+		return
+	}
+	s.connectionsPerIP[ipKey]--
+}
+
+// configureKeepAlive enables TCP keepalive probes with the given period.
+// Connections that are not plain TCP, such as TLS-wrapped ones, are left
+// untouched.
+func configureKeepAlive(conn net.Conn, period time.Duration) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return fmt.Errorf("enable keepalive: %w", err)
+	}
+	if err := tcpConn.SetKeepAlivePeriod(period); err != nil {
+		return fmt.Errorf("set keepalive period: %w", err)
+	}
+	return nil
+}
+
+// reserveConnectionSlot counts a new connection in activeConnections
+// unless MaxConnections is already reached. The check and the increment
+// are a single compare-and-swap, so concurrent accept loops cannot
+// overshoot the limit. On false it returns the count that was found.
+func (s *TCPServer) reserveConnectionSlot() (int64, bool) {
+	for {
+		current := s.activeConnections.Load()
+		if s.cfg.MaxConnections > 0 && current >= int64(s.cfg.MaxConnections) {
+			return current, false
+		}
+		if s.activeConnections.CompareAndSwap(current, current+1) {
+			return current, true
+		}
+	}
+}
+
+// maxPendingRejections caps how many rejection notices are written at
+// once, so a flood of connections over the limit cannot pile up
+// goroutines.
+const maxPendingRejections = 64
+
+// reject hands conn to rejectConnection on its own goroutine, or closes it
+// straight away when maxPendingRejections notices are already in flight.
+func (s *TCPServer) reject(
+	conn net.Conn,
+	result protocol.ResultCode,
+	current int,
+	limit int,
+) {
+	select {
+	case s.rejectSlots <- struct{}{}:
+	default:
+		s.logger.Printf("rejecting connection from %s: %s (no notice sent)", conn.RemoteAddr(), result)
+		_ = conn.Close()
+		return
+	}
+	go func() {
+		defer func() { <-s.rejectSlots }()
+		s.rejectConnection(conn, result, current, limit)
+	}()
+}
+
+// rejectWriteTimeout bounds the write of a rejection notice to a
+// connection that is about to be closed.
+const rejectWriteTimeout = 1 * time.Second
+
+// rejectConnection tells a connection that a connection limit was reached
+// and closes it. The connection is never registered with the hub.
+func (s *TCPServer) rejectConnection(
+	conn net.Conn,
+	result protocol.ResultCode,
+	current int,
+	limit int,
+) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	s.logger.Printf("rejecting connection from %s: %s", conn.RemoteAddr(), result)
+
+	frame := protocol.MustMarshal(protocol.ResponseMessage{
+		Type:      protocol.TypeResponse,
+		Operation: "CONNECT",
+		Result:    result,
+		Capacity: &protocol.CapacityHint{
+			Current: current,
+			Max:     limit,
+		},
+	})
+
+	_ = conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	_ = framing.NewLineWriter(conn).WriteFrame(context.Background(), frame)
+}
+
+// Bounds of the exponential backoff applied after transient accept errors.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = 1 * time.Second
+)
+
+// nextAcceptDelay doubles the previous backoff delay, starting at
+// minAcceptDelay and capped at maxAcceptDelay.
+func nextAcceptDelay(previous time.Duration) time.Duration {
+	if previous == 0 {
+		return minAcceptDelay
+	}
+	return min(previous*2, maxAcceptDelay)
+}
+
+// isTemporaryAcceptError reports whether an Accept error is transient,
+// such as running out of file descriptors, so accepting may be retried.
+func isTemporaryAcceptError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
 	}
 
-	deadline := time.Now().Add(time.Duration(seconds) * time.Second)
-	ctx, _ := context.WithDeadline(parent, deadline)
-	return ctx
+	return errors.Is(err, syscall.EMFILE) ||
+		errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED)
 }
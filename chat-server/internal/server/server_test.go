@@ -0,0 +1,640 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"chat-server/internal/config"
+	"chat-server/internal/framing"
+	"chat-server/internal/hub"
+	"chat-server/internal/protocol"
+)
+
+// fakeListener is a net.Listener that hands out scripted results, then
+// blocks until it is closed.
+type fakeListener struct {
+	mu      sync.Mutex
+	results []fakeAccept
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	// exhausted is closed when Accept is called after the last result.
+	exhaustOnce sync.Once
+	exhausted   chan struct{}
+}
+
+// fakeAccept is one scripted Accept result.
+type fakeAccept struct {
+	conn net.Conn
+	err  error
+}
+
+func newFakeListener(results ...fakeAccept) *fakeListener {
+	return &fakeListener{
+		results:   results,
+		closed:    make(chan struct{}),
+		exhausted: make(chan struct{}),
+	}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if len(l.results) > 0 {
+		result := l.results[0]
+		l.results = l.results[1:]
+		l.mu.Unlock()
+		return result.conn, result.err
+	}
+	l.mu.Unlock()
+
+	l.exhaustOnce.Do(func() { close(l.exhausted) })
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *fakeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *fakeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// newTestServer creates a TCPServer with the default configuration.
+func newTestServer(t *testing.T) *TCPServer {
+	t.Helper()
+
+	cfg, err := config.FromEnv()
+	if err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	logger := log.New(io.Discard, "", 0)
+	return NewTCPServer(logger, cfg, hub.New(logger, cfg, nil, nil, nil))
+}
+
+func TestServeRetriesTemporaryAcceptErrors(t *testing.T) {
+	serverConn, peerConn := net.Pipe()
+	defer peerConn.Close()
+
+	listener := newFakeListener(
+		fakeAccept{err: syscall.EMFILE},
+		fakeAccept{err: syscall.EMFILE},
+		fakeAccept{err: syscall.ECONNABORTED},
+		fakeAccept{conn: serverConn},
+	)
+	server := newTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ctx, listener)
+	}()
+
+	select {
+	case <-listener.exhausted:
+	case err := <-served:
+		t.Fatalf("Serve returned %v during transient accept errors", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server stopped accepting after transient errors")
+	}
+
+	cancel()
+	_ = listener.Close()
+	if err := <-served; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Serve returned %v, want %v", err, net.ErrClosed)
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
+
+func TestServeReturnsPermanentAcceptError(t *testing.T) {
+	permanent := errors.New("listener broken")
+	listener := newFakeListener(fakeAccept{err: permanent})
+	server := newTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := server.Serve(ctx, listener); !errors.Is(err, permanent) {
+		t.Errorf("Serve returned %v, want %v", err, permanent)
+	}
+}
+
+func TestNextAcceptDelayIsCapped(t *testing.T) {
+	delay := nextAcceptDelay(0)
+	if delay != minAcceptDelay {
+		t.Fatalf("first delay = %v, want %v", delay, minAcceptDelay)
+	}
+
+	for range 20 {
+		next := nextAcceptDelay(delay)
+		if next < delay || next > maxAcceptDelay {
+			t.Fatalf("delay after %v = %v, want between %v and %v", delay, next, delay, maxAcceptDelay)
+		}
+		delay = next
+	}
+	if delay != maxAcceptDelay {
+		t.Errorf("delay settled at %v, want %v", delay, maxAcceptDelay)
+	}
+}
+
+func TestServerFullReportsCapacity(t *testing.T) {
+	serverConn, peerConn := net.Pipe()
+	defer peerConn.Close()
+
+	listener := newFakeListener(fakeAccept{conn: serverConn})
+	server := newTestServer(t)
+	server.cfg.MaxConnections = 2
+	server.activeConnections.Store(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer listener.Close()
+	go func() {
+		_ = server.acceptLoop(ctx, listener)
+	}()
+
+	_ = peerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame, err := framing.NewLineReader(peerConn, 4096, 4096).ReadFrame()
+	if err != nil {
+		t.Fatalf("read rejection: %v", err)
+	}
+
+	var response protocol.ResponseMessage
+	if err := json.Unmarshal(frame, &response); err != nil {
+		t.Fatalf("decode %s: %v", frame, err)
+	}
+	if response.Result != protocol.ResultServerFull {
+		t.Errorf("result = %s, want %s", response.Result, protocol.ResultServerFull)
+	}
+	if response.Capacity == nil || *response.Capacity != (protocol.CapacityHint{Current: 2, Max: 2}) {
+		t.Errorf("capacity = %+v, want 2 of 2", response.Capacity)
+	}
+}
+
+// addrConn is a net.Conn reporting a chosen remote address.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func mustCIDRs(t *testing.T, blocks ...string) []*net.IPNet {
+	t.Helper()
+
+	var networks []*net.IPNet
+	for _, block := range blocks {
+		_, network, err := net.ParseCIDR(block)
+		if err != nil {
+			t.Fatalf("parse %q: %v", block, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func TestIsAddressAllowed(t *testing.T) {
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	tests := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		want    bool
+	}{
+		{name: "no filters", want: true},
+		{name: "loopback allowed", allowed: []string{"127.0.0.0/8"}, want: true},
+		{name: "loopback not in allow list", allowed: []string{"10.0.0.0/8"}, want: false},
+		{name: "loopback denied", denied: []string{"127.0.0.1/32"}, want: false},
+		{name: "deny beats allow", allowed: []string{"127.0.0.0/8"}, denied: []string{"127.0.0.1/32"}, want: false},
+		{name: "deny elsewhere", denied: []string{"192.168.0.0/16"}, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t)
+			server.cfg.AllowedCIDRs = mustCIDRs(t, test.allowed...)
+			server.cfg.DeniedCIDRs = mustCIDRs(t, test.denied...)
+
+			if got := server.isAddressAllowed(loopback); got != test.want {
+				t.Errorf("isAddressAllowed(%s) = %t, want %t", loopback, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDeniedConnectionIsClosedBeforeRegistering(t *testing.T) {
+	serverConn, peerConn := net.Pipe()
+	defer peerConn.Close()
+
+	listener := newFakeListener(fakeAccept{conn: addrConn{
+		Conn:   serverConn,
+		remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000},
+	}})
+	server := newTestServer(t)
+	server.cfg.DeniedCIDRs = mustCIDRs(t, "127.0.0.0/8")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer listener.Close()
+	go func() {
+		_ = server.acceptLoop(ctx, listener)
+	}()
+
+	_ = peerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := peerConn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("read %d bytes with error %v, want the connection closed", n, err)
+	}
+
+	<-listener.exhausted
+	if active := server.activeConnections.Load(); active != 0 {
+		t.Errorf("%d active connections, want the denied one never counted", active)
+	}
+}
+
+func TestConfigureKeepAliveOnTCPConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer dialed.Close()
+
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer accepted.Close()
+
+	if err := configureKeepAlive(accepted, 30*time.Second); err != nil {
+		t.Errorf("configure keepalive on %T: %v", accepted, err)
+	}
+}
+
+func TestConfigureKeepAliveSkipsOtherConns(t *testing.T) {
+	serverConn, peerConn := net.Pipe()
+	defer serverConn.Close()
+	defer peerConn.Close()
+
+	if err := configureKeepAlive(serverConn, 30*time.Second); err != nil {
+		t.Errorf("configure keepalive on %T: %v", serverConn, err)
+	}
+}
+
+func TestReloadUpdatesLiveConfig(t *testing.T) {
+	server := newTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.hub.Run(ctx)
+
+	next := server.cfg
+	next.MaxTextLength = server.cfg.MaxTextLength + 100
+	next.WriteTimeoutSecs = server.cfg.WriteTimeoutSecs + 7
+	next.MaxConnections = server.cfg.MaxConnections + 5
+	server.Reload(next)
+
+	live := server.liveConfig.Load()
+	if live.MaxTextLength != next.MaxTextLength || live.WriteTimeoutSecs != next.WriteTimeoutSecs {
+		t.Errorf("live limits = %d and %d, want %d and %d",
+			live.MaxTextLength, live.WriteTimeoutSecs, next.MaxTextLength, next.WriteTimeoutSecs)
+	}
+	if live.MaxConnections != server.cfg.MaxConnections {
+		t.Errorf("reload changed MaxConnections to %d", live.MaxConnections)
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := newTestServer(t)
+	server.cfg.MaxConnectionsPerIP = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ctx, listener)
+	}()
+	defer func() {
+		cancel()
+		_ = listener.Close()
+		<-served
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelShutdown()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	dial := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+	// accepted reports whether conn was let in: a rejected connection
+	// gets a notice and is closed, an accepted one hears nothing until it
+	// identifies.
+	accepted := func(conn net.Conn) bool {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		frame, err := framing.NewLineReader(conn, 4096, 4096).ReadFrame()
+		if errors.Is(err, framing.ErrFrameTimeout) {
+			return true
+		}
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		var response protocol.ResponseMessage
+		if err := json.Unmarshal(frame, &response); err != nil {
+			t.Fatalf("decode %s: %v", frame, err)
+		}
+		if response.Result != protocol.ResultTooManyConnections {
+			t.Errorf("rejection = %s, want %s", frame, protocol.ResultTooManyConnections)
+		}
+		return false
+	}
+
+	first, second := dial(), dial()
+	if !accepted(first) || !accepted(second) {
+		t.Fatal("connections under the per-IP cap were rejected")
+	}
+	if accepted(dial()) {
+		t.Fatal("third connection from the same IP was accepted")
+	}
+
+	// Closing a connection frees its slot once its client has finished.
+	_ = first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if accepted(dial()) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slot of a closed connection was never released")
+		}
+	}
+}
+
+func TestIPSlotsUnderConcurrency(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.MaxConnectionsPerIP = 5
+
+	var waitGroup sync.WaitGroup
+	var acquired sync.Map
+	for i := range 50 {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			if _, ok := server.acquireIPSlot("192.0.2.1"); ok {
+				acquired.Store(i, struct{}{})
+			}
+		}()
+	}
+	waitGroup.Wait()
+
+	count := 0
+	acquired.Range(func(_, _ any) bool {
+		count++
+		return true
+	})
+	if count != 5 {
+		t.Fatalf("%d slots acquired, want 5", count)
+	}
+
+	for range count {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			server.releaseIPSlot("192.0.2.1")
+		}()
+	}
+	waitGroup.Wait()
+	if len(server.connectionsPerIP) != 0 {
+		t.Errorf("counters left after releasing every slot: %v", server.connectionsPerIP)
+	}
+}
+
+func TestConnectionSlotsUnderConcurrency(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.MaxConnections = 5
+
+	var waitGroup sync.WaitGroup
+	for range 50 {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			server.reserveConnectionSlot()
+		}()
+	}
+	waitGroup.Wait()
+
+	if got := server.activeConnections.Load(); got != 5 {
+		t.Fatalf("%d slots reserved, want 5", got)
+	}
+	if current, ok := server.reserveConnectionSlot(); ok || current != 5 {
+		t.Errorf("reserve past the limit = (%d, %t), want (5, false)", current, ok)
+	}
+}
+
+func TestRejectionsAreBounded(t *testing.T) {
+	server := newTestServer(t)
+	for range cap(server.rejectSlots) {
+		server.rejectSlots <- struct{}{}
+	}
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	server.reject(serverSide, protocol.ResultServerFull, 1, 1)
+
+	_ = clientSide.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := clientSide.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("read from a connection rejected with no free slot = (%d, %v), want io.EOF", n, err)
+	}
+}
+
+func TestServeOnSeveralListenersSharesHub(t *testing.T) {
+	var listeners []net.Listener
+	for range 2 {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		listeners = append(listeners, listener)
+	}
+	server := newTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ctx, listeners...)
+	}()
+
+	// connect dials addr and identifies as username, returning a reader
+	// positioned after the IDENTIFY response.
+	connect := func(addr string, username string) (net.Conn, *framing.LineReader) {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial %s: %v", addr, err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		frame := protocol.MustMarshal(protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: username})
+		if _, err := conn.Write(append(frame, '\n')); err != nil {
+			t.Fatalf("write identify: %v", err)
+		}
+		reader := framing.NewLineReader(conn, 4096, 4096)
+		readUntil(t, reader, protocol.TypeResponse)
+		return conn, reader
+	}
+
+	_, aliceReader := connect(listeners[0].Addr().String(), "alice")
+	bobConn, _ := connect(listeners[1].Addr().String(), "bob")
+
+	newUser := readUntil(t, aliceReader, protocol.TypeNewUser)
+	if newUser["username"] != "bob" {
+		t.Errorf("alice got %v, want NEW_USER for bob", newUser)
+	}
+
+	text := protocol.MustMarshal(protocol.TextRequest{Type: protocol.TypeText, Username: "alice", Text: "across listeners"})
+	if _, err := bobConn.Write(append(text, '\n')); err != nil {
+		t.Fatalf("write text: %v", err)
+	}
+	if got := readUntil(t, aliceReader, protocol.TypeTextFrom); got["text"] != "across listeners" {
+		t.Errorf("alice got %v, want bob's message", got)
+	}
+
+	cancel()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := <-served; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Serve returned %v, want %v", err, net.ErrClosed)
+	}
+	for _, listener := range listeners {
+		if conn, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+			_ = conn.Close()
+			t.Errorf("%s still accepting after shutdown", listener.Addr())
+		}
+	}
+}
+
+// readUntil reads frames until one of messageType arrives and returns it
+// decoded.
+func readUntil(t *testing.T, reader *framing.LineReader, messageType protocol.MessageType) map[string]any {
+	t.Helper()
+
+	for {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", messageType, err)
+		}
+		var message map[string]any
+		if err := json.Unmarshal(frame, &message); err != nil {
+			t.Fatalf("decode %s: %v", frame, err)
+		}
+		if message["type"] == string(messageType) {
+			return message
+		}
+	}
+}
+
+func TestShutdownDeliversQueuedNotices(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := newTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ctx, listener)
+	}()
+
+	usernames := []string{"alice", "bob", "carol"}
+	readers := make([]*framing.LineReader, 0, len(usernames))
+	for _, username := range usernames {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		frame := protocol.MustMarshal(protocol.IdentifyRequest{Type: protocol.TypeIdentify, Username: username})
+		if _, err := conn.Write(append(frame, '\n')); err != nil {
+			t.Fatalf("write identify: %v", err)
+		}
+		reader := framing.NewLineReader(conn, 4096, 4096)
+		readUntil(t, reader, protocol.TypeResponse)
+		readers = append(readers, reader)
+	}
+
+	// The hub disconnects clients one by one on shutdown, telling those
+	// still connected about each departure; every one of those notices is
+	// queued after the context was canceled.
+	cancel()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	<-served
+
+	notices := 0
+	for i, reader := range readers {
+		for {
+			frame, err := reader.ReadFrame()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: read until close: %v", usernames[i], err)
+			}
+			var message protocol.DisconnectedMessage
+			if err := json.Unmarshal(frame, &message); err != nil {
+				t.Fatalf("decode %s: %v", frame, err)
+			}
+			if message.Type == protocol.TypeDisconnected && message.Reason == protocol.DisconnectReasonServerShutdown {
+				notices++
+			}
+		}
+	}
+
+	if want := len(usernames) * (len(usernames) - 1) / 2; notices != want {
+		t.Errorf("clients read %d SERVER_SHUTDOWN notices before the connection closed, want %d", notices, want)
+	}
+}
@@ -2,17 +2,41 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"chat-server/internal/config"
 	"chat-server/internal/framing"
 	"chat-server/internal/hub"
+	"chat-server/internal/protocol"
 )
 
+// priorityQueueDepth bounds the membership frames that may be queued on
+// top of a full regular write queue.
+const priorityQueueDepth = 16
+
+// outboundFrame is a frame waiting in a write queue. compression is only
+// set on the IDENTIFY response that negotiated it: every frame written
+// after that one is compressed with the method it names.
+type outboundFrame struct {
+	payload     []byte
+	compression string
+}
+
+// frameWriter is implemented by framing.LineWriter and
+// framing.CompressedWriter.
+type frameWriter interface {
+	WriteFrame(ctx context.Context, payload []byte) error
+	WriteFrames(ctx context.Context, payloads [][]byte) error
+}
+
 // TCPClient represents a single TCP-connected client.
 // It bridges raw network I/O with the hub event model.
 type TCPClient struct {
@@ -20,44 +44,126 @@ type TCPClient struct {
 	cfg    config.Config
 	hub    *hub.Hub
 
+	// liveConfig provides the current value of reloadable settings.
+	liveConfig *atomic.Pointer[config.Config]
+
 	conn     net.Conn
 	clientID hub.ClientID
 
-	writeQueue chan []byte
+	writeQueue chan outboundFrame
+
+	// priorityQueue carries membership frames, which are written before
+	// anything waiting in writeQueue.
+	priorityQueue chan outboundFrame
+
+	// writer frames the written payloads. It starts as a LineWriter and is
+	// replaced once compression is negotiated. Only writeLoop uses it.
+	writer frameWriter
+
+	// compressionQueued is set while the frame that negotiates compression
+	// waits in writeQueue, which the drop policies must not discard.
+	compressionQueued atomic.Bool
+
+	// done is closed by Close. The queues themselves are never closed, so
+	// a frame sent after Close is refused instead of panicking.
+	done chan struct{}
+
+	// writeLoopDone is closed when writeLoop returns.
+	writeLoopDone chan struct{}
+
+	// lastSeq is the sequence number of the last frame written or
+	// dropped, when SequenceNumbers is enabled.
+	lastSeq atomic.Uint64
+
+	// flowHighWater and flowLowWater are the write queue lengths at which
+	// FLOW_CONTROL notices are sent; flowHighWater is zero when disabled.
+	// flowPaused is set between a PAUSE and the following RESUME.
+	flowHighWater int
+	flowLowWater  int
+	flowPaused    atomic.Bool
 
 	closeOnce sync.Once
 }
 
 // NewTCPClient constructs a TCPClient bound to an existing TCP connection.
+// Timeouts are read from liveConfig on every use so that reloads apply to
+// the connection; cfg provides everything else.
 func NewTCPClient(
 	logger *log.Logger,
 	cfg config.Config,
+	liveConfig *atomic.Pointer[config.Config],
 	hubInstance *hub.Hub,
 	conn net.Conn,
 ) *TCPClient {
-	clientID := hub.ClientID(fmt.Sprintf(
-		"%s->%s",
-		conn.RemoteAddr().String(),
-		conn.LocalAddr().String(),
-	))
+	clientID := newSessionID()
+
+	var flowHighWater, flowLowWater int
+	if cfg.FlowControlHighPercent > 0 {
+		flowHighWater = max(1, cfg.WriteQueueDepth*cfg.FlowControlHighPercent/100)
+		flowLowWater = cfg.WriteQueueDepth * cfg.FlowControlLowPercent / 100
+	}
 
 	return &TCPClient{
 		logger:     logger,
 		cfg:        cfg,
 		hub:        hubInstance,
+		liveConfig: liveConfig,
 		conn:       conn,
 		clientID:   clientID,
-		writeQueue: make(chan []byte, cfg.WriteQueueDepth),
+		writeQueue: make(chan outboundFrame, cfg.WriteQueueDepth),
+		writer:     framing.NewLineWriter(conn),
+
+		priorityQueue: make(chan outboundFrame, priorityQueueDepth),
+		done:          make(chan struct{}),
+		writeLoopDone: make(chan struct{}),
+		flowHighWater: flowHighWater,
+		flowLowWater:  flowLowWater,
 	}
 }
 
+// sessionIDBytes is the amount of randomness in a session ID.
+const sessionIDBytes = 16
+
+// fallbackSessionCounter numbers sessions if the system random source fails.
+var fallbackSessionCounter atomic.Uint64
+
+// newSessionID returns a random opaque client ID. Unlike the connection
+// addresses, it is unique across address reuse and does not reveal the
+// network topology in logs.
+func newSessionID() hub.ClientID {
+	randomBytes := make([]byte, sessionIDBytes)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return hub.ClientID(fmt.Sprintf("session-%d", fallbackSessionCounter.Add(1)))
+	}
+	return hub.ClientID(hex.EncodeToString(randomBytes))
+}
+
+// shutdownWriteGrace bounds how long the write side keeps running once
+// parentCtx is canceled, so frames queued during shutdown, such as the
+// DISCONNECTED notices, still reach the client.
+const shutdownWriteGrace = 1 * time.Second
+
 // Run starts the client read/write loops and blocks until the client terminates.
+//
+// Canceling parentCtx stops reading right away, while writing goes on
+// until the hub closes the client or shutdownWriteGrace has passed.
 func (c *TCPClient) Run(parentCtx context.Context) {
-	c.hub.Register(c.clientID, c)
+	c.hub.Register(c.clientID, c, c.conn.RemoteAddr().String())
+
+	if c.cfg.SendHello {
+		c.writeHello(parentCtx)
+	}
 
 	clientContext, cancel := context.WithCancel(parentCtx)
 	defer cancel()
 
+	writeContext, cancelWrite := context.WithCancel(context.WithoutCancel(parentCtx))
+	defer cancelWrite()
+	stopGrace := context.AfterFunc(parentCtx, func() {
+		time.AfterFunc(shutdownWriteGrace, cancelWrite)
+	})
+	defer stopGrace()
+
 	var waitGroup sync.WaitGroup
 	waitGroup.Add(2)
 
@@ -68,7 +174,7 @@ func (c *TCPClient) Run(parentCtx context.Context) {
 
 	go func() {
 		defer waitGroup.Done()
-		c.writeLoop(clientContext)
+		c.writeLoop(writeContext)
 	}()
 
 	waitGroup.Wait()
@@ -77,10 +183,51 @@ func (c *TCPClient) Run(parentCtx context.Context) {
 	_ = c.Close()
 }
 
+// writeHello writes SERVER_HELLO straight to the connection. It runs before
+// writeLoop starts, so the hello is the first frame on the connection even
+// if the hub has already queued something, and it does not go through
+// Send, which only the hub goroutine may call.
+func (c *TCPClient) writeHello(ctx context.Context) {
+	if writeTimeoutSecs := c.liveConfig.Load().WriteTimeoutSecs; writeTimeoutSecs > 0 {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(time.Duration(writeTimeoutSecs) * time.Second))
+		defer func() { _ = c.conn.SetWriteDeadline(time.Time{}) }()
+	}
+
+	// A failed write also fails the first read or write of the loops,
+	// which end the connection.
+	_ = c.writer.WriteFrame(ctx, c.sequenced(c.helloFrame()))
+}
+
+// helloFrame builds the SERVER_HELLO frame, listing the operations that
+// are not disabled and the limits in force.
+func (c *TCPClient) helloFrame() []byte {
+	operations := make([]protocol.MessageType, 0)
+	for _, messageType := range protocol.ClientMessageTypes() {
+		if _, disabled := c.cfg.DisabledOperations[string(messageType)]; disabled {
+			continue
+		}
+		operations = append(operations, messageType)
+	}
+
+	return protocol.MustMarshal(protocol.ServerHelloMessage{
+		Type:       protocol.TypeServerHello,
+		Version:    protocol.ProtocolVersion,
+		MinVersion: protocol.MinProtocolVersion,
+		Operations: operations,
+		Limits: protocol.ServerLimits{
+			MaxFrameBytes:     c.cfg.MaxFrameBytes,
+			MaxTextLength:     c.liveConfig.Load().MaxTextLength,
+			MaxUsernameLength: c.cfg.MaxUsernameLength,
+			MaxRoomNameLength: c.cfg.MaxRoomNameLength,
+		},
+	})
+}
+
 // readLoop reads newline-delimited frames from the TCP connection
 // and forwards them to the hub.
 func (c *TCPClient) readLoop(ctx context.Context) {
-	lineReader := framing.NewLineReader(c.conn, c.cfg.MaxFrameBytes)
+	lineReader := framing.NewLineReader(c.conn, c.cfg.MaxFrameBytes, c.cfg.ReadBufferBytes)
+	lineReader.SetTrimCarriageReturn(c.cfg.TrimCarriageReturn)
 
 	for {
 		select {
@@ -89,13 +236,20 @@ func (c *TCPClient) readLoop(ctx context.Context) {
 		default:
 		}
 
-		if c.cfg.ReadTimeoutSecs > 0 {
+		// The deadline is set once per frame, so ReadTimeoutSecs is the
+		// budget for a whole frame, however many reads it takes.
+		if readTimeoutSecs := c.liveConfig.Load().ReadTimeoutSecs; readTimeoutSecs > 0 {
 			_ = c.conn.SetReadDeadline(
-				time.Now().Add(time.Duration(c.cfg.ReadTimeoutSecs) * time.Second),
+				time.Now().Add(time.Duration(readTimeoutSecs) * time.Second),
 			)
 		}
 
 		frame, err := lineReader.ReadFrame()
+		if errors.Is(err, framing.ErrFrameTooLarge) {
+			// The reader has skipped the oversized frame; keep the session.
+			c.hub.DeliverFrameTooLarge(c.clientID)
+			continue
+		}
 		if err != nil {
 			c.hub.Unregister(c.clientID, fmt.Sprintf("read error: %v", err))
 			return
@@ -105,66 +259,395 @@ func (c *TCPClient) readLoop(ctx context.Context) {
 	}
 }
 
+// maxWriteBatchFrames bounds how many queued frames are coalesced into a
+// single flush.
+const maxWriteBatchFrames = 64
+
 // writeLoop writes outbound frames to the TCP connection.
+// Frames already waiting in the queues when one is picked up are written
+// along with it and flushed once.
 func (c *TCPClient) writeLoop(ctx context.Context) {
-	lineWriter := framing.NewLineWriter(c.conn)
+	defer close(c.writeLoopDone)
+
+	batch := make([]outboundFrame, 0, maxWriteBatchFrames)
 
 	for {
-		select {
-		case <-ctx.Done():
-			return
+		var frame outboundFrame
 
-		case frame, ok := <-c.writeQueue:
-			if !ok {
+		// Drain priority frames first; otherwise wait for either queue.
+		select {
+		case frame = <-c.priorityQueue:
+		default:
+			select {
+			case <-ctx.Done():
 				return
+			case <-c.done:
+				c.flushRemaining()
+				return
+			case frame = <-c.priorityQueue:
+			case frame = <-c.writeQueue:
 			}
+		}
 
-			writeContext := ctx
-			var cancel context.CancelFunc
+		batch = append(batch[:0], frame)
+		batch = c.drainQueued(batch)
+		ok := true
+		if c.cfg.WriteCoalesceMs > 0 {
+			batch, ok = c.coalesceQueued(ctx, batch)
+		}
 
-			if c.cfg.WriteTimeoutSecs > 0 {
-				writeContext, cancel = context.WithTimeout(
-					ctx,
-					time.Duration(c.cfg.WriteTimeoutSecs)*time.Second,
-				)
-			}
+		writeContext := ctx
+		var cancel context.CancelFunc
 
-			err := lineWriter.WriteFrame(writeContext, frame)
+		if writeTimeoutSecs := c.liveConfig.Load().WriteTimeoutSecs; writeTimeoutSecs > 0 {
+			writeContext, cancel = context.WithTimeout(
+				ctx,
+				time.Duration(writeTimeoutSecs)*time.Second,
+			)
+		}
 
-			if cancel != nil {
-				cancel() // cancel immediately; do NOT defer inside the loop
-			}
+		err := c.writeBatch(writeContext, batch)
+		if err == nil {
+			err = c.resumeIfDrained(writeContext)
+		}
 
-			if err != nil {
-				c.hub.Unregister(c.clientID, fmt.Sprintf("write error: %v", err))
-				return
+		if cancel != nil {
+			cancel() // cancel immediately; do NOT defer inside the loop
+		}
+
+		if err != nil {
+			c.hub.Unregister(c.clientID, fmt.Sprintf("write error: %v", err))
+			return
+		}
+
+		// Close was called while coalescing; the client is shutting down.
+		if !ok {
+			c.flushRemaining()
+			return
+		}
+	}
+}
+
+// writeBatch writes frames in order and flushes them, switching c.writer
+// to compression right after the frame that negotiated it.
+func (c *TCPClient) writeBatch(ctx context.Context, batch []outboundFrame) error {
+	payloads := make([][]byte, 0, len(batch))
+	for _, frame := range batch {
+		payloads = append(payloads, c.sequenced(frame.payload))
+		if frame.compression == "" {
+			continue
+		}
+
+		if err := c.writer.WriteFrames(ctx, payloads); err != nil {
+			return err
+		}
+		payloads = payloads[:0]
+
+		compressedWriter, err := framing.NewCompressedWriter(c.conn, frame.compression)
+		if err != nil {
+			return err
+		}
+		c.writer = compressedWriter
+		c.compressionQueued.Store(false)
+	}
+
+	if len(payloads) == 0 {
+		return nil
+	}
+	return c.writer.WriteFrames(ctx, payloads)
+}
+
+// drainQueued appends frames that are already queued, priority frames
+// first, without blocking.
+func (c *TCPClient) drainQueued(batch []outboundFrame) []outboundFrame {
+	for len(batch) < maxWriteBatchFrames {
+		select {
+		case frame := <-c.priorityQueue:
+			batch = append(batch, frame)
+			continue
+		default:
+		}
+
+		select {
+		case frame := <-c.writeQueue:
+			batch = append(batch, frame)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// coalesceQueued keeps adding frames to batch until WriteCoalesceMs have
+// passed or the batch is full. It reports false if Close was called.
+func (c *TCPClient) coalesceQueued(ctx context.Context, batch []outboundFrame) ([]outboundFrame, bool) {
+	timer := time.NewTimer(time.Duration(c.cfg.WriteCoalesceMs) * time.Millisecond)
+	defer timer.Stop()
+
+	for len(batch) < maxWriteBatchFrames {
+		select {
+		case <-ctx.Done():
+			return batch, true
+		case <-timer.C:
+			return batch, true
+		case <-c.done:
+			return batch, false
+		case frame := <-c.priorityQueue:
+			batch = append(batch, frame)
+		case frame := <-c.writeQueue:
+			batch = append(batch, frame)
+		}
+	}
+	return batch, true
+}
+
+// flushRemaining writes the frames still queued once Close was called,
+// priority frames first, so final messages such as a RESPONSE or
+// DISCONNECTED reach the client. Close bounds it with a write deadline.
+func (c *TCPClient) flushRemaining() {
+	var remaining []outboundFrame
+	for _, queue := range []chan outboundFrame{c.priorityQueue, c.writeQueue} {
+	drain:
+		for {
+			select {
+			case frame := <-queue:
+				remaining = append(remaining, frame)
+			default:
+				break drain
 			}
 		}
 	}
+
+	if len(remaining) > 0 {
+		_ = c.writeBatch(context.Background(), remaining)
+	}
 }
 
+// errWriteQueueFull is returned by Send when the client is not reading
+// fast enough to keep up with outbound frames.
+var errWriteQueueFull = errors.New("client write queue is full")
+
+// errClientClosed is returned by Send and SendPriority after Close.
+var errClientClosed = errors.New("client is closed")
+
 // Send enqueues a frame for delivery to the client.
+//
+// If the write queue is full, Send waits up to WriteEnqueueTimeoutMs for
+// room to free up, which absorbs short bursts. Because Send is called from
+// the hub goroutine, this wait stalls the hub and should be kept short.
 func (c *TCPClient) Send(ctx context.Context, frame []byte) error {
+	return c.enqueue(ctx, outboundFrame{payload: frame})
+}
+
+// SendCompressed enqueues a frame like Send. Every frame written after it
+// is compressed with method, which must be supported by the framing
+// package; the hub only calls it for the IDENTIFY response.
+func (c *TCPClient) SendCompressed(ctx context.Context, frame []byte, method string) error {
+	return c.enqueue(ctx, outboundFrame{payload: frame, compression: method})
+}
+
+// enqueue adds a frame to the write queue on behalf of Send and
+// SendCompressed.
+func (c *TCPClient) enqueue(ctx context.Context, frame outboundFrame) error {
+	select {
+	case <-c.done:
+		return errClientClosed
+	default:
+	}
+
+	// Set before the frame is queued, so writeLoop can only clear it after
+	// taking the frame.
+	if frame.compression != "" {
+		c.compressionQueued.Store(true)
+	}
+
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	case c.writeQueue <- frame:
+		c.pauseIfFilling(ctx)
 		return nil
+	default:
+	}
+
+	enqueueTimeoutMs := c.liveConfig.Load().WriteEnqueueTimeoutMs
+	if enqueueTimeoutMs <= 0 {
+		return c.handleOverflow(frame)
+	}
+
+	timer := time.NewTimer(time.Duration(enqueueTimeoutMs) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return errClientClosed
+	case c.writeQueue <- frame:
+		c.pauseIfFilling(ctx)
+		return nil
+	case <-timer.C:
+		return c.handleOverflow(frame)
+	}
+}
+
+// pauseIfFilling sends FLOW_CONTROL PAUSE, ahead of the queued frames, the
+// first time the write queue reaches the high-water mark.
+func (c *TCPClient) pauseIfFilling(ctx context.Context) {
+	if c.flowHighWater == 0 || len(c.writeQueue) < c.flowHighWater {
+		return
+	}
+	if !c.flowPaused.CompareAndSwap(false, true) {
+		return
+	}
+	err := c.SendPriority(ctx, protocol.MustMarshal(protocol.FlowControlMessage{
+		Type:  protocol.TypeFlowControl,
+		State: protocol.FlowControlPause,
+	}))
+	if err != nil {
+		// Try again on the next send rather than resuming a client that
+		// was never paused.
+		c.flowPaused.Store(false)
+	}
+}
+
+// resumeIfDrained writes FLOW_CONTROL RESUME once a paused client's write
+// queue has drained to the low-water mark. It runs on the write loop, which
+// writes the notice itself rather than queueing it.
+func (c *TCPClient) resumeIfDrained(ctx context.Context) error {
+	if !c.flowPaused.Load() || len(c.writeQueue) > c.flowLowWater {
+		return nil
+	}
+	if !c.flowPaused.CompareAndSwap(true, false) {
+		return nil
+	}
+	return c.writer.WriteFrame(ctx, c.sequenced(protocol.MustMarshal(protocol.FlowControlMessage{
+		Type:  protocol.TypeFlowControl,
+		State: protocol.FlowControlResume,
+	})))
+}
+
+// handleOverflow applies the configured OverflowPolicy to a frame that
+// found the write queue full.
+//
+// The frame that negotiates compression is never dropped: the client
+// could not read anything written after it. When either drop policy
+// would discard it, the client is disconnected instead.
+func (c *TCPClient) handleOverflow(frame outboundFrame) error {
+	switch c.cfg.OverflowPolicy {
+	case config.OverflowDropNewest:
+		if frame.compression != "" {
+			return errWriteQueueFull
+		}
+		c.skipSequence()
+		return nil
+
+	case config.OverflowDropOldest:
+		// The oldest frame cannot be inspected before it is evicted.
+		if c.compressionQueued.Load() && frame.compression == "" {
+			return errWriteQueueFull
+		}
+
+		// Send is only called from the hub goroutine, so once a frame is
+		// evicted nothing else can take its slot; the loop only repeats
+		// if writeLoop raced us to the head of the queue.
+		for {
+			select {
+			case c.writeQueue <- frame:
+				return nil
+			default:
+			}
+
+			select {
+			case <-c.writeQueue:
+				c.skipSequence()
+			default:
+			}
+		}
+
 	default:
 		// Backpressure: if the client is not reading fast enough,
 		// fail closed to protect server resources.
-		return fmt.Errorf("client write queue is full")
+		return errWriteQueueFull
+	}
+}
+
+// SendPriority enqueues a frame ahead of regular traffic. It still
+// succeeds when the regular write queue is full, up to priorityQueueDepth
+// pending priority frames.
+func (c *TCPClient) SendPriority(ctx context.Context, frame []byte) error {
+	select {
+	case <-c.done:
+		return errClientClosed
+	default:
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case c.priorityQueue <- outboundFrame{payload: frame}:
+		return nil
+	default:
+		return errWriteQueueFull
 	}
 }
 
+// sequenced numbers a frame if SequenceNumbers is enabled. Numbers are
+// taken when a frame is written, so they follow the order on the wire
+// even when priority frames overtake queued ones.
+func (c *TCPClient) sequenced(frame []byte) []byte {
+	if !c.cfg.SequenceNumbers {
+		return frame
+	}
+	return protocol.WithSequence(frame, c.lastSeq.Add(1))
+}
+
+// skipSequence uses up a sequence number for a dropped frame, so the
+// client sees a gap where it would have been.
+func (c *TCPClient) skipSequence() {
+	if c.cfg.SequenceNumbers {
+		c.lastSeq.Add(1)
+	}
+}
+
+// closeDrainTimeout bounds how long queued frames may take to be written
+// after Close before the connection is closed.
+const closeDrainTimeout = 500 * time.Millisecond
+
 // Close closes the client connection and releases resources.
+//
+// Close does not block: the hub calls it from its own goroutine, where
+// waiting on one slow client would stall every other one. Frames queued
+// before Close are still written, as long as that completes within
+// closeDrainTimeout; the connection is then closed in the background and
+// whatever is left is dropped. Close only signals writeLoop through done,
+// so sends racing with it are refused rather than hitting a closed queue.
 func (c *TCPClient) Close() error {
-	var closeError error
-
 	c.closeOnce.Do(func() {
-		close(c.writeQueue)
-		closeError = c.conn.Close()
+		// The deadline also interrupts a write already in progress, so a
+		// client that stopped reading cannot delay the close for longer.
+		_ = c.conn.SetWriteDeadline(time.Now().Add(closeDrainTimeout))
+
+		close(c.done)
+
+		go c.closeAfterDrain()
 	})
 
-	return closeError
+	return nil
+}
+
+// closeAfterDrain closes the connection once writeLoop has written the
+// remaining frames, or closeDrainTimeout has passed.
+func (c *TCPClient) closeAfterDrain() {
+	timer := time.NewTimer(closeDrainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-c.writeLoopDone:
+	case <-timer.C:
+	}
+
+	if err := c.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		c.logger.Printf("client close error: id=%s err=%v", c.clientID, err)
+	}
 }
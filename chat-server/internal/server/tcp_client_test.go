@@ -0,0 +1,1037 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"chat-server/internal/config"
+	"chat-server/internal/framing"
+	"chat-server/internal/hub"
+	"chat-server/internal/protocol"
+)
+
+// newTestClient creates a TCPClient over an in-memory connection, with
+// the default configuration adjusted by configure when it is not nil.
+// It returns the client and the peer end of its connection; neither loop
+// is started.
+func newTestClient(t *testing.T, configure func(*config.Config)) (*TCPClient, net.Conn) {
+	t.Helper()
+
+	cfg, err := config.FromEnv()
+	if err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	liveConfig := &atomic.Pointer[config.Config]{}
+	liveConfig.Store(&cfg)
+
+	logger := log.New(io.Discard, "", 0)
+	serverConn, peerConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = peerConn.Close()
+	})
+
+	client := NewTCPClient(logger, cfg, liveConfig, hub.New(logger, cfg, nil, nil, nil), serverConn)
+	return client, peerConn
+}
+
+func TestSendWaitsForRoomInWriteQueue(t *testing.T) {
+	client, _ := newTestClient(t, func(cfg *config.Config) {
+		cfg.WriteQueueDepth = 1
+		cfg.WriteEnqueueTimeoutMs = 1000
+	})
+	ctx := context.Background()
+
+	if err := client.Send(ctx, []byte(`{"n":1}`)); err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-client.writeQueue
+	}()
+
+	if err := client.Send(ctx, []byte(`{"n":2}`)); err != nil {
+		t.Fatalf("send with room freed within the timeout: %v", err)
+	}
+}
+
+func TestSendFailsWhenWriteQueueStaysFull(t *testing.T) {
+	client, _ := newTestClient(t, func(cfg *config.Config) {
+		cfg.WriteQueueDepth = 1
+		cfg.WriteEnqueueTimeoutMs = 20
+		cfg.OverflowPolicy = config.OverflowDisconnect
+	})
+	ctx := context.Background()
+
+	if err := client.Send(ctx, []byte(`{"n":1}`)); err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+
+	if err := client.Send(ctx, []byte(`{"n":2}`)); !errors.Is(err, errWriteQueueFull) {
+		t.Fatalf("got error %v, want %v", err, errWriteQueueFull)
+	}
+}
+
+func TestSendWaitRespectsContext(t *testing.T) {
+	client, _ := newTestClient(t, func(cfg *config.Config) {
+		cfg.WriteQueueDepth = 1
+		cfg.WriteEnqueueTimeoutMs = 10_000
+	})
+
+	if err := client.Send(context.Background(), []byte(`{"n":1}`)); err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := client.Send(ctx, []byte(`{"n":2}`)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestDripFeedingClientIsDisconnected(t *testing.T) {
+	client, peerConn := newTestClient(t, func(cfg *config.Config) {
+		cfg.ReadTimeoutSecs = 1
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.hub.Run(ctx)
+
+	// The peer sends a byte every 50ms and never finishes the frame.
+	go func() {
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := peerConn.Write([]byte("x")); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		_, _ = io.Copy(io.Discard, peerConn)
+	}()
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.Run(ctx)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drip-feeding client still connected after 5s")
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("disconnected after %v, before the 1s frame budget", elapsed)
+	}
+}
+
+func TestWriteLoopSwitchesToCompression(t *testing.T) {
+	client, peerConn := newTestClient(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.writeLoop(ctx)
+
+	negotiating := []byte(`{"type":"RESPONSE","operation":"IDENTIFY","result":"SUCCESS","compression":"gzip"}`)
+	following := []byte(`{"type":"TEXT_FROM","username":"bob","text":"hi"}`)
+	if err := client.SendCompressed(ctx, negotiating, framing.CompressionGzip); err != nil {
+		t.Fatalf("send compressed: %v", err)
+	}
+	if err := client.Send(ctx, following); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	_ = peerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	peerReader := bufio.NewReader(peerConn)
+
+	// The negotiating frame itself is still newline-delimited.
+	line, err := peerReader.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("read negotiating frame: %v", err)
+	}
+	if got := bytes.TrimSuffix(line, []byte("\n")); !bytes.Equal(got, negotiating) {
+		t.Errorf("negotiating frame = %s, want %s", got, negotiating)
+	}
+
+	compressedReader, err := framing.NewCompressedReader(peerReader, framing.CompressionGzip, 4096)
+	if err != nil {
+		t.Fatalf("new compressed reader: %v", err)
+	}
+	frame, err := compressedReader.ReadFrame()
+	if err != nil {
+		t.Fatalf("read compressed frame: %v", err)
+	}
+	if !bytes.Equal(frame, following) {
+		t.Errorf("compressed frame = %s, want %s", frame, following)
+	}
+}
+
+func TestWriteLoopUncompressedByDefault(t *testing.T) {
+	client, peerConn := newTestClient(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.writeLoop(ctx)
+
+	frames := []string{`{"type":"RESPONSE","operation":"IDENTIFY","result":"SUCCESS"}`, `{"type":"NEW_USER","username":"bob"}`}
+	for _, frame := range frames {
+		if err := client.Send(ctx, []byte(frame)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+
+	_ = peerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	lineReader := framing.NewLineReader(peerConn, 4096, 4096)
+	for _, want := range frames {
+		frame, err := lineReader.ReadFrame()
+		if err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		if string(frame) != want {
+			t.Errorf("frame = %s, want %s", frame, want)
+		}
+	}
+}
+
+func TestPriorityFramesBypassFullQueue(t *testing.T) {
+	client, peerConn := newTestClient(t, func(cfg *config.Config) {
+		cfg.WriteQueueDepth = 1
+		cfg.WriteEnqueueTimeoutMs = 0
+		cfg.OverflowPolicy = config.OverflowDropNewest
+		cfg.FlowControlHighPercent = 0
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bulk := []string{`{"n":1}`, `{"n":2}`}
+	for _, frame := range bulk {
+		if err := client.Send(ctx, []byte(frame)); err != nil {
+			t.Fatalf("send bulk: %v", err)
+		}
+	}
+	membership := `{"type":"JOINED_ROOM","roomname":"den","username":"bob"}`
+	if err := client.SendPriority(ctx, []byte(membership)); err != nil {
+		t.Fatalf("send priority with a full queue: %v", err)
+	}
+
+	go client.writeLoop(ctx)
+
+	_ = peerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	lineReader := framing.NewLineReader(peerConn, 4096, 4096)
+
+	// The membership frame is written first; the second bulk frame found
+	// the queue full and was dropped.
+	for _, want := range []string{membership, bulk[0]} {
+		frame, err := lineReader.ReadFrame()
+		if err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		if string(frame) != want {
+			t.Errorf("frame = %s, want %s", frame, want)
+		}
+	}
+	if queued := len(client.writeQueue) + len(client.priorityQueue); queued != 0 {
+		t.Errorf("%d frames still queued, want the dropped frame gone", queued)
+	}
+}
+
+func TestPriorityQueueIsBounded(t *testing.T) {
+	client, _ := newTestClient(t, nil)
+	ctx := context.Background()
+
+	for i := range priorityQueueDepth {
+		if err := client.SendPriority(ctx, []byte(`{}`)); err != nil {
+			t.Fatalf("priority frame %d: %v", i+1, err)
+		}
+	}
+	if err := client.SendPriority(ctx, []byte(`{}`)); !errors.Is(err, errWriteQueueFull) {
+		t.Errorf("got error %v past the cap, want %v", err, errWriteQueueFull)
+	}
+}
+
+func TestSendAfterCloseIsRefused(t *testing.T) {
+	client, _ := newTestClient(t, func(cfg *config.Config) {
+		cfg.WriteQueueDepth = 1
+		cfg.WriteEnqueueTimeoutMs = 10_000
+	})
+	ctx := context.Background()
+
+	if err := client.Send(ctx, []byte(`{"n":1}`)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	// A send waiting for room in the full queue gives up on Close.
+	waiting := make(chan error, 1)
+	go func() {
+		waiting <- client.Send(ctx, []byte(`{"n":2}`))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_ = client.Close()
+
+	select {
+	case err := <-waiting:
+		if !errors.Is(err, errClientClosed) {
+			t.Errorf("waiting send: got error %v, want %v", err, errClientClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting send still blocked 5s after Close")
+	}
+
+	if err := client.Send(ctx, []byte(`{"n":3}`)); !errors.Is(err, errClientClosed) {
+		t.Errorf("send: got error %v, want %v", err, errClientClosed)
+	}
+	if err := client.SendPriority(ctx, []byte(`{"n":4}`)); !errors.Is(err, errClientClosed) {
+		t.Errorf("priority send: got error %v, want %v", err, errClientClosed)
+	}
+}
+
+func TestConnectionsFromSameAddressGetDistinctIDs(t *testing.T) {
+	cfg, err := config.FromEnv()
+	if err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	liveConfig := &atomic.Pointer[config.Config]{}
+	liveConfig.Store(&cfg)
+	logger := log.New(io.Discard, "", 0)
+	hubInstance := hub.New(logger, cfg, nil, nil, nil)
+
+	remote := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 50000}
+	var clients []*TCPClient
+	for range 2 {
+		serverConn, peerConn := net.Pipe()
+		t.Cleanup(func() {
+			_ = serverConn.Close()
+			_ = peerConn.Close()
+		})
+		conn := addrConn{Conn: serverConn, remote: remote}
+		clients = append(clients, NewTCPClient(logger, cfg, liveConfig, hubInstance, conn))
+	}
+
+	if clients[0].clientID == clients[1].clientID {
+		t.Errorf("both connections from %s got ID %s", remote, clients[0].clientID)
+	}
+	for _, client := range clients {
+		if id := string(client.clientID); strings.Contains(id, remote.IP.String()) {
+			t.Errorf("ID %s reveals the remote address", id)
+		}
+	}
+}
+
+// batchRecorder is a frameWriter recording each batch it is asked to write.
+type batchRecorder struct {
+	batches chan [][]byte
+}
+
+func (w *batchRecorder) WriteFrame(ctx context.Context, payload []byte) error {
+	return w.WriteFrames(ctx, [][]byte{payload})
+}
+
+func (w *batchRecorder) WriteFrames(_ context.Context, payloads [][]byte) error {
+	batch := make([][]byte, len(payloads))
+	copy(batch, payloads)
+	w.batches <- batch
+	return nil
+}
+
+func TestWriteLoopBatchesQueuedFrames(t *testing.T) {
+	client, _ := newTestClient(t, func(cfg *config.Config) {
+		cfg.WriteQueueDepth = 8
+	})
+	recorder := &batchRecorder{batches: make(chan [][]byte, 8)}
+	client.writer = recorder
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	frames := []string{`{"n":1}`, `{"n":2}`, `{"n":3}`, `{"n":4}`}
+	for _, frame := range frames {
+		if err := client.Send(ctx, []byte(frame)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	go client.writeLoop(ctx)
+
+	select {
+	case batch := <-recorder.batches:
+		if len(batch) != len(frames) {
+			t.Fatalf("first flush wrote %d frames, want all %d queued ones", len(batch), len(frames))
+		}
+		for i, payload := range batch {
+			if string(payload) != frames[i] {
+				t.Errorf("frame %d = %s, want %s", i, payload, frames[i])
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued frames were never written")
+	}
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	tests := []struct {
+		name           string
+		coalesceMs     int
+		wantFirstFlush int
+	}{
+		{name: "disabled", coalesceMs: 0, wantFirstFlush: 1},
+		{name: "enabled", coalesceMs: 300, wantFirstFlush: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, _ := newTestClient(t, func(cfg *config.Config) {
+				cfg.WriteQueueDepth = 8
+				cfg.WriteCoalesceMs = test.coalesceMs
+			})
+			recorder := &batchRecorder{batches: make(chan [][]byte, 8)}
+			client.writer = recorder
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go client.writeLoop(ctx)
+
+			// The first frame finds the queue otherwise empty; the others
+			// arrive shortly after, within the coalescing window.
+			if err := client.Send(ctx, []byte(`{"n":1}`)); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			time.Sleep(20 * time.Millisecond)
+			for _, frame := range []string{`{"n":2}`, `{"n":3}`} {
+				if err := client.Send(ctx, []byte(frame)); err != nil {
+					t.Fatalf("send: %v", err)
+				}
+			}
+
+			select {
+			case batch := <-recorder.batches:
+				if len(batch) != test.wantFirstFlush {
+					t.Errorf("first flush wrote %d frames, want %d", len(batch), test.wantFirstFlush)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("frames were never written")
+			}
+		})
+	}
+}
+
+func TestWriteCoalescingWaitIsBounded(t *testing.T) {
+	client, _ := newTestClient(t, func(cfg *config.Config) {
+		cfg.WriteCoalesceMs = 50
+	})
+	recorder := &batchRecorder{batches: make(chan [][]byte, 1)}
+	client.writer = recorder
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.writeLoop(ctx)
+
+	start := time.Now()
+	if err := client.Send(ctx, []byte(`{"n":1}`)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	select {
+	case batch := <-recorder.batches:
+		if len(batch) != 1 {
+			t.Errorf("flush wrote %d frames, want 1", len(batch))
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("lone frame flushed after %v, before the 50ms window closed", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a lone frame was held past the coalescing window")
+	}
+}
+
+func TestHelloArrivesBeforeClientInput(t *testing.T) {
+	client, peerConn := newTestClient(t, func(cfg *config.Config) {
+		cfg.SendHello = true
+		cfg.DisabledOperations = map[string]struct{}{string(protocol.TypeNewRoom): {}}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.hub.Run(ctx)
+	go client.Run(ctx)
+
+	_ = peerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame, err := framing.NewLineReader(peerConn, 4096, 4096).ReadFrame()
+	if err != nil {
+		t.Fatalf("read hello: %v", err)
+	}
+
+	var hello protocol.ServerHelloMessage
+	if err := json.Unmarshal(frame, &hello); err != nil {
+		t.Fatalf("decode %s: %v", frame, err)
+	}
+	if hello.Type != protocol.TypeServerHello || hello.Version != protocol.ProtocolVersion {
+		t.Errorf("hello = %s, want SERVER_HELLO with version %d", frame, protocol.ProtocolVersion)
+	}
+	if !slices.Contains(hello.Operations, protocol.TypeIdentify) || slices.Contains(hello.Operations, protocol.TypeNewRoom) {
+		t.Errorf("operations = %v, want IDENTIFY listed and the disabled NEW_ROOM left out", hello.Operations)
+	}
+}
+
+func TestHelloAdvertisesLimits(t *testing.T) {
+	client, _ := newTestClient(t, func(cfg *config.Config) {
+		cfg.MaxFrameBytes = 2048
+		cfg.MaxTextLength = 300
+		cfg.MaxUsernameLength = 12
+		cfg.MaxRoomNameLength = 20
+	})
+
+	var hello protocol.ServerHelloMessage
+	if err := json.Unmarshal(client.helloFrame(), &hello); err != nil {
+		t.Fatalf("decode hello: %v", err)
+	}
+	want := protocol.ServerLimits{
+		MaxFrameBytes:     2048,
+		MaxTextLength:     300,
+		MaxUsernameLength: 12,
+		MaxRoomNameLength: 20,
+	}
+	if hello.Limits != want {
+		t.Errorf("limits = %+v, want %+v", hello.Limits, want)
+	}
+
+	// MaxTextLength can be reloaded, so the hello follows the live config.
+	reloaded := *client.liveConfig.Load()
+	reloaded.MaxTextLength = 100
+	client.liveConfig.Store(&reloaded)
+	if err := json.Unmarshal(client.helloFrame(), &hello); err != nil {
+		t.Fatalf("decode hello: %v", err)
+	}
+	if hello.Limits.MaxTextLength != 100 {
+		t.Errorf("max text length after reload = %d, want 100", hello.Limits.MaxTextLength)
+	}
+}
+
+func TestNoHelloByDefault(t *testing.T) {
+	client, peerConn := newTestClient(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.hub.Run(ctx)
+	go client.Run(ctx)
+
+	_ = peerConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := peerConn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read %d bytes with error %v before any input, want nothing sent", n, err)
+	}
+}
+
+func TestOversizedFrameKeepsConnection(t *testing.T) {
+	client, peerConn := newTestClient(t, func(cfg *config.Config) {
+		cfg.MaxFrameBytes = 64
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.hub.Run(ctx)
+	go client.Run(ctx)
+
+	_ = peerConn.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		_, _ = peerConn.Write([]byte(strings.Repeat("x", 200) + "\n" + `{"type":"IDENTIFY","username":"alice"}` + "\n"))
+	}()
+
+	lineReader := framing.NewLineReader(peerConn, 4096, 4096)
+	for _, want := range []struct {
+		operation string
+		result    protocol.ResultCode
+	}{
+		{operation: "INVALID", result: protocol.ResultFrameTooLarge},
+		{operation: "IDENTIFY", result: protocol.ResultSuccess},
+	} {
+		frame, err := lineReader.ReadFrame()
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		var response protocol.ResponseMessage
+		if err := json.Unmarshal(frame, &response); err != nil {
+			t.Fatalf("decode %s: %v", frame, err)
+		}
+		if response.Operation != want.operation || response.Result != want.result {
+			t.Errorf("response = %s, want %s %s", frame, want.operation, want.result)
+		}
+	}
+}
+
+func TestCarriageReturnFramesDecode(t *testing.T) {
+	client, peerConn := newTestClient(t, func(cfg *config.Config) {
+		cfg.TrimCarriageReturn = true
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.hub.Run(ctx)
+	go client.Run(ctx)
+
+	_ = peerConn.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		_, _ = peerConn.Write([]byte("{\"type\":\"IDENTIFY\",\"username\":\"alice\"}\r\n{\"type\":\"USERS\"}\r\n"))
+	}()
+
+	lineReader := framing.NewLineReader(peerConn, 4096, 4096)
+	frame, err := lineReader.ReadFrame()
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	var response protocol.ResponseMessage
+	if err := json.Unmarshal(frame, &response); err != nil {
+		t.Fatalf("decode %s: %v", frame, err)
+	}
+	if response.Result != protocol.ResultSuccess {
+		t.Errorf("IDENTIFY response = %s, want %s", frame, protocol.ResultSuccess)
+	}
+
+	for {
+		frame, err := lineReader.ReadFrame()
+		if err != nil {
+			t.Fatalf("read USER_LIST: %v", err)
+		}
+		if bytes.Contains(frame, []byte(`"type":"USER_LIST"`)) {
+			break
+		}
+	}
+}
+
+func TestCloseWritesQueuedFramesFirst(t *testing.T) {
+	client, peerConn := newTestClient(t, nil)
+	ctx := context.Background()
+
+	frames := []string{
+		`{"type":"RESPONSE","operation":"KICK","result":"SUCCESS"}`,
+		`{"type":"DISCONNECTED","username":"bob","reason":"KICKED"}`,
+		`{"type":"SERVER_NOTICE","text":"bye"}`,
+	}
+	for _, frame := range frames {
+		if err := client.Send(ctx, []byte(frame)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	go client.writeLoop(ctx)
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+
+	_ = peerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	lineReader := framing.NewLineReader(peerConn, 4096, 4096)
+	for _, want := range frames {
+		frame, err := lineReader.ReadFrame()
+		if err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		if string(frame) != want {
+			t.Errorf("frame = %s, want %s", frame, want)
+		}
+	}
+	if _, err := lineReader.ReadFrame(); !errors.Is(err, io.EOF) {
+		t.Errorf("got error %v after the queued frames, want io.EOF", err)
+	}
+}
+
+func TestCloseWhileSending(t *testing.T) {
+	client, peerConn := newTestClient(t, nil)
+	ctx := context.Background()
+	go client.writeLoop(ctx)
+	go func() { _, _ = io.Copy(io.Discard, peerConn) }()
+
+	sent := make(chan error, 1)
+	go func() {
+		// Full queues are expected; only a refusal after Close ends the loop.
+		for {
+			err := client.Send(ctx, []byte(`{"type":"SERVER_NOTICE","text":"hi"}`))
+			if errors.Is(err, errClientClosed) {
+				sent <- err
+				return
+			}
+			err = client.SendPriority(ctx, []byte(`{"type":"LEFT_ROOM"}`))
+			if errors.Is(err, errClientClosed) {
+				sent <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_ = client.Close()
+
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sends still accepted 5s after Close")
+	}
+	select {
+	case <-client.writeLoopDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write loop still running 5s after Close")
+	}
+}
+
+func TestCloseIsBoundedWhenPeerStopsReading(t *testing.T) {
+	client, peerConn := newTestClient(t, nil)
+	ctx := context.Background()
+
+	if err := client.Send(ctx, []byte(`{"type":"SERVER_NOTICE","text":"unread"}`)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	go client.writeLoop(ctx)
+
+	start := time.Now()
+	_ = client.Close()
+
+	// The peer never reads, so only the drain timeout ends the write.
+	select {
+	case <-client.writeLoopDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write loop still blocked 5s after Close")
+	}
+	if elapsed := time.Since(start); elapsed > 2*closeDrainTimeout+time.Second {
+		t.Errorf("close took %v, want about %v", elapsed, closeDrainTimeout)
+	}
+
+	_ = peerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, peerConn); err != nil {
+		t.Errorf("connection not closed after the drain timeout: %v", err)
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy     string
+		wantErr    error
+		wantQueued []string
+	}{
+		{policy: config.OverflowDisconnect, wantErr: errWriteQueueFull, wantQueued: []string{`{"n":1}`, `{"n":2}`}},
+		{policy: config.OverflowDropOldest, wantQueued: []string{`{"n":2}`, `{"n":3}`}},
+		{policy: config.OverflowDropNewest, wantQueued: []string{`{"n":1}`, `{"n":2}`}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			client, _ := newTestClient(t, func(cfg *config.Config) {
+				cfg.WriteQueueDepth = 2
+				cfg.WriteEnqueueTimeoutMs = 0
+				cfg.FlowControlHighPercent = 0
+				cfg.OverflowPolicy = test.policy
+			})
+			ctx := context.Background()
+
+			for _, frame := range []string{`{"n":1}`, `{"n":2}`} {
+				if err := client.Send(ctx, []byte(frame)); err != nil {
+					t.Fatalf("send %s: %v", frame, err)
+				}
+			}
+			if err := client.Send(ctx, []byte(`{"n":3}`)); !errors.Is(err, test.wantErr) {
+				t.Errorf("send into a full queue: got error %v, want %v", err, test.wantErr)
+			}
+
+			var queued []string
+			for len(client.writeQueue) > 0 {
+				queued = append(queued, string((<-client.writeQueue).payload))
+			}
+			if !slices.Equal(queued, test.wantQueued) {
+				t.Errorf("queued = %v, want %v", queued, test.wantQueued)
+			}
+		})
+	}
+}
+
+func TestDropPoliciesKeepCompressionFrame(t *testing.T) {
+	negotiating := []byte(`{"type":"RESPONSE","operation":"IDENTIFY","result":"SUCCESS","compression":"gzip"}`)
+
+	t.Run(config.OverflowDropOldest, func(t *testing.T) {
+		client, _ := newTestClient(t, func(cfg *config.Config) {
+			cfg.WriteQueueDepth = 2
+			cfg.WriteEnqueueTimeoutMs = 0
+			cfg.FlowControlHighPercent = 0
+			cfg.OverflowPolicy = config.OverflowDropOldest
+		})
+		ctx := context.Background()
+
+		if err := client.SendCompressed(ctx, negotiating, framing.CompressionGzip); err != nil {
+			t.Fatalf("send compressed: %v", err)
+		}
+		if err := client.Send(ctx, []byte(`{"n":1}`)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		if err := client.Send(ctx, []byte(`{"n":2}`)); !errors.Is(err, errWriteQueueFull) {
+			t.Errorf("send into a full queue: got error %v, want %v", err, errWriteQueueFull)
+		}
+		if oldest := <-client.writeQueue; !bytes.Equal(oldest.payload, negotiating) {
+			t.Errorf("oldest queued frame = %s, want the negotiating frame", oldest.payload)
+		}
+	})
+
+	t.Run(config.OverflowDropNewest, func(t *testing.T) {
+		client, _ := newTestClient(t, func(cfg *config.Config) {
+			cfg.WriteQueueDepth = 1
+			cfg.WriteEnqueueTimeoutMs = 0
+			cfg.FlowControlHighPercent = 0
+			cfg.OverflowPolicy = config.OverflowDropNewest
+		})
+		ctx := context.Background()
+
+		if err := client.Send(ctx, []byte(`{"n":1}`)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		err := client.SendCompressed(ctx, negotiating, framing.CompressionGzip)
+		if !errors.Is(err, errWriteQueueFull) {
+			t.Errorf("send compressed into a full queue: got error %v, want %v", err, errWriteQueueFull)
+		}
+	})
+}
+
+func TestSequenceNumbersIncreaseByOne(t *testing.T) {
+	client, peerConn := newTestClient(t, func(cfg *config.Config) {
+		cfg.SequenceNumbers = true
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.writeLoop(ctx)
+
+	if err := client.Send(ctx, []byte(`{"type":"NEW_USER","username":"bob"}`)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if err := client.SendPriority(ctx, []byte(`{"type":"JOINED_ROOM","roomname":"den","username":"bob"}`)); err != nil {
+		t.Fatalf("send priority: %v", err)
+	}
+	if err := client.Send(ctx, []byte(`{"type":"LEFT_ROOM","roomname":"den","username":"bob"}`)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	_ = peerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	lineReader := framing.NewLineReader(peerConn, 4096, 4096)
+	var seqs []uint64
+	for range 3 {
+		frame, err := lineReader.ReadFrame()
+		if err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		var header struct {
+			Seq *uint64 `json:"seq"`
+		}
+		if err := json.Unmarshal(frame, &header); err != nil || header.Seq == nil {
+			t.Fatalf("frame %s has no seq: %v", frame, err)
+		}
+		seqs = append(seqs, *header.Seq)
+	}
+
+	// Frames are numbered as they are written, so a priority frame that
+	// overtakes queued ones still arrives in sequence.
+	if !slices.Equal(seqs, []uint64{1, 2, 3}) {
+		t.Errorf("sequence numbers = %v, want 1, 2, 3 in order", seqs)
+	}
+}
+
+func TestDroppedFrameLeavesSequenceGap(t *testing.T) {
+	client, peerConn := newTestClient(t, func(cfg *config.Config) {
+		cfg.SequenceNumbers = true
+		cfg.WriteQueueDepth = 1
+		cfg.WriteEnqueueTimeoutMs = 0
+		cfg.FlowControlHighPercent = 0
+		cfg.OverflowPolicy = config.OverflowDropNewest
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, frame := range []string{`{"n":1}`, `{"n":2}`} {
+		if err := client.Send(ctx, []byte(frame)); err != nil {
+			t.Fatalf("send %s: %v", frame, err)
+		}
+	}
+
+	go client.writeLoop(ctx)
+	_ = peerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	lineReader := framing.NewLineReader(peerConn, 4096, 4096)
+	if _, err := lineReader.ReadFrame(); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	if err := client.Send(ctx, []byte(`{"n":3}`)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	frame, err := lineReader.ReadFrame()
+	if err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+
+	var header struct {
+		N   int    `json:"n"`
+		Seq uint64 `json:"seq"`
+	}
+	if err := json.Unmarshal(frame, &header); err != nil {
+		t.Fatalf("decode %s: %v", frame, err)
+	}
+	if header.N != 3 || header.Seq != 3 {
+		t.Errorf("second delivered frame = %s, want n 3 with seq 3", frame)
+	}
+}
+
+func TestNoSequenceNumbersByDefault(t *testing.T) {
+	client, peerConn := newTestClient(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.writeLoop(ctx)
+
+	frame := `{"type":"NEW_USER","username":"bob"}`
+	if err := client.Send(ctx, []byte(frame)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	_ = peerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := framing.NewLineReader(peerConn, 4096, 4096).ReadFrame()
+	if err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	if string(got) != frame {
+		t.Errorf("frame = %s, want it unchanged", got)
+	}
+}
+
+func TestBlankLinesIgnoredOnTheWire(t *testing.T) {
+	client, peerConn := newTestClient(t, func(cfg *config.Config) {
+		cfg.IgnoreEmptyFrames = true
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.hub.Run(ctx)
+	go client.Run(ctx)
+
+	_ = peerConn.SetDeadline(time.Now().Add(5 * time.Second))
+	input := "\n\r\n" + `{"type":"IDENTIFY","username":"alice"}` + "\n\n" + `{"type":"USERS"}` + "\n"
+	go func() {
+		_, _ = io.WriteString(peerConn, input)
+	}()
+
+	lineReader := framing.NewLineReader(peerConn, 4096, 4096)
+	for _, want := range []protocol.MessageType{protocol.TypeResponse, protocol.TypeUserList} {
+		frame, err := lineReader.ReadFrame()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", want, err)
+		}
+		var header struct {
+			Type protocol.MessageType `json:"type"`
+		}
+		if err := json.Unmarshal(frame, &header); err != nil || header.Type != want {
+			t.Fatalf("got %s, want %s", frame, want)
+		}
+	}
+}
+
+func TestFlowControlNoticesOncePerCrossing(t *testing.T) {
+	client, _ := newTestClient(t, func(cfg *config.Config) {
+		cfg.WriteQueueDepth = 10
+		cfg.FlowControlHighPercent = 80
+		cfg.FlowControlLowPercent = 20
+	})
+	recorder := &batchRecorder{batches: make(chan [][]byte, 8)}
+	client.writer = recorder
+	ctx := context.Background()
+
+	// notices returns the FLOW_CONTROL states queued ahead of regular
+	// traffic and written by the write loop since the last call.
+	notices := func() []string {
+		t.Helper()
+		var states []string
+		collect := func(frame []byte) {
+			var notice protocol.FlowControlMessage
+			if err := json.Unmarshal(frame, &notice); err != nil || notice.Type != protocol.TypeFlowControl {
+				t.Fatalf("unexpected frame %s", frame)
+			}
+			states = append(states, notice.State)
+		}
+		for len(client.priorityQueue) > 0 {
+			collect((<-client.priorityQueue).payload)
+		}
+		for len(recorder.batches) > 0 {
+			for _, frame := range <-recorder.batches {
+				collect(frame)
+			}
+		}
+		return states
+	}
+	fill := func(length int) {
+		t.Helper()
+		for len(client.writeQueue) < length {
+			if err := client.Send(ctx, []byte(`{"type":"NEW_USER"}`)); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+		}
+	}
+	drainTo := func(length int) {
+		t.Helper()
+		for len(client.writeQueue) > length {
+			<-client.writeQueue
+		}
+		if err := client.resumeIfDrained(ctx); err != nil {
+			t.Fatalf("resume: %v", err)
+		}
+	}
+
+	fill(7)
+	if got := notices(); len(got) != 0 {
+		t.Fatalf("notices below the high-water mark: %v", got)
+	}
+	fill(10)
+	if got := notices(); !slices.Equal(got, []string{protocol.FlowControlPause}) {
+		t.Fatalf("notices filling past the high-water mark = %v, want one PAUSE", got)
+	}
+
+	drainTo(3)
+	if got := notices(); len(got) != 0 {
+		t.Fatalf("notices above the low-water mark: %v", got)
+	}
+	drainTo(2)
+	drainTo(0)
+	if got := notices(); !slices.Equal(got, []string{protocol.FlowControlResume}) {
+		t.Fatalf("notices draining to the low-water mark = %v, want one RESUME", got)
+	}
+
+	fill(8)
+	if got := notices(); !slices.Equal(got, []string{protocol.FlowControlPause}) {
+		t.Errorf("notices on the second crossing = %v, want one PAUSE", got)
+	}
+}
+
+func TestNoFlowControlWhenDisabled(t *testing.T) {
+	client, _ := newTestClient(t, func(cfg *config.Config) {
+		cfg.WriteQueueDepth = 4
+		cfg.FlowControlHighPercent = 0
+	})
+
+	for range 4 {
+		if err := client.Send(context.Background(), []byte(`{"type":"NEW_USER"}`)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+
+	if queued := len(client.priorityQueue); queued != 0 {
+		t.Errorf("%d notices queued with flow control disabled", queued)
+	}
+}